@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"loyaltySys/internal/logger"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	addr := flag.String("a", "localhost:8081", "address to listen on")
+	logLevel := flag.String("l", "info", "log level")
+	logFormat := flag.String("log-format", logger.FormatConsole, "log encoding, console or json")
+	cfg := mockConfig{}
+	flag.DurationVar(&cfg.Latency, "latency", 0, "delay of every answer")
+	flag.Float64Var(&cfg.RateLimit, "rate-limit", 0, "share of the requests answered 429, from 0 to 1")
+	flag.IntVar(&cfg.RetryAfter, "retry-after", 60, "Retry-After of the 429 answers in seconds")
+	flag.DurationVar(&cfg.Step, "step", time.Second, "time the order spends in REGISTERED and then in PROCESSING")
+	flag.Float64Var(&cfg.Accrual, "accrual", 500, "accrual of the processed orders")
+	flag.Float64Var(&cfg.Invalid, "invalid", 0, "share of the orders ending INVALID, from 0 to 1")
+	flag.Float64Var(&cfg.Unregistered, "unregistered", 0, "share of the orders answered 204, from 0 to 1")
+	flag.StringVar(&cfg.BatchPath, "batch-path", "/api/orders/batch", "path of the batch endpoint, empty disables it")
+	flag.Parse()
+	if env, ok := os.LookupEnv("RUN_ADDRESS"); ok {
+		*addr = env
+	}
+
+	l, err := logger.Initialize(*logLevel, *logFormat)
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer l.SafeSync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: *addr, Handler: newAccrualMock(cfg).Router()}
+	errCh := make(chan error, 1)
+	go func() {
+		l.Infof("accrual mock listening on %s: %+v", *addr, cfg)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("accrual mock failed: %w", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down the accrual mock: %w", err)
+	}
+	l.Info("accrual mock stopped")
+	return nil
+}
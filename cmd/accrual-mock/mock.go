@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Statuses of the order in the accrual system.
+const (
+	statusRegistered = "REGISTERED"
+	statusProcessing = "PROCESSING"
+	statusProcessed  = "PROCESSED"
+	statusInvalid    = "INVALID"
+)
+
+// mockConfig is the behavior of the fake accrual system.
+type mockConfig struct {
+	Latency      time.Duration // delay of every answer
+	RateLimit    float64       // share of the requests answered 429
+	RetryAfter   int           // Retry-After of the 429 answers in seconds
+	Step         time.Duration // time the order spends in REGISTERED and then in PROCESSING
+	Accrual      float64       // accrual of the processed orders
+	Invalid      float64       // share of the orders ending INVALID
+	Unregistered float64       // share of the orders the accrual system doesn't know
+	BatchPath    string        // path of the batch endpoint, empty disables it
+}
+
+// accrualAnswer is the answer about the order.
+type accrualAnswer struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+// accrualMock is a fake accrual system. An order is registered on the first request about it and moves
+// from REGISTERED to PROCESSING and then to PROCESSED or INVALID a step apart. Whether the order is invalid
+// or unknown is derived from its number, so the answers about it are the same across the restarts.
+type accrualMock struct {
+	cfg mockConfig
+	now func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// newAccrualMock creates the fake accrual system.
+func newAccrualMock(cfg mockConfig) *accrualMock {
+	return &accrualMock{cfg: cfg, now: time.Now, seen: make(map[string]time.Time)}
+}
+
+// Router returns the routes of the accrual system.
+func (m *accrualMock) Router() http.Handler {
+	r := chi.NewRouter()
+	r.Use(m.delay, m.limit)
+	r.Get("/api/orders/{number}", m.getOrder)
+	if m.cfg.BatchPath != "" {
+		r.Get(m.cfg.BatchPath, m.getOrders)
+		r.Post(m.cfg.BatchPath, m.getOrders)
+	}
+	return r
+}
+
+// delay holds every answer for the configured latency or until the request is canceled.
+func (m *accrualMock) delay(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.cfg.Latency > 0 {
+			t := time.NewTimer(m.cfg.Latency)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limit answers the configured share of the requests 429 Too Many Requests.
+func (m *accrualMock) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.cfg.RateLimit > 0 && rand.Float64() < m.cfg.RateLimit {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", strconv.Itoa(m.cfg.RetryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("No more than N requests per minute allowed"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getOrder answers about the order, 204 if the accrual system doesn't know it.
+func (m *accrualMock) getOrder(w http.ResponseWriter, r *http.Request) {
+	answer, ok := m.answer(chi.URLParam(r, "number"))
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(answer)
+}
+
+// getOrders answers about the orders of the JSON array in the body or of the order query parameters,
+// leaving out the ones the accrual system doesn't know.
+func (m *accrualMock) getOrders(w http.ResponseWriter, r *http.Request) {
+	numbers := r.URL.Query()["order"]
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+			http.Error(w, "the body is not a JSON array of the order numbers", http.StatusBadRequest)
+			return
+		}
+	}
+	answers := make([]accrualAnswer, 0, len(numbers))
+	for _, number := range numbers {
+		if answer, ok := m.answer(number); ok {
+			answers = append(answers, answer)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(answers)
+}
+
+// answer returns the current answer about the order, false if the accrual system doesn't know it.
+// The order is registered on the first request about it.
+func (m *accrualMock) answer(number string) (accrualAnswer, bool) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(number))
+	// the hash picks the fate of the order, a share of [0, 1) compared with the configured shares
+	share := float64(h.Sum64()%10000) / 10000
+	if share < m.cfg.Unregistered {
+		return accrualAnswer{}, false
+	}
+
+	m.mu.Lock()
+	since, ok := m.seen[number]
+	if !ok {
+		since = m.now()
+		m.seen[number] = since
+	}
+	m.mu.Unlock()
+
+	answer := accrualAnswer{Order: number}
+	switch elapsed := m.now().Sub(since); {
+	case elapsed < m.cfg.Step:
+		answer.Status = statusRegistered
+	case elapsed < 2*m.cfg.Step:
+		answer.Status = statusProcessing
+	case share < m.cfg.Unregistered+m.cfg.Invalid:
+		answer.Status = statusInvalid
+	default:
+		answer.Status = statusProcessed
+		accrual := m.cfg.Accrual
+		answer.Accrual = &accrual
+	}
+	return answer, true
+}
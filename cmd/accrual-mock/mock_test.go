@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// get answers the request to the fake accrual system, decoding the JSON answer into v.
+func get(t *testing.T, h http.Handler, req *http.Request, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec
+}
+
+func TestAccrualMock_Progression(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := newAccrualMock(mockConfig{Step: time.Second, Accrual: 42})
+	m.now = func() time.Time { return now }
+	h := m.Router()
+
+	for _, want := range []string{statusRegistered, statusProcessing, statusProcessed} {
+		var answer accrualAnswer
+		rec := get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/12345678903", nil), &answer)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "12345678903", answer.Order)
+		assert.Equal(t, want, answer.Status)
+		now = now.Add(time.Second)
+	}
+	var answer accrualAnswer
+	get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/12345678903", nil), &answer)
+	require.NotNil(t, answer.Accrual)
+	assert.Equal(t, 42.0, *answer.Accrual)
+}
+
+func TestAccrualMock_Fate(t *testing.T) {
+	t.Run("unregistered", func(t *testing.T) {
+		h := newAccrualMock(mockConfig{Unregistered: 1}).Router()
+		rec := get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/1", nil), nil)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		h := newAccrualMock(mockConfig{Invalid: 1}).Router()
+		var answer accrualAnswer
+		get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/1", nil), &answer)
+		assert.Equal(t, statusInvalid, answer.Status)
+		assert.Nil(t, answer.Accrual)
+	})
+}
+
+func TestAccrualMock_RateLimit(t *testing.T) {
+	h := newAccrualMock(mockConfig{RateLimit: 1, RetryAfter: 7}).Router()
+	rec := get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/1", nil), nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get("Retry-After"))
+}
+
+func TestAccrualMock_Batch(t *testing.T) {
+	h := newAccrualMock(mockConfig{BatchPath: "/api/orders/batch"}).Router()
+
+	var answers []accrualAnswer
+	rec := get(t, h, httptest.NewRequest(http.MethodPost, "/api/orders/batch", strings.NewReader(`["1","2"]`)), &answers)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, answers, 2)
+
+	answers = nil
+	get(t, h, httptest.NewRequest(http.MethodGet, "/api/orders/batch?order=1&order=2&order=3", nil), &answers)
+	assert.Len(t, answers, 3)
+
+	rec = get(t, h, httptest.NewRequest(http.MethodPost, "/api/orders/batch", strings.NewReader(`{`)), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
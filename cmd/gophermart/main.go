@@ -2,17 +2,35 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"loyaltySys/internal/auth"
+	"loyaltySys/internal/captcha"
+	"loyaltySys/internal/clock"
 	"loyaltySys/internal/config"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
 	"loyaltySys/internal/handlers"
+	"loyaltySys/internal/lifecycle"
 	"loyaltySys/internal/logger"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/middleware"
+	"loyaltySys/internal/repository"
 	"loyaltySys/internal/service/accrual"
+	"loyaltySys/internal/service/export"
+	"loyaltySys/internal/service/report"
 	"loyaltySys/internal/service/server"
+	"loyaltySys/internal/service/snapshot"
+	"loyaltySys/internal/service/webhook"
+	"loyaltySys/internal/sms"
+	"loyaltySys/internal/tracing"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -28,34 +46,262 @@ func run() error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 	// Initialize logger
-	l, err := logger.Initialize(cfg.LogLevel)
+	l, err := logger.Initialize(cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
 		return fmt.Errorf("failed to initialize logger: %w", err)
 	}
 	defer l.SafeSync()
 
+	// The migrate command manages the schema and the seed command fills it with the test data, both exit
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			return runMigrate(context.Background(), cfg.DBConfig.DSN, cfg.DBConfig.MigrationLockTimeout, args[1:], os.Stdout)
+		case "seed":
+			return runSeed(context.Background(), cfg, l.SugaredLogger, args[1:], os.Stdout)
+		default:
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+	}
+
 	// create a context that listens for OS signals to shut down the server
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Trace the requests across the storage and the accrual system, exporting the spans if configured
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+
 	// Initialize JWT from environment variables
-	auth.InitJWTFromEnv(l.SugaredLogger)
+	if err := auth.InitJWTFromEnv(l.SugaredLogger); err != nil {
+		return fmt.Errorf("failed to initialize JWT: %w", err)
+	}
+
+	// Shared dependencies of the subsystems
+	clk := clock.New()
+	reg := metrics.NewRegistry()
+	// Order status changes are published by the accrual service and streamed to the users
+	bus := events.NewBus()
+	// The uploaded orders are handed over to the accrual service without waiting for the poll
+	accrualQueue := dispatch.NewQueue(dispatch.DefaultSize)
+
+	trustedProxies, err := middleware.ParseTrustedProxies(cfg.ServerConfig.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+	// Allow the browser clients on other origins if configured
+	cors, err := middleware.NewCORS(middleware.CORSOptions{
+		AllowedOrigins:   cfg.ServerConfig.CORSAllowedOrigins,
+		AllowedHeaders:   cfg.ServerConfig.CORSAllowedHeaders,
+		AllowCredentials: cfg.ServerConfig.CORSAllowCredentials,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure CORS: %w", err)
+	}
+	// Serve the loyalty programs of several tenants if configured
+	tenantMW, err := middleware.NewTenant(cfg.ServerConfig.Tenants)
+	if err != nil {
+		return fmt.Errorf("failed to configure tenants: %w", err)
+	}
+	// Hash the passwords with the configured cost, the hashes of another cost are upgraded on login
+	passwords, err := auth.NewPasswordHasher(cfg.ServerConfig.PasswordCost)
+	if err != nil {
+		return fmt.Errorf("failed to configure password hashing: %w", err)
+	}
+	// Enable CAPTCHA on registration if configured
+	captchaVerifier, err := captcha.NewVerifier(cfg.CaptchaConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize captcha: %w", err)
+	}
+	// Enable the phone login if an SMS provider is configured
+	smsSender, err := sms.NewSender(cfg.SMSConfig, l.SugaredLogger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize sms: %w", err)
+	}
+
+	// Export the data for the analytics if a destination is configured
+	exportSink, err := export.NewSink(cfg.ExportConfig)
+	if err != nil {
+		return fmt.Errorf("failed to configure export: %w", err)
+	}
+	if exportSink != nil && cfg.ExportConfig.Interval <= 0 {
+		return errors.New("failed to configure export: EXPORT_INTERVAL must be positive")
+	}
 
-	// Initialize storage
-	storage := handlers.NewStorage(ctx, cfg.DBConfig.DSN, l.SugaredLogger)
+	// Initialize the repository shared by the handlers and the background services
+	repo, err := repository.New(ctx, cfg.DBConfig.DSN, l.SugaredLogger,
+		db.WithAutoMigrate(cfg.DBConfig.AutoMigrate),
+		db.WithMigrationLockTimeout(cfg.DBConfig.MigrationLockTimeout),
+		db.WithMetrics(reg),
+		db.WithSlowQueryThreshold(cfg.DBConfig.SlowQueryThreshold),
+		db.WithPoolSettings(db.PoolSettings{
+			MaxConns:          int32(cfg.DBConfig.MaxConns),
+			MinConns:          int32(cfg.DBConfig.MinConns),
+			MaxConnLifetime:   cfg.DBConfig.MaxConnLifetime,
+			MaxConnIdleTime:   cfg.DBConfig.MaxConnIdleTime,
+			HealthCheckPeriod: cfg.DBConfig.HealthCheckPeriod,
+
+			QueryExecMode:          cfg.DBConfig.QueryExecMode,
+			StatementCacheCapacity: cfg.DBConfig.StatementCacheCapacity,
+			StatementTimeout:       cfg.DBConfig.StatementTimeout,
+		}),
+		db.WithDailyWithdrawalLimits(cfg.DBConfig.DailyWithdrawalLimit, cfg.DBConfig.GlobalDailyWithdrawalLimit),
+		db.WithClock(clk),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the repository: %w", err)
+	}
 	// Initialize handler
-	h := handlers.NewHandler(storage, l.SugaredLogger)
+	handlerOpts := []handlers.Option{
+		handlers.WithLogger(l.SugaredLogger),
+		handlers.WithClock(clk),
+		handlers.WithMetrics(reg),
+		handlers.WithMinWithdrawal(cfg.MinWithdrawal),
+		handlers.WithTenantMinWithdrawals(cfg.TenantMinWithdrawals),
+		handlers.WithTrustedProxies(trustedProxies),
+		handlers.WithEvents(bus),
+		handlers.WithAccrualQueue(accrualQueue),
+		handlers.WithTenant(tenantMW),
+		handlers.WithPasswordHasher(passwords),
+		handlers.WithRateLimits(
+			middleware.RateLimit{RPS: cfg.ServerConfig.RateLimitUserRPS, Burst: cfg.ServerConfig.RateLimitUserBurst},
+			middleware.RateLimit{RPS: cfg.ServerConfig.RateLimitIPRPS, Burst: cfg.ServerConfig.RateLimitIPBurst},
+		),
+	}
+	if cfg.ServerConfig.MetricsAddr == "" {
+		handlerOpts = append(handlerOpts, handlers.WithAdminMetrics())
+	}
+	if cfg.ServerConfig.PprofEnabled && cfg.ServerConfig.PprofAddr == "" {
+		handlerOpts = append(handlerOpts, handlers.WithPprof())
+	}
+	if cors != nil {
+		handlerOpts = append(handlerOpts, handlers.WithCORS(cors))
+	}
+	if captchaVerifier != nil {
+		handlerOpts = append(handlerOpts, handlers.WithCaptcha(captchaVerifier))
+	}
+	if smsSender != nil {
+		handlerOpts = append(handlerOpts, handlers.WithSMS(smsSender, cfg.SMSConfig.OTPTTL))
+	}
+	h := handlers.NewHandler(repo, handlerOpts...)
+
+	// Initialize accrual service
+	if err := accrual.ValidateAuth(cfg.AccrualConfig); err != nil {
+		return fmt.Errorf("failed to configure accrual: %w", err)
+	}
+	accrualSvc := accrual.NewAccrualService(cfg.AccrualConfig.AccrualAddr, repo.Orders, cfg.AccrualConfig,
+		accrual.WithLogger(l.SugaredLogger),
+		accrual.WithClock(clk),
+		accrual.WithMetrics(reg),
+		accrual.WithEvents(bus),
+		accrual.WithQueue(accrualQueue),
+		accrual.WithNotifier(repo.Orders),
+		accrual.WithAudit(repo.Orders),
+		accrual.WithBacklog(repo.Orders),
+		accrual.WithPollerLock(repo.Orders),
+	)
+
+	// Initialize webhook delivery service
+	webhookSvc := webhook.NewWebhookService(repo.Deliveries, cfg.WebhookConfig,
+		webhook.WithLogger(l.SugaredLogger),
+		webhook.WithClock(clk),
+	)
+
+	// Initialize daily balance snapshot job
+	snapshotSvc := snapshot.NewSnapshotService(repo.Snapshots, cfg.SnapshotConfig,
+		snapshot.WithLogger(l.SugaredLogger),
+		snapshot.WithClock(clk),
+	)
 
-	// Initialize accrual service and start it
-	accrualStorage := accrual.NewStorage(ctx, cfg.DBConfig.DSN, l.SugaredLogger)
-	accrualSvc := accrual.NewAccrualService(cfg.AccrualConfig.AccrualAddr, accrualStorage, cfg.AccrualConfig, l.SugaredLogger)
-	accrualSvc.Start(ctx)
+	// Initialize the reporting views refresh job
+	reportSvc := report.NewReportService(repo.Reports, cfg.ReportConfig,
+		report.WithLogger(l.SugaredLogger),
+		report.WithClock(clk),
+	)
+
+	// Initialize the data export job
+	var exportSvc *export.ExportService
+	if exportSink != nil {
+		exportSvc = export.NewExportService(repo.Exports, exportSink, cfg.ExportConfig,
+			export.WithLogger(l.SugaredLogger),
+			export.WithClock(clk),
+		)
+	}
 
 	// Initialize server
-	srv := server.NewServer(cfg, h, l.SugaredLogger)
-	// Start server
-	if err := srv.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	srv := server.NewServer(cfg, h, server.WithLogger(l.SugaredLogger))
+
+	// Register subsystems, they are started in order and stopped in reverse order: on the signal the HTTP server
+	// stops accepting the requests and drains the ones in flight, then the background services and the accrual
+	// service are stopped, each finishing its running cycle, the database pool is closed after them. The hooks without their own timeout are given
+	// the shutdown timeout
+	lc := lifecycle.New(l.SugaredLogger, lifecycle.WithDefaultTimeout(cfg.ServerConfig.ShutdownTimeout))
+	// The spans are exported after all the subsystems are stopped
+	lc.Append(lifecycle.Hook{
+		Name:   "tracing",
+		OnStop: shutdownTracing,
+	})
+	// The database is closed after all its users are stopped
+	lc.Append(lifecycle.Hook{
+		Name:   "repository",
+		OnStop: func(context.Context) error { return repo.Close() },
+	})
+	lc.Append(lifecycle.Hook{
+		Name: "accrual service",
+		OnStart: func(ctx context.Context) error {
+			accrualSvc.Start(ctx)
+			return nil
+		},
+		// the requests in flight are limited by the accrual timeout, storing their answers by the shutdown timeout
+		OnStop:      accrualSvc.Stop,
+		StopTimeout: time.Duration(cfg.AccrualConfig.Timeout)*time.Second + cfg.ServerConfig.ShutdownTimeout,
+	})
+	lc.Append(lifecycle.Hook{
+		Name: "webhook service",
+		OnStart: func(ctx context.Context) error {
+			webhookSvc.Start(ctx)
+			return nil
+		},
+		OnStop: webhookSvc.Stop,
+	})
+	lc.Append(lifecycle.Hook{
+		Name: "snapshot service",
+		OnStart: func(ctx context.Context) error {
+			snapshotSvc.Start(ctx)
+			return nil
+		},
+		OnStop: snapshotSvc.Stop,
+	})
+	lc.Append(lifecycle.Hook{
+		Name: "report service",
+		OnStart: func(ctx context.Context) error {
+			reportSvc.Start(ctx)
+			return nil
+		},
+		OnStop: reportSvc.Stop,
+	})
+	if exportSvc != nil {
+		lc.Append(lifecycle.Hook{
+			Name: "export service",
+			OnStart: func(ctx context.Context) error {
+				exportSvc.Start(ctx)
+				return nil
+			},
+			OnStop: exportSvc.Stop,
+		})
+	}
+	lc.Append(lifecycle.Hook{
+		Name:        "HTTP server",
+		OnStart:     func(context.Context) error { return srv.Listen() },
+		OnStop:      srv.Stop,
+		StopTimeout: cfg.ServerConfig.ShutdownTimeout,
+	})
+
+	// Run until the stopping signal is received
+	if err := lc.Run(ctx); err != nil {
+		return fmt.Errorf("failed to run the application: %w", err)
 	}
 	return nil
 }
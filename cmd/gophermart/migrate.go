@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"loyaltySys/internal/db/migrations"
+	"strconv"
+	"time"
+)
+
+// migrateUsage describes the migrate command.
+const migrateUsage = `usage: gophermart [flags] migrate <command>
+
+commands:
+  up        apply all the pending migrations
+  down N    roll back the last N migrations
+  status    list the migrations and whether they are applied
+  version   print the version of the last applied migration`
+
+// runMigrate runs the migrate command on the database and writes its output. The commands changing
+// the schema wait up to the lock timeout for another instance applying the migrations.
+func runMigrate(ctx context.Context, dsn string, lockTimeout time.Duration, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	// Check the arguments before connecting
+	steps := 0
+	switch args[0] {
+	case "up", "status", "version":
+		if len(args) != 1 {
+			return errors.New(migrateUsage)
+		}
+	case "down":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of migrations %q\n%s", args[1], migrateUsage)
+		}
+		steps = n
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+
+	mg, err := migrations.New(dsn, migrations.WithLockTimeout(lockTimeout))
+	if err != nil {
+		return err
+	}
+	defer mg.Close()
+
+	switch args[0] {
+	case "up":
+		if err := mg.Up(ctx); err != nil {
+			return err
+		}
+	case "down":
+		if err := mg.Down(ctx, steps); err != nil {
+			return err
+		}
+	case "status":
+		all, err := mg.Status()
+		if err != nil {
+			return err
+		}
+		for _, m := range all {
+			state := "pending"
+			if m.Dirty {
+				state = "dirty"
+			} else if m.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(out, "%06d_%s\t%s\n", m.Version, m.Name, state)
+		}
+		// The schema migrated by a newer binary has migrations unknown to this one
+		if err := mg.Check(true); errors.Is(err, migrations.ErrSchemaTooNew) {
+			fmt.Fprintln(out, err)
+		}
+		return nil
+	}
+
+	// Every command but status reports the resulting version
+	version, dirty, err := mg.Version()
+	if err != nil {
+		return err
+	}
+	if dirty {
+		fmt.Fprintf(out, "%d (dirty)\n", version)
+		return nil
+	}
+	fmt.Fprintln(out, version)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/config"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/tenant"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// seedUsage describes the seed command.
+const seedUsage = `usage: gophermart [flags] seed [seed flags]
+
+Fills the database with the test users, their orders in all the statuses and withdrawals
+for the local development and the load tests. All the users share the password.
+
+seed flags:`
+
+// runSeed runs the seed command on the database of the config and writes the counts of the generated rows.
+func runSeed(ctx context.Context, cfg *config.Config, logger *zap.SugaredLogger, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, seedUsage)
+		fs.PrintDefaults()
+	}
+	opts := db.SeedOptions{}
+	fs.IntVar(&opts.Users, "users", 100, "number of users")
+	fs.IntVar(&opts.OrdersPerUser, "orders", 20, "number of orders of every user")
+	fs.IntVar(&opts.WithdrawalsPerUser, "withdrawals", 5, "number of withdrawals of every user")
+	fs.StringVar(&opts.LoginPrefix, "prefix", "seed_user_", "prefix of the logins followed by the number of the user")
+	fs.Int64Var(&opts.RandSeed, "seed", 0, "seed of the generator, the same seed generates the same dataset, 0 picks a random one")
+	password := fs.String("password", "password", "password of all the users")
+	tenantID := fs.String("tenant", tenant.Default, "tenant of the users")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if err := tenant.Validate(*tenantID); err != nil {
+		return err
+	}
+	if opts.RandSeed == 0 {
+		opts.RandSeed = time.Now().UnixNano()
+	}
+
+	// The users share the password, so it is hashed once
+	passwords, err := auth.NewPasswordHasher(cfg.ServerConfig.PasswordCost)
+	if err != nil {
+		return err
+	}
+	if opts.PasswordHash, err = passwords.Hash(*password); err != nil {
+		return err
+	}
+
+	storage, err := db.NewDB(ctx, cfg.DBConfig.DSN,
+		db.WithLogger(logger),
+		db.WithAutoMigrate(cfg.DBConfig.AutoMigrate),
+		db.WithMigrationLockTimeout(cfg.DBConfig.MigrationLockTimeout),
+	)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	res, err := storage.Seed(tenant.WithTenant(ctx, *tenantID), opts)
+	if err != nil {
+		return fmt.Errorf("failed to seed the database: %w", err)
+	}
+	fmt.Fprintf(out, "users: %d, orders: %d, withdrawals: %d, seed: %d\n", res.Users, res.Orders, res.Withdrawals, opts.RandSeed)
+	return nil
+}
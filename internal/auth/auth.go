@@ -4,11 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"loyaltySys/internal/models"
+	"loyaltySys/internal/config"
+	"loyaltySys/internal/problem"
+	"loyaltySys/internal/tenant"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/lestrrat-go/jwx/v2/jwt"
@@ -19,25 +24,47 @@ var (
 	tokenOnce sync.Once          // tokenOnce is a once.Do for the token auth.
 	TokenAuth *jwtauth.JWTAuth   // TokenAuth is the JWT authentication middleware.
 	tokenSkew = 30 * time.Second // tokenSkew is the acceptable skew for the token.
+	tokenTTL  = time.Hour        // tokenTTL is the lifetime of the token.
 )
 
+// Token scopes. A token without the scope claim has full access.
+const (
+	ScopeRead  = "read"  // ScopeRead allows viewing orders, balance and withdrawals.
+	ScopeWrite = "write" // ScopeWrite allows uploading orders and withdrawing points.
+)
+
+// scopeClaim is the JWT claim holding the space-separated list of scopes.
+const scopeClaim = "scope"
+
+// tenantClaim is the JWT claim holding the tenant of the user, tokens without it belong to the default one.
+const tenantClaim = "tenant"
+
 var (
-	errClaimNotFound       = errors.New("user_id not found in claims")     // errClaimNotFound is the error returned when the user ID is not found in the claims.
-	errCredRequired        = errors.New("login and password are required") // errCredRequired is the error returned when the login and password are required.
-	errOrderNumberRequired = errors.New("order number is required")        // errOrderNumberRequired is the error returned when the order number is required.
-	errInvalidOrderNumber  = errors.New("invalid order number")            // errInvalidOrderNumber is the error returned when the order number is invalid.
+	errClaimNotFound       = errors.New("user_id not found in claims")           // errClaimNotFound is the error returned when the user ID is not found in the claims.
+	errOrderNumberRequired = errors.New("order number is required")              // errOrderNumberRequired is the error returned when the order number is required.
+	errInvalidOrderNumber  = errors.New("invalid order number")                  // errInvalidOrderNumber is the error returned when the order number is invalid.
+	errOrderNumberNotDigit = errors.New("order number must contain digits only") // errOrderNumberNotDigit is the error returned when the order number has other characters.
 )
 
 // InitJWTFromEnv initializes the JWT authentication middleware from the environment variables.
-func InitJWTFromEnv(logger *zap.SugaredLogger) {
+// The secret is taken from AUTH_SECRET or, if it is not set, from the file in AUTH_SECRET_FILE.
+func InitJWTFromEnv(logger *zap.SugaredLogger) error {
+	var err error
 	tokenOnce.Do(func() {
 		secret := os.Getenv("AUTH_SECRET")
+		if path := os.Getenv("AUTH_SECRET_FILE"); secret == "" && path != "" {
+			if secret, err = config.ReadSecretFile(path); err != nil {
+				err = fmt.Errorf("failed to load AUTH_SECRET_FILE: %w", err)
+				return
+			}
+		}
 		if secret == "" {
 			logger.Warn("AUTH_SECRET is not set, setting test secret")
 			secret = "test-secret"
 		}
 		TokenAuth = jwtauth.New("HS256", []byte(secret), nil, jwt.WithAcceptableSkew(tokenSkew))
 	})
+	return err
 }
 
 // GetUserIDFromCtx extracts the user ID from the JWT token in the context.
@@ -52,12 +79,25 @@ func GetUserIDFromCtx(ctx context.Context) (int64, error) {
 	return strconv.ParseInt(userID, 10, 64)
 }
 
-// validateUser validates the user.
-func ValidateUser(user models.User) (bool, error) {
-	if user.Login == "" || user.Password == "" {
-		return false, errCredRequired
+// GetUserIDFromRequest extracts the user ID from the bearer token of the request,
+// for the middlewares running before the authentication.
+func GetUserIDFromRequest(r *http.Request) (int64, error) {
+	token, err := jwtauth.VerifyRequest(TokenAuth, r, jwtauth.TokenFromHeader)
+	if err != nil {
+		return 0, err
 	}
-	return true, nil
+	return GetUserIDFromCtx(jwtauth.NewContext(r.Context(), token, nil))
+}
+
+// NormalizeOrderNumber returns the canonical form of the order number: the whitespace and the dashes
+// separating the digit groups are removed, so "1234 5678-903" is the same order as "12345678903".
+func NormalizeOrderNumber(orderNumber string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' {
+			return -1
+		}
+		return r
+	}, orderNumber)
 }
 
 // validateOrderNumber validates the order number.
@@ -65,6 +105,11 @@ func ValidateOrderNumber(orderNumber string) (bool, error) {
 	if orderNumber == "" {
 		return false, errOrderNumberRequired
 	}
+	for _, r := range orderNumber {
+		if r < '0' || r > '9' {
+			return false, errOrderNumberNotDigit
+		}
+	}
 	if !checkLuhn(orderNumber) {
 		return false, errInvalidOrderNumber
 	}
@@ -89,12 +134,24 @@ func checkLuhn(purportedCC string) bool {
 	return sum%10 == 0
 }
 
-// generateToken generates a new JWT token for the user.
-func GenerateToken(userID int64) (string, error) {
+// GenerateToken generates a new JWT token for the user of the default tenant with full access issued at the given time.
+func GenerateToken(issuedAt time.Time, userID int64) (string, error) {
+	return GenerateScopedToken(issuedAt, userID, ScopeRead, ScopeWrite)
+}
+
+// GenerateScopedToken generates a new JWT token for the user of the default tenant limited to the given scopes.
+func GenerateScopedToken(issuedAt time.Time, userID int64, scopes ...string) (string, error) {
+	return GenerateTenantToken(issuedAt, tenant.Default, userID, scopes...)
+}
+
+// GenerateTenantToken generates a new JWT token for the user of the tenant limited to the given scopes.
+func GenerateTenantToken(issuedAt time.Time, tenantID string, userID int64, scopes ...string) (string, error) {
 	claims := map[string]interface{}{
 		"user_id":   strconv.FormatInt(userID, 10),
-		"issued_at": time.Now().Unix(),
-		"exp":       time.Now().Add(time.Hour).Unix(),
+		tenantClaim: tenantID,
+		scopeClaim:  strings.Join(scopes, " "),
+		"issued_at": issuedAt.Unix(),
+		"exp":       issuedAt.Add(tokenTTL).Unix(),
 	}
 	_, token, err := TokenAuth.Encode(claims)
 	if err != nil {
@@ -102,3 +159,52 @@ func GenerateToken(userID int64) (string, error) {
 	}
 	return token, nil
 }
+
+// HasScope reports whether the JWT token in the context grants the scope.
+func HasScope(ctx context.Context, scope string) bool {
+	_, claims, _ := jwtauth.FromContext(ctx)
+	granted, ok := claims[scopeClaim].(string)
+	if !ok {
+		// tokens issued before scopes were introduced have full access
+		return true
+	}
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator is a middleware rejecting the requests without a valid token, like the jwtauth one,
+// with the problem details. The tenant of the token replaces the one of the request context.
+// It must be used after the jwtauth verifier.
+func Authenticator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, claims, err := jwtauth.FromContext(r.Context())
+		if err != nil {
+			problem.Write(w, r, http.StatusUnauthorized, problem.Unauthorized, err.Error())
+			return
+		}
+		if token == nil {
+			problem.Write(w, r, http.StatusUnauthorized, problem.Unauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		tenantID, _ := claims[tenantClaim].(string)
+		next.ServeHTTP(w, r.WithContext(tenant.WithTenant(r.Context(), tenantID)))
+	})
+}
+
+// RequireScope is a middleware rejecting requests whose token doesn't grant the scope.
+// It must be used after the jwtauth verifier.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasScope(r.Context(), scope) {
+				problem.Write(w, r, http.StatusForbidden, problem.InsufficientScope, "Token scope is insufficient")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
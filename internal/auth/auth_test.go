@@ -2,13 +2,19 @@ package auth
 
 import (
 	"context"
-	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGenerateToken(t *testing.T) {
@@ -19,7 +25,7 @@ func TestGenerateToken(t *testing.T) {
 	InitJWTFromEnv(zap.NewNop().Sugar())
 
 	const uid int64 = 123
-	tokenStr, err := GenerateToken(uid)
+	tokenStr, err := GenerateToken(time.Now(), uid)
 	assert.NoError(t, err, "failed to generate token")
 	assert.NotEmpty(t, tokenStr, "token is empty")
 
@@ -33,6 +39,112 @@ func TestGenerateToken(t *testing.T) {
 	assert.True(t, ok, "decoded token has no exp claim")
 }
 
+func TestGenerateToken_Expiry(t *testing.T) {
+	TokenAuth = nil
+	tokenOnce = sync.Once{}
+
+	t.Setenv("AUTH_SECRET", "sign-secret")
+	assert.NoError(t, InitJWTFromEnv(zap.NewNop().Sugar()))
+
+	issuedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tokenStr, err := GenerateToken(issuedAt, 1)
+	assert.NoError(t, err)
+
+	tok, err := TokenAuth.Decode(tokenStr)
+	assert.NoError(t, err)
+	assert.Equal(t, issuedAt.Add(tokenTTL), tok.Expiration())
+
+	// a token past its lifetime is rejected
+	_, err = jwtauth.VerifyToken(TokenAuth, tokenStr)
+	assert.Error(t, err)
+	tokenStr, err = GenerateToken(time.Now().Add(-tokenTTL/2), 1)
+	assert.NoError(t, err)
+	_, err = jwtauth.VerifyToken(TokenAuth, tokenStr)
+	assert.NoError(t, err)
+}
+
+func TestInitJWTFromEnv_SecretFile(t *testing.T) {
+	TokenAuth = nil
+	tokenOnce = sync.Once{}
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0o600))
+	t.Setenv("AUTH_SECRET", "")
+	t.Setenv("AUTH_SECRET_FILE", secretFile)
+	assert.NoError(t, InitJWTFromEnv(zap.NewNop().Sugar()))
+
+	tokenStr, err := GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	_, err = jwtauth.New("HS256", []byte("file-secret"), nil).Decode(tokenStr)
+	assert.NoError(t, err, "token must be signed with the secret from the file")
+}
+
+func TestRequireScope(t *testing.T) {
+	auth := jwtauth.New("HS256", []byte("any"), nil)
+
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		scope    string
+		wantCode int
+	}{
+		{name: "full_token_write", claims: map[string]any{"user_id": "1", "scope": "read write"}, scope: ScopeWrite, wantCode: http.StatusOK},
+		{name: "read_only_token_read", claims: map[string]any{"user_id": "1", "scope": "read"}, scope: ScopeRead, wantCode: http.StatusOK},
+		{name: "read_only_token_write", claims: map[string]any{"user_id": "1", "scope": "read"}, scope: ScopeWrite, wantCode: http.StatusForbidden},
+		{name: "legacy_token_without_scope", claims: map[string]any{"user_id": "1"}, scope: ScopeWrite, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, _, err := auth.Encode(tt.claims)
+			assert.NoError(t, err)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(jwtauth.NewContext(req.Context(), tok, nil))
+
+			rec := httptest.NewRecorder()
+			RequireScope(tt.scope)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestAuthenticator_Tenant(t *testing.T) {
+	TokenAuth = nil
+	tokenOnce = sync.Once{}
+	t.Setenv("AUTH_SECRET", "sign-secret")
+	assert.NoError(t, InitJWTFromEnv(zap.NewNop().Sugar()))
+
+	tenantToken, err := GenerateTenantToken(time.Now(), "acme", 1, ScopeRead)
+	assert.NoError(t, err)
+	_, legacyToken, err := TokenAuth.Encode(map[string]any{"user_id": "1"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		wantTenant string
+	}{
+		{name: "token_tenant", token: tenantToken, wantTenant: "acme"},
+		{name: "legacy_token_default", token: legacyToken, wantTenant: tenant.Default},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := jwtauth.Verifier(TokenAuth)(Authenticator(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = tenant.FromContext(r.Context())
+			})))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			// the tenant of the token replaces the one of the header
+			req = req.WithContext(tenant.WithTenant(req.Context(), "globex"))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.wantTenant, got)
+		})
+	}
+}
+
 func TestGetUserIDFromCtx(t *testing.T) {
 	auth := jwtauth.New("HS256", []byte("any"), nil)
 
@@ -89,24 +201,28 @@ func TestGetUserIDFromCtx(t *testing.T) {
 	}
 }
 
-func TestValidateUser(t *testing.T) {
-	tests := []struct {
-		name string
-		u    models.User
-		ok   bool
-	}{
-		{"ok", models.User{Login: "alice", Password: "pwd"}, true},
-		{"empty login", models.User{Login: "", Password: "pwd"}, false},
-		{"empty password", models.User{Login: "bob", Password: ""}, false},
-		{"both empty", models.User{}, false},
-	}
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			ok, err := ValidateUser(tc.u)
-			assert.Equal(t, tc.ok, ok, "ValidateUser() ok = %v, want %v", ok, tc.ok)
-			assert.Equal(t, tc.ok, err == nil, "ValidateUser() err = %v, want nil", err)
-		})
-	}
+func TestGetUserIDFromRequest(t *testing.T) {
+	TokenAuth = nil
+	tokenOnce = sync.Once{}
+	t.Setenv("AUTH_SECRET", "sign-secret")
+	InitJWTFromEnv(zap.NewNop().Sugar())
+
+	token, err := GenerateToken(time.Now(), 42)
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	userID, err := GetUserIDFromRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), userID)
+
+	// no token or an expired one
+	_, err = GetUserIDFromRequest(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Error(t, err)
+	expired, err := GenerateToken(time.Now().Add(-2*tokenTTL), 42)
+	assert.NoError(t, err)
+	r.Header.Set("Authorization", "Bearer "+expired)
+	_, err = GetUserIDFromRequest(r)
+	assert.Error(t, err)
 }
 
 func TestValidateOrderNumber(t *testing.T) {
@@ -119,6 +235,9 @@ func TestValidateOrderNumber(t *testing.T) {
 		{"79927398713", true},
 		{"", false},
 		{"1234567890123", false},
+		{"7992739871a", false},
+		{"7992739871:", false},
+		{"7992 7398 713", false},
 	}
 	for _, tc := range tests {
 		t.Run(tc.number, func(t *testing.T) {
@@ -129,6 +248,25 @@ func TestValidateOrderNumber(t *testing.T) {
 	}
 }
 
+func TestNormalizeOrderNumber(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"12345678903", "12345678903"},
+		{" 1234 5678 903\n", "12345678903"},
+		{"1234-5678-903", "12345678903"},
+		{"1234\t5678 - 903", "12345678903"},
+		{"1234.5678.903", "1234.5678.903"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.number, func(t *testing.T) {
+			assert.Equal(t, tc.want, NormalizeOrderNumber(tc.number))
+		})
+	}
+}
+
 func Test_checkLuhn(t *testing.T) {
 	tests := []struct {
 		number string
@@ -146,3 +284,54 @@ func Test_checkLuhn(t *testing.T) {
 		})
 	}
 }
+
+func TestValidatePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		ok    bool
+	}{
+		{"+79161234567", true},
+		{"+15550001111", true},
+		{"", false},
+		{"79161234567", false},
+		{"+0123456789", false},
+		{"+7916abc4567", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.phone, func(t *testing.T) {
+			ok, err := ValidatePhone(tc.phone)
+			assert.Equal(t, tc.ok, ok, "ValidatePhone() ok = %v, want %v", ok, tc.ok)
+			assert.Equal(t, tc.ok, err == nil, "ValidatePhone() err = %v, want nil", err)
+		})
+	}
+}
+
+func TestGenerateOTP(t *testing.T) {
+	code, err := GenerateOTP()
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[0-9]{6}$`, code)
+}
+
+func TestPasswordHasher(t *testing.T) {
+	_, err := NewPasswordHasher(bcrypt.MaxCost + 1)
+	assert.Error(t, err)
+
+	old, err := NewPasswordHasher(bcrypt.MinCost)
+	assert.NoError(t, err)
+	p, err := NewPasswordHasher(bcrypt.MinCost + 1)
+	assert.NoError(t, err)
+
+	hash, err := p.Hash("secret")
+	assert.NoError(t, err)
+	assert.NoError(t, p.Compare(hash, "secret"))
+	assert.Error(t, p.Compare(hash, "wrong"))
+	assert.False(t, p.NeedsRehash(hash))
+
+	// the hash of the old cost is still accepted and upgraded
+	oldHash, err := old.Hash("secret")
+	assert.NoError(t, err)
+	assert.NoError(t, p.Compare(oldHash, "secret"))
+	assert.True(t, p.NeedsRehash(oldHash))
+	// the hash of another algorithm is upgraded too
+	assert.True(t, p.NeedsRehash("$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA"))
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+)
+
+// otpDigits is the length of the one-time login code.
+const otpDigits = 6
+
+// phonePattern matches the phone numbers in the E.164 format.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+var (
+	errPhoneRequired = errors.New("phone is required")                 // errPhoneRequired is the error returned when the phone is empty.
+	errInvalidPhone  = errors.New("phone must be in the E.164 format") // errInvalidPhone is the error returned when the phone is malformed.
+)
+
+// ValidatePhone validates the phone number.
+func ValidatePhone(phone string) (bool, error) {
+	if phone == "" {
+		return false, errPhoneRequired
+	}
+	if !phonePattern.MatchString(phone) {
+		return false, errInvalidPhone
+	}
+	return true, nil
+}
+
+// GenerateOTP generates a random numeric one-time login code.
+func GenerateOTP() (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < otpDigits; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	return fmt.Sprintf("%0*d", otpDigits, n), nil
+}
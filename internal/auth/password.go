@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultPasswordCost is the bcrypt cost of the password hashes unless another one is configured.
+const DefaultPasswordCost = bcrypt.DefaultCost
+
+// DefaultPasswordHasher hashes the passwords with the default cost.
+var DefaultPasswordHasher = &PasswordHasher{cost: DefaultPasswordCost}
+
+// PasswordHasher hashes the passwords with bcrypt of the configured cost and tells the stored hashes
+// made with other parameters, so they are upgraded when the user logs in with the password.
+type PasswordHasher struct {
+	cost int
+}
+
+// NewPasswordHasher creates a hasher of the bcrypt cost, between bcrypt.MinCost and bcrypt.MaxCost.
+func NewPasswordHasher(cost int) (*PasswordHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("invalid bcrypt cost %d: must be between %d and %d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &PasswordHasher{cost: cost}, nil
+}
+
+// Hash returns the hash of the password.
+func (p *PasswordHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), p.cost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// Compare checks the password against its hash, made with any parameters.
+func (p *PasswordHasher) Compare(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// NeedsRehash reports whether the hash is made with other parameters than the configured ones:
+// another cost or another algorithm.
+func (p *PasswordHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != p.cost
+}
@@ -0,0 +1,105 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/captcha/config"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Supported CAPTCHA providers.
+const (
+	ProviderTurnstile = "turnstile"
+	ProviderReCaptcha = "recaptcha"
+)
+
+// Verification endpoints of the supported providers.
+const (
+	turnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	recaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+var (
+	ErrInvalidToken        = errors.New("invalid captcha token")        // ErrInvalidToken is returned when the provider rejects the token.
+	ErrUnsupportedProvider = errors.New("unsupported captcha provider") // ErrUnsupportedProvider is returned for an unknown provider name.
+)
+
+// Verifier checks a CAPTCHA challenge token solved by the client.
+type Verifier interface {
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// NewVerifier creates a verifier for the configured provider.
+// It returns nil if CAPTCHA is disabled.
+func NewVerifier(cfg config.CaptchaConfig) (Verifier, error) {
+	verifyURL := cfg.VerifyURL
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case ProviderTurnstile:
+		if verifyURL == "" {
+			verifyURL = turnstileVerifyURL
+		}
+	case ProviderReCaptcha:
+		if verifyURL == "" {
+			verifyURL = recaptchaVerifyURL
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, cfg.Provider)
+	}
+	return &siteVerifier{
+		client:    resty.New().SetTimeout(5 * time.Second),
+		verifyURL: verifyURL,
+		secret:    cfg.Secret,
+	}, nil
+}
+
+// siteVerifier implements the siteverify API shared by Turnstile and reCAPTCHA.
+type siteVerifier struct {
+	client    *resty.Client
+	verifyURL string
+	secret    string
+}
+
+// siteVerifyResp is the response of the siteverify API.
+type siteVerifyResp struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Verify sends the token to the provider and returns ErrInvalidToken if it is rejected.
+func (v *siteVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return ErrInvalidToken
+	}
+	form := map[string]string{
+		"secret":   v.secret,
+		"response": token,
+	}
+	if remoteIP != "" {
+		form["remoteip"] = remoteIP
+	}
+
+	resp, err := v.client.R().
+		SetContext(ctx).
+		SetFormData(form).
+		Post(v.verifyURL)
+	if err != nil {
+		return fmt.Errorf("captcha verification request failed: %w", err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("captcha provider returned %d", resp.StatusCode())
+	}
+	r := &siteVerifyResp{}
+	if err := json.Unmarshal(resp.Body(), r); err != nil {
+		return fmt.Errorf("unmarshal captcha response: %w", err)
+	}
+	if !r.Success {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, r.ErrorCodes)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"loyaltySys/internal/captcha/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVerifier(t *testing.T) {
+	v, err := NewVerifier(config.CaptchaConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, v, "captcha must be disabled without provider")
+
+	v, err = NewVerifier(config.CaptchaConfig{Provider: ProviderTurnstile, Secret: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, turnstileVerifyURL, v.(*siteVerifier).verifyURL)
+
+	_, err = NewVerifier(config.CaptchaConfig{Provider: "unknown"})
+	assert.ErrorIs(t, err, ErrUnsupportedProvider)
+}
+
+func TestSiteVerifier_Verify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "secret", r.PostForm.Get("secret"))
+		assert.Equal(t, "10.0.0.1", r.PostForm.Get("remoteip"))
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": r.PostForm.Get("response") == "valid"})
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier(config.CaptchaConfig{Provider: ProviderReCaptcha, Secret: "secret", VerifyURL: srv.URL})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "valid_token", token: "valid"},
+		{name: "invalid_token", token: "invalid", wantErr: ErrInvalidToken},
+		{name: "empty_token", token: "", wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Verify(context.Background(), tt.token, "10.0.0.1")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
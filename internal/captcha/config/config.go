@@ -0,0 +1,8 @@
+package config
+
+// CaptchaConfig is the registration CAPTCHA configuration. CAPTCHA is disabled if Provider is empty.
+type CaptchaConfig struct {
+	Provider  string `env:"CAPTCHA_PROVIDER"`   // CAPTCHA provider: turnstile or recaptcha
+	Secret    string `env:"CAPTCHA_SECRET"`     // Secret key issued by the provider
+	VerifyURL string `env:"CAPTCHA_VERIFY_URL"` // Overrides the provider verification URL
+}
@@ -0,0 +1,134 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the services, so time-dependent behavior can be tested deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// New returns the clock backed by the time package.
+func New() Clock {
+	return realClock{}
+}
+
+// realClock implements Clock with the time package.
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time on the returned channel.
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// NewTicker returns a new ticker backed by time.Ticker.
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker wraps time.Ticker to implement Ticker.
+type realTicker struct {
+	*time.Ticker
+}
+
+// C returns the channel on which the ticks are delivered.
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Mock is a manually advanced clock for tests.
+type Mock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*mockWaiter
+}
+
+// mockWaiter is a pending After call or an active ticker of the mock clock.
+type mockWaiter struct {
+	at     time.Time
+	period time.Duration // zero for After
+	ch     chan time.Time
+	done   bool
+}
+
+// NewMock creates a mock clock set to the given time.
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+// Now returns the current mock time.
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After returns a channel receiving the mock time once it is advanced by d.
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &mockWaiter{at: m.now.Add(d), ch: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	return w.ch
+}
+
+// NewTicker returns a ticker firing every time the mock clock passes the period.
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &mockWaiter{at: m.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	return &mockTicker{m: m, w: w}
+}
+
+// Advance moves the mock time forward and fires the due timers and tickers.
+// Like time.Ticker, a ticker drops the ticks a slow receiver can't keep up with.
+func (m *Mock) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+	pending := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.done {
+			continue
+		}
+		for !w.at.After(m.now) {
+			select {
+			case w.ch <- w.at:
+			default:
+			}
+			if w.period == 0 {
+				w.done = true
+				break
+			}
+			w.at = w.at.Add(w.period)
+		}
+		if !w.done {
+			pending = append(pending, w)
+		}
+	}
+	m.waiters = pending
+}
+
+// mockTicker is a ticker of the mock clock.
+type mockTicker struct {
+	m *Mock
+	w *mockWaiter
+}
+
+// C returns the channel on which the ticks are delivered.
+func (t *mockTicker) C() <-chan time.Time { return t.w.ch }
+
+// Stop turns off the ticker.
+func (t *mockTicker) Stop() {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.w.done = true
+}
@@ -0,0 +1,39 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMock_After(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMock(start)
+	ch := m.After(time.Second)
+
+	m.Advance(500 * time.Millisecond)
+	assert.Empty(t, ch, "must not fire before the duration elapses")
+
+	m.Advance(500 * time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-ch)
+	assert.Equal(t, start.Add(time.Second), m.Now())
+}
+
+func TestMock_Ticker(t *testing.T) {
+	m := NewMock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tk := m.NewTicker(time.Second)
+
+	for i := 0; i < 3; i++ {
+		m.Advance(time.Second)
+		select {
+		case <-tk.C():
+		default:
+			t.Fatalf("tick %d was not delivered", i)
+		}
+	}
+
+	tk.Stop()
+	m.Advance(time.Second)
+	assert.Empty(t, tk.C(), "stopped ticker must not fire")
+}
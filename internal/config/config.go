@@ -3,18 +3,43 @@ package config
 import (
 	"flag"
 	"fmt"
+	captcha "loyaltySys/internal/captcha/config"
 	db "loyaltySys/internal/db/config"
+	"loyaltySys/internal/logger"
+	"loyaltySys/internal/models"
 	accrual "loyaltySys/internal/service/accrual/config"
+	export "loyaltySys/internal/service/export/config"
+	report "loyaltySys/internal/service/report/config"
 	server "loyaltySys/internal/service/server/config"
+	snapshot "loyaltySys/internal/service/snapshot/config"
+	webhook "loyaltySys/internal/service/webhook/config"
+	sms "loyaltySys/internal/sms/config"
+	"loyaltySys/internal/tenant"
+	tracing "loyaltySys/internal/tracing/config"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
-	ServerConfig  server.ServerConfig
-	AccrualConfig accrual.AccrualConfig
-	DBConfig      db.DBConfig
-	LogLevel      string `env:"LOG_LEVEL"` // Log level
+	ServerConfig   server.ServerConfig
+	AccrualConfig  accrual.AccrualConfig
+	DBConfig       db.DBConfig
+	CaptchaConfig  captcha.CaptchaConfig
+	SMSConfig      sms.SMSConfig
+	WebhookConfig  webhook.WebhookConfig
+	SnapshotConfig snapshot.SnapshotConfig
+	ReportConfig   report.ReportConfig
+	ExportConfig   export.ExportConfig
+	TracingConfig  tracing.TracingConfig
+	LogLevel       string       `env:"LOG_LEVEL"`      // Log level
+	LogFormat      string       `env:"LOG_FORMAT"`     // Log encoding, console or json
+	MinWithdrawal  models.Money `env:"MIN_WITHDRAWAL"` // Minimum withdrawal amount, 0 disables the limit
+	// Minimum withdrawal amounts of the tenants overriding MinWithdrawal, parsed from TENANT_MIN_WITHDRAWALS
+	TenantMinWithdrawals map[string]models.Money
 }
 
 // GetConfig applies the following priority: CLI flags > ENV > default
@@ -22,16 +47,84 @@ func GetConfig() (*Config, error) {
 	// default config
 	cfg := &Config{
 		ServerConfig: server.ServerConfig{
-			Host: "localhost:8080",
+			Host:               "localhost:8080",
+			RateLimitUserRPS:   10,
+			RateLimitUserBurst: 20,
+			RateLimitIPRPS:     1,
+			RateLimitIPBurst:   10,
+			PasswordCost:       bcrypt.DefaultCost,
+			// the slow clients don't hold the connections for long
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   5 * time.Second,
+			// the certificates outlive the restarts, not to run into the Let's Encrypt rate limits
+			ACMECacheDir: "autocert-cache",
 		},
 		AccrualConfig: accrual.AccrualConfig{
 			AccrualAddr: "http://localhost:8081",
 			Timeout:     10,
+			MaxAttempts: 20,
+			// the retries of a request fit in the processing of the order
+			RequestTimeout: 3 * time.Second,
+			// the accrual system registers the orders of the partner shops with a delay
+			NotRegisteredTTL: 72 * time.Hour,
+			ClaimLimit:       500,
+			// the batch endpoint is off unless its path is set
+			BatchSize:   100,
+			BatchFormat: accrual.BatchFormatJSON,
+			// the transient network failures are retried at once, the order fails if they persist
+			RetryCount:   2,
+			RetryWait:    100 * time.Millisecond,
+			RetryMaxWait: 2 * time.Second,
+			RetryOn:      []string{accrual.RetryOnError},
+			// a Retry-After far in the future doesn't stall the pipeline for long
+			RetryAfterMax: 10 * time.Minute,
+			// the concurrency is halved on overload and ramped back up while the accrual system keeps up
+			Concurrency:    64,
+			MinConcurrency: 1,
+			AuthHeader:     "X-API-Key",
 		},
 		DBConfig: db.DBConfig{
-			DSN: "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable",
+			DSN:         "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable",
+			AutoMigrate: true,
+			// the replicas starting together wait for the one applying the migrations
+			MigrationLockTimeout: time.Minute,
+			// one pool is shared by the HTTP server and the background services
+			MaxConns:          20,
+			MinConns:          2,
+			MaxConnLifetime:   time.Hour,
+			MaxConnIdleTime:   30 * time.Minute,
+			HealthCheckPeriod: time.Minute,
+
+			StatementTimeout:   10 * time.Second,
+			SlowQueryThreshold: 200 * time.Millisecond,
+		},
+		SMSConfig: sms.SMSConfig{
+			OTPTTL: 5 * time.Minute,
+		},
+		WebhookConfig: webhook.WebhookConfig{
+			Interval:    5 * time.Second,
+			Timeout:     10 * time.Second,
+			MaxAttempts: 8,
+		},
+		SnapshotConfig: snapshot.SnapshotConfig{
+			Interval:     time.Hour,
+			BackfillDays: 7,
 		},
-		LogLevel: "debug",
+		ReportConfig: report.ReportConfig{
+			Interval: 15 * time.Minute,
+		},
+		ExportConfig: export.ExportConfig{
+			Interval: 24 * time.Hour,
+		},
+		TracingConfig: tracing.TracingConfig{
+			ServiceName: "gophermart",
+			SampleRatio: 1,
+		},
+		LogLevel:  "debug",
+		LogFormat: logger.FormatConsole,
 	}
 
 	// parse config from environment variables
@@ -44,17 +137,152 @@ func GetConfig() (*Config, error) {
 	if err := env.Parse(&cfg.AccrualConfig); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	if err := env.Parse(&cfg.CaptchaConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.SMSConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.WebhookConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.SnapshotConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.ReportConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.ExportConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := env.Parse(&cfg.TracingConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
 	if err := env.Parse(cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
+	// parse the minimum withdrawals of the tenants, the env package doesn't parse the maps
+	if v, ok := os.LookupEnv("TENANT_MIN_WITHDRAWALS"); ok {
+		minWithdrawals, err := ParseTenantAmounts(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TENANT_MIN_WITHDRAWALS: %w", err)
+		}
+		cfg.TenantMinWithdrawals = minWithdrawals
+	}
+
+	// read the DSN from the secret file if it is not set explicitly
+	if _, ok := os.LookupEnv("DATABASE_URI"); !ok && cfg.DBConfig.DSNFile != "" {
+		dsn, err := ReadSecretFile(cfg.DBConfig.DSNFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DATABASE_URI_FILE: %w", err)
+		}
+		cfg.DBConfig.DSN = dsn
+	}
+	// read the accrual auth secret from the secret file if it is not set explicitly
+	if _, ok := os.LookupEnv("ACCRUAL_AUTH_SECRET"); !ok && cfg.AccrualConfig.AuthSecretFile != "" {
+		secret, err := ReadSecretFile(cfg.AccrualConfig.AuthSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ACCRUAL_AUTH_SECRET_FILE: %w", err)
+		}
+		cfg.AccrualConfig.AuthSecret = secret
+	}
+
 	// CLI flags override ENV/default (only if explicitly set)
 	flag.StringVar(&cfg.ServerConfig.Host, "a", cfg.ServerConfig.Host, "server address")
 	flag.StringVar(&cfg.DBConfig.DSN, "d", cfg.DBConfig.DSN, "database URI")
+	flag.IntVar(&cfg.DBConfig.MaxConns, "db-max-conns", cfg.DBConfig.MaxConns, "maximum number of database connections")
+	flag.IntVar(&cfg.DBConfig.MinConns, "db-min-conns", cfg.DBConfig.MinConns, "database connections kept open when idle")
+	flag.DurationVar(&cfg.DBConfig.MaxConnLifetime, "db-max-conn-lifetime", cfg.DBConfig.MaxConnLifetime, "age after which a database connection is closed")
+	flag.DurationVar(&cfg.DBConfig.MaxConnIdleTime, "db-max-conn-idle-time", cfg.DBConfig.MaxConnIdleTime, "idle time after which a database connection is closed")
+	flag.DurationVar(&cfg.DBConfig.HealthCheckPeriod, "db-health-check-period", cfg.DBConfig.HealthCheckPeriod, "interval of checking the idle database connections")
+	flag.StringVar(&cfg.DBConfig.QueryExecMode, "db-query-exec-mode", cfg.DBConfig.QueryExecMode, "query exec mode: cache_statement, cache_describe, describe_exec, exec or simple_protocol")
+	flag.IntVar(&cfg.DBConfig.StatementCacheCapacity, "db-statement-cache-capacity", cfg.DBConfig.StatementCacheCapacity, "statements cached by a database connection")
+	flag.DurationVar(&cfg.DBConfig.MigrationLockTimeout, "db-migration-lock-timeout", cfg.DBConfig.MigrationLockTimeout, "wait for another instance applying the migrations, 0 doesn't wait")
+	flag.DurationVar(&cfg.DBConfig.StatementTimeout, "db-statement-timeout", cfg.DBConfig.StatementTimeout, "limit of a database statement and of a storage call, 0 keeps the statement_timeout of the DSN")
+	flag.DurationVar(&cfg.DBConfig.SlowQueryThreshold, "db-slow-query-threshold", cfg.DBConfig.SlowQueryThreshold, "duration after which a query is logged as slow, 0 disables it")
 	flag.StringVar(&cfg.AccrualConfig.AccrualAddr, "r", cfg.AccrualConfig.AccrualAddr, "accrual system address")
 	flag.StringVar(&cfg.LogLevel, "l", cfg.LogLevel, "log level")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log encoding, console or json")
 	flag.IntVar(&cfg.AccrualConfig.Timeout, "t", cfg.AccrualConfig.Timeout, "accrual timeout in seconds")
+	flag.DurationVar(&cfg.AccrualConfig.RequestTimeout, "accrual-request-timeout", cfg.AccrualConfig.RequestTimeout, "timeout of an accrual request attempt, 0 uses the accrual timeout")
+	flag.IntVar(&cfg.AccrualConfig.MaxAttempts, "accrual-max-attempts", cfg.AccrualConfig.MaxAttempts, "failed accrual attempts before an order is dead-lettered, 0 retries forever")
+	flag.DurationVar(&cfg.AccrualConfig.NotRegisteredTTL, "accrual-not-registered-ttl", cfg.AccrualConfig.NotRegisteredTTL, "age of an order unknown to the accrual system it is dead-lettered at, 0 waits forever")
+	flag.IntVar(&cfg.AccrualConfig.ClaimLimit, "accrual-claim-limit", cfg.AccrualConfig.ClaimLimit, "orders claimed by an accrual poll, 0 claims all the due ones")
+	flag.StringVar(&cfg.AccrualConfig.BatchPath, "accrual-batch-path", cfg.AccrualConfig.BatchPath, "path of the accrual batch endpoint, empty requests the orders one by one")
+	flag.IntVar(&cfg.AccrualConfig.BatchSize, "accrual-batch-size", cfg.AccrualConfig.BatchSize, "orders requested from the accrual batch endpoint at once")
+	flag.StringVar(&cfg.AccrualConfig.BatchFormat, "accrual-batch-format", cfg.AccrualConfig.BatchFormat, "format of the accrual batch request: json or query")
+	flag.IntVar(&cfg.AccrualConfig.RetryCount, "accrual-retry-count", cfg.AccrualConfig.RetryCount, "retries of a failed accrual request before the order fails, 0 doesn't retry")
+	flag.DurationVar(&cfg.AccrualConfig.RetryWait, "accrual-retry-wait", cfg.AccrualConfig.RetryWait, "wait before the first retry of an accrual request, doubled with every retry")
+	flag.DurationVar(&cfg.AccrualConfig.RetryMaxWait, "accrual-retry-max-wait", cfg.AccrualConfig.RetryMaxWait, "cap of the wait between the retries of an accrual request")
+	flag.DurationVar(&cfg.AccrualConfig.RetryAfterMax, "accrual-retry-after-max", cfg.AccrualConfig.RetryAfterMax, "cap of the pause of the accrual requests on 429, 0 pauses for as long as Retry-After says")
+	flag.IntVar(&cfg.AccrualConfig.Concurrency, "accrual-concurrency", cfg.AccrualConfig.Concurrency, "max accrual requests of the polled orders in flight, adapted down on 429 and 500, 0 doesn't cap them")
+	flag.IntVar(&cfg.AccrualConfig.MinConcurrency, "accrual-min-concurrency", cfg.AccrualConfig.MinConcurrency, "accrual requests in flight the adapted cap doesn't go below")
+	flag.DurationVar(&cfg.AccrualConfig.HedgeDelay, "accrual-hedge-delay", cfg.AccrualConfig.HedgeDelay, "delay of the second accrual request about an order not answered yet, 0 doesn't hedge")
+	flag.StringVar(&cfg.AccrualConfig.Auth, "accrual-auth", cfg.AccrualConfig.Auth, "auth of the accrual requests: api_key, bearer, basic, empty sends no credentials")
+	flag.StringVar(&cfg.AccrualConfig.AuthHeader, "accrual-auth-header", cfg.AccrualConfig.AuthHeader, "header of the accrual API key")
+	flag.StringVar(&cfg.AccrualConfig.AuthUser, "accrual-auth-user", cfg.AccrualConfig.AuthUser, "user of the accrual basic auth")
+	flag.Func("accrual-retry-on", "comma-separated conditions of the accrual request retries: error, 5xx", func(v string) error {
+		cfg.AccrualConfig.RetryOn = strings.Split(v, ",")
+		return nil
+	})
+	flag.Func("cors-origins", "comma-separated origins allowed to make cross-origin requests", func(v string) error {
+		cfg.ServerConfig.CORSAllowedOrigins = strings.Split(v, ",")
+		return nil
+	})
+	flag.Func("cors-headers", "comma-separated extra headers allowed in cross-origin requests", func(v string) error {
+		cfg.ServerConfig.CORSAllowedHeaders = strings.Split(v, ",")
+		return nil
+	})
+	flag.BoolVar(&cfg.ServerConfig.CORSAllowCredentials, "cors-credentials", cfg.ServerConfig.CORSAllowCredentials, "allow cross-origin requests with cookies")
+	flag.Func("tenants", "comma-separated tenants served by the deployment, the first one is the default", func(v string) error {
+		cfg.ServerConfig.Tenants = strings.Split(v, ",")
+		return nil
+	})
+	flag.IntVar(&cfg.ServerConfig.PasswordCost, "password-cost", cfg.ServerConfig.PasswordCost, "bcrypt cost of the password hashes, the other hashes are upgraded on login")
+	flag.DurationVar(&cfg.ServerConfig.ReadTimeout, "http-read-timeout", cfg.ServerConfig.ReadTimeout, "time to read a request with its body, 0 doesn't limit it")
+	flag.DurationVar(&cfg.ServerConfig.ReadHeaderTimeout, "http-read-header-timeout", cfg.ServerConfig.ReadHeaderTimeout, "time to read the request headers, 0 uses the read timeout")
+	flag.DurationVar(&cfg.ServerConfig.WriteTimeout, "http-write-timeout", cfg.ServerConfig.WriteTimeout, "time to write a response, the event streams aside, 0 doesn't limit it")
+	flag.DurationVar(&cfg.ServerConfig.IdleTimeout, "http-idle-timeout", cfg.ServerConfig.IdleTimeout, "time a keep-alive connection waits for the next request, 0 uses the read timeout")
+	flag.DurationVar(&cfg.ServerConfig.ShutdownTimeout, "shutdown-timeout", cfg.ServerConfig.ShutdownTimeout, "time the requests in flight are given to finish on shutdown, also the stop timeout of the subsystems")
+	flag.BoolVar(&cfg.ServerConfig.PprofEnabled, "pprof", cfg.ServerConfig.PprofEnabled, "serve the profiling endpoints of net/http/pprof")
+	flag.StringVar(&cfg.ServerConfig.PprofAddr, "pprof-address", cfg.ServerConfig.PprofAddr, "address of the debug server of the profiling endpoints, empty mounts them under the admin routes")
+	flag.StringVar(&cfg.ServerConfig.MetricsAddr, "metrics-address", cfg.ServerConfig.MetricsAddr, "address of the internal server of the Prometheus metrics, empty mounts them under the admin routes")
+	flag.StringVar(&cfg.TracingConfig.Endpoint, "otel-endpoint", cfg.TracingConfig.Endpoint, "OTLP/HTTP collector the spans are exported to, empty discards them")
+	flag.Float64Var(&cfg.TracingConfig.SampleRatio, "otel-sample-ratio", cfg.TracingConfig.SampleRatio, "share of the traces started by the service that are sampled")
+	flag.Func("acme-domains", "comma-separated domains of the Let's Encrypt certificates, empty serves plain HTTP", func(v string) error {
+		cfg.ServerConfig.ACMEDomains = strings.Split(v, ",")
+		return nil
+	})
+	flag.StringVar(&cfg.ServerConfig.ACMECacheDir, "acme-cache-dir", cfg.ServerConfig.ACMECacheDir, "directory of the ACME account key and certificates")
+	flag.StringVar(&cfg.ServerConfig.ACMEEmail, "acme-email", cfg.ServerConfig.ACMEEmail, "contact of the ACME account")
+	flag.StringVar(&cfg.ServerConfig.ACMEHTTPAddr, "acme-http-address", cfg.ServerConfig.ACMEHTTPAddr, "address answering the ACME http-01 challenges and redirecting to HTTPS, empty relies on tls-alpn-01")
 	flag.Parse()
 
 	return cfg, nil
 }
+
+// ParseTenantAmounts parses the comma-separated tenant=amount pairs, e.g. "acme=10,globex=2.5".
+func ParseTenantAmounts(v string) (map[string]models.Money, error) {
+	amounts := make(map[string]models.Money)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, amount, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tenant amount %q, tenant=amount expected", pair)
+		}
+		id = strings.TrimSpace(id)
+		if err := tenant.Validate(id); err != nil {
+			return nil, err
+		}
+		m, err := models.ParseMoney(amount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount of tenant %s: %w", id, err)
+		}
+		amounts[id] = m
+	}
+	return amounts, nil
+}
@@ -3,9 +3,12 @@ package config
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	db "loyaltySys/internal/db/config"
+	"loyaltySys/internal/models"
 	accrual "loyaltySys/internal/service/accrual/config"
 	server "loyaltySys/internal/service/server/config"
 
@@ -303,3 +306,722 @@ func TestGetConfig_FlagParsing(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConfig_SecretFiles(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	dsnFile := filepath.Join(t.TempDir(), "dsn")
+	assert.NoError(t, os.WriteFile(dsnFile, []byte("file_dsn\n"), 0o600))
+
+	tests := []struct {
+		name    string
+		envVars map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "DSN from file",
+			envVars: map[string]string{"DATABASE_URI_FILE": dsnFile},
+			want:    "file_dsn",
+		},
+		{
+			name:    "ENV takes priority over file",
+			envVars: map[string]string{"DATABASE_URI": "env_dsn", "DATABASE_URI_FILE": dsnFile},
+			want:    "env_dsn",
+		},
+		{
+			name:    "Missing file",
+			envVars: map[string]string{"DATABASE_URI_FILE": filepath.Join(t.TempDir(), "missing")},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			os.Args = []string{"cmd"}
+			assert.NoError(t, os.Unsetenv("DATABASE_URI"))
+			for k, v := range tc.envVars {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := GetConfig()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, cfg.DBConfig.DSN)
+		})
+	}
+}
+
+func TestGetConfig_CORS(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	tests := []struct {
+		name            string
+		envVars         map[string]string
+		args            []string
+		wantOrigins     []string
+		wantHeaders     []string
+		wantCredentials bool
+	}{
+		{
+			name: "CORS from ENV",
+			envVars: map[string]string{
+				"CORS_ALLOWED_ORIGINS":   "https://app.example.com,https://*.example.com",
+				"CORS_ALLOWED_HEADERS":   "X-Client-Version",
+				"CORS_ALLOW_CREDENTIALS": "true",
+			},
+			wantOrigins:     []string{"https://app.example.com", "https://*.example.com"},
+			wantHeaders:     []string{"X-Client-Version"},
+			wantCredentials: true,
+		},
+		{
+			name:            "Flags override ENV",
+			envVars:         map[string]string{"CORS_ALLOWED_ORIGINS": "https://env.example.com"},
+			args:            []string{"-cors-origins=https://flag.example.com,http://localhost:3000", "-cors-headers=X-A,X-B", "-cors-credentials"},
+			wantOrigins:     []string{"https://flag.example.com", "http://localhost:3000"},
+			wantHeaders:     []string{"X-A", "X-B"},
+			wantCredentials: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			for _, k := range []string{"CORS_ALLOWED_ORIGINS", "CORS_ALLOWED_HEADERS", "CORS_ALLOW_CREDENTIALS"} {
+				t.Setenv(k, "")
+				assert.NoError(t, os.Unsetenv(k))
+			}
+			for k, v := range tc.envVars {
+				t.Setenv(k, v)
+			}
+			os.Args = append([]string{"cmd"}, tc.args...)
+
+			cfg, err := GetConfig()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantOrigins, cfg.ServerConfig.CORSAllowedOrigins)
+			assert.Equal(t, tc.wantHeaders, cfg.ServerConfig.CORSAllowedHeaders)
+			assert.Equal(t, tc.wantCredentials, cfg.ServerConfig.CORSAllowCredentials)
+		})
+	}
+}
+
+func TestGetConfig_Tenants(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		args        []string
+		wantTenants []string
+	}{
+		{name: "Default", wantTenants: nil},
+		{name: "Tenants from ENV", envVars: map[string]string{"TENANTS": "acme,globex"}, wantTenants: []string{"acme", "globex"}},
+		{name: "Flag overrides ENV", envVars: map[string]string{"TENANTS": "acme"}, args: []string{"-tenants=globex,initech"}, wantTenants: []string{"globex", "initech"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			t.Setenv("TENANTS", "")
+			assert.NoError(t, os.Unsetenv("TENANTS"))
+			for k, v := range tc.envVars {
+				t.Setenv(k, v)
+			}
+			os.Args = append([]string{"cmd"}, tc.args...)
+
+			cfg, err := GetConfig()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantTenants, cfg.ServerConfig.Tenants)
+		})
+	}
+}
+
+func TestGetConfig_RateLimits(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	for _, k := range []string{"RATE_LIMIT_USER_RPS", "RATE_LIMIT_USER_BURST", "RATE_LIMIT_IP_RPS", "RATE_LIMIT_IP_BURST"} {
+		t.Setenv(k, "")
+		assert.NoError(t, os.Unsetenv(k))
+	}
+
+	// the limits are enabled by default
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(10), cfg.ServerConfig.RateLimitUserRPS)
+	assert.Equal(t, 20, cfg.ServerConfig.RateLimitUserBurst)
+	assert.Equal(t, float64(1), cfg.ServerConfig.RateLimitIPRPS)
+	assert.Equal(t, 10, cfg.ServerConfig.RateLimitIPBurst)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("RATE_LIMIT_USER_RPS", "0")
+	t.Setenv("RATE_LIMIT_IP_RPS", "0.5")
+	t.Setenv("RATE_LIMIT_IP_BURST", "3")
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Zero(t, cfg.ServerConfig.RateLimitUserRPS)
+	assert.Equal(t, 0.5, cfg.ServerConfig.RateLimitIPRPS)
+	assert.Equal(t, 3, cfg.ServerConfig.RateLimitIPBurst)
+}
+
+func TestGetConfig_Migrate(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-d", "postgres://localhost/test", "migrate", "down", "2"}
+	t.Setenv("DATABASE_AUTO_MIGRATE", "")
+	assert.NoError(t, os.Unsetenv("DATABASE_AUTO_MIGRATE"))
+
+	// the migrations are applied on startup by default, the command follows the flags
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.True(t, cfg.DBConfig.AutoMigrate)
+	assert.Equal(t, time.Minute, cfg.DBConfig.MigrationLockTimeout)
+	assert.Equal(t, "postgres://localhost/test", cfg.DBConfig.DSN)
+	assert.Equal(t, []string{"migrate", "down", "2"}, flag.Args())
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-db-migration-lock-timeout", "0"}
+	t.Setenv("DATABASE_AUTO_MIGRATE", "false")
+	t.Setenv("DATABASE_MIGRATION_LOCK_TIMEOUT", "5m")
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.False(t, cfg.DBConfig.AutoMigrate)
+	assert.Zero(t, cfg.DBConfig.MigrationLockTimeout)
+}
+
+func TestGetConfig_Pool(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	// the pool is sized by the defaults
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, cfg.DBConfig.MaxConns)
+	assert.Equal(t, 2, cfg.DBConfig.MinConns)
+	assert.Equal(t, time.Hour, cfg.DBConfig.MaxConnLifetime)
+	assert.Equal(t, 30*time.Minute, cfg.DBConfig.MaxConnIdleTime)
+	assert.Equal(t, time.Minute, cfg.DBConfig.HealthCheckPeriod)
+	assert.Empty(t, cfg.DBConfig.QueryExecMode)
+	assert.Zero(t, cfg.DBConfig.StatementCacheCapacity)
+	assert.Equal(t, 10*time.Second, cfg.DBConfig.StatementTimeout)
+	assert.Equal(t, 200*time.Millisecond, cfg.DBConfig.SlowQueryThreshold)
+
+	// the environment overrides the defaults and the flags override the environment
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-db-max-conns", "50", "-db-health-check-period", "15s", "-db-query-exec-mode", "simple_protocol", "-db-statement-timeout", "3s"}
+	t.Setenv("DATABASE_QUERY_EXEC_MODE", "cache_describe")
+	t.Setenv("DATABASE_STATEMENT_CACHE_CAPACITY", "128")
+	t.Setenv("DATABASE_SLOW_QUERY_THRESHOLD", "0")
+	t.Setenv("DATABASE_STATEMENT_TIMEOUT", "30s")
+	t.Setenv("DATABASE_MAX_CONNS", "20")
+	t.Setenv("DATABASE_MIN_CONNS", "5")
+	t.Setenv("DATABASE_MAX_CONN_LIFETIME", "10m")
+	t.Setenv("DATABASE_MAX_CONN_IDLE_TIME", "2m")
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 50, cfg.DBConfig.MaxConns)
+	assert.Equal(t, 5, cfg.DBConfig.MinConns)
+	assert.Equal(t, 10*time.Minute, cfg.DBConfig.MaxConnLifetime)
+	assert.Equal(t, 2*time.Minute, cfg.DBConfig.MaxConnIdleTime)
+	assert.Equal(t, 15*time.Second, cfg.DBConfig.HealthCheckPeriod)
+	assert.Equal(t, "simple_protocol", cfg.DBConfig.QueryExecMode)
+	assert.Equal(t, 128, cfg.DBConfig.StatementCacheCapacity)
+	assert.Zero(t, cfg.DBConfig.SlowQueryThreshold)
+	assert.Equal(t, 3*time.Second, cfg.DBConfig.StatementTimeout)
+}
+
+func TestGetConfig_Export(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+
+	// the export is disabled by default and runs daily once a destination is set
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, cfg.ExportConfig.Interval)
+	assert.Empty(t, cfg.ExportConfig.Dir)
+	assert.Empty(t, cfg.ExportConfig.S3Bucket)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("EXPORT_INTERVAL", "1h")
+	t.Setenv("EXPORT_S3_ENDPOINT", "https://s3.example.com")
+	t.Setenv("EXPORT_S3_BUCKET", "bi")
+	t.Setenv("EXPORT_S3_SECRET_KEY", "secret")
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, cfg.ExportConfig.Interval)
+	assert.Equal(t, "https://s3.example.com", cfg.ExportConfig.S3Endpoint)
+	assert.Equal(t, "bi", cfg.ExportConfig.S3Bucket)
+	assert.Equal(t, "secret", cfg.ExportConfig.S3SecretKey)
+}
+
+func TestGetConfig_PasswordCost(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	t.Setenv("PASSWORD_BCRYPT_COST", "")
+	assert.NoError(t, os.Unsetenv("PASSWORD_BCRYPT_COST"))
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, cfg.ServerConfig.PasswordCost)
+
+	// the flag overrides the environment
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("PASSWORD_BCRYPT_COST", "12")
+	os.Args = []string{"cmd", "-password-cost=14"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 14, cfg.ServerConfig.PasswordCost)
+}
+
+func TestGetConfig_AccrualFailures(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, cfg.AccrualConfig.MaxAttempts)
+	assert.Equal(t, 72*time.Hour, cfg.AccrualConfig.NotRegisteredTTL)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_MAX_ATTEMPTS", "0")
+	os.Args = []string{"cmd", "-accrual-not-registered-ttl=24h"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.AccrualConfig.MaxAttempts)
+	assert.Equal(t, 24*time.Hour, cfg.AccrualConfig.NotRegisteredTTL)
+}
+
+func TestGetConfig_AccrualBatch(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.AccrualConfig.BatchPath)
+	assert.Equal(t, 100, cfg.AccrualConfig.BatchSize)
+	assert.Equal(t, "json", cfg.AccrualConfig.BatchFormat)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_BATCH_PATH", "/api/orders/batch")
+	t.Setenv("ACCRUAL_BATCH_SIZE", "50")
+	os.Args = []string{"cmd", "-accrual-batch-format=query"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/orders/batch", cfg.AccrualConfig.BatchPath)
+	assert.Equal(t, 50, cfg.AccrualConfig.BatchSize)
+	assert.Equal(t, "query", cfg.AccrualConfig.BatchFormat)
+}
+
+func TestGetConfig_AccrualRetries(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cfg.AccrualConfig.RetryCount)
+	assert.Equal(t, 100*time.Millisecond, cfg.AccrualConfig.RetryWait)
+	assert.Equal(t, 2*time.Second, cfg.AccrualConfig.RetryMaxWait)
+	assert.Equal(t, []string{"error"}, cfg.AccrualConfig.RetryOn)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_RETRY_COUNT", "5")
+	t.Setenv("ACCRUAL_RETRY_ON", "error,5xx")
+	os.Args = []string{"cmd", "-accrual-retry-wait=1s", "-accrual-retry-max-wait=10s"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cfg.AccrualConfig.RetryCount)
+	assert.Equal(t, time.Second, cfg.AccrualConfig.RetryWait)
+	assert.Equal(t, 10*time.Second, cfg.AccrualConfig.RetryMaxWait)
+	assert.Equal(t, []string{"error", "5xx"}, cfg.AccrualConfig.RetryOn)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-accrual-retry-on=5xx", "-accrual-retry-count=0"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.AccrualConfig.RetryCount)
+	assert.Equal(t, []string{"5xx"}, cfg.AccrualConfig.RetryOn)
+}
+
+func TestGetConfig_AccrualRequestTimeout(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, cfg.AccrualConfig.Timeout)
+	assert.Equal(t, 3*time.Second, cfg.AccrualConfig.RequestTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_REQUEST_TIMEOUT", "500ms")
+	os.Args = []string{"cmd", "-t=20"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, cfg.AccrualConfig.Timeout)
+	assert.Equal(t, 500*time.Millisecond, cfg.AccrualConfig.RequestTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-accrual-request-timeout=2s"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, cfg.AccrualConfig.RequestTimeout)
+}
+
+func TestGetConfig_AccrualRetryAfterMax(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, cfg.AccrualConfig.RetryAfterMax)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_RETRY_AFTER_MAX", "1m")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.AccrualConfig.RetryAfterMax)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-accrual-retry-after-max=0"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Zero(t, cfg.AccrualConfig.RetryAfterMax)
+}
+
+func TestGetConfig_AccrualConcurrency(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 64, cfg.AccrualConfig.Concurrency)
+	assert.Equal(t, 1, cfg.AccrualConfig.MinConcurrency)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_CONCURRENCY", "16")
+	os.Args = []string{"cmd", "-accrual-min-concurrency=4"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 16, cfg.AccrualConfig.Concurrency)
+	assert.Equal(t, 4, cfg.AccrualConfig.MinConcurrency)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-accrual-concurrency=0"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Zero(t, cfg.AccrualConfig.Concurrency)
+}
+
+func TestGetConfig_AccrualAuth(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.AccrualConfig.Auth)
+	assert.Equal(t, "X-API-Key", cfg.AccrualConfig.AuthHeader)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_AUTH", "basic")
+	t.Setenv("ACCRUAL_AUTH_SECRET", "env_pass")
+	os.Args = []string{"cmd", "-accrual-auth-user=shop"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "basic", cfg.AccrualConfig.Auth)
+	assert.Equal(t, "shop", cfg.AccrualConfig.AuthUser)
+	assert.Equal(t, "env_pass", cfg.AccrualConfig.AuthSecret)
+
+	// the secret is read from the file if it is not set explicitly
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("file_key\n"), 0o600))
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	assert.NoError(t, os.Unsetenv("ACCRUAL_AUTH_SECRET"))
+	t.Setenv("ACCRUAL_AUTH_SECRET_FILE", secretFile)
+	os.Args = []string{"cmd", "-accrual-auth=api_key", "-accrual-auth-header=X-Shop-Key"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "api_key", cfg.AccrualConfig.Auth)
+	assert.Equal(t, "X-Shop-Key", cfg.AccrualConfig.AuthHeader)
+	assert.Equal(t, "file_key", cfg.AccrualConfig.AuthSecret)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_AUTH_SECRET_FILE", filepath.Join(t.TempDir(), "missing"))
+	os.Args = []string{"cmd"}
+	_, err = GetConfig()
+	assert.Error(t, err)
+}
+
+func TestGetConfig_AccrualHedgeDelay(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Zero(t, cfg.AccrualConfig.HedgeDelay)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACCRUAL_HEDGE_DELAY", "300ms")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 300*time.Millisecond, cfg.AccrualConfig.HedgeDelay)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-accrual-hedge-delay=1s"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, cfg.AccrualConfig.HedgeDelay)
+}
+
+func TestGetConfig_ACME(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.ServerConfig.ACMEDomains)
+	assert.Equal(t, "autocert-cache", cfg.ServerConfig.ACMECacheDir)
+	assert.Empty(t, cfg.ServerConfig.ACMEHTTPAddr)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ACME_DOMAINS", "loyalty.example.com,www.loyalty.example.com")
+	t.Setenv("ACME_CACHE_DIR", "/var/lib/gophermart/certs")
+	t.Setenv("ACME_EMAIL", "ops@example.com")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"loyalty.example.com", "www.loyalty.example.com"}, cfg.ServerConfig.ACMEDomains)
+	assert.Equal(t, "/var/lib/gophermart/certs", cfg.ServerConfig.ACMECacheDir)
+	assert.Equal(t, "ops@example.com", cfg.ServerConfig.ACMEEmail)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-acme-domains=shop.example.com", "-acme-http-address=:80"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"shop.example.com"}, cfg.ServerConfig.ACMEDomains)
+	assert.Equal(t, ":80", cfg.ServerConfig.ACMEHTTPAddr)
+}
+
+func TestGetConfig_Pprof(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.False(t, cfg.ServerConfig.PprofEnabled)
+	assert.Empty(t, cfg.ServerConfig.PprofAddr)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("ENABLE_PPROF", "true")
+	t.Setenv("PPROF_ADDRESS", "localhost:6060")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.True(t, cfg.ServerConfig.PprofEnabled)
+	assert.Equal(t, "localhost:6060", cfg.ServerConfig.PprofAddr)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-pprof=false", "-pprof-address="}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.False(t, cfg.ServerConfig.PprofEnabled)
+	assert.Empty(t, cfg.ServerConfig.PprofAddr)
+}
+
+func TestGetConfig_Tracing(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.TracingConfig.Endpoint)
+	assert.Equal(t, "gophermart", cfg.TracingConfig.ServiceName)
+	assert.Equal(t, 1.0, cfg.TracingConfig.SampleRatio)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://otel-collector:4318")
+	t.Setenv("OTEL_SERVICE_NAME", "gophermart-eu")
+	t.Setenv("OTEL_TRACES_SAMPLE_RATIO", "0.1")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://otel-collector:4318", cfg.TracingConfig.Endpoint)
+	assert.Equal(t, "gophermart-eu", cfg.TracingConfig.ServiceName)
+	assert.Equal(t, 0.1, cfg.TracingConfig.SampleRatio)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-otel-endpoint=", "-otel-sample-ratio=0.5"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.TracingConfig.Endpoint)
+	assert.Equal(t, 0.5, cfg.TracingConfig.SampleRatio)
+}
+
+func TestGetConfig_ShutdownTimeout(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, cfg.ServerConfig.ShutdownTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, cfg.ServerConfig.ShutdownTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-shutdown-timeout=1m"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.ServerConfig.ShutdownTimeout)
+}
+
+func TestGetConfig_HTTPTimeouts(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Second, cfg.ServerConfig.ReadTimeout)
+	assert.Equal(t, 5*time.Second, cfg.ServerConfig.ReadHeaderTimeout)
+	assert.Equal(t, 30*time.Second, cfg.ServerConfig.WriteTimeout)
+	assert.Equal(t, 2*time.Minute, cfg.ServerConfig.IdleTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("HTTP_READ_TIMEOUT", "1m")
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "0")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "30s")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.ServerConfig.ReadTimeout)
+	assert.Equal(t, 2*time.Second, cfg.ServerConfig.ReadHeaderTimeout)
+	assert.Zero(t, cfg.ServerConfig.WriteTimeout)
+	assert.Equal(t, 30*time.Second, cfg.ServerConfig.IdleTimeout)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-http-write-timeout=10s", "-http-read-header-timeout=1s"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, cfg.ServerConfig.WriteTimeout)
+	assert.Equal(t, time.Second, cfg.ServerConfig.ReadHeaderTimeout)
+}
+
+func TestGetConfig_LogFormat(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "console", cfg.LogFormat)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("LOG_FORMAT", "json")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "json", cfg.LogFormat)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-log-format=console"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "console", cfg.LogFormat)
+}
+
+func TestGetConfig_MetricsAddr(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.ServerConfig.MetricsAddr)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("METRICS_ADDRESS", "localhost:9090")
+	os.Args = []string{"cmd"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:9090", cfg.ServerConfig.MetricsAddr)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd", "-metrics-address=:9100"}
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, ":9100", cfg.ServerConfig.MetricsAddr)
+}
+
+func TestGetConfig_TenantMinWithdrawals(t *testing.T) {
+	originalArgs, originalFlags := saveOriginalState()
+	defer restoreOriginalState(originalArgs, originalFlags)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	os.Args = []string{"cmd"}
+	cfg, err := GetConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.TenantMinWithdrawals)
+
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	t.Setenv("TENANT_MIN_WITHDRAWALS", "acme=10, globex=2.5")
+	cfg, err = GetConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]models.Money{"acme": models.MoneyFromFloat(10), "globex": models.MoneyFromFloat(2.5)}, cfg.TenantMinWithdrawals)
+
+	for _, v := range []string{"acme", "acme=ten", "Acme=10"} {
+		flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+		t.Setenv("TENANT_MIN_WITHDRAWALS", v)
+		_, err = GetConfig()
+		assert.Error(t, err, v)
+	}
+}
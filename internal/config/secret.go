@@ -0,0 +1,20 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile reads a secret mounted as a file (Docker/K8s secrets), trailing whitespace is trimmed.
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"strings"
+)
+
+// SaveAccrualResponse records the raw response of the accrual service about the order.
+func (db *OrderStore) SaveAccrualResponse(ctx context.Context, resp *models.AccrualResponse) error {
+	db.logger.Debugf("Saving accrual response %d for order %s", resp.StatusCode, resp.Order)
+	// Postgres text takes neither the NUL characters nor the invalid UTF-8, which a broken response may contain
+	resp.Body = strings.ReplaceAll(strings.ToValidUTF8(resp.Body, "\uFFFD"), "\x00", "\uFFFD")
+	err := db.pool.QueryRow(ctx, "INSERT INTO accrual_responses (order_number, status_code, body) VALUES ($1, $2, $3) RETURNING id, received_at",
+		resp.Order, resp.StatusCode, resp.Body).Scan(&resp.ID, &resp.ReceivedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save accrual response: %w", err)
+	}
+	return nil
+}
+
+// GetAccrualResponses returns the raw responses of the accrual service about the order, oldest first.
+// The responses of the soft-deleted order are returned too, ErrOrderNotFound is returned if the tenant has no such order.
+func (db *OrderStore) GetAccrualResponses(ctx context.Context, number string) ([]models.AccrualResponse, error) {
+	db.logger.Debugf("Getting accrual responses for order %s", number)
+	var exists bool
+	if err := db.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM orders WHERE order_number = $1 AND tenant_id = $2)", number, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to get an order: %w", err)
+	}
+	if !exists {
+		return nil, ErrOrderNotFound
+	}
+
+	rows, err := db.pool.Query(ctx, "SELECT id, order_number, status_code, body, received_at FROM accrual_responses WHERE order_number = $1 ORDER BY received_at, id", number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual responses: %w", err)
+	}
+	defer rows.Close()
+	responses := []models.AccrualResponse{}
+	for rows.Next() {
+		r := models.AccrualResponse{}
+		if err := rows.Scan(&r.ID, &r.Order, &r.StatusCode, &r.Body, &r.ReceivedAt); err != nil {
+			return nil, fmt.Errorf("scan accrual response: %w", err)
+		}
+		responses = append(responses, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get accrual responses: %w", err)
+	}
+	return responses, nil
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetUserRole returns the role of the user, the deleted users and the ones of other tenants are reported as not found.
+func (db *UserStore) GetUserRole(ctx context.Context, userID int64) (models.Role, error) {
+	db.logger.Debugf("Getting role of user %d", userID)
+	var role models.Role
+	err := db.pool.QueryRow(ctx, "SELECT role FROM users WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL", userID, tenant.FromContext(ctx)).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user role: %w", err)
+	}
+	return role, nil
+}
+
+// GetUserInfo returns the user's account of the tenant, the deleted one too, so the admins can restore it.
+func (db *UserStore) GetUserInfo(ctx context.Context, userID int64) (*models.UserInfo, error) {
+	db.logger.Debugf("Getting user %d", userID)
+	u := &models.UserInfo{}
+	err := db.pool.QueryRow(ctx, "SELECT id, login, COALESCE(phone, ''), role, created_at, deleted_at FROM users WHERE id = $1 AND tenant_id = $2", userID, tenant.FromContext(ctx)).
+		Scan(&u.ID, &u.Login, &u.Phone, &u.Role, &u.CreatedAt, &u.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return u, nil
+}
+
+// SearchUsers gets a page of the tenant's users matching the query, latest first.
+func (db *UserStore) SearchUsers(ctx context.Context, q models.UserQuery) ([]models.UserInfo, error) {
+	db.logger.Debugf("Searching users by login %q", q.Login)
+	conds := []string{"tenant_id = $1", "deleted_at IS NULL"}
+	if q.Deleted {
+		conds[1] = "deleted_at IS NOT NULL"
+	}
+	args := []any{tenant.FromContext(ctx)}
+	if q.Login != "" {
+		// the wildcards in the search string are matched literally
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Login)
+		args = append(args, "%"+escaped+"%")
+		conds = append(conds, fmt.Sprintf("login ILIKE $%d", len(args)))
+	}
+	if q.After != nil {
+		id, err := strconv.ParseInt(q.After.Key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor key: %w", err)
+		}
+		args = append(args, q.After.At, id)
+		conds = append(conds, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	query := "SELECT id, login, COALESCE(phone, ''), role, created_at, deleted_at FROM users WHERE " + strings.Join(conds, " AND ") +
+		" ORDER BY created_at DESC, id DESC"
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	defer rows.Close()
+	users := []models.UserInfo{}
+	for rows.Next() {
+		u := models.UserInfo{}
+		if err := rows.Scan(&u.ID, &u.Login, &u.Phone, &u.Role, &u.CreatedAt, &u.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	return users, nil
+}
+
+// CreateAdjustment records the admin's correction of the user's balance, a debit can't make the balance negative.
+func (db *WithdrawalStore) CreateAdjustment(ctx context.Context, adj *models.Adjustment) error {
+	db.logger.Debugf("Adjusting balance of user %d by %s", adj.UserID, adj.Amount)
+	return db.retry(ctx, func(ctx context.Context) error { return db.createAdjustment(ctx, adj) })
+}
+
+// createAdjustment runs the transaction of CreateAdjustment.
+func (db *WithdrawalStore) createAdjustment(ctx context.Context, adj *models.Adjustment) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Serialize with the user's withdrawals like Withdraw does
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", adj.UserID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock for user %d: %w", adj.UserID, err)
+		}
+		var exists bool
+		if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL)", adj.UserID, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check user: %w", err)
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+		if adj.Amount < 0 {
+			balance, err := db.loadBalance(ctx, tx, adj.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to get balance: %w", err)
+			}
+			if balance.Current+adj.Amount < 0 {
+				db.logger.Debugf("insufficient balance: %s < %s", balance.Current, -adj.Amount)
+				return ErrInsufficientBalance
+			}
+		}
+
+		err := tx.QueryRow(ctx, "INSERT INTO balance_adjustments (user_id, admin_id, amount, reason) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+			adj.UserID, adj.AdminID, adj.Amount, adj.Reason).Scan(&adj.ID, &adj.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create an adjustment: %w", err)
+		}
+		return db.changeBalance(ctx, tx, adj.UserID, adj.Amount, 0)
+	})
+}
+
+// RequeueOrder resets the invalid or stuck order to NEW, so the accrual service processes it again,
+// and records who requeued it and why. The failed attempts of the dead-lettered order are forgotten.
+func (db *OrderStore) RequeueOrder(ctx context.Context, rq *models.OrderRequeue) error {
+	db.logger.Debugf("Requeueing order %s", rq.Order)
+	return db.retry(ctx, func(ctx context.Context) error { return db.requeueOrder(ctx, rq) })
+}
+
+// requeueOrder runs the transaction of RequeueOrder.
+func (db *OrderStore) requeueOrder(ctx context.Context, rq *models.OrderRequeue) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Lock the order, so the accrual service can't change it meanwhile
+		err := tx.QueryRow(ctx, "SELECT status FROM orders WHERE order_number = $1 AND tenant_id = $2 AND deleted_at IS NULL FOR UPDATE", rq.Order, tenant.FromContext(ctx)).Scan(&rq.PreviousStatus)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get an order status: %w", err)
+		}
+		// The processed orders are never requeued, so the balance doesn't change
+		if rq.PreviousStatus != models.StatusInvalid && rq.PreviousStatus != models.StatusProcessing {
+			return ErrOrderNotRequeueable
+		}
+		if _, err := tx.Exec(ctx, `UPDATE orders SET status = 'NEW', accrual = NULL,
+				attempts = 0, next_retry_at = NULL, claimed_until = NULL, dead_lettered_at = NULL, failure_reason = NULL
+			WHERE order_number = $1`, rq.Order); err != nil {
+			return fmt.Errorf("failed to update an order: %w", err)
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO order_history (order_number, status) VALUES ($1, 'NEW')", rq.Order); err != nil {
+			return fmt.Errorf("failed to insert an order history: %w", err)
+		}
+		err = tx.QueryRow(ctx, "INSERT INTO order_requeues (order_number, admin_id, previous_status, reason) VALUES ($1, $2, $3, $4) RETURNING id, requeued_at",
+			rq.Order, rq.AdminID, rq.PreviousStatus, rq.Reason).Scan(&rq.ID, &rq.RequeuedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create an order requeue: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetStats returns the operational summary of the tenant: the users, the orders by status, the points totals,
+// the accrual backlog and the balances of the reporting view.
+func (db *OrderStore) GetStats(ctx context.Context) (*models.Stats, error) {
+	db.logger.Debug("Getting stats")
+	tenantID := tenant.FromContext(ctx)
+	stats := &models.Stats{Orders: make(map[models.OrderStatus]int64)}
+	if err := db.pool.QueryRow(ctx, "SELECT count(*) FROM users WHERE tenant_id = $1 AND deleted_at IS NULL", tenantID).Scan(&stats.Users); err != nil {
+		return nil, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	// Every status is reported, even if there are no orders with it
+	rows, err := db.pool.Query(ctx, `
+		SELECT s.status, count(o.order_number)
+		FROM unnest(enum_range(NULL::order_status)) AS s(status)
+		LEFT JOIN orders o ON o.status = s.status AND o.tenant_id = $1 AND o.deleted_at IS NULL
+		GROUP BY s.status`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count orders: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status models.OrderStatus
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan orders count: %w", err)
+		}
+		stats.Orders[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count orders: %w", err)
+	}
+
+	err = db.pool.QueryRow(ctx, `
+		SELECT (SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE tenant_id = $1 AND status = 'PROCESSED' AND deleted_at IS NULL),
+			(SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE tenant_id = $1)`, tenantID).Scan(&stats.Accrued, &stats.Withdrawn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum points: %w", err)
+	}
+	// The backlog is what GetUnprocessedOrders returns to the accrual service
+	err = db.pool.QueryRow(ctx, `
+		SELECT count(*), MIN(o.uploaded_at) FROM orders o
+		JOIN users u ON u.id = o.user_id AND u.deleted_at IS NULL
+		WHERE o.status IN ('NEW', 'PROCESSING') AND o.tenant_id = $1 AND o.deleted_at IS NULL`, tenantID).
+		Scan(&stats.Backlog.Orders, &stats.Backlog.Oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual backlog: %w", err)
+	}
+	// The balances are read from the reporting view, not summed from the ledger on every request
+	err = db.pool.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE current <> 0), COALESCE(SUM(current), 0), COALESCE(SUM(accrued), 0),
+			COALESCE(SUM(adjusted), 0), COALESCE(SUM(withdrawn), 0), MIN(refreshed_at)
+		FROM balance_report WHERE tenant_id = $1`, tenantID).
+		Scan(&stats.Balances.Users, &stats.Balances.Current, &stats.Balances.Accrued,
+			&stats.Balances.Adjusted, &stats.Balances.Withdrawn, &stats.Balances.RefreshedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance report: %w", err)
+	}
+	return stats, nil
+}
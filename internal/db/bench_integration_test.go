@@ -0,0 +1,127 @@
+//go:build integration_tests
+// +build integration_tests
+
+package db
+
+import (
+	"context"
+	"loyaltySys/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// The size of the dataset of the benchmarks: the users with their orders, mostly processed, and withdrawals.
+const (
+	benchUsers              = 1000
+	benchOrdersPerUser      = 200
+	benchWithdrawalsPerUser = 50
+)
+
+// withoutIndexScans are the DSN parameters barring the planner from the index scans,
+// the baseline the indexes are compared with.
+const withoutIndexScans = "&enable_indexscan=off&enable_indexonlyscan=off&enable_bitmapscan=off"
+
+// seedBenchData fills the database with the dataset of the benchmarks and returns the ID of one of its users.
+// The dataset is removed when the benchmark ends.
+func seedBenchData(b *testing.B) int64 {
+	b.Helper()
+	ctx := context.Background()
+	db := newTestDB(b)
+	b.Cleanup(func() { closeTestDB(b, db) })
+
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO users (login, password, created_at)
+		SELECT 'bench_' || i, 'bench', now() - i * interval '1 minute' FROM generate_series(1, $1::integer) i`, benchUsers)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		if _, err := db.pool.Exec(ctx, `DELETE FROM users WHERE login LIKE 'bench\_%'`); err != nil {
+			b.Error(err)
+		}
+	})
+	// Every 50th order is still waiting for the accrual service
+	_, err = db.pool.Exec(ctx, `
+		INSERT INTO orders (order_number, user_id, status, accrual, uploaded_at)
+		SELECT 'bench_' || u.id || '_' || i, u.id,
+			CASE WHEN i % 50 = 0 THEN 'NEW'::order_status ELSE 'PROCESSED'::order_status END,
+			CASE WHEN i % 50 = 0 THEN NULL ELSE 10 END,
+			now() - i * interval '1 hour'
+		FROM users u, generate_series(1, $1::integer) i
+		WHERE u.login LIKE 'bench\_%'`, benchOrdersPerUser)
+	require.NoError(b, err)
+	_, err = db.pool.Exec(ctx, `
+		INSERT INTO withdrawals (user_id, order_number, summ, processed_at)
+		SELECT u.id, 'bench_w_' || u.id || '_' || i, 1, now() - i * interval '1 hour'
+		FROM users u, generate_series(1, $1::integer) i
+		WHERE u.login LIKE 'bench\_%'`, benchWithdrawalsPerUser)
+	require.NoError(b, err)
+	// Update the statistics and the visibility map, so the planner sees the dataset and may scan the indexes only
+	_, err = db.pool.Exec(ctx, "VACUUM ANALYZE users, orders, withdrawals")
+	require.NoError(b, err)
+
+	var userID int64
+	require.NoError(b, db.pool.QueryRow(ctx, "SELECT id FROM users WHERE login = 'bench_1'").Scan(&userID))
+	return userID
+}
+
+// runWithIndexes runs the benchmark on the storage using the indexes and on the one scanning the tables.
+func runWithIndexes(b *testing.B, bench func(b *testing.B, db *testDB)) {
+	for _, bc := range []struct {
+		name string
+		dsn  string
+	}{
+		{name: "indexes", dsn: getDSN()},
+		{name: "seq_scans", dsn: getDSN() + withoutIndexScans},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			d, err := NewDB(context.Background(), bc.dsn, WithLogger(zap.NewNop().Sugar()))
+			require.NoError(b, err)
+			db := withStores(d)
+			defer closeTestDB(b, db)
+			bench(b, db)
+		})
+	}
+}
+
+func BenchmarkDB_GetOrdersPage(b *testing.B) {
+	userID := seedBenchData(b)
+
+	runWithIndexes(b, func(b *testing.B, db *testDB) {
+		ctx := context.Background()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			page, err := db.GetOrdersPage(ctx, userID, models.OrderFilter{}, models.Page{Limit: 20})
+			require.NoError(b, err)
+			require.Len(b, page.Orders, 20)
+		}
+	})
+}
+
+func BenchmarkDB_GetUnprocessedOrders(b *testing.B) {
+	seedBenchData(b)
+
+	runWithIndexes(b, func(b *testing.B, db *testDB) {
+		ctx := context.Background()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+			require.NoError(b, err)
+			require.GreaterOrEqual(b, len(orders), benchUsers*benchOrdersPerUser/50)
+		}
+	})
+}
+
+func BenchmarkDB_GetWithdrawalsPage(b *testing.B) {
+	userID := seedBenchData(b)
+
+	runWithIndexes(b, func(b *testing.B, db *testDB) {
+		ctx := context.Background()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			page, err := db.GetWithdrawalsPage(ctx, userID, models.WithdrawalQuery{Limit: 20})
+			require.NoError(b, err)
+			require.Len(b, page.Withdrawals, 20)
+		}
+	})
+}
@@ -1,5 +1,32 @@
 package config
 
+import (
+	"loyaltySys/internal/models"
+	"time"
+)
+
 type DBConfig struct {
-	DSN string `env:"DATABASE_URI"` // Database URI
+	DSN     string `env:"DATABASE_URI"`      // Database URI
+	DSNFile string `env:"DATABASE_URI_FILE"` // File containing the database URI, used if DATABASE_URI is not set
+
+	AutoMigrate          bool          `env:"DATABASE_AUTO_MIGRATE"`           // Apply the pending migrations on startup, otherwise they are applied with the migrate command
+	MigrationLockTimeout time.Duration `env:"DATABASE_MIGRATION_LOCK_TIMEOUT"` // Wait for another instance applying the migrations, 0 doesn't wait
+
+	// Connection pool settings, 0 keeps the value of the DSN or the pgxpool default
+	MaxConns          int           `env:"DATABASE_MAX_CONNS"`           // Maximum number of connections in the pool
+	MinConns          int           `env:"DATABASE_MIN_CONNS"`           // Connections kept open even when idle
+	MaxConnLifetime   time.Duration `env:"DATABASE_MAX_CONN_LIFETIME"`   // Age after which a connection is closed
+	MaxConnIdleTime   time.Duration `env:"DATABASE_MAX_CONN_IDLE_TIME"`  // Idle time after which a connection is closed
+	HealthCheckPeriod time.Duration `env:"DATABASE_HEALTH_CHECK_PERIOD"` // Interval of checking the idle connections
+
+	// Query execution settings, empty or 0 keeps the value of the DSN or the pgx default
+	QueryExecMode          string `env:"DATABASE_QUERY_EXEC_MODE"`          // cache_statement, cache_describe, describe_exec, exec or simple_protocol
+	StatementCacheCapacity int    `env:"DATABASE_STATEMENT_CACHE_CAPACITY"` // Statements cached by a connection
+
+	StatementTimeout time.Duration `env:"DATABASE_STATEMENT_TIMEOUT"` // Limit of a statement and of a storage call, 0 keeps the statement_timeout of the DSN
+
+	SlowQueryThreshold time.Duration `env:"DATABASE_SLOW_QUERY_THRESHOLD"` // Queries running longer are logged as slow, 0 disables it
+
+	DailyWithdrawalLimit       models.Money `env:"WITHDRAWAL_DAILY_LIMIT"`        // Per-user daily withdrawal cap, 0 disables it
+	GlobalDailyWithdrawalLimit models.Money `env:"WITHDRAWAL_GLOBAL_DAILY_LIMIT"` // Daily withdrawal cap of all the users of a tenant, 0 disables it
 }
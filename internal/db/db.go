@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"loyaltySys/internal/clock"
 	"loyaltySys/internal/db/migrations"
+	"loyaltySys/internal/metrics"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -14,32 +20,70 @@ import (
 
 // DB struct for the database.
 type DB struct {
-	pool   *pgxpool.Pool
-	logger *zap.SugaredLogger
+	pool             *retryPool
+	retries          retryPolicy // how the transient errors are retried
+	metrics          *metrics.Registry
+	logger           *zap.SugaredLogger
+	clock            clock.Clock   // decides the day of the daily withdrawal caps, stamps the webhook events
+	dailyLimit       models.Money  // per-user daily withdrawal cap, 0 disables it
+	globalDailyLimit models.Money  // daily withdrawal cap of all the users of a tenant, 0 disables it
+	autoMigrate      bool          // apply the pending migrations on connecting
+	migrationLock    time.Duration // wait for another instance applying the migrations
+	poolSettings     PoolSettings
+	slowQuery        time.Duration // queries running longer are logged as slow, 0 disables it
+}
+
+// PoolSettings are the settings of the connection pool and its connections, a zero field keeps the value
+// of the DSN or the pgx default.
+type PoolSettings struct {
+	MaxConns          int32         // maximum number of connections
+	MinConns          int32         // connections kept open even when idle
+	MaxConnLifetime   time.Duration // age after which a connection is closed
+	MaxConnIdleTime   time.Duration // idle time after which a connection is closed
+	HealthCheckPeriod time.Duration // interval of checking the idle connections
+
+	QueryExecMode          string        // how the queries are executed, one of the queryExecModes
+	StatementCacheCapacity int           // number of the prepared or described statements cached by a connection
+	StatementTimeout       time.Duration // statement_timeout of the connections and the deadline of a storage call
+}
+
+// queryExecModes are the query exec modes by their names in the DSN default_query_exec_mode parameter.
+// The statements are prepared once per connection with cache_statement, simple_protocol works behind
+// the poolers not supporting the prepared statements, e.g. PgBouncer in the transaction mode.
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
 }
 
 // NewDB provides the new data base connection with the provided configuration.
-func NewDB(ctx context.Context, dsn string, logger *zap.SugaredLogger) (*DB, error) {
-	logger.Debugf("Connecting to database with DSN: %s", dsn)
-	// Run migrations before establishing the connection
-	if err := migrations.RunMigrations(dsn, true); err != nil {
-		return nil, fmt.Errorf("failed to run DB migrations: %w", err)
+func NewDB(ctx context.Context, dsn string, opts ...Option) (*DB, error) {
+	db := &DB{logger: zap.NewNop().Sugar(), clock: clock.New(), autoMigrate: true, migrationLock: migrations.DefaultLockTimeout, retries: defaultRetryPolicy}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	db.logger.Debugf("Connecting to database with DSN: %s", dsn)
+	// Check the schema version and run the migrations before establishing the connection
+	if err := migrations.Ensure(ctx, dsn, db.autoMigrate, migrations.WithLockTimeout(db.migrationLock), migrations.WithLogger(db.logger)); err != nil {
+		return nil, fmt.Errorf("failed to prepare the DB schema: %w", err)
 	}
 	// Initialize a new connection pool with the provided DSN
-	pool, err := initPool(ctx, dsn, logger)
+	pool, err := initPool(ctx, dsn, newQueryTracer(db.logger, db.metrics, db.slowQuery), db.logger, db.poolSettings)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise a connection pool: %w", err)
 	}
+	db.pool = &retryPool{Pool: pool, db: db}
+	registerPoolCollector(db, db.metrics)
 
-	logger.Debug("Database connection established successfully")
-	return &DB{
-		pool:   pool,
-		logger: logger,
-	}, nil
+	db.logger.Debug("Database connection established successfully")
+	return db, nil
 }
 
 // initPool initializes a new connection pool.
-func initPool(ctx context.Context, dsn string, logger *zap.SugaredLogger) (*pgxpool.Pool, error) {
+func initPool(ctx context.Context, dsn string, tracer *queryTracer, logger *zap.SugaredLogger, settings PoolSettings) (*pgxpool.Pool, error) {
 	// Parse the DSN and create a new connection pool with tracing enabled
 	poolCfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
@@ -47,7 +91,43 @@ func initPool(ctx context.Context, dsn string, logger *zap.SugaredLogger) (*pgxp
 	}
 
 	// Set the connection pool configuration
-	poolCfg.ConnConfig.Tracer = &queryTracer{logger: logger}
+	poolCfg.ConnConfig.Tracer = tracer
+	if settings.MaxConns > 0 {
+		poolCfg.MaxConns = settings.MaxConns
+	}
+	if settings.MinConns > 0 {
+		poolCfg.MinConns = settings.MinConns
+	}
+	if settings.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = settings.MaxConnLifetime
+	}
+	if settings.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = settings.MaxConnIdleTime
+	}
+	if settings.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = settings.HealthCheckPeriod
+	}
+	if poolCfg.MinConns > poolCfg.MaxConns {
+		return nil, fmt.Errorf("min connections %d exceed max connections %d", poolCfg.MinConns, poolCfg.MaxConns)
+	}
+	if settings.QueryExecMode != "" {
+		mode, ok := queryExecModes[settings.QueryExecMode]
+		if !ok {
+			return nil, fmt.Errorf("unknown query exec mode %q", settings.QueryExecMode)
+		}
+		poolCfg.ConnConfig.DefaultQueryExecMode = mode
+	}
+	if settings.StatementCacheCapacity > 0 {
+		poolCfg.ConnConfig.StatementCacheCapacity = settings.StatementCacheCapacity
+		poolCfg.ConnConfig.DescriptionCacheCapacity = settings.StatementCacheCapacity
+	}
+	// The server cancels the runaway statements itself, even if the client is gone
+	if settings.StatementTimeout > 0 {
+		poolCfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(settings.StatementTimeout.Milliseconds(), 10)
+	}
+	logger.Debugf("Connection pool: max %d, min %d connections, lifetime %s, idle time %s, health check every %s, query exec mode %s, statement cache %d, statement timeout %s",
+		poolCfg.MaxConns, poolCfg.MinConns, poolCfg.MaxConnLifetime, poolCfg.MaxConnIdleTime, poolCfg.HealthCheckPeriod,
+		poolCfg.ConnConfig.DefaultQueryExecMode, poolCfg.ConnConfig.StatementCacheCapacity, settings.StatementTimeout)
 	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize a connection pool: %w", err)
@@ -68,40 +148,40 @@ func (db *DB) Close() error {
 
 // -------Methods for http handlers-------
 // CreateUser creates a new user and returns the user ID created by the database.
-func (db *DB) CreateUser(ctx context.Context, user *models.User) (userID int64, err error) {
+func (db *UserStore) CreateUser(ctx context.Context, user *models.User) (userID int64, err error) {
 	db.logger.Debugf("Creating user %s", user.Login)
-	// Begin a new transaction
-	tx, err := db.pool.Begin(ctx)
-	if err != nil {
-		return -1, fmt.Errorf("failed to begin a transaction: %w", err)
-	}
-	defer func() {
-		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
-			db.logger.Errorf("failed to rollback a transaction: %v", err)
-		}
-	}()
-	// Add a new user to the database if the user already exists, return an error
-	if err := tx.QueryRow(ctx, "INSERT INTO users (login, password) VALUES ($1, $2) RETURNING id", user.Login, user.Password).Scan(&userID); err != nil {
-		if isErrorDuplicate(err) {
-			return -1, ErrUserAlreadyExists
-		}
-		return -1, fmt.Errorf("failed to create a user: %w", err)
-	}
+	err = db.retry(ctx, func(ctx context.Context) (err error) {
+		userID, err = db.createUser(ctx, user)
+		return err
+	})
+	return userID, err
+}
 
-	// Commit the transaction
-	if err := tx.Commit(ctx); err != nil {
-		return -1, fmt.Errorf("failed to commit a transaction: %w", err)
+// createUser runs the transaction of CreateUser.
+func (db *UserStore) createUser(ctx context.Context, user *models.User) (userID int64, err error) {
+	err = db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Add a new user to the database if the user already exists, return an error
+		if err := tx.QueryRow(ctx, "INSERT INTO users (tenant_id, login, password) VALUES ($1, $2, $3) RETURNING id", tenant.FromContext(ctx), user.Login, user.Password).Scan(&userID); err != nil {
+			if isErrorDuplicate(err) {
+				return ErrUserAlreadyExists
+			}
+			return fmt.Errorf("failed to create a user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
 	}
 	return userID, nil
 }
 
-// GetUser gets the user by login and returns the hash of the password.
-func (db *DB) GetUser(ctx context.Context, login string) (*models.User, error) {
+// GetUser gets the user of the tenant by login and returns the hash of the password.
+func (db *UserStore) GetUser(ctx context.Context, login string) (*models.User, error) {
 	db.logger.Debugf("Getting user by login: %s", login)
 	// Get the user by login
 	u := &models.User{}
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, password FROM users WHERE login=$1`, login,
+		`SELECT id, password FROM users WHERE tenant_id=$1 AND login=$2 AND deleted_at IS NULL`, tenant.FromContext(ctx), login,
 	).Scan(&u.ID, &u.Password)
 	// If the user is not found, return an error
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -116,41 +196,282 @@ func (db *DB) GetUser(ctx context.Context, login string) (*models.User, error) {
 	return u, nil
 }
 
-// CreateOrder creates a new order and returns an error if the order already exists.
-func (db *DB) CreateOrder(ctx context.Context, order *models.Order) error {
-	db.logger.Debugf("Creating order %s", order.Number)
-	// Begin a new transaction
-	tx, err := db.pool.Begin(ctx)
+// GetUserByPhone gets the user of the tenant by the registered phone number.
+func (db *UserStore) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	db.logger.Debugf("Getting user by phone: %s", phone)
+	// Get the user by phone
+	u := &models.User{}
+	err := db.pool.QueryRow(ctx,
+		`SELECT id, login FROM users WHERE tenant_id=$1 AND phone=$2 AND deleted_at IS NULL`, tenant.FromContext(ctx), phone,
+	).Scan(&u.ID, &u.Login)
+	// If the user is not found, return an error
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed to begin a transaction: %w", err)
+		return nil, fmt.Errorf("select user by phone: %w", err)
 	}
-	defer func() {
-		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
-			db.logger.Errorf("failed to rollback a transaction: %v", err)
+	return u, nil
+}
+
+// SetUserPhone registers the phone number of the user and returns an error if it belongs to another user of the tenant.
+func (db *UserStore) SetUserPhone(ctx context.Context, userID int64, phone string) error {
+	db.logger.Debugf("Setting phone for user %d", userID)
+	// Update the user's phone
+	cmdTag, err := db.pool.Exec(ctx, "UPDATE users SET phone = $1 WHERE id = $2 AND tenant_id = $3 AND deleted_at IS NULL", phone, userID, tenant.FromContext(ctx))
+	if err != nil {
+		if isErrorDuplicate(err) {
+			return ErrPhoneAlreadyExists
 		}
-	}()
+		return fmt.Errorf("failed to set user phone: %w", err)
+	}
+	// If the user is not found, return an error
+	if cmdTag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
 
-	// Try to insert the new order
-	if _, err := tx.Exec(ctx, "INSERT INTO orders (order_number, user_id) VALUES ($1, $2)", order.Number, order.UserID); err != nil {
+// UpdatePasswordHash replaces the user's password hash with the one of the same password made with other parameters.
+// The hash is replaced only if it is still the old one, so the hash changed meanwhile is kept.
+func (db *UserStore) UpdatePasswordHash(ctx context.Context, userID int64, oldHash, newHash string) error {
+	db.logger.Debugf("Updating password hash for user %d", userID)
+	cmdTag, err := db.pool.Exec(ctx, "UPDATE users SET password = $1 WHERE id = $2 AND tenant_id = $3 AND password = $4 AND deleted_at IS NULL",
+		newHash, userID, tenant.FromContext(ctx), oldHash)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		db.logger.Debugf("password hash of user %d has changed or the user is deleted", userID)
+	}
+	return nil
+}
+
+// SaveOTP stores the one-time code for the phone replacing the previous one.
+func (db *UserStore) SaveOTP(ctx context.Context, otp *models.OTP) error {
+	db.logger.Debugf("Saving one-time code for phone %s", otp.Phone)
+	// Insert the code or replace the previous one and reset the attempts
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO otp_codes (tenant_id, phone, code_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, phone) DO UPDATE
+		SET code_hash = EXCLUDED.code_hash, attempts = 0, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		tenant.FromContext(ctx), otp.Phone, otp.CodeHash, otp.CreatedAt, otp.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save one-time code: %w", err)
+	}
+	return nil
+}
+
+// GetOTP gets the last one-time code sent to the phone.
+func (db *UserStore) GetOTP(ctx context.Context, phone string) (*models.OTP, error) {
+	db.logger.Debugf("Getting one-time code for phone %s", phone)
+	otp := &models.OTP{Phone: phone}
+	err := db.pool.QueryRow(ctx,
+		"SELECT code_hash, attempts, created_at, expires_at FROM otp_codes WHERE tenant_id = $1 AND phone = $2", tenant.FromContext(ctx), phone,
+	).Scan(&otp.CodeHash, &otp.Attempts, &otp.CreatedAt, &otp.ExpiresAt)
+	// If the code is not found, return an error
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOTPNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get one-time code: %w", err)
+	}
+	return otp, nil
+}
+
+// IncOTPAttempts counts a failed attempt to enter the one-time code sent to the phone.
+func (db *UserStore) IncOTPAttempts(ctx context.Context, phone string) error {
+	db.logger.Debugf("Counting failed one-time code attempt for phone %s", phone)
+	if _, err := db.pool.Exec(ctx, "UPDATE otp_codes SET attempts = attempts + 1 WHERE tenant_id = $1 AND phone = $2", tenant.FromContext(ctx), phone); err != nil {
+		return fmt.Errorf("failed to count one-time code attempt: %w", err)
+	}
+	return nil
+}
+
+// DeleteOTP consumes the one-time code sent to the phone and returns an error if it is already consumed.
+func (db *UserStore) DeleteOTP(ctx context.Context, phone string) error {
+	db.logger.Debugf("Deleting one-time code for phone %s", phone)
+	cmdTag, err := db.pool.Exec(ctx, "DELETE FROM otp_codes WHERE tenant_id = $1 AND phone = $2", tenant.FromContext(ctx), phone)
+	if err != nil {
+		return fmt.Errorf("failed to delete one-time code: %w", err)
+	}
+	// If the code is not found, return an error
+	if cmdTag.RowsAffected() == 0 {
+		return ErrOTPNotFound
+	}
+	return nil
+}
+
+// reuploadable is the condition of the ON CONFLICT update of the order inserted again: the deleted order
+// is restored for its owner if it is still new, its history gets the new upload.
+const reuploadable = "orders.deleted_at IS NOT NULL AND orders.user_id = EXCLUDED.user_id AND orders.status = 'NEW'"
+
+// CreateOrder creates a new order and returns an error if the order already exists.
+func (db *OrderStore) CreateOrder(ctx context.Context, order *models.Order) error {
+	db.logger.Debugf("Creating order %s", order.Number)
+	return db.retry(ctx, func(ctx context.Context) error { return db.createOrder(ctx, order) })
+}
+
+// createOrder runs the transaction of CreateOrder.
+func (db *OrderStore) createOrder(ctx context.Context, order *models.Order) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Try to insert the new order, the one the user deleted while it was new is uploaded again
+		tag, err := tx.Exec(ctx, `INSERT INTO orders (order_number, user_id, tenant_id) VALUES ($1, $2, $3)
+			ON CONFLICT (order_number) DO UPDATE SET deleted_at = NULL, uploaded_at = now()
+			WHERE `+reuploadable, order.Number, order.UserID, tenant.FromContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to insert an order: %w", err)
+		}
 		// If duplicate, check which user owns the order
-		if isErrorDuplicate(err) {
+		if tag.RowsAffected() == 0 {
 			return db.isUserOrder(ctx, order.Number, order.UserID)
 		}
-		return fmt.Errorf("failed to insert an order: %w", err)
+		// Start the processing history of the order
+		if _, err := tx.Exec(ctx, "INSERT INTO order_history (order_number, status) VALUES ($1, $2)", order.Number, models.StatusNew); err != nil {
+			return fmt.Errorf("failed to insert an order history: %w", err)
+		}
+		return nil
+	})
+}
+
+// CreateOrders creates the orders with the numbers for the user in a single transaction: the numbers are
+// copied into a staging table and merged into the orders, so the round trips don't grow with the batch.
+// The returned slice holds the error of each number, nil for the created orders, ErrOrderAlreadyExists
+// for the ones already uploaded by the user and ErrOrderAlreadyAdded for the ones of other users.
+func (db *OrderStore) CreateOrders(ctx context.Context, userID int64, numbers []string) ([]error, error) {
+	db.logger.Debugf("Creating a batch of %d orders for user %d", len(numbers), userID)
+	var errs []error
+	err := db.retry(ctx, func(ctx context.Context) (err error) {
+		errs, err = db.createOrders(ctx, userID, numbers)
+		return err
+	})
+	return errs, err
+}
+
+// createOrders runs the transaction of CreateOrders.
+func (db *OrderStore) createOrders(ctx context.Context, userID int64, numbers []string) ([]error, error) {
+	created := make(map[string]bool, len(numbers))
+	owners := make(map[string]int64)
+	err := db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Copy the numbers into the staging table, dropped at the end so the batches of a caller's transaction
+		// don't collide
+		if _, err := tx.Exec(ctx, "CREATE TEMP TABLE orders_upload (order_number TEXT NOT NULL) ON COMMIT DROP"); err != nil {
+			return fmt.Errorf("failed to create the staging table: %w", err)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"orders_upload"}, []string{"order_number"},
+			pgx.CopyFromSlice(len(numbers), func(i int) ([]any, error) { return []any{numbers[i]}, nil })); err != nil {
+			return fmt.Errorf("failed to copy the order numbers: %w", err)
+		}
+
+		// Merge the new numbers into the orders starting their processing history
+		rows, err := tx.Query(ctx, `WITH inserted AS (
+				INSERT INTO orders (order_number, user_id, tenant_id)
+				SELECT DISTINCT order_number, $1::integer, $3::text FROM orders_upload
+				ON CONFLICT (order_number) DO UPDATE SET deleted_at = NULL, uploaded_at = now()
+				WHERE `+reuploadable+`
+				RETURNING order_number
+			), history AS (
+				INSERT INTO order_history (order_number, status)
+				SELECT order_number, $2::order_status FROM inserted
+			)
+			SELECT order_number FROM inserted`, userID, models.StatusNew, tenant.FromContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to merge the orders: %w", err)
+		}
+		inserted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("failed to merge the orders: %w", err)
+		}
+		for _, number := range inserted {
+			created[number] = true
+		}
+
+		// The numbers not created are already uploaded, by the user or by another one
+		rows, err = tx.Query(ctx, "SELECT DISTINCT order_number, user_id FROM orders JOIN orders_upload USING (order_number)")
+		if err != nil {
+			return fmt.Errorf("failed to get the owners of the orders: %w", err)
+		}
+		var (
+			number string
+			owner  int64
+		)
+		if _, err := pgx.ForEachRow(rows, []any{&number, &owner}, func() error {
+			owners[number] = owner
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to get the owners of the orders: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, "DROP TABLE orders_upload"); err != nil {
+			return fmt.Errorf("failed to drop the staging table: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit a transaction: %w", err)
+	errs := make([]error, len(numbers))
+	for i, number := range numbers {
+		switch {
+		case created[number]:
+		case owners[number] == userID:
+			errs[i] = ErrOrderAlreadyExists
+		default:
+			errs[i] = ErrOrderAlreadyAdded
+		}
 	}
-	return nil
+	return errs, nil
 }
 
-// GetOrders gets the orders for the user and returns them.
-func (db *DB) GetOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+// GetOrders gets the orders for the user matching the filter and returns them.
+func (db *OrderStore) GetOrders(ctx context.Context, userID int64, filter models.OrderFilter) ([]models.Order, error) {
 	db.logger.Debugf("Getting orders for user %d", userID)
+	return db.queryOrders(ctx, userID, filter, models.Page{})
+}
+
+// queryOrders gets the orders for the user matching the filter, starting after the cursor of the page
+// and limited by its limit if they are set.
+func (db *OrderStore) queryOrders(ctx context.Context, userID int64, filter models.OrderFilter, page models.Page) ([]models.Order, error) {
+	// Build the conditions, so the filter is served by the orders indexes
+	conds := []string{"user_id = $1", "tenant_id = $2", "deleted_at IS NULL"}
+	args := []any{userID, tenant.FromContext(ctx)}
+	if len(filter.Statuses) > 0 {
+		statuses := make([]string, len(filter.Statuses))
+		for i, st := range filter.Statuses {
+			statuses[i] = string(st)
+		}
+		args = append(args, statuses)
+		conds = append(conds, fmt.Sprintf("status = ANY($%d::text[]::order_status[])", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conds = append(conds, fmt.Sprintf("uploaded_at >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conds = append(conds, fmt.Sprintf("uploaded_at <= $%d", len(args)))
+	}
+	column, dir, err := sortColumn(orderSortColumns, filter.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if page.After != nil {
+		after, err := cursorValue(page.After, filter.Sort.Field == models.SortAccrual)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, after, page.After.Key)
+		conds = append(conds, keysetCond(column, dir, len(args)))
+	}
 	// Get the orders for the user
-	rows, err := db.pool.Query(ctx, "SELECT order_number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC", userID)
+	query := "SELECT order_number, status, accrual, uploaded_at FROM orders WHERE " + strings.Join(conds, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, order_number %s", column, dir, dir)
+	if page.Limit > 0 {
+		args = append(args, page.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := db.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get orders: %w", err)
 	}
@@ -160,7 +481,7 @@ func (db *DB) GetOrders(ctx context.Context, userID int64) ([]models.Order, erro
 	for rows.Next() {
 		order := models.Order{}
 		// Scan the order
-		var accrual *float64
+		var accrual *models.Money
 		err := rows.Scan(&order.Number, &order.Status, &accrual, &order.UploadedAt)
 		if err != nil {
 			return nil, err
@@ -172,110 +493,346 @@ func (db *DB) GetOrders(ctx context.Context, userID int64) ([]models.Order, erro
 		// Append the order to the list
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get orders: %w", err)
+	}
 	return orders, nil
 }
 
-// GetBalance gets the balance for the user and returns it.
-func (db *DB) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
-	db.logger.Debugf("Getting balance for user %d", userID)
-	// Begin a new transaction
-	tx, err := db.pool.Begin(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin a transaction: %w", err)
+// GetOrder gets the user's order with its processing history, the orders of other users are not found.
+func (db *OrderStore) GetOrder(ctx context.Context, userID int64, number string) (*models.OrderDetail, error) {
+	db.logger.Debugf("Getting order %s for user %d", number, userID)
+	// Get the order of the user
+	order := &models.OrderDetail{}
+	var accrual *models.Money
+	err := db.pool.QueryRow(ctx,
+		"SELECT order_number, status, accrual, uploaded_at FROM orders WHERE order_number = $1 AND user_id = $2 AND tenant_id = $3 AND deleted_at IS NULL", number, userID, tenant.FromContext(ctx),
+	).Scan(&order.Number, &order.Status, &accrual, &order.UploadedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOrderNotFound
 	}
-	defer func() {
-		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
-			db.logger.Errorf("failed to rollback a transaction: %v", err)
-		}
-	}()
-	// Get the balance
-	balance, err := db.loadBalance(ctx, tx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get balance: %w", err)
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	// If the accrual sum is not nil, set the accrual sum
+	if accrual != nil {
+		order.Accrual = *accrual
 	}
 
-	return balance, nil
+	// Get the processing history of the order
+	rows, err := db.pool.Query(ctx, "SELECT status, accrual, changed_at FROM order_history WHERE order_number = $1 ORDER BY changed_at, id", number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order history: %w", err)
+	}
+	defer rows.Close()
+	order.History = []models.OrderStatusChange{}
+	for rows.Next() {
+		change := models.OrderStatusChange{}
+		var accrual *models.Money
+		if err := rows.Scan(&change.Status, &accrual, &change.ChangedAt); err != nil {
+			return nil, fmt.Errorf("scan order history: %w", err)
+		}
+		if accrual != nil {
+			change.Accrual = *accrual
+		}
+		order.History = append(order.History, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get order history: %w", err)
+	}
+	return order, nil
 }
 
-// getBalanceInTx gets the balance for the user within a transaction and returns it.
-func (db *DB) loadBalance(ctx context.Context, tx pgx.Tx, userID int64) (*models.Balance, error) {
-	db.logger.Debugf("Getting balance for user %d within transaction", userID)
+// GetOrdersByNumbers gets the user's orders with the given numbers, unknown numbers and orders of other users are skipped.
+func (db *OrderStore) GetOrdersByNumbers(ctx context.Context, userID int64, numbers []string) ([]models.Order, error) {
+	db.logger.Debugf("Getting %d orders by numbers for user %d", len(numbers), userID)
+	// Get the requested orders of the user
+	rows, err := db.pool.Query(ctx, "SELECT order_number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 AND tenant_id = $2 AND order_number = ANY($3) AND deleted_at IS NULL ORDER BY uploaded_at DESC", userID, tenant.FromContext(ctx), numbers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orders by numbers: %w", err)
+	}
+	defer rows.Close()
+	// Get the orders
+	orders := []models.Order{}
+	for rows.Next() {
+		order := models.Order{}
+		// Scan the order
+		var accrual *models.Money
+		if err := rows.Scan(&order.Number, &order.Status, &accrual, &order.UploadedAt); err != nil {
+			return nil, fmt.Errorf("scan order: %w", err)
+		}
+		// If the accrual sum is not nil, set the accrual sum
+		if accrual != nil {
+			order.Accrual = *accrual
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get orders by numbers: %w", err)
+	}
+	return orders, nil
+}
 
-	// Get the balance for the user
-	balance := &models.Balance{}
-	var accrual float64
-	var withdrawn float64
+// GetBalance gets the balance for the user and returns it.
+func (db *WithdrawalStore) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
+	db.logger.Debugf("Getting balance for user %d", userID)
+	var balance *models.Balance
+	err := db.retry(ctx, func(ctx context.Context) (err error) {
+		balance, err = db.getBalance(ctx, userID)
+		return err
+	})
+	return balance, err
+}
 
-	// Get the withdrawn sum within transaction
-	err := tx.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE user_id = $1", userID).Scan(&withdrawn)
+// getBalance runs the transaction of GetBalance.
+func (db *WithdrawalStore) getBalance(ctx context.Context, userID int64) (balance *models.Balance, err error) {
+	err = db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) (err error) {
+		// Get the balance
+		if balance, err = db.loadBalance(ctx, tx, userID); err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get withdrawn sum: %w", err)
+		return nil, err
 	}
+	return balance, nil
+}
 
-	// Get the accrual sum within transaction
-	err = tx.QueryRow(ctx, "SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE user_id = $1 AND status = 'PROCESSED'", userID).Scan(&accrual)
+// GetOrdersVersion returns the version of the user's orders that changes whenever an order is added,
+// changes its status or is removed: the number of the orders and the latest entry of their history.
+func (db *OrderStore) GetOrdersVersion(ctx context.Context, userID int64) (string, error) {
+	db.logger.Debugf("Getting orders version for user %d", userID)
+	var count, lastChange int64
+	err := db.pool.QueryRow(ctx, `
+		SELECT count(*), COALESCE(max(h.last_id), 0)
+		FROM orders o
+		LEFT JOIN LATERAL (SELECT max(id) AS last_id FROM order_history WHERE order_number = o.order_number) h ON true
+		WHERE o.user_id = $1 AND o.tenant_id = $2 AND o.deleted_at IS NULL`, userID, tenant.FromContext(ctx)).Scan(&count, &lastChange)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get accrual sum: %w", err)
+		return "", fmt.Errorf("failed to get orders version: %w", err)
 	}
+	return fmt.Sprintf("%d-%d", count, lastChange), nil
+}
 
-	// Set the balance values
-	balance.Withdrawn = withdrawn
-	balance.Current = accrual - balance.Withdrawn
+// GetBalanceVersion returns the version of the user's balance that changes with the orders, the withdrawals
+// and the adjustments.
+func (db *WithdrawalStore) GetBalanceVersion(ctx context.Context, userID int64) (string, error) {
+	db.logger.Debugf("Getting balance version for user %d", userID)
+	ordersVersion, err := db.Orders().GetOrdersVersion(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	// The withdrawals and the adjustments are never changed or removed, their number is enough
+	var withdrawals, adjustments int64
+	err = db.pool.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM withdrawals WHERE user_id = $1 AND tenant_id = $2),
+			(SELECT count(*) FROM balance_adjustments WHERE user_id = $1)`, userID, tenant.FromContext(ctx)).Scan(&withdrawals, &adjustments)
+	if err != nil {
+		return "", fmt.Errorf("failed to get balance version: %w", err)
+	}
+	return fmt.Sprintf("%s-%d-%d", ordersVersion, withdrawals, adjustments), nil
+}
 
+// loadBalance gets the balance for the user within a transaction and returns it.
+// The balance is a single row kept up to date by changeBalance, a user without it has the zero balance.
+func (db *DB) loadBalance(ctx context.Context, tx pgx.Tx, userID int64) (*models.Balance, error) {
+	db.logger.Debugf("Getting balance for user %d within transaction", userID)
+	balance := &models.Balance{}
+	err := tx.QueryRow(ctx, "SELECT current, withdrawn FROM balances WHERE user_id = $1", userID).Scan(&balance.Current, &balance.Withdrawn)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
 	return balance, nil
 }
 
-// Withdraw requests a withdrawal from the user's balance and returns an error if the balance is less than the withdrawal sum.
-func (db *DB) Withdraw(ctx context.Context, withdrawal *models.Withdrawal) error {
-	db.logger.Debugf("Withdrawing %f for order %s", withdrawal.Sum, withdrawal.Order)
-	// Begin a new transaction
-	tx, err := db.pool.Begin(ctx)
+// changeBalance adds the amounts to the user's current and withdrawn balance within the transaction
+// changing the orders, the withdrawals or the adjustments. The balance can't go below zero as the debits
+// are checked under the user's advisory lock, while the accruals only add to it.
+func (db *DB) changeBalance(ctx context.Context, tx pgx.Tx, userID int64, current, withdrawn models.Money) error {
+	db.logger.Debugf("Changing balance for user %d: current %s, withdrawn %s", userID, current, withdrawn)
+	_, err := tx.Exec(ctx, `
+		INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			current = balances.current + EXCLUDED.current,
+			withdrawn = balances.withdrawn + EXCLUDED.withdrawn,
+			updated_at = now()`, userID, current, withdrawn)
 	if err != nil {
-		return fmt.Errorf("failed to begin a transaction: %w", err)
+		return fmt.Errorf("failed to change balance: %w", err)
 	}
-	defer func() {
-		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
-			db.logger.Errorf("failed to rollback a transaction: %v", err)
+	return nil
+}
+
+// Withdraw requests a withdrawal from the user's balance and returns an error if the balance is less than the withdrawal sum.
+func (db *WithdrawalStore) Withdraw(ctx context.Context, withdrawal *models.Withdrawal) error {
+	db.logger.Debugf("Withdrawing %s for order %s", withdrawal.Sum, withdrawal.Order)
+	return db.retry(ctx, func(ctx context.Context) error { return db.withdraw(ctx, withdrawal) })
+}
+
+// withdraw runs the transaction of Withdraw.
+func (db *WithdrawalStore) withdraw(ctx context.Context, withdrawal *models.Withdrawal) error {
+	// The locks are released with the transaction
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Acquire an advisory lock for the user for the duration of the transaction
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", withdrawal.UserID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock for user %d: %w", withdrawal.UserID, err)
 		}
-	}()
 
-	// Acquire an advisory lock for the user for the duration of the transaction
-	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", withdrawal.UserID); err != nil {
-		return fmt.Errorf("failed to acquire advisory lock for user %d: %w", withdrawal.UserID, err)
-	}
+		// Check if the balance is enough using transaction-aware GetBalance
+		balance, err := db.loadBalance(ctx, tx, withdrawal.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
+		// If the balance is not enough, return an error
+		if balance.Current < withdrawal.Sum {
+			db.logger.Debugf("insufficient balance: %s < %s", balance.Current, withdrawal.Sum)
+			return ErrInsufficientBalance
+		}
+		// Check the daily withdrawal caps
+		if err := db.checkDailyLimits(ctx, tx, withdrawal); err != nil {
+			return err
+		}
+
+		// Insert the new withdrawal
+		return db.insertWithdrawal(ctx, tx, withdrawal)
+	})
+}
+
+// WithdrawBatch withdraws the balance for the orders of the user in a single transaction.
+// Every withdrawal succeeds or fails on its own: the returned slice holds the error of each of them,
+// nil for the completed ones, while the error is returned if the whole batch failed.
+func (db *WithdrawalStore) WithdrawBatch(ctx context.Context, userID int64, withdrawals []models.Withdrawal) ([]error, error) {
+	db.logger.Debugf("Withdrawing a batch of %d for user %d", len(withdrawals), userID)
+	var errs []error
+	err := db.retry(ctx, func(ctx context.Context) (err error) {
+		errs, err = db.withdrawBatch(ctx, userID, withdrawals)
+		return err
+	})
+	return errs, err
+}
+
+// withdrawBatch runs the transaction of WithdrawBatch.
+func (db *WithdrawalStore) withdrawBatch(ctx context.Context, userID int64, withdrawals []models.Withdrawal) ([]error, error) {
+	errs := make([]error, len(withdrawals))
+	// The locks are released with the transaction
+	err := db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Acquire an advisory lock for the user for the duration of the transaction
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", userID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock for user %d: %w", userID, err)
+		}
+		balance, err := db.loadBalance(ctx, tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
 
-	// Check if the balance is enough using transaction-aware GetBalance
-	balance, err := db.loadBalance(ctx, tx, withdrawal.UserID)
+		// The withdrawals are applied in order, each of them spends the balance left by the previous ones
+		current := balance.Current
+		for i := range withdrawals {
+			withdrawal := &withdrawals[i]
+			withdrawal.UserID = userID
+			if current < withdrawal.Sum {
+				db.logger.Debugf("insufficient balance: %s < %s", current, withdrawal.Sum)
+				errs[i] = ErrInsufficientBalance
+				continue
+			}
+			if err := db.checkDailyLimits(ctx, tx, withdrawal); err != nil {
+				if !errors.Is(err, ErrDailyLimitExceeded) {
+					return err
+				}
+				errs[i] = err
+				continue
+			}
+			// A failed insert aborts the transaction, so every withdrawal has its own savepoint
+			err := db.WithTx(ctx, func(ctx context.Context, sp pgx.Tx) error {
+				return db.insertWithdrawal(ctx, sp, withdrawal)
+			})
+			if err != nil {
+				if !errors.Is(err, ErrOrderAlreadyExists) && !errors.Is(err, ErrOrderNumberUsed) {
+					return err
+				}
+				errs[i] = err
+				continue
+			}
+			current -= withdrawal.Sum
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get balance: %w", err)
+		return nil, err
 	}
-	// If the balance is not enough, return an error
-	if balance.Current < withdrawal.Sum {
-		db.logger.Debugf("insufficient balance: %f < %f", balance.Current, withdrawal.Sum)
-		return ErrInsufficientBalance
+	return errs, nil
+}
+
+// insertWithdrawal inserts the withdrawal, takes it from the balance and notifies the user's webhooks about it.
+// The number already withdrawn for by the user is ErrOrderAlreadyExists, the one of an accrual order
+// or of another user's withdrawal is ErrOrderNumberUsed.
+func (db *DB) insertWithdrawal(ctx context.Context, tx pgx.Tx, withdrawal *models.Withdrawal) error {
+	// Tell the user's own repeated withdrawal from the number used by another user
+	var ownerID int64
+	err := tx.QueryRow(ctx, "SELECT user_id FROM withdrawals WHERE order_number = $1", withdrawal.Order).Scan(&ownerID)
+	switch {
+	case err == nil && ownerID == withdrawal.UserID:
+		return ErrOrderAlreadyExists
+	case err == nil:
+		return ErrOrderNumberUsed
+	case !errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("failed to get a withdrawal owner: %w", err)
 	}
 
-	// Insert the new withdrawal
-	if _, err := tx.Exec(ctx, "INSERT INTO withdrawals (order_number, user_id, summ) VALUES ($1, $2, $3)", withdrawal.Order, withdrawal.UserID, withdrawal.Sum); err != nil {
-		if isErrorDuplicate(err) {
+	// The constraints reject the numbers of the accrual orders and the concurrent withdrawals of other users
+	if _, err := tx.Exec(ctx, "INSERT INTO withdrawals (order_number, user_id, tenant_id, summ, description) VALUES ($1, $2, $3, $4, $5)",
+		withdrawal.Order, withdrawal.UserID, tenant.FromContext(ctx), withdrawal.Sum, withdrawal.Description); err != nil {
+		switch violatedConstraint(err) {
+		case "":
+			return fmt.Errorf("failed to create a withdrawal: %w", err)
+		case "withdrawals_pkey":
 			return ErrOrderAlreadyExists
+		default:
+			return ErrOrderNumberUsed
 		}
-		return fmt.Errorf("failed to create a withdrawal: %w", err)
 	}
-
-	// Commit the transaction (locks are automatically released)
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit a transaction: %w", err)
+	if err := db.changeBalance(ctx, tx, withdrawal.UserID, -withdrawal.Sum, withdrawal.Sum); err != nil {
+		return err
 	}
-	return nil
+	event := models.WithdrawalEvent{Order: withdrawal.Order, Sum: withdrawal.Sum, At: db.clock.Now()}
+	return db.enqueueWebhookEvent(ctx, tx, withdrawal.UserID, models.WebhookWithdrawalCompleted, event.At, event)
 }
 
-// GetWithdrawals gets the withdrawals for the user and returns them.
-func (db *DB) GetWithdrawals(ctx context.Context, userID int64) ([]models.Withdrawal, error) {
+// GetWithdrawals gets a page of the withdrawals for the user, latest first, and returns them.
+func (db *WithdrawalStore) GetWithdrawals(ctx context.Context, userID int64, q models.WithdrawalQuery) ([]models.Withdrawal, error) {
 	db.logger.Debugf("Getting withdrawals for user %d", userID)
+	// Build the conditions
+	conds := []string{"user_id = $1", "tenant_id = $2"}
+	args := []any{userID, tenant.FromContext(ctx)}
+	if !q.From.IsZero() {
+		args = append(args, q.From)
+		conds = append(conds, fmt.Sprintf("processed_at >= $%d", len(args)))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To)
+		conds = append(conds, fmt.Sprintf("processed_at <= $%d", len(args)))
+	}
+	column, dir, err := sortColumn(withdrawalSortColumns, q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if q.After != nil {
+		after, err := cursorValue(q.After, q.Sort.Field == models.SortSum)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, after, q.After.Key)
+		conds = append(conds, keysetCond(column, dir, len(args)))
+	}
+	query := "SELECT order_number, summ, processed_at, description FROM withdrawals WHERE " + strings.Join(conds, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, order_number %s", column, dir, dir)
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
 
 	// Get the withdrawals for the user
-	rows, err := db.pool.Query(ctx, "SELECT order_number, summ, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at DESC", userID)
+	rows, err := db.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get withdrawals: %w", err)
 	}
@@ -286,26 +843,85 @@ func (db *DB) GetWithdrawals(ctx context.Context, userID int64) ([]models.Withdr
 	for rows.Next() {
 		// Scan the withdrawal
 		withdrawal := models.Withdrawal{}
-		err := rows.Scan(&withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt)
+		err := rows.Scan(&withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt, &withdrawal.Description)
 		if err != nil {
 			return nil, err
 		}
 		// Append the withdrawal to the list
 		withdrawals = append(withdrawals, withdrawal)
 	}
-
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get withdrawals: %w", err)
+	}
 	return withdrawals, nil
 }
 
+// GetTransactions gets the user's ledger: the accruals, the withdrawals and the adjustments in chronological order
+// with the running balance.
+func (db *WithdrawalStore) GetTransactions(ctx context.Context, userID int64) ([]models.Transaction, error) {
+	db.logger.Debugf("Getting transactions for user %d", userID)
+	// Merge the accruals, the withdrawals and the adjustments, an accrual takes place when the order is processed
+	rows, err := db.pool.Query(ctx, `
+		SELECT type, order_number, amount, reason, at, SUM(amount) OVER (ORDER BY at, type, order_number, seq) AS balance
+		FROM (
+			SELECT 'ACCRUAL' AS type, o.order_number, o.accrual AS amount, '' AS reason,
+				COALESCE((SELECT MAX(h.changed_at) FROM order_history h
+					WHERE h.order_number = o.order_number AND h.status = 'PROCESSED'), o.uploaded_at) AS at, 0::bigint AS seq
+			FROM orders o
+			WHERE o.user_id = $1 AND o.tenant_id = $2 AND o.status = 'PROCESSED' AND o.accrual > 0 AND o.deleted_at IS NULL
+			UNION ALL
+			SELECT 'WITHDRAWAL', order_number, -summ, '', processed_at, 0
+			FROM withdrawals
+			WHERE user_id = $1 AND tenant_id = $2
+			UNION ALL
+			SELECT 'ADJUSTMENT', '', amount, reason, created_at, id
+			FROM balance_adjustments
+			WHERE user_id = $1
+		) t
+		ORDER BY at, type, order_number, seq`, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+	defer rows.Close()
+	// Get the transactions
+	transactions := []models.Transaction{}
+	for rows.Next() {
+		tr := models.Transaction{}
+		if err := rows.Scan(&tr.Type, &tr.Order, &tr.Amount, &tr.Reason, &tr.At, &tr.Balance); err != nil {
+			return nil, fmt.Errorf("scan transaction: %w", err)
+		}
+		transactions = append(transactions, tr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+	return transactions, nil
+}
+
 // -------Methods for accrual service-------
-// GetUnprocessedOrders gets the unprocessed orders and returns them.
-func (db *DB) GetUnprocessedOrders(ctx context.Context) ([]models.Order, error) {
+// GetUnprocessedOrders claims the unprocessed orders due for the accrual request, up to the limit, 0 for no limit,
+// the oldest upload first, and returns them with the numbers of their failed attempts. The claimed orders aren't returned
+// again for claimFor, so the instances polling together don't request the same orders; the postponed orders
+// and the ones claimed by another poll are skipped.
+func (db *OrderStore) GetUnprocessedOrders(ctx context.Context, limit int, claimFor time.Duration) ([]models.Order, error) {
 	db.logger.Debug("Getting unprocessed orders")
-	// Get the unprocessed orders
+	// Claim the unprocessed orders, the ones locked by a concurrent claim are skipped
 	rows, err := db.pool.Query(ctx, `
-  			SELECT order_number, status, COALESCE(accrual, 0) AS accrual, uploaded_at
-  			FROM orders
- 			WHERE status IN ('NEW','PROCESSING')`)
+		UPDATE orders o SET claimed_until = now() + make_interval(secs => $2)
+		FROM (
+			SELECT o.order_number
+			FROM orders o
+			JOIN users u ON u.id = o.user_id AND u.deleted_at IS NULL
+			WHERE o.status IN ('NEW','PROCESSING') AND o.deleted_at IS NULL
+			  AND (o.next_retry_at IS NULL OR o.next_retry_at <= now())
+			  AND (o.claimed_until IS NULL OR o.claimed_until <= now())
+			ORDER BY o.uploaded_at, o.order_number
+			LIMIT NULLIF($1, 0)
+			FOR UPDATE OF o SKIP LOCKED
+		) c
+		WHERE o.order_number = c.order_number
+		RETURNING o.order_number, o.user_id, o.status, COALESCE(o.accrual, 0) AS accrual, o.uploaded_at, o.attempts`,
+		limit, claimFor.Seconds())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get unprocessed orders: %w", err)
 	}
@@ -315,26 +931,155 @@ func (db *DB) GetUnprocessedOrders(ctx context.Context) ([]models.Order, error)
 	// Scan the orders
 	for rows.Next() {
 		var o models.Order
-		if err := rows.Scan(&o.Number, &o.Status, &o.Accrual, &o.UploadedAt); err != nil {
+		if err := rows.Scan(&o.Number, &o.UserID, &o.Status, &o.Accrual, &o.UploadedAt, &o.Attempts); err != nil {
 			return nil, fmt.Errorf("scan order: %w", err)
 		}
 		// Append the order to the list
 		orders = append(orders, o)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get unprocessed orders: %w", err)
+	}
 	return orders, nil
 }
 
-// UpdateOrder updates the order and returns an error if the order is not found.
-func (db *DB) UpdateOrder(ctx context.Context, order *models.Order) error {
-	db.logger.Debugf("Updating order %s", order.Number)
-	// Update the order
-	cmdTag, err := db.pool.Exec(ctx, "UPDATE orders SET status = $1, accrual = $2 WHERE order_number = $3", order.Status, order.Accrual, order.Number)
+// ClaimOrder claims the unprocessed order for claimFor, like GetUnprocessedOrders does, and reports
+// if it's claimed. The order that's processed, postponed, or claimed by a poll meanwhile isn't claimed.
+func (db *OrderStore) ClaimOrder(ctx context.Context, number string, claimFor time.Duration) (bool, error) {
+	db.logger.Debugf("Claiming order %s", number)
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE orders o SET claimed_until = now() + make_interval(secs => $2)
+		FROM (
+			SELECT o.order_number
+			FROM orders o
+			JOIN users u ON u.id = o.user_id AND u.deleted_at IS NULL
+			WHERE o.order_number = $1
+			  AND o.status IN ('NEW','PROCESSING') AND o.deleted_at IS NULL
+			  AND (o.next_retry_at IS NULL OR o.next_retry_at <= now())
+			  AND (o.claimed_until IS NULL OR o.claimed_until <= now())
+			FOR UPDATE OF o SKIP LOCKED
+		) c
+		WHERE o.order_number = c.order_number`,
+		number, claimFor.Seconds())
 	if err != nil {
-		return fmt.Errorf("failed to update an order: %w", err)
+		return false, fmt.Errorf("failed to claim an order: %w", err)
 	}
-	// If the order is not found, return an error
-	if cmdTag.RowsAffected() == 0 {
-		return ErrOrderNotFound
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetAccrualBacklog returns the orders across the tenants GetUnprocessedOrders returns sooner or later,
+// the postponed and the claimed ones included.
+func (db *OrderStore) GetAccrualBacklog(ctx context.Context) (*models.AccrualBacklog, error) {
+	backlog := &models.AccrualBacklog{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE o.status = 'NEW'), count(*) FILTER (WHERE o.status = 'PROCESSING'), MIN(o.uploaded_at)
+		FROM orders o
+		JOIN users u ON u.id = o.user_id AND u.deleted_at IS NULL
+		WHERE o.status IN ('NEW','PROCESSING') AND o.deleted_at IS NULL`).
+		Scan(&backlog.New, &backlog.Processing, &backlog.Oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual backlog: %w", err)
 	}
-	return nil
+	return backlog, nil
+}
+
+// UpdateOrder updates the order, records the status change in the order history and returns an error if the order is not found.
+func (db *OrderStore) UpdateOrder(ctx context.Context, order *models.Order) error {
+	db.logger.Debugf("Updating order %s", order.Number)
+	return db.retry(ctx, func(ctx context.Context) error { return db.updateOrder(ctx, order) })
+}
+
+// updateOrder runs the transaction of UpdateOrder.
+func (db *OrderStore) updateOrder(ctx context.Context, order *models.Order) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Lock the order and get the current status
+		var status models.OrderStatus
+		var userID int64
+		var accrual models.Money
+		err := tx.QueryRow(ctx, "SELECT status, user_id, COALESCE(accrual, 0) FROM orders WHERE order_number = $1 AND deleted_at IS NULL FOR UPDATE", order.Number).Scan(&status, &userID, &accrual)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get an order status: %w", err)
+		}
+		// Update the order
+		if _, err := tx.Exec(ctx, "UPDATE orders SET status = $1, accrual = $2 WHERE order_number = $3", order.Status, order.Accrual, order.Number); err != nil {
+			return fmt.Errorf("failed to update an order: %w", err)
+		}
+		// Only the processed orders count in the balance
+		var credit models.Money
+		if order.Status == models.StatusProcessed {
+			credit += order.Accrual
+		}
+		if status == models.StatusProcessed {
+			credit -= accrual
+		}
+		if credit != 0 {
+			if err := db.changeBalance(ctx, tx, userID, credit, 0); err != nil {
+				return err
+			}
+		}
+		// Record the status change
+		if status != order.Status {
+			if _, err := tx.Exec(ctx, "INSERT INTO order_history (order_number, status, accrual) VALUES ($1, $2, $3)", order.Number, order.Status, order.Accrual); err != nil {
+				return fmt.Errorf("failed to insert an order history: %w", err)
+			}
+		}
+		// Notify the user's webhooks about the processed order
+		if status != order.Status && order.Status == models.StatusProcessed {
+			event := models.OrderEvent{Number: order.Number, Status: order.Status, Accrual: order.Accrual, At: db.clock.Now()}
+			if err := db.enqueueWebhookEvent(ctx, tx, userID, models.WebhookOrderProcessed, event.At, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PostponeOrder records the failed accrual attempts of the unprocessed order, so it isn't requested again
+// before retryAt. ErrOrderNotFound is returned if the order is processed or deleted meanwhile.
+func (db *OrderStore) PostponeOrder(ctx context.Context, number string, attempts int, retryAt time.Time) error {
+	db.logger.Debugf("Postponing order %s after %d attempts", number, attempts)
+	return db.retry(ctx, func(ctx context.Context) error {
+		tag, err := db.pool.Exec(ctx, `
+			UPDATE orders SET attempts = $2, next_retry_at = $3
+			WHERE order_number = $1 AND status IN ('NEW','PROCESSING') AND deleted_at IS NULL`, number, attempts, retryAt)
+		if err != nil {
+			return fmt.Errorf("failed to postpone an order: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrOrderNotFound
+		}
+		return nil
+	})
+}
+
+// DeleteOrder deletes the user's order that is still new, the orders of other users are reported as not found.
+func (db *OrderStore) DeleteOrder(ctx context.Context, userID int64, number string) error {
+	db.logger.Debugf("Deleting order %s of user %d", number, userID)
+	return db.retry(ctx, func(ctx context.Context) error { return db.deleteOrder(ctx, userID, number) })
+}
+
+// deleteOrder runs the transaction of DeleteOrder.
+func (db *OrderStore) deleteOrder(ctx context.Context, userID int64, number string) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Lock the order, so the accrual service can't change it meanwhile
+		var status models.OrderStatus
+		err := tx.QueryRow(ctx, "SELECT status FROM orders WHERE order_number = $1 AND user_id = $2 AND tenant_id = $3 AND deleted_at IS NULL FOR UPDATE", number, userID, tenant.FromContext(ctx)).Scan(&status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get an order status: %w", err)
+		}
+		if status != models.StatusNew {
+			return ErrOrderNotNew
+		}
+		// Delete the order, it is kept with its history until it is uploaded again
+		if _, err := tx.Exec(ctx, "UPDATE orders SET deleted_at = now() WHERE order_number = $1", number); err != nil {
+			return fmt.Errorf("failed to delete an order: %w", err)
+		}
+		return nil
+	})
 }
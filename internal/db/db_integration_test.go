@@ -4,22 +4,33 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"log"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/db/migrations"
+	"loyaltySys/internal/metrics"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx"
+	pgx5 "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestMain(m *testing.M) {
@@ -183,18 +194,31 @@ func getHostPort(hostPort string) (string, uint16, error) {
 	return hostPortParts[0], uint16(port), nil
 }
 
-func newTestDB(t *testing.T) *DB {
+// testDB is the database with the methods of all the stores, as the tests check them together.
+type testDB struct {
+	*DB
+	*UserStore
+	*OrderStore
+	*WithdrawalStore
+	*WebhookStore
+}
+
+func withStores(db *DB) *testDB {
+	return &testDB{DB: db, UserStore: db.Users(), OrderStore: db.Orders(), WithdrawalStore: db.Withdrawals(), WebhookStore: db.Webhooks()}
+}
+
+func newTestDB(t testing.TB) *testDB {
 	t.Helper()
 	dsn := getDSN()
-	db, err := NewDB(context.Background(), dsn, zap.NewNop().Sugar())
+	db, err := NewDB(context.Background(), dsn, WithLogger(zap.NewNop().Sugar()))
 	if err != nil {
 		t.Error(err)
 		return nil
 	}
-	return db
+	return withStores(db)
 }
 
-func closeTestDB(t *testing.T, db *DB) {
+func closeTestDB(t testing.TB, db *testDB) {
 	t.Helper()
 	if err := db.Close(); err != nil {
 		t.Error(err)
@@ -358,6 +382,7 @@ func TestDB_GetOrders(t *testing.T) {
 	cases := []struct {
 		Name   string
 		UserID int64
+		Filter models.OrderFilter
 		want   *models.Order
 	}{
 		{
@@ -373,11 +398,36 @@ func TestDB_GetOrders(t *testing.T) {
 			UserID: 2,
 			want:   nil,
 		},
+		{
+			Name:   "filter_by_status_and_date",
+			UserID: 1,
+			Filter: models.OrderFilter{
+				Statuses: []models.OrderStatus{models.StatusNew, models.StatusProcessing},
+				From:     time.Now().Add(-time.Hour),
+				To:       time.Now().Add(time.Hour),
+			},
+			want: &models.Order{
+				Number: "1234567890",
+				Status: "NEW",
+			},
+		},
+		{
+			Name:   "filter_by_other_status",
+			UserID: 1,
+			Filter: models.OrderFilter{Statuses: []models.OrderStatus{models.StatusProcessed}},
+			want:   nil,
+		},
+		{
+			Name:   "filter_by_future_date",
+			UserID: 1,
+			Filter: models.OrderFilter{From: time.Now().Add(time.Hour)},
+			want:   nil,
+		},
 	}
 	for i, tc := range cases {
 		i, tc := i, tc
 		t.Run(fmt.Sprintf("test #%d: %s", i, tc.Name), func(t *testing.T) {
-			orders, err := db.GetOrders(context.Background(), tc.UserID)
+			orders, err := db.GetOrders(context.Background(), tc.UserID, tc.Filter)
 			assert.NoError(t, err)
 			if tc.want == nil {
 				require.Empty(t, orders)
@@ -391,6 +441,83 @@ func TestDB_GetOrders(t *testing.T) {
 	}
 }
 
+func TestDB_GetOrdersByNumbers(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	cases := []struct {
+		Name    string
+		UserID  int64
+		Numbers []string
+		want    []string
+	}{
+		{
+			Name:    "get_known_orders",
+			UserID:  1,
+			Numbers: []string{"1234567890", "0000000000"},
+			want:    []string{"1234567890"},
+		},
+		{
+			Name:    "skip_orders_of_other_user",
+			UserID:  2,
+			Numbers: []string{"1234567890"},
+			want:    nil,
+		},
+	}
+	for i, tc := range cases {
+		i, tc := i, tc
+		t.Run(fmt.Sprintf("test #%d: %s", i, tc.Name), func(t *testing.T) {
+			orders, err := db.GetOrdersByNumbers(context.Background(), tc.UserID, tc.Numbers)
+			assert.NoError(t, err)
+			var got []string
+			for _, o := range orders {
+				got = append(got, o.Number)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestDB_PhoneOTP(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+	const phone = "+79161234567"
+
+	// register the phone
+	require.NoError(t, db.SetUserPhone(ctx, 1, phone))
+	assert.ErrorIs(t, db.SetUserPhone(ctx, 2, phone), ErrPhoneAlreadyExists)
+	assert.ErrorIs(t, db.SetUserPhone(ctx, 1000, "+79160000000"), ErrUserNotFound)
+	u, err := db.GetUserByPhone(ctx, phone)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), u.ID)
+	_, err = db.GetUserByPhone(ctx, "+79160000000")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// store, count the attempts and consume the code
+	now := time.Now().Truncate(time.Second)
+	otp := &models.OTP{Phone: phone, CodeHash: "hash", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+	require.NoError(t, db.SaveOTP(ctx, otp))
+	require.NoError(t, db.IncOTPAttempts(ctx, phone))
+	got, err := db.GetOTP(ctx, phone)
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Attempts)
+	assert.True(t, got.ExpiresAt.Equal(otp.ExpiresAt))
+
+	// a new code resets the attempts
+	otp.CodeHash = "new-hash"
+	require.NoError(t, db.SaveOTP(ctx, otp))
+	got, err = db.GetOTP(ctx, phone)
+	require.NoError(t, err)
+	assert.Equal(t, "new-hash", got.CodeHash)
+	assert.Equal(t, 0, got.Attempts)
+
+	require.NoError(t, db.DeleteOTP(ctx, phone))
+	assert.ErrorIs(t, db.DeleteOTP(ctx, phone), ErrOTPNotFound)
+	_, err = db.GetOTP(ctx, phone)
+	assert.ErrorIs(t, err, ErrOTPNotFound)
+}
+
 func TestDB_GetUnprocessedOrders(t *testing.T) {
 	db := newTestDB(t)
 	defer closeTestDB(t, db)
@@ -411,7 +538,7 @@ func TestDB_GetUnprocessedOrders(t *testing.T) {
 	for i, tc := range cases {
 		i, tc := i, tc
 		t.Run(fmt.Sprintf("test #%d: %s", i, tc.Name), func(t *testing.T) {
-			orders, err := db.GetUnprocessedOrders(context.Background())
+			orders, err := db.GetUnprocessedOrders(context.Background(), 0, 0)
 			assert.NoError(t, err)
 			if tc.want == nil {
 				require.Empty(t, orders)
@@ -425,6 +552,163 @@ func TestDB_GetUnprocessedOrders(t *testing.T) {
 	}
 }
 
+func TestDB_GetUnprocessedOrders_Claim(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the claimed orders are skipped by the other polls until the claim expires
+	claimed, err := db.GetUnprocessedOrders(ctx, 0, 2*time.Second)
+	require.NoError(t, err)
+	require.NotEmpty(t, claimed)
+	orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+	require.Eventually(t, func() bool {
+		orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+		require.NoError(t, err)
+		return len(orders) == len(claimed)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// the claim is bounded by the limit, the oldest orders first
+	oldest := claimed[0]
+	for _, o := range claimed {
+		if o.UploadedAt.Before(oldest.UploadedAt) {
+			oldest = o
+		}
+	}
+	orders, err = db.GetUnprocessedOrders(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, oldest.UploadedAt, orders[0].UploadedAt)
+}
+
+func TestDB_ClaimOrder(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	const number = "378282246310005"
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: number}))
+	// the order isn't left for the other tests
+	defer func() { require.NoError(t, db.RemoveOrder(ctx, number)) }()
+
+	// the order is claimed once until the claim expires
+	claimed, err := db.ClaimOrder(ctx, number, time.Second)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = db.ClaimOrder(ctx, number, time.Second)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	// the poll skips the claimed order
+	orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+	require.NoError(t, err)
+	for _, o := range orders {
+		assert.NotEqual(t, number, o.Number)
+	}
+	require.Eventually(t, func() bool {
+		claimed, err := db.ClaimOrder(ctx, number, 0)
+		require.NoError(t, err)
+		return claimed
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// the unknown order isn't claimed
+	claimed, err = db.ClaimOrder(ctx, "0", time.Second)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+}
+
+func TestDB_GetAccrualBacklog(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	before, err := db.GetAccrualBacklog(ctx)
+	require.NoError(t, err)
+	const number = "6011000000000004"
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: number}))
+	// the order isn't left for the other tests
+	defer func() { require.NoError(t, db.RemoveOrder(ctx, number)) }()
+
+	// the uploaded order waits for the accrual service
+	after, err := db.GetAccrualBacklog(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before.New+1, after.New)
+	assert.Equal(t, before.Processing, after.Processing)
+	require.NotNil(t, after.Oldest)
+	if before.Oldest != nil {
+		assert.Equal(t, *before.Oldest, *after.Oldest)
+	}
+}
+
+func TestDB_PostponeOrder(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+	const number = "5500000000000004"
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: number}))
+	// the order isn't left for the other tests
+	defer func() { require.NoError(t, db.RemoveOrder(ctx, number)) }()
+
+	pending := func() []string {
+		orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+		require.NoError(t, err)
+		var numbers []string
+		for _, o := range orders {
+			numbers = append(numbers, o.Number)
+		}
+		return numbers
+	}
+	require.Contains(t, pending(), number)
+
+	// the postponed order is skipped until its retry time
+	require.NoError(t, db.PostponeOrder(ctx, number, 1, time.Now().Add(time.Hour)))
+	assert.NotContains(t, pending(), number)
+	require.NoError(t, db.PostponeOrder(ctx, number, 2, time.Now().Add(-time.Second)))
+	orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+	require.NoError(t, err)
+	for _, o := range orders {
+		if o.Number == number {
+			assert.Equal(t, 2, o.Attempts)
+		}
+	}
+
+	// the dead-lettered order is invalid and listed for the admins until it is requeued
+	require.NoError(t, db.DeadLetterOrder(ctx, number, 3, "failed 3 times"))
+	assert.NotContains(t, pending(), number)
+	assert.ErrorIs(t, db.DeadLetterOrder(ctx, number, 3, "failed 3 times"), ErrOrderNotFound)
+	order, err := db.GetOrder(ctx, 1, number)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusInvalid, order.Status)
+	require.Len(t, order.History, 2)
+	assert.Equal(t, models.StatusInvalid, order.History[1].Status)
+	dead, err := db.GetDeadLetterOrders(ctx, models.Page{})
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, number, dead[0].Number)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, "failed 3 times", dead[0].Reason)
+	dead, err = db.GetDeadLetterOrders(ctx, models.Page{After: &models.Cursor{At: dead[0].DeadLetteredAt, Key: dead[0].Number}})
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+
+	// the requeue counts the attempts anew
+	require.NoError(t, db.RequeueOrder(ctx, &models.OrderRequeue{Order: number, AdminID: 1, Reason: "retry"}))
+	orders, err = db.GetUnprocessedOrders(ctx, 0, 0)
+	require.NoError(t, err)
+	require.Contains(t, pending(), number)
+	for _, o := range orders {
+		if o.Number == number {
+			assert.Zero(t, o.Attempts)
+		}
+	}
+	dead, err = db.GetDeadLetterOrders(ctx, models.Page{})
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+
+	assert.ErrorIs(t, db.PostponeOrder(ctx, "79927398713", 1, time.Now()), ErrOrderNotFound)
+}
+
 func TestDB_UpdateOrder(t *testing.T) {
 	db := newTestDB(t)
 	defer closeTestDB(t, db)
@@ -440,7 +724,7 @@ func TestDB_UpdateOrder(t *testing.T) {
 			Order: &models.Order{
 				Number:  "1234567890",
 				Status:  "PROCESSED",
-				Accrual: 100,
+				Accrual: models.MoneyFromFloat(100),
 			},
 			ExpectedErr: nil,
 			wantErr:     false,
@@ -450,7 +734,7 @@ func TestDB_UpdateOrder(t *testing.T) {
 			Order: &models.Order{
 				Number:  "1234567891",
 				Status:  "PROCESSED",
-				Accrual: 100,
+				Accrual: models.MoneyFromFloat(100),
 			},
 			ExpectedErr: ErrOrderNotFound,
 			wantErr:     true,
@@ -470,6 +754,33 @@ func TestDB_UpdateOrder(t *testing.T) {
 	}
 }
 
+func TestDB_GetOrder(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	// the order is uploaded and processed by the previous tests
+	order, err := db.GetOrder(context.Background(), 1, "1234567890")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusProcessed, order.Status)
+	assert.Equal(t, models.MoneyFromFloat(100), order.Accrual)
+	require.Len(t, order.History, 2)
+	assert.Equal(t, models.StatusNew, order.History[0].Status)
+	assert.Equal(t, models.StatusProcessed, order.History[1].Status)
+	assert.Equal(t, models.MoneyFromFloat(100), order.History[1].Accrual)
+
+	// repeated update with the same status isn't recorded
+	require.NoError(t, db.UpdateOrder(context.Background(), &models.Order{Number: "1234567890", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(100)}))
+	order, err = db.GetOrder(context.Background(), 1, "1234567890")
+	require.NoError(t, err)
+	assert.Len(t, order.History, 2)
+
+	// the orders of other users are not found
+	_, err = db.GetOrder(context.Background(), 2, "1234567890")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	_, err = db.GetOrder(context.Background(), 1, "0000000000")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+}
+
 func TestDB_Withdraw(t *testing.T) {
 	db := newTestDB(t)
 	defer closeTestDB(t, db)
@@ -483,9 +794,10 @@ func TestDB_Withdraw(t *testing.T) {
 		{
 			Name: "withdraw",
 			Withdrawal: &models.Withdrawal{
-				UserID: 1,
-				Order:  "1234567890",
-				Sum:    20,
+				UserID:      1,
+				Order:       "2377225624",
+				Sum:         models.MoneyFromFloat(20),
+				Description: "Coffee",
 			},
 			ExpectedErr: nil,
 			wantErr:     false,
@@ -495,7 +807,7 @@ func TestDB_Withdraw(t *testing.T) {
 			Withdrawal: &models.Withdrawal{
 				UserID: 1,
 				Order:  "1234567891",
-				Sum:    250,
+				Sum:    models.MoneyFromFloat(250),
 			},
 			ExpectedErr: ErrInsufficientBalance,
 			wantErr:     true,
@@ -523,15 +835,17 @@ func TestDB_GetWithdrawals(t *testing.T) {
 	cases := []struct {
 		Name   string
 		UserID int64
+		Query  models.WithdrawalQuery
 		want   *models.Withdrawal
 	}{
 		{
 			Name:   "get_orders",
 			UserID: 1,
 			want: &models.Withdrawal{
-				Order:       "1234567890",
-				Sum:         20,
+				Order:       "2377225624",
+				Sum:         models.MoneyFromFloat(20),
 				ProcessedAt: time.Now(),
+				Description: "Coffee",
 			},
 		},
 		{
@@ -539,19 +853,52 @@ func TestDB_GetWithdrawals(t *testing.T) {
 			UserID: 2,
 			want:   nil,
 		},
+		{
+			Name:   "first_page",
+			UserID: 1,
+			Query:  models.WithdrawalQuery{From: time.Now().Add(-time.Hour), Limit: 1},
+			want: &models.Withdrawal{
+				Order: "2377225624",
+				Sum:   models.MoneyFromFloat(20),
+			},
+		},
+		{
+			Name:   "cursor_in_future",
+			UserID: 1,
+			Query:  models.WithdrawalQuery{After: &models.Cursor{At: time.Now().Add(time.Hour), Key: ""}, Limit: 1},
+			want: &models.Withdrawal{
+				Order: "2377225624",
+				Sum:   models.MoneyFromFloat(20),
+			},
+		},
+		{
+			Name:   "cursor_in_past",
+			UserID: 1,
+			Query:  models.WithdrawalQuery{After: &models.Cursor{At: time.Now().Add(-time.Hour), Key: ""}},
+			want:   nil,
+		},
+		{
+			Name:   "filter_by_future_date",
+			UserID: 1,
+			Query:  models.WithdrawalQuery{From: time.Now().Add(time.Hour)},
+			want:   nil,
+		},
 	}
 	for i, tc := range cases {
 		i, tc := i, tc
 		t.Run(fmt.Sprintf("test #%d: %s", i, tc.Name), func(t *testing.T) {
-			withdrawals, err := db.GetWithdrawals(context.Background(), tc.UserID)
+			withdrawals, err := db.GetWithdrawals(context.Background(), tc.UserID, tc.Query)
 			assert.NoError(t, err)
 			if tc.want == nil {
 				require.Empty(t, withdrawals)
 			} else {
-				require.NotEmpty(t, withdrawals)
+				require.Len(t, withdrawals, 1)
 				assert.Equal(t, tc.want.Order, withdrawals[0].Order)
 				assert.Equal(t, tc.want.Sum, withdrawals[0].Sum)
 				assert.NotEmpty(t, withdrawals[0].ProcessedAt)
+				if tc.want.Description != "" {
+					assert.Equal(t, tc.want.Description, withdrawals[0].Description)
+				}
 			}
 		})
 	}
@@ -570,8 +917,8 @@ func TestDB_GetBalance(t *testing.T) {
 			Name:   "get_balance",
 			UserID: 1,
 			want: &models.Balance{
-				Current:   80,
-				Withdrawn: 20,
+				Current:   models.MoneyFromFloat(80),
+				Withdrawn: models.MoneyFromFloat(20),
 			},
 		},
 	}
@@ -584,3 +931,1365 @@ func TestDB_GetBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_GetTransactions(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	// user 1 got the accrual for the processed order and withdrew a part of it in the previous tests
+	transactions, err := db.GetTransactions(context.Background(), 1)
+	require.NoError(t, err)
+	require.Len(t, transactions, 2)
+	assert.Equal(t, models.TransactionAccrual, transactions[0].Type)
+	assert.Equal(t, "1234567890", transactions[0].Order)
+	assert.Equal(t, models.MoneyFromFloat(100), transactions[0].Amount)
+	assert.Equal(t, models.MoneyFromFloat(100), transactions[0].Balance)
+	assert.Equal(t, models.TransactionWithdrawal, transactions[1].Type)
+	assert.Equal(t, models.MoneyFromFloat(-20), transactions[1].Amount)
+	assert.Equal(t, models.MoneyFromFloat(80), transactions[1].Balance)
+	assert.False(t, transactions[1].At.Before(transactions[0].At))
+
+	transactions, err = db.GetTransactions(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Empty(t, transactions)
+}
+
+func TestDB_Webhooks(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// register the webhooks up to the limit
+	webhook := &models.Webhook{UserID: 1, URL: "https://example.com/hook", Secret: "secret", Events: []string{models.WebhookWithdrawalCompleted}}
+	require.NoError(t, db.CreateWebhook(ctx, webhook, 1))
+	assert.NotZero(t, webhook.ID)
+	assert.ErrorIs(t, db.CreateWebhook(ctx, &models.Webhook{UserID: 1, URL: "https://example.com/other", Secret: "secret", Events: models.WebhookEvents}, 1), ErrTooManyWebhooks)
+	webhooks, err := db.GetWebhooks(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+	assert.Equal(t, webhook.URL, webhooks[0].URL)
+	assert.Empty(t, webhooks[0].Secret)
+
+	// the withdrawal is queued for the subscribed webhook, stamped by the clock of the storage
+	at := time.Date(2001, 1, 1, 12, 0, 0, 0, time.UTC)
+	db.clock = clock.NewMock(at)
+	require.NoError(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "4242424242424242", Sum: models.MoneyFromFloat(10)}))
+	deliveries, err := db.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	d := deliveries[0]
+	assert.Equal(t, models.WebhookWithdrawalCompleted, d.Event)
+	assert.Equal(t, webhook.URL, d.URL)
+	assert.Equal(t, "secret", d.Secret)
+	var payload struct {
+		Event string                 `json:"event"`
+		Data  models.WithdrawalEvent `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(d.Payload, &payload))
+	assert.Equal(t, models.WebhookWithdrawalCompleted, payload.Event)
+	assert.Equal(t, "4242424242424242", payload.Data.Order)
+	assert.Equal(t, models.MoneyFromFloat(10), payload.Data.Sum)
+	assert.True(t, at.Equal(payload.Data.At))
+
+	// the claimed delivery is leased
+	deliveries, err = db.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	// record the outcome
+	now := time.Now()
+	d.Status, d.Attempts, d.ResponseCode, d.DeliveredAt, d.NextAttemptAt = models.DeliveryDelivered, 1, 200, &now, now
+	require.NoError(t, db.UpdateWebhookDelivery(ctx, &d))
+	deliveries, err = db.GetWebhookDeliveries(ctx, 1, webhook.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, models.DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 200, deliveries[0].ResponseCode)
+	assert.NotNil(t, deliveries[0].DeliveredAt)
+
+	// other users don't see the webhook
+	_, err = db.GetWebhookDeliveries(ctx, 2, webhook.ID, 10)
+	assert.ErrorIs(t, err, ErrWebhookNotFound)
+	assert.ErrorIs(t, db.DeleteWebhook(ctx, 2, webhook.ID), ErrWebhookNotFound)
+	require.NoError(t, db.DeleteWebhook(ctx, 1, webhook.ID))
+	assert.ErrorIs(t, db.DeleteWebhook(ctx, 1, webhook.ID), ErrWebhookNotFound)
+}
+
+func TestDB_Versions(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	orders, err := db.GetOrdersVersion(ctx, 1)
+	require.NoError(t, err)
+	balance, err := db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+
+	// a new order changes both versions
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: "4012888888881881"}))
+	newOrders, err := db.GetOrdersVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, orders, newOrders)
+	newBalance, err := db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, balance, newBalance)
+
+	// a status change of the order changes both versions too
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "4012888888881881", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(10)}))
+	orders, err = db.GetOrdersVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, newOrders, orders)
+	balance, err = db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, newBalance, balance)
+
+	// a withdrawal changes only the balance version
+	require.NoError(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "79927398713", Sum: models.MoneyFromFloat(5)}))
+	newOrders, err = db.GetOrdersVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, orders, newOrders)
+	newBalance, err = db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, balance, newBalance)
+}
+
+func TestDB_DeleteOrder(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the processed order can't be deleted
+	assert.ErrorIs(t, db.DeleteOrder(ctx, 1, "1234567890"), ErrOrderNotNew)
+	// the orders of other users are not found
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: "5555555555554444"}))
+	assert.ErrorIs(t, db.DeleteOrder(ctx, 2, "5555555555554444"), ErrOrderNotFound)
+
+	// the new order is deleted with its history
+	require.NoError(t, db.DeleteOrder(ctx, 1, "5555555555554444"))
+	_, err := db.GetOrder(ctx, 1, "5555555555554444")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	assert.ErrorIs(t, db.DeleteOrder(ctx, 1, "5555555555554444"), ErrOrderNotFound)
+}
+
+func TestDB_BalanceSnapshots(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	last, err := db.GetLastSnapshotDay(ctx)
+	require.NoError(t, err)
+	assert.True(t, last.IsZero())
+
+	// the balance at the end of today includes the whole ledger of user 1
+	today := time.Now().UTC()
+	n, err := db.SnapshotBalances(ctx, today)
+	require.NoError(t, err)
+	assert.NotZero(t, n)
+	balance, err := db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	history, err := db.GetBalanceHistory(ctx, 1, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, today.Format("2006-01-02"), history[0].Date)
+	assert.Equal(t, balance.Current, history[0].Current)
+	assert.Equal(t, balance.Withdrawn, history[0].Withdrawn)
+
+	// the recorded day is kept, the users didn't exist a year ago
+	n, err = db.SnapshotBalances(ctx, today)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	n, err = db.SnapshotBalances(ctx, today.AddDate(-1, 0, 0))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	last, err = db.GetLastSnapshotDay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, today.Format("2006-01-02"), last.Format("2006-01-02"))
+
+	// the range is limited by the days
+	history, err = db.GetBalanceHistory(ctx, 1, today.AddDate(0, 0, 1), time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	history, err = db.GetBalanceHistory(ctx, 1, today, today)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestDB_Admin(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the new users get the user role
+	role, err := db.GetUserRole(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, role)
+	_, err = db.GetUserRole(ctx, 1000)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	adminID, err := db.CreateUser(ctx, &models.User{Login: "support_admin", Password: "secret"})
+	require.NoError(t, err)
+	_, err = db.pool.Exec(ctx, "UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	require.NoError(t, err)
+	role, err = db.GetUserRole(ctx, adminID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, role)
+
+	info, err := db.GetUserInfo(ctx, adminID)
+	require.NoError(t, err)
+	assert.Equal(t, "support_admin", info.Login)
+	assert.Equal(t, models.RoleAdmin, info.Role)
+	_, err = db.GetUserInfo(ctx, 1000)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// the underscore is matched literally, latest first
+	otherID, err := db.CreateUser(ctx, &models.User{Login: "SUPPORT_agent", Password: "secret"})
+	require.NoError(t, err)
+	_, err = db.CreateUser(ctx, &models.User{Login: "supportXagent", Password: "secret"})
+	require.NoError(t, err)
+	users, err := db.SearchUsers(ctx, models.UserQuery{Login: "support_"})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, otherID, users[0].ID)
+	assert.Equal(t, adminID, users[1].ID)
+
+	// the next page starts after the cursor
+	users, err = db.SearchUsers(ctx, models.UserQuery{Login: "support_", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	after := &models.Cursor{At: users[0].CreatedAt, Key: strconv.FormatInt(users[0].ID, 10)}
+	users, err = db.SearchUsers(ctx, models.UserQuery{Login: "support_", After: after})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, adminID, users[0].ID)
+}
+
+func TestDB_Adjustments(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	before, err := db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	version, err := db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+
+	// the credit is added to the current balance only
+	credit := &models.Adjustment{UserID: 1, AdminID: 1, Amount: models.MoneyFromFloat(25.5), Reason: "lost accrual"}
+	require.NoError(t, db.CreateAdjustment(ctx, credit))
+	assert.NotZero(t, credit.ID)
+	assert.False(t, credit.CreatedAt.IsZero())
+	balance, err := db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, before.Current+models.MoneyFromFloat(25.5), balance.Current)
+	assert.Equal(t, before.Withdrawn, balance.Withdrawn)
+	newVersion, err := db.GetBalanceVersion(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, version, newVersion)
+
+	// the debit can't make the balance negative
+	debit := &models.Adjustment{UserID: 1, AdminID: 1, Amount: -(balance.Current + models.MoneyFromFloat(1)), Reason: "duplicate accrual"}
+	assert.ErrorIs(t, db.CreateAdjustment(ctx, debit), ErrInsufficientBalance)
+	debit.Amount = models.MoneyFromFloat(-10)
+	require.NoError(t, db.CreateAdjustment(ctx, debit))
+	balance, err = db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, before.Current+models.MoneyFromFloat(15.5), balance.Current)
+
+	assert.ErrorIs(t, db.CreateAdjustment(ctx, &models.Adjustment{UserID: 1000, AdminID: 1, Amount: models.MoneyFromFloat(1), Reason: "goodwill"}), ErrUserNotFound)
+
+	// the adjustments are in the ledger, the running balance ends with the current one
+	transactions, err := db.GetTransactions(ctx, 1)
+	require.NoError(t, err)
+	require.NotEmpty(t, transactions)
+	var adjustments []models.Transaction
+	for _, tr := range transactions {
+		if tr.Type == models.TransactionAdjustment {
+			adjustments = append(adjustments, tr)
+		}
+	}
+	require.Len(t, adjustments, 2)
+	assert.Equal(t, "lost accrual", adjustments[0].Reason)
+	assert.Equal(t, models.MoneyFromFloat(-10), adjustments[1].Amount)
+	assert.Equal(t, balance.Current, transactions[len(transactions)-1].Balance)
+}
+
+func TestDB_RequeueOrder(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{UserID: 1, Number: "4111111111111111"}))
+	// the new order is already in the queue
+	rq := &models.OrderRequeue{Order: "4111111111111111", AdminID: 1, Reason: "retry"}
+	assert.ErrorIs(t, db.RequeueOrder(ctx, rq), ErrOrderNotRequeueable)
+	assert.ErrorIs(t, db.RequeueOrder(ctx, &models.OrderRequeue{Order: "79927398713", AdminID: 1, Reason: "retry"}), ErrOrderNotFound)
+
+	// the invalid order is new again with the audit record
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "4111111111111111", Status: models.StatusInvalid}))
+	require.NoError(t, db.RequeueOrder(ctx, rq))
+	assert.NotZero(t, rq.ID)
+	assert.Equal(t, models.StatusInvalid, rq.PreviousStatus)
+	order, err := db.GetOrder(ctx, 1, "4111111111111111")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusNew, order.Status)
+	require.Len(t, order.History, 3)
+	assert.Equal(t, models.StatusNew, order.History[2].Status)
+	var reason string
+	require.NoError(t, db.pool.QueryRow(ctx, "SELECT reason FROM order_requeues WHERE id = $1", rq.ID).Scan(&reason))
+	assert.Equal(t, "retry", reason)
+}
+
+func TestDB_AccrualResponses(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	_, err := db.GetAccrualResponses(ctx, "79927398713")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	responses, err := db.GetAccrualResponses(ctx, "4111111111111111")
+	require.NoError(t, err)
+	assert.Empty(t, responses)
+
+	// the body is kept as received, the characters Postgres can't store are replaced
+	busy := &models.AccrualResponse{Order: "4111111111111111", StatusCode: 429, Body: "No more than 60 requests per minute allowed"}
+	require.NoError(t, db.SaveAccrualResponse(ctx, busy))
+	assert.NotZero(t, busy.ID)
+	assert.False(t, busy.ReceivedAt.IsZero())
+	require.NoError(t, db.SaveAccrualResponse(ctx, &models.AccrualResponse{Order: "4111111111111111", StatusCode: 200, Body: "{\"order\":\x00\xff}"}))
+	assert.Error(t, db.SaveAccrualResponse(ctx, &models.AccrualResponse{Order: "79927398713", StatusCode: 204}))
+
+	responses, err = db.GetAccrualResponses(ctx, "4111111111111111")
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+	assert.Equal(t, *busy, responses[0])
+	assert.Equal(t, 200, responses[1].StatusCode)
+	assert.Equal(t, "{\"order\":\uFFFD\uFFFD}", responses[1].Body)
+}
+
+func TestDB_Stats(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	stats, err := db.GetStats(ctx)
+	require.NoError(t, err)
+	var users int64
+	require.NoError(t, db.pool.QueryRow(ctx, "SELECT count(*) FROM users").Scan(&users))
+	assert.Equal(t, users, stats.Users)
+	assert.Len(t, stats.Orders, 4)
+	// the requeued order is waiting for the accrual service
+	assert.Equal(t, stats.Orders[models.StatusNew]+stats.Orders[models.StatusProcessing], stats.Backlog.Orders)
+	assert.NotZero(t, stats.Backlog.Orders)
+	require.NotNil(t, stats.Backlog.Oldest)
+	assert.NotZero(t, stats.Accrued)
+	assert.NotZero(t, stats.Withdrawn)
+}
+
+func TestDB_Sort(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the orders sorted by the accrual, the orders without it count as zero
+	orders, err := db.GetOrders(ctx, 1, models.OrderFilter{Sort: models.Sort{Field: models.SortAccrual, Order: models.SortAsc}})
+	require.NoError(t, err)
+	require.NotEmpty(t, orders)
+	for i := 1; i < len(orders); i++ {
+		assert.LessOrEqual(t, orders[i-1].Accrual, orders[i].Accrual)
+	}
+	_, err = db.GetOrders(ctx, 1, models.OrderFilter{Sort: models.Sort{Field: "status; DROP TABLE orders"}})
+	assert.Error(t, err)
+
+	// the pages of the withdrawals sorted by the sum
+	require.NoError(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "5105105105105100", Sum: models.MoneyFromFloat(5)}))
+	all, err := db.GetWithdrawals(ctx, 1, models.WithdrawalQuery{Sort: models.Sort{Field: models.SortSum}})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(all), 2)
+	for i := 1; i < len(all); i++ {
+		assert.GreaterOrEqual(t, all[i-1].Sum, all[i].Sum)
+	}
+	q := models.WithdrawalQuery{Sort: models.Sort{Field: models.SortSum}, Limit: 1}
+	page, err := db.GetWithdrawals(ctx, 1, q)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	sum := page[0].Sum
+	q.After = &models.Cursor{At: page[0].ProcessedAt, Key: page[0].Order, Value: &sum}
+	page, err = db.GetWithdrawals(ctx, 1, q)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, all[1].Order, page[0].Order)
+
+	// the oldest withdrawal first
+	asc, err := db.GetWithdrawals(ctx, 1, models.WithdrawalQuery{Sort: models.Sort{Order: models.SortAsc}})
+	require.NoError(t, err)
+	require.Len(t, asc, len(all))
+	for i := 1; i < len(asc); i++ {
+		assert.False(t, asc[i].ProcessedAt.Before(asc[i-1].ProcessedAt))
+	}
+}
+
+func TestDB_OrdersAndWithdrawalsPages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	// the pages of the orders follow each other without overlapping
+	all, err := db.GetOrders(ctx, 1, models.OrderFilter{})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(all), 2)
+	var paged []models.Order
+	page := models.Page{Limit: 1}
+	for {
+		p, err := db.GetOrdersPage(ctx, 1, models.OrderFilter{}, page)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(p.Orders), 1)
+		paged = append(paged, p.Orders...)
+		if p.Next == nil {
+			break
+		}
+		page.After = p.Next
+	}
+	require.Len(t, paged, len(all))
+	for i := range all {
+		assert.Equal(t, all[i].Number, paged[i].Number)
+	}
+
+	// the page with all the orders has no next one
+	p, err := db.GetOrdersPage(ctx, 1, models.OrderFilter{}, models.Page{Limit: len(all)})
+	require.NoError(t, err)
+	assert.Len(t, p.Orders, len(all))
+	assert.Nil(t, p.Next)
+	_, err = db.GetOrdersPage(ctx, 1, models.OrderFilter{}, models.Page{})
+	assert.Error(t, err)
+
+	// the withdrawals sorted by the sum carry the sum in the cursor
+	q := models.WithdrawalQuery{Sort: models.Sort{Field: models.SortSum}, Limit: 1}
+	first, err := db.GetWithdrawalsPage(ctx, 1, q)
+	require.NoError(t, err)
+	require.Len(t, first.Withdrawals, 1)
+	require.NotNil(t, first.Next)
+	require.NotNil(t, first.Next.Value)
+	assert.Equal(t, first.Withdrawals[0].Sum, *first.Next.Value)
+	q.After = first.Next
+	second, err := db.GetWithdrawalsPage(ctx, 1, q)
+	require.NoError(t, err)
+	require.Len(t, second.Withdrawals, 1)
+	assert.NotEqual(t, first.Withdrawals[0].Order, second.Withdrawals[0].Order)
+	assert.LessOrEqual(t, second.Withdrawals[0].Sum, first.Withdrawals[0].Sum)
+}
+
+func TestDB_RetryTransientErrors(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	db.retries = retryPolicy{attempts: 3, base: time.Millisecond, max: 5 * time.Millisecond}
+	const failSerialization = `DO $$ BEGIN RAISE EXCEPTION 'conflict' USING ERRCODE = '40001'; END $$`
+
+	// the serialization failure is retried until the operation succeeds
+	attempts := 0
+	err := db.retry(ctx, func(context.Context) error {
+		attempts++
+		if attempts == 1 {
+			_, err := db.pool.Pool.Exec(ctx, failSerialization)
+			return err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// the permanent errors are returned at once
+	attempts = 0
+	err = db.retry(ctx, func(context.Context) error {
+		attempts++
+		_, err := db.GetUser(ctx, "nobody")
+		return err
+	})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.Equal(t, 1, attempts)
+
+	// the statement failing every time ends with the typed error
+	_, err = db.pool.Exec(ctx, failSerialization)
+	var retryErr *RetryError
+	require.ErrorAs(t, err, &retryErr)
+	assert.Equal(t, 3, retryErr.Attempts)
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "40001", pgErr.Code)
+}
+
+func TestDB_CreateOrders(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "4539578763621486", UserID: 1}))
+	userID, err := db.CreateUser(ctx, &models.User{Login: "orders_batch", Password: "orders_batch"})
+	require.NoError(t, err)
+
+	// the new numbers are created, the ones of other users are reported
+	errs, err := db.CreateOrders(ctx, userID, []string{"5555555555554444", "4539578763621486", "5105105105105100"})
+	require.NoError(t, err)
+	require.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrOrderAlreadyAdded)
+	assert.NoError(t, errs[2])
+
+	// the created orders start their processing history
+	order, err := db.GetOrder(ctx, userID, "5105105105105100")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusNew, order.Status)
+	require.Len(t, order.History, 1)
+	assert.Equal(t, models.StatusNew, order.History[0].Status)
+
+	// uploading them again reports them as the user's own
+	errs, err = db.CreateOrders(ctx, userID, []string{"5555555555554444"})
+	require.NoError(t, err)
+	assert.Equal(t, []error{ErrOrderAlreadyExists}, errs)
+}
+
+func TestDB_SoftDelete(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	userID, err := db.CreateUser(ctx, &models.User{Login: "soft_delete", Password: "soft_delete"})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "430686224857", UserID: userID}))
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "840757999486", UserID: userID}))
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "840757999486", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(25)}))
+
+	// the removed order is hidden and its accrual is taken back
+	require.NoError(t, db.RemoveOrder(ctx, "840757999486"))
+	_, err = db.GetOrder(ctx, userID, "840757999486")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	balance, err := db.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(0), balance.Current)
+	assert.ErrorIs(t, db.RemoveOrder(ctx, "840757999486"), ErrOrderNotFound)
+
+	// the number stays taken by the removed order
+	assert.ErrorIs(t, db.CreateOrder(ctx, &models.Order{Number: "840757999486", UserID: 1}), ErrOrderAlreadyAdded)
+
+	// the restored order is credited again
+	require.NoError(t, db.RestoreOrder(ctx, "840757999486"))
+	balance, err = db.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.MoneyFromFloat(25), balance.Current)
+	assert.ErrorIs(t, db.RestoreOrder(ctx, "840757999486"), ErrOrderNotFound)
+
+	// the accrual spent already can't be taken back
+	require.NoError(t, db.Withdraw(ctx, &models.Withdrawal{UserID: userID, Order: "734990647020", Sum: models.MoneyFromFloat(20)}))
+	assert.ErrorIs(t, db.RemoveOrder(ctx, "840757999486"), ErrInsufficientBalance)
+
+	// the order deleted by the user is restored when the user uploads it again
+	require.NoError(t, db.DeleteOrder(ctx, userID, "430686224857"))
+	_, err = db.GetOrder(ctx, userID, "430686224857")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "430686224857", UserID: userID}))
+	order, err := db.GetOrder(ctx, userID, "430686224857")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusNew, order.Status)
+
+	// the deleted user can't log in and the orders of the user are not processed
+	require.NoError(t, db.DeleteUser(ctx, userID))
+	_, err = db.GetUser(ctx, "soft_delete")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = db.GetUserRole(ctx, userID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	orders, err := db.GetUnprocessedOrders(ctx, 0, 0)
+	require.NoError(t, err)
+	for _, o := range orders {
+		assert.NotEqual(t, "430686224857", o.Number)
+	}
+	assert.ErrorIs(t, db.DeleteUser(ctx, userID), ErrUserNotFound)
+
+	// the admins still see the deleted account and may list it
+	info, err := db.GetUserInfo(ctx, userID)
+	require.NoError(t, err)
+	assert.NotNil(t, info.DeletedAt)
+	users, err := db.SearchUsers(ctx, models.UserQuery{Login: "soft_delete", Deleted: true})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, userID, users[0].ID)
+
+	// the restored user logs in again with the same balance
+	require.NoError(t, db.RestoreUser(ctx, userID))
+	_, err = db.GetUser(ctx, "soft_delete")
+	require.NoError(t, err)
+	balance, err = db.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.MoneyFromFloat(5), balance.Current)
+	assert.ErrorIs(t, db.RestoreUser(ctx, userID), ErrUserNotFound)
+}
+
+func TestDB_ListenNewOrders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	wake, err := db.ListenNewOrders(ctx)
+	require.NoError(t, err)
+
+	// every insert into the orders notifies the listener
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "79927398713", UserID: 1}))
+	select {
+	case <-wake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification about the new order")
+	}
+
+	// the channel is closed when the context is done
+	cancel()
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-wake:
+			return !ok
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDB_TryLockPoller(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lost, ok, err := db.TryLockPoller(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the lock is held by one instance at a time
+	_, ok, err = db.TryLockPoller(context.Background())
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the lock is released when the context is done
+	cancel()
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poller lock wasn't released")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, ok, err = db.TryLockPoller(ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestDB_PoolSettings(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithPoolSettings(PoolSettings{
+		MaxConns:        3,
+		MaxConnLifetime: 10 * time.Minute,
+	}))
+	require.NoError(t, err)
+	defer closeTestDB(t, withStores(db))
+	// the settings override the defaults, the zero ones keep them
+	assert.Equal(t, int32(3), db.pool.Config().MaxConns)
+	assert.Equal(t, 10*time.Minute, db.pool.Config().MaxConnLifetime)
+	assert.Equal(t, 30*time.Minute, db.pool.Config().MaxConnIdleTime)
+
+	_, err = NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithPoolSettings(PoolSettings{MaxConns: 2, MinConns: 5}))
+	assert.Error(t, err)
+	_, err = NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithPoolSettings(PoolSettings{QueryExecMode: "prepared"}))
+	assert.Error(t, err)
+}
+
+func TestDB_QueryMetrics(t *testing.T) {
+	ctx := context.Background()
+	reg := metrics.NewRegistry()
+	d, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithMetrics(reg))
+	require.NoError(t, err)
+	db := withStores(d)
+	defer closeTestDB(t, db)
+
+	_, err = db.GetOrders(ctx, 1, models.OrderFilter{})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "6011000990139424", UserID: 1}))
+	assert.ErrorIs(t, db.CreateOrder(ctx, &models.Order{Number: "6011000990139424", UserID: 1}), ErrOrderAlreadyExists)
+
+	// the queries are named by the methods running them
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	durations, errs := map[string]uint64{}, map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch f.GetName() {
+			case "gophermart_db_query_duration_seconds":
+				durations[m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+			case "gophermart_db_query_errors_total":
+				errs[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, uint64(1), durations["OrderStore.queryOrders"])
+	assert.GreaterOrEqual(t, durations["OrderStore.createOrder"], uint64(4))
+	assert.Equal(t, float64(1), errs["OrderStore.createOrder"])
+	assert.NotContains(t, errs, "OrderStore.queryOrders")
+}
+
+func TestDB_PoolStats(t *testing.T) {
+	ctx := context.Background()
+	reg := metrics.NewRegistry()
+	d, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithMetrics(reg), WithPoolSettings(PoolSettings{MaxConns: 4}))
+	require.NoError(t, err)
+	db := withStores(d)
+	defer closeTestDB(t, db)
+
+	require.NoError(t, db.Ping(ctx))
+	_, err = db.GetOrders(ctx, 1, models.OrderFilter{})
+	require.NoError(t, err)
+	stats := db.Stats()
+	assert.Equal(t, int32(4), stats.MaxConns)
+	assert.Positive(t, stats.AcquireCount)
+	assert.Zero(t, stats.AcquiredConns)
+
+	// the statistics are exported when the metrics are scraped
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	gauges := map[string]float64{}
+	for _, f := range families {
+		if m := f.GetMetric(); len(m) == 1 && m[0].GetGauge() != nil {
+			gauges[f.GetName()] = m[0].GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, float64(4), gauges["gophermart_db_pool_max_conns"])
+	assert.Contains(t, gauges, "gophermart_db_pool_acquired_conns")
+
+	// the repository opened again on the registry replaces the collector
+	d2, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithMetrics(reg))
+	require.NoError(t, err)
+	defer closeTestDB(t, withStores(d2))
+	_, err = reg.Gather()
+	require.NoError(t, err)
+}
+
+func TestDB_SlowQueries(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zap.WarnLevel)
+	d, err := NewDB(ctx, getDSN(), WithLogger(zap.New(core).Sugar()), WithSlowQueryThreshold(50*time.Millisecond))
+	require.NoError(t, err)
+	db := withStores(d)
+	defer closeTestDB(t, db)
+
+	_, err = db.pool.Exec(ctx, "SELECT $1::text", "fast")
+	require.NoError(t, err)
+	assert.Zero(t, logs.Len())
+
+	// the slow statement is logged without the arguments
+	_, err = db.pool.Exec(ctx, "SELECT pg_sleep(0.1), $1::text", "secret")
+	require.NoError(t, err)
+	entries := logs.FilterMessageSnippet("slow query").All()
+	require.Len(t, entries, 1)
+	assert.Contains(t, entries[0].Message, "SELECT pg_sleep(0.1), $1::text")
+	assert.NotContains(t, entries[0].Message, "secret")
+}
+
+func TestDB_StatementTimeout(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithPoolSettings(PoolSettings{StatementTimeout: 200 * time.Millisecond}))
+	require.NoError(t, err)
+	db := withStores(d)
+	defer closeTestDB(t, db)
+
+	// the connections limit the statements themselves
+	var timeout string
+	require.NoError(t, db.pool.QueryRow(ctx, "SHOW statement_timeout").Scan(&timeout))
+	assert.Equal(t, "200ms", timeout)
+
+	// the runaway query fails after the timeout instead of holding the caller
+	start := time.Now()
+	_, err = db.pool.Exec(ctx, "SELECT pg_sleep(5)")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, Retryable, Classify(err))
+
+	// the rows are read within the deadline of the call
+	_, err = db.GetOrders(ctx, 1, models.OrderFilter{})
+	require.NoError(t, err)
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want Kind
+	}{
+		{err: fmt.Errorf("get order: %w", ErrOrderNotFound), want: NotFound},
+		{err: ErrOrderNumberUsed, want: Conflict},
+		{err: &DailyLimitError{}, want: Conflict},
+		{err: &RetryError{Attempts: 3, Err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}}, want: Retryable},
+		{err: &pgconn.PgError{Code: pgerrcode.QueryCanceled}, want: Retryable},
+		{err: &pgconn.PgError{Code: pgerrcode.TooManyConnections}, want: Retryable},
+		{err: fmt.Errorf("failed to get balance: %w", context.DeadlineExceeded), want: Retryable},
+		{err: &pgconn.PgError{Code: pgerrcode.ForeignKeyViolation}, want: Conflict},
+		{err: &pgconn.PgError{Code: pgerrcode.UndefinedColumn}, want: Permanent},
+		{err: context.Canceled, want: Permanent},
+	} {
+		assert.Equal(t, tc.want, Classify(tc.err), "%v", tc.err)
+	}
+}
+
+func TestDB_QueryExecModes(t *testing.T) {
+	ctx := context.Background()
+	for mode, want := range queryExecModes {
+		t.Run(mode, func(t *testing.T) {
+			d, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithPoolSettings(PoolSettings{
+				QueryExecMode:          mode,
+				StatementCacheCapacity: 16,
+			}))
+			require.NoError(t, err)
+			db := withStores(d)
+			defer closeTestDB(t, db)
+			assert.Equal(t, want, db.pool.Config().ConnConfig.DefaultQueryExecMode)
+			assert.Equal(t, 16, db.pool.Config().ConnConfig.StatementCacheCapacity)
+
+			// the queries with the arrays, the enums and the amounts work in every mode
+			_, err = db.GetOrders(ctx, 1, models.OrderFilter{Statuses: []models.OrderStatus{models.StatusNew, models.StatusProcessed}})
+			require.NoError(t, err)
+			_, err = db.GetBalance(ctx, 1)
+			require.NoError(t, err)
+			_, err = db.GetWithdrawals(ctx, 1, models.WithdrawalQuery{})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDB_DailyWithdrawalLimits(t *testing.T) {
+	ctx := context.Background()
+	var used, globalUsed models.Money
+	dayStart := time.Now().UTC().Truncate(24 * time.Hour)
+	plain := newTestDB(t)
+	defer closeTestDB(t, plain)
+	require.NoError(t, plain.pool.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE user_id = 1 AND processed_at >= $1", dayStart).Scan(&used))
+	require.NoError(t, plain.pool.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE tenant_id = 'default' AND processed_at >= $1", dayStart).Scan(&globalUsed))
+	balance, err := plain.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, balance.Current, models.MoneyFromFloat(1))
+
+	newLimitedDB := func(perUser, global models.Money) *testDB {
+		db, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithDailyWithdrawalLimits(perUser, global))
+		require.NoError(t, err)
+		return withStores(db)
+	}
+
+	// the user cap is reached
+	db := newLimitedDB(used, 0)
+	err = db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "6011111111111117", Sum: models.MoneyFromFloat(1)})
+	closeTestDB(t, db)
+	require.ErrorIs(t, err, ErrDailyLimitExceeded)
+	var limitErr *DailyLimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.False(t, limitErr.Global)
+	assert.Equal(t, used, limitErr.Used)
+	assert.Equal(t, dayStart.Add(24*time.Hour), limitErr.ResetAt)
+
+	// the day is the one of the clock, all the withdrawals are made since the mocked one
+	var allUsed models.Money
+	require.NoError(t, plain.pool.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE user_id = 1").Scan(&allUsed))
+	clockDB, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithDailyWithdrawalLimits(allUsed, 0),
+		WithClock(clock.NewMock(time.Date(2001, 1, 1, 12, 0, 0, 0, time.UTC))))
+	require.NoError(t, err)
+	db = withStores(clockDB)
+	err = db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "6011111111111117", Sum: models.MoneyFromFloat(1)})
+	closeTestDB(t, db)
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, allUsed, limitErr.Used)
+	assert.Equal(t, time.Date(2001, 1, 2, 0, 0, 0, 0, time.UTC), limitErr.ResetAt)
+
+	// the global cap is reached
+	db = newLimitedDB(0, globalUsed)
+	err = db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "6011111111111117", Sum: models.MoneyFromFloat(1)})
+	closeTestDB(t, db)
+	require.ErrorAs(t, err, &limitErr)
+	assert.True(t, limitErr.Global)
+
+	// the withdrawal within the caps passes
+	db = newLimitedDB(used+models.MoneyFromFloat(1), globalUsed+models.MoneyFromFloat(1))
+	defer closeTestDB(t, db)
+	require.NoError(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "6011111111111117", Sum: models.MoneyFromFloat(1)}))
+}
+
+func TestDB_WithdrawBatch(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	balance, err := db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, balance.Current, models.MoneyFromFloat(3))
+
+	// the withdrawals spend the balance in order, the failed ones don't abort the batch
+	errs, err := db.WithdrawBatch(ctx, 1, []models.Withdrawal{
+		{Order: "378282246310005", Sum: models.MoneyFromFloat(1)},
+		{Order: "6011111111111117", Sum: models.MoneyFromFloat(1)},
+		{Order: "30569309025904", Sum: balance.Current},
+		{Order: "3566002020360505", Sum: models.MoneyFromFloat(2)},
+	})
+	require.NoError(t, err)
+	require.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrOrderAlreadyExists)
+	assert.ErrorIs(t, errs[2], ErrInsufficientBalance)
+	assert.NoError(t, errs[3])
+
+	after, err := db.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, balance.Current-models.MoneyFromFloat(3), after.Current)
+	assert.Equal(t, balance.Withdrawn+models.MoneyFromFloat(3), after.Withdrawn)
+}
+
+func TestDB_WithdrawalOrderNumbers(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	require.NoError(t, db.CreateAdjustment(ctx, &models.Adjustment{UserID: 2, AdminID: 1, Amount: models.MoneyFromFloat(10), Reason: "withdrawal numbers"}))
+	before, err := db.GetBalance(ctx, 2)
+	require.NoError(t, err)
+
+	// the number of an accrual order or of another user's withdrawal isn't withdrawn for
+	assert.ErrorIs(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 2, Order: "4012888888881881", Sum: models.MoneyFromFloat(1)}), ErrOrderNumberUsed)
+	assert.ErrorIs(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 2, Order: "2377225624", Sum: models.MoneyFromFloat(1)}), ErrOrderNumberUsed)
+	assert.ErrorIs(t, db.Withdraw(ctx, &models.Withdrawal{UserID: 1, Order: "2377225624", Sum: models.MoneyFromFloat(1)}), ErrOrderAlreadyExists)
+	errs, err := db.WithdrawBatch(ctx, 2, []models.Withdrawal{
+		{Order: "4012888888881881", Sum: models.MoneyFromFloat(1)},
+		{Order: "6331101999990016", Sum: models.MoneyFromFloat(1)},
+	})
+	require.NoError(t, err)
+	require.Len(t, errs, 2)
+	assert.ErrorIs(t, errs[0], ErrOrderNumberUsed)
+	assert.NoError(t, errs[1])
+	after, err := db.GetBalance(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, before.Current-models.MoneyFromFloat(1), after.Current)
+
+	// the constraints hold for the rows written around the storage too
+	_, err = db.pool.Exec(ctx, "INSERT INTO withdrawals (user_id, order_number, summ) VALUES (2, '4012888888881881', 1)")
+	assert.Equal(t, "withdrawals_order_number_accrual", violatedConstraint(err))
+	_, err = db.pool.Exec(ctx, "INSERT INTO withdrawals (user_id, order_number, summ) VALUES (2, '2377225624', 1)")
+	assert.Equal(t, "withdrawals_order_number_key", violatedConstraint(err))
+}
+
+func TestDB_BalanceLedger(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the balances kept with every change match the ones summed from the orders, the withdrawals and the adjustments
+	rows, err := db.pool.Query(ctx, `
+		SELECT u.id, COALESCE(b.current, 0), COALESCE(b.withdrawn, 0),
+			COALESCE((SELECT SUM(accrual) FROM orders WHERE user_id = u.id AND status = 'PROCESSED' AND deleted_at IS NULL), 0)
+				+ COALESCE((SELECT SUM(amount) FROM balance_adjustments WHERE user_id = u.id), 0)
+				- COALESCE((SELECT SUM(summ) FROM withdrawals WHERE user_id = u.id), 0),
+			COALESCE((SELECT SUM(summ) FROM withdrawals WHERE user_id = u.id), 0)
+		FROM users u
+		LEFT JOIN balances b ON b.user_id = u.id`)
+	require.NoError(t, err)
+	defer rows.Close()
+	users := 0
+	for rows.Next() {
+		var userID int64
+		var current, withdrawn, summedCurrent, summedWithdrawn models.Money
+		require.NoError(t, rows.Scan(&userID, &current, &withdrawn, &summedCurrent, &summedWithdrawn))
+		assert.Equal(t, summedCurrent, current, "current balance of user %d", userID)
+		assert.Equal(t, summedWithdrawn, withdrawn, "withdrawn balance of user %d", userID)
+		users++
+	}
+	require.NoError(t, rows.Err())
+	assert.Positive(t, users)
+
+	// the accrual is credited once and corrected when the processed order changes
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "5610591081018250", UserID: 2}))
+	before, err := db.GetBalance(ctx, 2)
+	require.NoError(t, err)
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "5610591081018250", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(10)}))
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "5610591081018250", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(7)}))
+	after, err := db.GetBalance(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, before.Current+models.MoneyFromFloat(7), after.Current)
+	assert.Equal(t, before.Withdrawn, after.Withdrawn)
+}
+
+func TestDB_Tenants(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+	acme := tenant.WithTenant(ctx, "acme")
+
+	// the logins and the phones are unique within a tenant
+	defaultID, err := db.CreateUser(ctx, &models.User{Login: "tenant_user", Password: "secret"})
+	require.NoError(t, err)
+	acmeID, err := db.CreateUser(acme, &models.User{Login: "tenant_user", Password: "secret"})
+	require.NoError(t, err)
+	assert.NotEqual(t, defaultID, acmeID)
+	_, err = db.CreateUser(acme, &models.User{Login: "tenant_user", Password: "secret"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	require.NoError(t, db.SetUserPhone(ctx, defaultID, "+79160000001"))
+	require.NoError(t, db.SetUserPhone(acme, acmeID, "+79160000001"))
+	u, err := db.GetUserByPhone(acme, "+79160000001")
+	require.NoError(t, err)
+	assert.Equal(t, acmeID, u.ID)
+	u, err = db.GetUser(acme, "tenant_user")
+	require.NoError(t, err)
+	assert.Equal(t, acmeID, u.ID)
+
+	// the users of other tenants are not found
+	_, err = db.GetUserRole(ctx, acmeID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = db.GetUserRole(acme, defaultID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = db.GetUserInfo(ctx, acmeID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	users, err := db.SearchUsers(acme, models.UserQuery{Login: "tenant_user"})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, acmeID, users[0].ID)
+
+	// the orders and the withdrawals belong to the tenant of their user
+	require.NoError(t, db.CreateOrder(acme, &models.Order{Number: "8200000000016", UserID: acmeID}))
+	assert.Error(t, db.CreateOrder(ctx, &models.Order{Number: "8200000000024", UserID: acmeID}))
+	orders, err := db.GetOrders(acme, acmeID, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 1)
+	orders, err = db.GetOrders(ctx, acmeID, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+	_, err = db.GetOrder(ctx, acmeID, "8200000000016")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	assert.ErrorIs(t, db.RemoveOrder(ctx, "8200000000016"), ErrOrderNotFound)
+
+	require.NoError(t, db.CreateAdjustment(acme, &models.Adjustment{UserID: acmeID, AdminID: acmeID, Amount: models.MoneyFromFloat(10), Reason: "tenant"}))
+	assert.ErrorIs(t, db.CreateAdjustment(ctx, &models.Adjustment{UserID: acmeID, AdminID: 1, Amount: models.MoneyFromFloat(10), Reason: "tenant"}), ErrUserNotFound)
+	require.NoError(t, db.Withdraw(acme, &models.Withdrawal{UserID: acmeID, Order: "8200000000032", Sum: models.MoneyFromFloat(4)}))
+	withdrawals, err := db.GetWithdrawals(acme, acmeID, models.WithdrawalQuery{})
+	require.NoError(t, err)
+	assert.Len(t, withdrawals, 1)
+	withdrawals, err = db.GetWithdrawals(ctx, acmeID, models.WithdrawalQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, withdrawals)
+
+	// the stats and the global daily cap count the tenant only
+	stats, err := db.GetStats(acme)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Users)
+	assert.Equal(t, int64(1), stats.Orders[models.StatusNew])
+	assert.Equal(t, models.MoneyFromFloat(4), stats.Withdrawn)
+	limitedDB, err := NewDB(ctx, getDSN(), WithLogger(zap.NewNop().Sugar()), WithDailyWithdrawalLimits(0, models.MoneyFromFloat(5)))
+	require.NoError(t, err)
+	limited := withStores(limitedDB)
+	defer closeTestDB(t, limited)
+	err = limited.Withdraw(acme, &models.Withdrawal{UserID: acmeID, Order: "8200000000040", Sum: models.MoneyFromFloat(2)})
+	assert.ErrorIs(t, err, ErrDailyLimitExceeded)
+	require.NoError(t, limited.Withdraw(acme, &models.Withdrawal{UserID: acmeID, Order: "8200000000040", Sum: models.MoneyFromFloat(1)}))
+}
+
+func TestDB_MigrationStatus(t *testing.T) {
+	mg, err := migrations.New(getDSN())
+	require.NoError(t, err)
+	defer mg.Close()
+
+	// the test database is migrated to the last embedded migration
+	all, err := migrations.Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, all)
+	version, dirty, err := mg.Version()
+	require.NoError(t, err)
+	assert.False(t, dirty)
+	assert.Equal(t, all[len(all)-1].Version, version)
+
+	status, err := mg.Status()
+	require.NoError(t, err)
+	require.Len(t, status, len(all))
+	for _, m := range status {
+		assert.True(t, m.Applied, "migration %d_%s", m.Version, m.Name)
+		assert.False(t, m.Dirty)
+	}
+
+	// the number of the migrations to roll back is checked
+	assert.Error(t, mg.Down(context.Background(), 0))
+}
+
+func TestDB_SchemaVersionCheck(t *testing.T) {
+	ctx := context.Background()
+	latest, err := migrations.Latest()
+	require.NoError(t, err)
+	plain := newTestDB(t)
+	defer closeTestDB(t, plain)
+	setVersion := func(version uint, dirty bool) {
+		_, err := plain.pool.Exec(ctx, "UPDATE schema_migrations SET version = $1, dirty = $2", version, dirty)
+		require.NoError(t, err)
+	}
+	defer setVersion(latest, false)
+
+	// the schema migrated by a newer binary is refused, with or without the auto-migration
+	setVersion(latest+1, false)
+	_, err = NewDB(ctx, getDSN())
+	assert.ErrorIs(t, err, migrations.ErrSchemaTooNew)
+	_, err = NewDB(ctx, getDSN(), WithAutoMigrate(false))
+	assert.ErrorIs(t, err, migrations.ErrSchemaTooNew)
+
+	// the failed migration must be fixed first
+	setVersion(latest, true)
+	_, err = NewDB(ctx, getDSN())
+	assert.ErrorIs(t, err, migrations.ErrSchemaDirty)
+
+	// the pending migrations must be applied if the auto-migration is disabled
+	setVersion(latest-1, false)
+	_, err = NewDB(ctx, getDSN(), WithAutoMigrate(false))
+	assert.ErrorIs(t, err, migrations.ErrSchemaOutdated)
+
+	setVersion(latest, false)
+	db, err := NewDB(ctx, getDSN(), WithAutoMigrate(false))
+	require.NoError(t, err)
+	closeTestDB(t, withStores(db))
+}
+
+func TestDB_MigrationLock(t *testing.T) {
+	ctx := context.Background()
+	latest, err := migrations.Latest()
+	require.NoError(t, err)
+	plain := newTestDB(t)
+	defer closeTestDB(t, plain)
+
+	// another instance is applying the migrations
+	holder, err := plain.pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer holder.Release()
+	_, err = holder.Exec(ctx, "SELECT pg_advisory_lock(2, 0)")
+	require.NoError(t, err)
+
+	// the up-to-date schema is used without waiting for the lock
+	db, err := NewDB(ctx, getDSN(), WithMigrationLockTimeout(0))
+	require.NoError(t, err)
+	closeTestDB(t, withStores(db))
+
+	// the pending migrations wait for the lock
+	_, err = plain.pool.Exec(ctx, "UPDATE schema_migrations SET version = $1", latest-1)
+	require.NoError(t, err)
+	_, err = NewDB(ctx, getDSN(), WithMigrationLockTimeout(100*time.Millisecond))
+	assert.ErrorIs(t, err, migrations.ErrMigrationLocked)
+	_, err = plain.pool.Exec(ctx, "UPDATE schema_migrations SET version = $1", latest)
+	require.NoError(t, err)
+
+	// the instance waiting for the lock goes on once it is released
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = holder.Exec(ctx, "SELECT pg_advisory_unlock(2, 0)")
+	}()
+	db, err = NewDB(ctx, getDSN(), WithMigrationLockTimeout(10*time.Second))
+	require.NoError(t, err)
+	closeTestDB(t, withStores(db))
+}
+
+func TestDB_Seed(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := tenant.WithTenant(context.Background(), "seed_test")
+	defer func() {
+		_, err := db.pool.Exec(context.Background(), "DELETE FROM users WHERE tenant_id = 'seed_test'")
+		require.NoError(t, err)
+	}()
+
+	opts := SeedOptions{Users: 5, OrdersPerUser: 20, WithdrawalsPerUser: 3, LoginPrefix: "seed_", PasswordHash: "hash", RandSeed: 1}
+	res, err := db.Seed(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 5, res.Users)
+	assert.Equal(t, 100, res.Orders)
+	assert.Positive(t, res.Withdrawals)
+
+	// the seeded users are served by the stores of their tenant
+	user, err := db.GetUser(ctx, "seed_1")
+	require.NoError(t, err)
+	orders, err := db.GetOrders(ctx, user.ID, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 20)
+
+	// the orders are in all the statuses and the balances match them and the withdrawals
+	var statuses, mismatched int
+	require.NoError(t, db.pool.QueryRow(ctx, "SELECT COUNT(DISTINCT status) FROM orders WHERE tenant_id = 'seed_test'").Scan(&statuses))
+	assert.Equal(t, 4, statuses)
+	require.NoError(t, db.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM users u JOIN balances b ON b.user_id = u.id
+		WHERE u.tenant_id = 'seed_test' AND (
+			b.withdrawn <> COALESCE((SELECT SUM(summ) FROM withdrawals WHERE user_id = u.id), 0) OR
+			b.current <> COALESCE((SELECT SUM(accrual) FROM orders WHERE user_id = u.id AND status = 'PROCESSED'), 0) - b.withdrawn OR
+			b.current < 0)`).Scan(&mismatched))
+	assert.Zero(t, mismatched)
+
+	// the logins are taken by the first seed
+	_, err = db.Seed(ctx, opts)
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+}
+
+func TestDB_Export(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "8300000000014", UserID: 1}))
+
+	// every order and withdrawal is written with the header
+	var orders, withdrawals bytes.Buffer
+	ordersN, withdrawalsN, err := db.Export(ctx, &orders, &withdrawals)
+	require.NoError(t, err)
+	var wantOrders, wantWithdrawals int64
+	require.NoError(t, db.pool.QueryRow(ctx, "SELECT (SELECT COUNT(*) FROM orders), (SELECT COUNT(*) FROM withdrawals)").Scan(&wantOrders, &wantWithdrawals))
+	assert.Equal(t, wantOrders, ordersN)
+	assert.Equal(t, wantWithdrawals, withdrawalsN)
+
+	records, err := csv.NewReader(&orders).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, int(ordersN)+1)
+	assert.Equal(t, []string{"order_number", "tenant_id", "user_id", "status", "accrual", "uploaded_at", "deleted_at"}, records[0])
+	records, err = csv.NewReader(&withdrawals).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"order_number", "tenant_id", "user_id", "sum", "description", "processed_at"}, records[0])
+}
+
+func TestDB_BalanceReport(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the report catches up with the ledger on refresh
+	require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "8400000000012", UserID: 1}))
+	require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "8400000000012", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(12.5)}))
+	refreshed, err := db.RefreshBalanceReport(ctx)
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+
+	var mismatched int
+	require.NoError(t, db.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM balance_report r LEFT JOIN balances b ON b.user_id = r.user_id
+		WHERE r.current <> COALESCE(b.current, 0) OR r.withdrawn <> COALESCE(b.withdrawn, 0)`).Scan(&mismatched))
+	assert.Zero(t, mismatched)
+
+	stats, err := db.GetStats(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, stats.Balances.RefreshedAt)
+	assert.Equal(t, stats.Balances.Accrued+stats.Balances.Adjusted-stats.Balances.Withdrawn, stats.Balances.Current)
+	assert.Positive(t, stats.Balances.Users)
+
+	// the report isn't refreshed while another instance refreshes it
+	conn, err := db.pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer conn.Release()
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock(3, 0)")
+	require.NoError(t, err)
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock(3, 0)")
+	refreshed, err = db.RefreshBalanceReport(ctx)
+	require.NoError(t, err)
+	assert.False(t, refreshed)
+}
+
+func TestDB_WithTx(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the nested operations are rolled back with the transaction they are composed into
+	err := db.WithTx(ctx, func(ctx context.Context, _ pgx5.Tx) error {
+		userID, err := db.CreateUser(ctx, &models.User{Login: "tx_user", Password: "hash"})
+		require.NoError(t, err)
+		require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "8500000000019", UserID: userID}))
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	_, err = db.GetUser(ctx, "tx_user")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// the failed nested operation is rolled back to its savepoint, the transaction goes on
+	err = db.WithTx(ctx, func(ctx context.Context, _ pgx5.Tx) error {
+		userID, err := db.CreateUser(ctx, &models.User{Login: "tx_user", Password: "hash"})
+		require.NoError(t, err)
+		_, err = db.CreateUser(ctx, &models.User{Login: "tx_user", Password: "hash"})
+		require.ErrorIs(t, err, ErrUserAlreadyExists)
+		return db.CreateOrder(ctx, &models.Order{Number: "8500000000019", UserID: userID})
+	})
+	require.NoError(t, err)
+	user, err := db.GetUser(ctx, "tx_user")
+	require.NoError(t, err)
+	orders, err := db.GetOrders(ctx, user.ID, models.OrderFilter{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 1)
+}
+
+func TestDB_WithTx_Batches(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the batches run in the caller's transaction, two uploads in one of them don't collide
+	var userID int64
+	err := db.WithTx(ctx, func(ctx context.Context, _ pgx5.Tx) error {
+		var err error
+		userID, err = db.CreateUser(ctx, &models.User{Login: "tx_batch_user", Password: "hash"})
+		require.NoError(t, err)
+		errs, err := db.CreateOrders(ctx, userID, []string{"8500000000027"})
+		require.NoError(t, err)
+		assert.Equal(t, []error{nil}, errs)
+		errs, err = db.CreateOrders(ctx, userID, []string{"8500000000027", "8500000000035"})
+		require.NoError(t, err)
+		assert.Equal(t, []error{ErrOrderAlreadyExists, nil}, errs)
+		errs, err = db.WithdrawBatch(ctx, userID, []models.Withdrawal{{Order: "8500000000043", Sum: models.MoneyFromFloat(1)}})
+		require.NoError(t, err)
+		assert.Equal(t, []error{ErrInsufficientBalance}, errs)
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+
+	// and are rolled back with it
+	_, err = db.GetUser(ctx, "tx_batch_user")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	orders, err := db.GetOrdersByNumbers(ctx, userID, []string{"8500000000027", "8500000000035"})
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func TestDB_WithTx_Orders(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+
+	// the order operations see the rows of the caller's transaction and are rolled back with it
+	var userID int64
+	err := db.WithTx(ctx, func(ctx context.Context, _ pgx5.Tx) error {
+		var err error
+		userID, err = db.CreateUser(ctx, &models.User{Login: "tx_order_user", Password: "hash"})
+		require.NoError(t, err)
+		require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "8500000000050", UserID: userID}))
+		require.NoError(t, db.CreateOrder(ctx, &models.Order{Number: "8500000000068", UserID: userID}))
+		require.NoError(t, db.UpdateOrder(ctx, &models.Order{Number: "8500000000050", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(5)}))
+		require.NoError(t, db.DeleteOrder(ctx, userID, "8500000000068"))
+		require.NoError(t, db.CreateAdjustment(ctx, &models.Adjustment{UserID: userID, AdminID: 1, Amount: models.MoneyFromFloat(-5), Reason: "tx"}))
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	_, err = db.GetUser(ctx, "tx_order_user")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	orders, err := db.GetOrdersByNumbers(ctx, userID, []string{"8500000000050", "8500000000068"})
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func TestDB_UpdatePasswordHash(t *testing.T) {
+	db := newTestDB(t)
+	defer closeTestDB(t, db)
+	ctx := context.Background()
+	userID, err := db.CreateUser(ctx, &models.User{Login: "rehash_user", Password: "old"})
+	require.NoError(t, err)
+
+	// the hash is replaced while it is the old one
+	require.NoError(t, db.UpdatePasswordHash(ctx, userID, "old", "new"))
+	user, err := db.GetUser(ctx, "rehash_user")
+	require.NoError(t, err)
+	assert.Equal(t, "new", user.Password)
+
+	// the hash changed meanwhile is kept
+	require.NoError(t, db.UpdatePasswordHash(ctx, userID, "old", "newer"))
+	user, err = db.GetUser(ctx, "rehash_user")
+	require.NoError(t, err)
+	assert.Equal(t, "new", user.Password)
+}
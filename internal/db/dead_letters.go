@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DeadLetterOrder makes the unprocessed order the accrual service gave up on INVALID with the reason
+// of the failure, so it isn't requested anymore until an admin requeues it.
+// ErrOrderNotFound is returned if the order is processed or deleted meanwhile.
+func (db *OrderStore) DeadLetterOrder(ctx context.Context, number string, attempts int, reason string) error {
+	db.logger.Debugf("Dead-lettering order %s after %d attempts", number, attempts)
+	return db.retry(ctx, func(ctx context.Context) error {
+		return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, `
+				UPDATE orders SET status = 'INVALID', accrual = NULL, attempts = $2, next_retry_at = NULL,
+					dead_lettered_at = now(), failure_reason = $3
+				WHERE order_number = $1 AND status IN ('NEW','PROCESSING') AND deleted_at IS NULL`, number, attempts, reason)
+			if err != nil {
+				return fmt.Errorf("failed to dead-letter an order: %w", err)
+			}
+			if tag.RowsAffected() == 0 {
+				return ErrOrderNotFound
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO order_history (order_number, status) VALUES ($1, 'INVALID')", number); err != nil {
+				return fmt.Errorf("failed to insert an order history: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// GetDeadLetterOrders returns a page of the tenant's dead-lettered orders, latest first.
+func (db *OrderStore) GetDeadLetterOrders(ctx context.Context, page models.Page) ([]models.DeadLetterOrder, error) {
+	db.logger.Debug("Getting dead-lettered orders")
+	conds := []string{"tenant_id = $1", "dead_lettered_at IS NOT NULL", "deleted_at IS NULL"}
+	args := []any{tenant.FromContext(ctx)}
+	if page.After != nil {
+		args = append(args, page.After.At, page.After.Key)
+		conds = append(conds, fmt.Sprintf("(dead_lettered_at, order_number) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	query := `SELECT order_number, user_id, attempts, COALESCE(failure_reason, ''), uploaded_at, dead_lettered_at
+		FROM orders WHERE ` + strings.Join(conds, " AND ") + " ORDER BY dead_lettered_at DESC, order_number DESC"
+	if page.Limit > 0 {
+		args = append(args, page.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead-lettered orders: %w", err)
+	}
+	defer rows.Close()
+	orders := []models.DeadLetterOrder{}
+	for rows.Next() {
+		o := models.DeadLetterOrder{}
+		if err := rows.Scan(&o.Number, &o.UserID, &o.Attempts, &o.Reason, &o.UploadedAt, &o.DeadLetteredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead-lettered order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get dead-lettered orders: %w", err)
+	}
+	return orders, nil
+}
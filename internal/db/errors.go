@@ -10,15 +10,88 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// Kind classifies the storage failures by what the caller may do about them.
+type Kind int
+
+const (
+	// Permanent failures fail the same if repeated: a bug, a broken schema or an unexpected error.
+	Permanent Kind = iota
+	// Retryable failures may succeed later: the database is unavailable or overloaded, or the call timed out.
+	Retryable
+	// Conflict failures are rejected by the state of the data: a duplicate, a spent balance or a finished order.
+	Conflict
+	// NotFound failures miss the requested data.
+	NotFound
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Retryable:
+		return "retryable"
+	case Conflict:
+		return "conflict"
+	case NotFound:
+		return "not found"
+	default:
+		return "permanent"
+	}
+}
+
+// Error is a storage error of a known kind, the errors of the package are compared with errors.Is.
+type Error struct {
+	Kind Kind
+	msg  string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
 var (
-	ErrUserAlreadyExists   = errors.New("user already exists")
-	ErrOrderAlreadyExists  = errors.New("order already exists")
-	ErrOrderAlreadyAdded   = errors.New("order already added by another user")
-	ErrInsufficientBalance = errors.New("insufficient balance")
-	ErrUserNotFound        = errors.New("user not found")
-	ErrOrderNotFound       = errors.New("order not found")
+	ErrUserAlreadyExists   = &Error{Conflict, "user already exists"}
+	ErrOrderAlreadyExists  = &Error{Conflict, "order already exists"}
+	ErrOrderAlreadyAdded   = &Error{Conflict, "order already added by another user"}
+	ErrInsufficientBalance = &Error{Conflict, "insufficient balance"}
+	ErrUserNotFound        = &Error{NotFound, "user not found"}
+	ErrOrderNotFound       = &Error{NotFound, "order not found"}
+	ErrOrderNotNew         = &Error{Conflict, "order processing has started"}
+	ErrOrderNotRequeueable = &Error{Conflict, "order is new or processed"}
+	ErrPhoneAlreadyExists  = &Error{Conflict, "phone already registered by another user"}
+	ErrOTPNotFound         = &Error{NotFound, "one-time code not found"}
+	ErrWebhookNotFound     = &Error{NotFound, "webhook not found"}
+	ErrTooManyWebhooks     = &Error{Conflict, "too many webhooks"}
+	ErrDailyLimitExceeded  = &Error{Conflict, "daily withdrawal limit exceeded"}
+	ErrOrderNumberUsed     = &Error{Conflict, "order number already used by an accrual order or another user's withdrawal"}
 )
 
+// Classify returns the kind of the storage error: the kind of the error of the package, or the kind the failure
+// of the database is of. The transient failures the retries ran out for are Retryable, the caller may retry later.
+func Classify(err error) Kind {
+	var storageErr *Error
+	if errors.As(err, &storageErr) {
+		return storageErr.Kind
+	}
+	var retryErr *RetryError
+	if errors.As(err, &retryErr) || isTransient(err) || errors.Is(err, context.DeadlineExceeded) {
+		return Retryable
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return Retryable
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		// the statement timeout, the shutdown of the server and the exhausted connections or memory
+		case pgerrcode.IsOperatorIntervention(pgErr.Code), pgerrcode.IsInsufficientResources(pgErr.Code):
+			return Retryable
+		case pgerrcode.IsIntegrityConstraintViolation(pgErr.Code), pgErr.Code == pgerrcode.LockNotAvailable:
+			return Conflict
+		}
+	}
+	return Permanent
+}
+
 // isErrorDuplicate checks for specific PostgreSQL error codes that indicate duplicate errors.
 func isErrorDuplicate(err error) bool {
 	var pgErr *pgconn.PgError
@@ -31,6 +104,15 @@ func isErrorDuplicate(err error) bool {
 	return false
 }
 
+// violatedConstraint returns the name of the unique constraint the error violates, empty if it isn't a violation.
+func violatedConstraint(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return pgErr.ConstraintName
+	}
+	return ""
+}
+
 // isUserOrder checks if the order belongs to the user.
 func (db *DB) isUserOrder(ctx context.Context, orderNumber string, userID int64) error {
 	db.logger.Debugf("Checking if order %s is already added by user %d", orderNumber, userID)
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The columns of the exported tables, the timestamps are written in UTC.
+const (
+	exportOrdersQuery = `COPY (
+		SELECT order_number, tenant_id, user_id, status, accrual, uploaded_at, deleted_at
+		FROM orders ORDER BY uploaded_at, order_number
+	) TO STDOUT WITH (FORMAT csv, HEADER)`
+	exportWithdrawalsQuery = `COPY (
+		SELECT order_number, tenant_id, user_id, summ AS sum, description, processed_at
+		FROM withdrawals ORDER BY processed_at, order_number
+	) TO STDOUT WITH (FORMAT csv, HEADER)`
+)
+
+// Export writes the orders, the soft-deleted ones too, and the withdrawals of all the tenants as CSV with a header
+// and returns the numbers of the written rows. Both tables are read from the same snapshot of the database.
+// The rows are streamed into the writers as they are read, so the export is neither retried nor limited
+// by the statement timeout.
+func (db *DB) Export(ctx context.Context, orders, withdrawals io.Writer) (ordersN, withdrawalsN int64, err error) {
+	db.logger.Debug("Exporting orders and withdrawals")
+	// Begin a new read-only transaction seeing a single snapshot
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			db.logger.Errorf("failed to rollback a transaction: %v", err)
+		}
+	}()
+	if _, err := tx.Exec(ctx, "SET LOCAL TimeZone = 'UTC'"); err != nil {
+		return 0, 0, fmt.Errorf("failed to set the time zone: %w", err)
+	}
+
+	tag, err := tx.Conn().PgConn().CopyTo(ctx, orders, exportOrdersQuery)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to export orders: %w", err)
+	}
+	ordersN = tag.RowsAffected()
+	tag, err = tx.Conn().PgConn().CopyTo(ctx, withdrawals, exportWithdrawalsQuery)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to export withdrawals: %w", err)
+	}
+	withdrawalsN = tag.RowsAffected()
+
+	// Commit the transaction
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit a transaction: %w", err)
+	}
+	return ordersN, withdrawalsN, nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// globalLimitLockKey is the advisory lock serializing the withdrawals of all the users of a tenant
+// while the global daily cap is checked, the second key is the hash of the tenant.
+// The two-key lock space does not overlap the user locks.
+const globalLimitLockKey = 1
+
+// DailyLimitError is returned when a withdrawal exceeds a daily cap, it matches ErrDailyLimitExceeded.
+type DailyLimitError struct {
+	Global  bool         // the global cap is exceeded, not the user one
+	Limit   models.Money // the cap
+	Used    models.Money // the amount withdrawn since the start of the day
+	ResetAt time.Time    // the start of the next day in UTC
+}
+
+func (e *DailyLimitError) Error() string {
+	scope := "user"
+	if e.Global {
+		scope = "global"
+	}
+	return fmt.Sprintf("%s daily withdrawal limit %.2f exceeded, %.2f used, resets at %s",
+		scope, e.Limit.Float64(), e.Used.Float64(), e.ResetAt.Format(time.RFC3339))
+}
+
+func (e *DailyLimitError) Unwrap() error {
+	return ErrDailyLimitExceeded
+}
+
+// checkDailyLimits checks that the withdrawal fits the daily caps within the withdrawal transaction.
+// The caller holds the user advisory lock, the global cap of the tenant takes one more lock shared by its users.
+func (db *DB) checkDailyLimits(ctx context.Context, tx pgx.Tx, withdrawal *models.Withdrawal) error {
+	if db.dailyLimit <= 0 && db.globalDailyLimit <= 0 {
+		return nil
+	}
+	dayStart := db.clock.Now().UTC().Truncate(24 * time.Hour)
+	resetAt := dayStart.Add(24 * time.Hour)
+
+	if db.dailyLimit > 0 {
+		var used models.Money
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE user_id = $1 AND processed_at >= $2",
+			withdrawal.UserID, dayStart).Scan(&used); err != nil {
+			return fmt.Errorf("failed to get the daily withdrawals: %w", err)
+		}
+		if used+withdrawal.Sum > db.dailyLimit {
+			db.logger.Debugf("daily withdrawal limit of user %d exceeded: %s + %s > %s", withdrawal.UserID, used, withdrawal.Sum, db.dailyLimit)
+			return &DailyLimitError{Limit: db.dailyLimit, Used: used, ResetAt: resetAt}
+		}
+	}
+
+	if db.globalDailyLimit > 0 {
+		tenantID := tenant.FromContext(ctx)
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", globalLimitLockKey, tenantID); err != nil {
+			return fmt.Errorf("failed to acquire the global withdrawal lock: %w", err)
+		}
+		var used models.Money
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(SUM(summ), 0) FROM withdrawals WHERE tenant_id = $1 AND processed_at >= $2",
+			tenantID, dayStart).Scan(&used); err != nil {
+			return fmt.Errorf("failed to get the daily withdrawals: %w", err)
+		}
+		if used+withdrawal.Sum > db.globalDailyLimit {
+			db.logger.Debugf("global daily withdrawal limit of tenant %s exceeded: %s + %s > %s", tenantID, used, withdrawal.Sum, db.globalDailyLimit)
+			return &DailyLimitError{Global: true, Limit: db.globalDailyLimit, Used: used, ResetAt: resetAt}
+		}
+	}
+	return nil
+}
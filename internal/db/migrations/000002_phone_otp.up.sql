@@ -0,0 +1,11 @@
+-- Phone numbers for the one-time code login
+ALTER TABLE users ADD COLUMN phone TEXT UNIQUE;
+
+-- One-time login codes, only the last code sent to the phone is kept
+CREATE TABLE otp_codes (
+    phone TEXT NOT NULL PRIMARY KEY,
+    code_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_user_status_uploaded_at;
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at;
+CREATE INDEX idx_orders_user_id ON orders (user_id);
@@ -0,0 +1,5 @@
+-- Indexes for filtering the user's orders by status and upload date,
+-- the index on user_id alone is covered by them
+DROP INDEX IF EXISTS idx_orders_user_id;
+CREATE INDEX idx_orders_user_uploaded_at ON orders (user_id, uploaded_at DESC);
+CREATE INDEX idx_orders_user_status_uploaded_at ON orders (user_id, status, uploaded_at DESC);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at_order;
+CREATE INDEX idx_withdrawals_user_processed_at ON withdrawals (user_id, processed_at DESC);
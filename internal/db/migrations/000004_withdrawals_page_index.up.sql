@@ -0,0 +1,3 @@
+-- Index for the withdrawals pages ordered by processed_at and order_number
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at;
+CREATE INDEX idx_withdrawals_user_processed_at_order ON withdrawals (user_id, processed_at DESC, order_number DESC);
@@ -0,0 +1,17 @@
+-- Status changes of the orders
+CREATE TABLE order_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_number TEXT NOT NULL REFERENCES orders(order_number) ON DELETE CASCADE,
+    status order_status NOT NULL,
+    accrual DECIMAL(10, 2) CHECK (accrual >= 0),
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Indexes for order_history table
+CREATE INDEX idx_order_history_order_number ON order_history (order_number, changed_at);
+
+-- History of the existing orders: the upload and the current status, if it has changed
+INSERT INTO order_history (order_number, status, changed_at)
+SELECT order_number, 'NEW', uploaded_at FROM orders;
+INSERT INTO order_history (order_number, status, accrual)
+SELECT order_number, status, accrual FROM orders WHERE status <> 'NEW';
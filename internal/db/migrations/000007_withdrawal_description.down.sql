@@ -0,0 +1 @@
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS description;
@@ -0,0 +1,2 @@
+-- Optional note of the user about the withdrawal
+ALTER TABLE withdrawals ADD COLUMN description TEXT NOT NULL DEFAULT '';
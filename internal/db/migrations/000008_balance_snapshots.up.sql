@@ -0,0 +1,11 @@
+-- Balance of the users at the end of every day (UTC)
+CREATE TABLE balance_snapshots (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    current DECIMAL(12, 2) NOT NULL,
+    withdrawn DECIMAL(12, 2) NOT NULL,
+    PRIMARY KEY (user_id, day)
+);
+
+-- Index for finding the last snapshot day
+CREATE INDEX idx_balance_snapshots_day ON balance_snapshots (day);
@@ -0,0 +1,7 @@
+-- Roles of the users, the admins are promoted manually:
+-- UPDATE users SET role = 'admin' WHERE login = '...';
+CREATE TYPE user_role AS ENUM ('user', 'admin');
+ALTER TABLE users ADD COLUMN role user_role NOT NULL DEFAULT 'user';
+
+-- Index for the users pages ordered by created_at and id
+CREATE INDEX idx_users_created_at_id ON users (created_at DESC, id DESC);
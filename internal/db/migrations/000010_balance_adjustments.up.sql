@@ -0,0 +1,12 @@
+-- Manual corrections of the balance by the admins: a positive amount is a credit, a negative one is a debit
+CREATE TABLE balance_adjustments (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    admin_id INT REFERENCES users(id) ON DELETE SET NULL,
+    amount DECIMAL(10, 2) NOT NULL CHECK (amount <> 0),
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Index for the user's adjustments in the balance and the ledger
+CREATE INDEX idx_balance_adjustments_user_created_at ON balance_adjustments (user_id, created_at);
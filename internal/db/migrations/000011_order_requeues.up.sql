@@ -0,0 +1,12 @@
+-- Audit of the orders sent back to the accrual service by the admins
+CREATE TABLE order_requeues (
+    id BIGSERIAL PRIMARY KEY,
+    order_number TEXT NOT NULL REFERENCES orders(order_number) ON DELETE CASCADE,
+    admin_id INT REFERENCES users(id) ON DELETE SET NULL,
+    previous_status order_status NOT NULL,
+    reason TEXT NOT NULL,
+    requeued_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Index for the requeues of an order
+CREATE INDEX idx_order_requeues_order_number ON order_requeues (order_number, requeued_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_withdrawals_processed_at;
@@ -0,0 +1,2 @@
+-- Index for the global daily withdrawal cap summing the withdrawals of all the users
+CREATE INDEX idx_withdrawals_processed_at ON withdrawals (processed_at);
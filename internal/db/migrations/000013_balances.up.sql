@@ -0,0 +1,18 @@
+-- Balance of every user kept up to date in the same transactions that process the orders, make the withdrawals
+-- and the adjustments, so it is read as a single row instead of summing them on every request
+CREATE TABLE balances (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    current DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    withdrawn DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (withdrawn >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Backfill the balances of the existing users
+INSERT INTO balances (user_id, current, withdrawn)
+SELECT u.id,
+    COALESCE(o.accrued, 0) + COALESCE(a.adjusted, 0) - COALESCE(w.withdrawn, 0),
+    COALESCE(w.withdrawn, 0)
+FROM users u
+LEFT JOIN (SELECT user_id, SUM(accrual) AS accrued FROM orders WHERE status = 'PROCESSED' GROUP BY user_id) o ON o.user_id = u.id
+LEFT JOIN (SELECT user_id, SUM(summ) AS withdrawn FROM withdrawals GROUP BY user_id) w ON w.user_id = u.id
+LEFT JOIN (SELECT user_id, SUM(amount) AS adjusted FROM balance_adjustments GROUP BY user_id) a ON a.user_id = u.id;
@@ -0,0 +1,4 @@
+ALTER TABLE balance_adjustments ALTER COLUMN amount TYPE DECIMAL(10, 2);
+ALTER TABLE withdrawals ALTER COLUMN summ TYPE DECIMAL(10, 2);
+ALTER TABLE order_history ALTER COLUMN accrual TYPE DECIMAL(10, 2);
+ALTER TABLE orders ALTER COLUMN accrual TYPE DECIMAL(10, 2);
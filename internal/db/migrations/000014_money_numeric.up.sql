@@ -0,0 +1,5 @@
+-- The amounts are kept in hundredths, widen them to the precision of the balances they add up to
+ALTER TABLE orders ALTER COLUMN accrual TYPE NUMERIC(12, 2);
+ALTER TABLE order_history ALTER COLUMN accrual TYPE NUMERIC(12, 2);
+ALTER TABLE withdrawals ALTER COLUMN summ TYPE NUMERIC(12, 2);
+ALTER TABLE balance_adjustments ALTER COLUMN amount TYPE NUMERIC(12, 2);
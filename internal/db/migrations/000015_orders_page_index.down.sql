@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_orders_user_status_uploaded_at_order;
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at_order;
+CREATE INDEX idx_orders_user_uploaded_at ON orders (user_id, uploaded_at DESC);
+CREATE INDEX idx_orders_user_status_uploaded_at ON orders (user_id, status, uploaded_at DESC);
@@ -0,0 +1,5 @@
+-- Indexes for the orders pages ordered by uploaded_at and order_number, with and without the status filter
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at;
+DROP INDEX IF EXISTS idx_orders_user_status_uploaded_at;
+CREATE INDEX idx_orders_user_uploaded_at_order ON orders (user_id, uploaded_at DESC, order_number DESC);
+CREATE INDEX idx_orders_user_status_uploaded_at_order ON orders (user_id, status, uploaded_at DESC, order_number DESC);
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS orders_notify_new ON orders;
+DROP FUNCTION IF EXISTS notify_new_orders();
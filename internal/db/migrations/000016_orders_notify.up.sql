@@ -0,0 +1,11 @@
+-- Notify the accrual worker listening on the orders_new channel about the uploaded orders,
+-- once per statement, so a batch upload wakes it up once
+CREATE OR REPLACE FUNCTION notify_new_orders() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('orders_new', '');
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER orders_notify_new AFTER INSERT ON orders
+	FOR EACH STATEMENT EXECUTE FUNCTION notify_new_orders();
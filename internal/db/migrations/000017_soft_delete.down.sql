@@ -0,0 +1,11 @@
+-- Dropping the columns would bring the soft-deleted rows back, so the migration fails while there are any;
+-- they are purged by hand, together with the rows referring to them, before migrating down
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM orders WHERE deleted_at IS NOT NULL) OR EXISTS (SELECT 1 FROM users WHERE deleted_at IS NOT NULL) THEN
+		RAISE EXCEPTION 'soft-deleted users or orders exist, purge them before migrating down';
+	END IF;
+END;
+$$;
+ALTER TABLE orders DROP COLUMN deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,4 @@
+-- Soft deletion of the users and the orders: the deleted rows are kept for the references and the moderation
+-- and hidden from the queries, the order numbers and the logins stay taken
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE orders ADD COLUMN deleted_at TIMESTAMPTZ;
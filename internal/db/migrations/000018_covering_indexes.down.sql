@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at_order;
+CREATE INDEX idx_withdrawals_user_processed_at_order ON withdrawals (user_id, processed_at DESC, order_number DESC);
+DROP INDEX IF EXISTS idx_orders_unprocessed;
+CREATE INDEX idx_orders_status ON orders (status);
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at_order;
+CREATE INDEX idx_orders_user_uploaded_at_order ON orders (user_id, uploaded_at DESC, order_number DESC);
@@ -0,0 +1,14 @@
+-- Covering indexes for the hot paths, so they are served by the index-only scans:
+-- the users' orders pages, the accrual queue and the users' withdrawals
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at_order;
+CREATE INDEX idx_orders_user_uploaded_at_order ON orders (user_id, uploaded_at DESC, order_number DESC)
+    INCLUDE (status, accrual) WHERE deleted_at IS NULL;
+
+-- The accrual queue is a small part of the orders, the full status index is not used otherwise
+DROP INDEX IF EXISTS idx_orders_status;
+CREATE INDEX idx_orders_unprocessed ON orders (status) INCLUDE (user_id, accrual, uploaded_at)
+    WHERE status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
+
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at_order;
+CREATE INDEX idx_withdrawals_user_processed_at_order ON withdrawals (user_id, processed_at DESC, order_number DESC)
+    INCLUDE (summ, description);
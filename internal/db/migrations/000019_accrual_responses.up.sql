@@ -0,0 +1,11 @@
+-- Raw responses of the accrual service per order, kept to investigate the disputes about the awarded points
+CREATE TABLE accrual_responses (
+    id BIGSERIAL PRIMARY KEY,
+    order_number TEXT NOT NULL REFERENCES orders(order_number) ON DELETE CASCADE,
+    status_code INT NOT NULL,
+    body TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Index for the responses of an order
+CREATE INDEX idx_accrual_responses_order_number ON accrual_responses (order_number, received_at);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS withdrawals_check_order_number ON withdrawals;
+DROP FUNCTION IF EXISTS check_withdrawal_order_number();
+ALTER TABLE withdrawals DROP CONSTRAINT IF EXISTS withdrawals_order_number_key;
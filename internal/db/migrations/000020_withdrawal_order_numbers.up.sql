@@ -0,0 +1,18 @@
+-- A withdrawal order number is used once: neither by the withdrawals of other users nor by the accrual orders.
+-- The migration fails if the withdrawals of different users share a number, such duplicates are resolved by hand
+ALTER TABLE withdrawals ADD CONSTRAINT withdrawals_order_number_key UNIQUE (order_number);
+
+-- The numbers of the orders, the soft-deleted ones too, are checked by the trigger, a constraint can't refer to
+-- another table; the violation is reported as the one of the withdrawals_order_number_accrual constraint
+CREATE FUNCTION check_withdrawal_order_number() RETURNS trigger AS $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM orders WHERE order_number = NEW.order_number) THEN
+		RAISE EXCEPTION 'order number % is used by an accrual order', NEW.order_number
+			USING ERRCODE = 'unique_violation', CONSTRAINT = 'withdrawals_order_number_accrual', TABLE = 'withdrawals';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER withdrawals_check_order_number BEFORE INSERT OR UPDATE OF order_number ON withdrawals
+	FOR EACH ROW EXECUTE FUNCTION check_withdrawal_order_number();
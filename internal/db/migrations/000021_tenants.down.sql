@@ -0,0 +1,24 @@
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at_order;
+CREATE INDEX idx_withdrawals_user_processed_at_order ON withdrawals (user_id, processed_at DESC, order_number DESC)
+    INCLUDE (summ, description);
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at_order;
+CREATE INDEX idx_orders_user_uploaded_at_order ON orders (user_id, uploaded_at DESC, order_number DESC)
+    INCLUDE (status, accrual) WHERE deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_users_created_at_id;
+CREATE INDEX idx_users_created_at_id ON users (created_at DESC, id DESC);
+
+ALTER TABLE otp_codes DROP CONSTRAINT IF EXISTS otp_codes_pkey;
+ALTER TABLE otp_codes DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE otp_codes ADD PRIMARY KEY (phone);
+
+-- The migration fails if the logins or the phones of different tenants collide, such duplicates are resolved by hand
+ALTER TABLE withdrawals DROP CONSTRAINT IF EXISTS withdrawals_user_tenant_fkey;
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_user_tenant_fkey;
+ALTER TABLE orders DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_id_tenant_key;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_tenant_phone_key;
+ALTER TABLE users ADD CONSTRAINT users_phone_key UNIQUE (phone);
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_tenant_login_key;
+ALTER TABLE users ADD CONSTRAINT users_login_key UNIQUE (login);
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
@@ -0,0 +1,30 @@
+-- Tenants: one deployment serves several loyalty programs, the existing data belongs to the default one.
+-- The logins and the phones are unique within a tenant, the order numbers stay unique across them,
+-- as the accrual system knows the orders by their numbers only
+ALTER TABLE users ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_login_key;
+ALTER TABLE users ADD CONSTRAINT users_tenant_login_key UNIQUE (tenant_id, login);
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_phone_key;
+ALTER TABLE users ADD CONSTRAINT users_tenant_phone_key UNIQUE (tenant_id, phone);
+-- Referenced by the orders and the withdrawals, so they can't belong to another tenant than their user
+ALTER TABLE users ADD CONSTRAINT users_id_tenant_key UNIQUE (id, tenant_id);
+
+ALTER TABLE orders ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE orders ADD CONSTRAINT orders_user_tenant_fkey FOREIGN KEY (user_id, tenant_id) REFERENCES users (id, tenant_id) ON DELETE CASCADE;
+ALTER TABLE withdrawals ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE withdrawals ADD CONSTRAINT withdrawals_user_tenant_fkey FOREIGN KEY (user_id, tenant_id) REFERENCES users (id, tenant_id) ON DELETE CASCADE;
+
+-- The one-time codes are sent for a login to the tenant
+ALTER TABLE otp_codes ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE otp_codes DROP CONSTRAINT IF EXISTS otp_codes_pkey;
+ALTER TABLE otp_codes ADD PRIMARY KEY (tenant_id, phone);
+
+-- The users pages and the covering indexes of the hot paths are scoped by the tenant
+DROP INDEX IF EXISTS idx_users_created_at_id;
+CREATE INDEX idx_users_created_at_id ON users (tenant_id, created_at DESC, id DESC);
+DROP INDEX IF EXISTS idx_orders_user_uploaded_at_order;
+CREATE INDEX idx_orders_user_uploaded_at_order ON orders (user_id, uploaded_at DESC, order_number DESC)
+    INCLUDE (status, accrual, tenant_id) WHERE deleted_at IS NULL;
+DROP INDEX IF EXISTS idx_withdrawals_user_processed_at_order;
+CREATE INDEX idx_withdrawals_user_processed_at_order ON withdrawals (user_id, processed_at DESC, order_number DESC)
+    INCLUDE (summ, description, tenant_id);
@@ -0,0 +1,23 @@
+-- Balances of the users summed from the ledger for the reporting, refreshed by the report job aside from
+-- the transactions keeping the balances table, so the reports don't read or lock the transactional tables
+CREATE MATERIALIZED VIEW balance_report AS
+SELECT u.id AS user_id, u.tenant_id,
+    COALESCE(o.accrued, 0) AS accrued,
+    COALESCE(a.adjusted, 0) AS adjusted,
+    COALESCE(w.withdrawn, 0) AS withdrawn,
+    COALESCE(o.accrued, 0) + COALESCE(a.adjusted, 0) - COALESCE(w.withdrawn, 0) AS current,
+    COALESCE(o.orders, 0) AS orders,
+    COALESCE(w.withdrawals, 0) AS withdrawals,
+    now() AS refreshed_at
+FROM users u
+LEFT JOIN (
+    SELECT user_id, SUM(accrual) FILTER (WHERE status = 'PROCESSED') AS accrued, COUNT(*) AS orders
+    FROM orders WHERE deleted_at IS NULL GROUP BY user_id
+) o ON o.user_id = u.id
+LEFT JOIN (SELECT user_id, SUM(summ) AS withdrawn, COUNT(*) AS withdrawals FROM withdrawals GROUP BY user_id) w ON w.user_id = u.id
+LEFT JOIN (SELECT user_id, SUM(amount) AS adjusted FROM balance_adjustments GROUP BY user_id) a ON a.user_id = u.id
+WHERE u.deleted_at IS NULL;
+
+-- The unique index lets the view be refreshed concurrently with the reads
+CREATE UNIQUE INDEX idx_balance_report_user_id ON balance_report (user_id);
+CREATE INDEX idx_balance_report_tenant ON balance_report (tenant_id);
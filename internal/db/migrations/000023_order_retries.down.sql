@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_orders_unprocessed;
+CREATE INDEX idx_orders_unprocessed ON orders (status) INCLUDE (user_id, accrual, uploaded_at)
+    WHERE status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS next_retry_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS attempts;
@@ -0,0 +1,8 @@
+-- The failed accrual attempts of the orders: the order isn't requested again before next_retry_at,
+-- which is infinity once the attempts are exhausted, until the order is requeued
+ALTER TABLE orders ADD COLUMN attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN next_retry_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS idx_orders_unprocessed;
+CREATE INDEX idx_orders_unprocessed ON orders (status) INCLUDE (user_id, accrual, uploaded_at, attempts, next_retry_at)
+    WHERE status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
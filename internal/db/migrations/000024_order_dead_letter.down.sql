@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_orders_dead_lettered;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS failure_reason;
+ALTER TABLE orders DROP COLUMN IF EXISTS dead_lettered_at;
@@ -0,0 +1,15 @@
+-- The dead letters: the orders the accrual service gave up on are INVALID with the reason of the failure,
+-- kept apart from the ones the accrual system found invalid for the admins to handle
+ALTER TABLE orders ADD COLUMN dead_lettered_at TIMESTAMPTZ;
+ALTER TABLE orders ADD COLUMN failure_reason TEXT;
+
+-- The orders given up so far waited with next_retry_at set to infinity
+INSERT INTO order_history (order_number, status)
+SELECT order_number, 'INVALID' FROM orders
+WHERE next_retry_at = 'infinity' AND status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
+UPDATE orders SET status = 'INVALID', accrual = NULL, next_retry_at = NULL, dead_lettered_at = now(),
+    failure_reason = 'failed ' || attempts || ' times'
+WHERE next_retry_at = 'infinity' AND status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
+
+CREATE INDEX idx_orders_dead_lettered ON orders (tenant_id, dead_lettered_at DESC, order_number DESC)
+    WHERE dead_lettered_at IS NOT NULL AND deleted_at IS NULL;
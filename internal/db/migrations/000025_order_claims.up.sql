@@ -0,0 +1,3 @@
+-- The orders claimed by a poll aren't claimed by the other pollers before claimed_until,
+-- so the replicas share the backlog; the claim of a poller gone meanwhile expires
+ALTER TABLE orders ADD COLUMN claimed_until TIMESTAMPTZ;
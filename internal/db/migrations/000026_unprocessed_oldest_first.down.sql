@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_unprocessed;
+CREATE INDEX idx_orders_unprocessed ON orders (status) INCLUDE (user_id, accrual, uploaded_at, attempts, next_retry_at)
+    WHERE status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
@@ -0,0 +1,6 @@
+-- The accrual queue is claimed the oldest first: keyed by the upload time the index is walked in the claim order
+-- and the claim stops at its limit, instead of sorting the whole backlog on every poll during a burst
+DROP INDEX IF EXISTS idx_orders_unprocessed;
+CREATE INDEX idx_orders_unprocessed ON orders (uploaded_at, order_number)
+    INCLUDE (status, user_id, accrual, attempts, next_retry_at, claimed_until)
+    WHERE status IN ('NEW', 'PROCESSING') AND deleted_at IS NULL;
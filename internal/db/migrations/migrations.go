@@ -1,46 +1,295 @@
 package migrations
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/lib/pq"
+	"go.uber.org/zap"
 )
 
 //go:embed *.sql
 var migrationsDir embed.FS
 
-// RunMigrations applies the database migrations using the provided DSN.
-func RunMigrations(dsn string, flow bool) error {
+// Errors of the schema version check.
+var (
+	ErrSchemaTooNew   = errors.New("database schema is newer than the migrations of the binary")
+	ErrSchemaOutdated = errors.New("database schema has pending migrations")
+	ErrSchemaDirty    = errors.New("database schema is dirty")
+)
+
+// ErrMigrationLocked is returned when another instance holds the migration lock longer than the lock timeout.
+var ErrMigrationLocked = errors.New("migrations are being applied by another instance")
+
+// The migration lock is a session advisory lock in the two-key space, which does not overlap the user locks
+// of the storage, and is released with the connection if the instance holding it dies.
+const (
+	lockClassID = 2 // lockClassID is the first key of the migration lock.
+	lockObjID   = 0 // lockObjID is the second key of the migration lock.
+)
+
+const (
+	DefaultLockTimeout = time.Minute            // DefaultLockTimeout is the default wait for the migration lock.
+	lockPollInterval   = 500 * time.Millisecond // lockPollInterval is the interval of the attempts to take the migration lock.
+)
+
+// Migration is an embedded migration with its state in the database.
+type Migration struct {
+	Version uint
+	Name    string
+	Applied bool
+	Dirty   bool // the migration failed halfway and the schema must be fixed by hand
+}
+
+// Migrator applies the embedded migrations to the database.
+type Migrator struct {
+	m           *migrate.Migrate
+	dsn         string
+	lockTimeout time.Duration
+	logger      *zap.SugaredLogger
+}
+
+// Option is a functional option of the migrator.
+type Option func(*Migrator)
+
+// WithLockTimeout sets how long the migrations wait for another instance applying them, DefaultLockTimeout by default.
+func WithLockTimeout(d time.Duration) Option {
+	return func(mg *Migrator) {
+		mg.lockTimeout = d
+	}
+}
+
+// WithLogger sets the logger reporting the wait for the migration lock.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(mg *Migrator) {
+		mg.logger = logger
+	}
+}
+
+// New creates the migrator of the database with the provided DSN.
+func New(dsn string, opts ...Option) (*Migrator, error) {
 	d, err := iofs.New(migrationsDir, ".")
 	if err != nil {
-		return fmt.Errorf("failed to return an iofs driver: %w", err)
+		return nil, fmt.Errorf("failed to return an iofs driver: %w", err)
 	}
 
 	m, err := migrate.NewWithSourceInstance("iofs", d, dsn)
 	if err != nil {
-		return fmt.Errorf("failed to get a new migrate instance: %w", err)
+		return nil, fmt.Errorf("failed to get a new migrate instance: %w", err)
 	}
-	if flow {
-		// If flow is true, apply migrations in a forward direction
-		if err := m.Up(); err != nil {
-			if !errors.Is(err, migrate.ErrNoChange) {
-				return fmt.Errorf("failed to apply migrations to the DB: %w", err)
-			}
-		}
+	mg := &Migrator{m: m, dsn: dsn, lockTimeout: DefaultLockTimeout, logger: zap.NewNop().Sugar()}
+	for _, opt := range opts {
+		opt(mg)
+	}
+	return mg, nil
+}
+
+// Close closes the connection to the database.
+func (mg *Migrator) Close() error {
+	srcErr, dbErr := mg.m.Close()
+	return errors.Join(srcErr, dbErr)
+}
+
+// Up applies all the pending migrations holding the migration lock, so the replicas starting together
+// don't race: the others wait and find the schema migrated. If the lock isn't taken within the lock timeout,
+// the up-to-date schema is left as it is and ErrMigrationLocked is returned otherwise.
+func (mg *Migrator) Up(ctx context.Context) error {
+	if err := mg.Check(true); err != nil {
+		return err
+	}
+	unlock, err := mg.lock(ctx)
+	if errors.Is(err, ErrMigrationLocked) && mg.Check(false) == nil {
+		mg.logger.Info("Migrations are locked by another instance, the schema is up to date")
 		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// The instance holding the lock before may have applied the migrations or failed halfway
+	if err := mg.Check(true); err != nil {
+		return err
+	}
+	if err := mg.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to apply migrations to the DB: %w", err)
+	}
+	return nil
+}
+
+// Down rolls back the last n applied migrations holding the migration lock.
+func (mg *Migrator) Down(ctx context.Context, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid number of migrations to roll back: %d", n)
+	}
+	unlock, err := mg.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := mg.m.Steps(-n); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to rollback migrations in the DB: %w", err)
+	}
+	return nil
+}
+
+// lock takes the migration lock on a connection of its own, waiting for the instance holding it
+// up to the lock timeout, and returns the function releasing it.
+func (mg *Migrator) lock(ctx context.Context) (unlock func(), err error) {
+	conn, err := pgx.Connect(ctx, mg.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect for the migration lock: %w", err)
+	}
+	release := func() {
+		// closing the connection releases the lock too
+		closeCtx, cancel := context.WithTimeout(context.Background(), lockPollInterval)
+		defer cancel()
+		conn.Close(closeCtx)
+	}
 
-	} // If flow is false, apply migrations in a backward direction
-	if err := m.Down(); err != nil {
-		if !errors.Is(err, migrate.ErrNoChange) {
-			return fmt.Errorf("failed to rollback migrations in the DB: %w", err)
+	deadline := time.Now().Add(mg.lockTimeout)
+	for waiting := false; ; waiting = true {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1, $2)", lockClassID, lockObjID).Scan(&locked); err != nil {
+			release()
+			return nil, fmt.Errorf("failed to take the migration lock: %w", err)
 		}
+		if locked {
+			if waiting {
+				mg.logger.Info("Migration lock taken")
+			}
+			return func() {
+				if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1, $2)", lockClassID, lockObjID); err != nil {
+					mg.logger.Warnf("failed to release the migration lock: %v", err)
+				}
+				release()
+			}, nil
+		}
+		if !time.Now().Before(deadline) {
+			release()
+			return nil, fmt.Errorf("%w: waited %s", ErrMigrationLocked, mg.lockTimeout)
+		}
+		if !waiting {
+			mg.logger.Infof("Waiting up to %s for another instance applying the migrations", mg.lockTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, fmt.Errorf("failed to take the migration lock: %w", ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Version returns the version of the last applied migration, 0 if none is applied.
+func (mg *Migrator) Version() (version uint, dirty bool, err error) {
+	version, dirty, err = mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get the migration version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// Check checks the binary can work with the database schema: the schema is not dirty, nor newer than
+// the last embedded migration, as the older binaries don't know how to use it. The pending migrations
+// are allowed if they are going to be applied.
+func (mg *Migrator) Check(allowPending bool) error {
+	version, dirty, err := mg.Version()
+	if err != nil {
+		return err
+	}
+	latest, err := Latest()
+	if err != nil {
+		return err
+	}
+	switch {
+	case dirty:
+		return fmt.Errorf("%w: migration %d failed, fix it and force the version", ErrSchemaDirty, version)
+	case version > latest:
+		return fmt.Errorf("%w: schema version %d, latest known migration %d", ErrSchemaTooNew, version, latest)
+	case version < latest && !allowPending:
+		return fmt.Errorf("%w: schema version %d, latest migration %d, apply them with the migrate command", ErrSchemaOutdated, version, latest)
 	}
 	return nil
 }
+
+// Status returns the embedded migrations in order, marking the applied ones.
+func (mg *Migrator) Status() ([]Migration, error) {
+	current, dirty, err := mg.Version()
+	if err != nil {
+		return nil, err
+	}
+	all, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		all[i].Applied = all[i].Version <= current
+		all[i].Dirty = dirty && all[i].Version == current
+	}
+	return all, nil
+}
+
+// Migrations returns the embedded migrations in order.
+func Migrations() ([]Migration, error) {
+	d, err := iofs.New(migrationsDir, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to return an iofs driver: %w", err)
+	}
+	defer d.Close()
+
+	var all []Migration
+	version, err := d.First()
+	for err == nil {
+		r, name, readErr := d.ReadUp(version)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read migration %d: %w", version, readErr)
+		}
+		r.Close()
+		all = append(all, Migration{Version: version, Name: name})
+		version, err = d.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	return all, nil
+}
+
+// Latest returns the version of the last embedded migration.
+func Latest() (uint, error) {
+	all, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(all) == 0 {
+		return 0, nil
+	}
+	return all[len(all)-1].Version, nil
+}
+
+// Ensure checks the database schema version with the provided DSN and applies the pending migrations
+// if apply is set, otherwise the schema must be up to date.
+func Ensure(ctx context.Context, dsn string, apply bool, opts ...Option) error {
+	mg, err := New(dsn, opts...)
+	if err != nil {
+		return err
+	}
+	defer mg.Close()
+
+	if apply {
+		return mg.Up(ctx)
+	}
+	return mg.Check(false)
+}
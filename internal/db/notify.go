@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// newOrdersChannel is the channel the orders trigger notifies about the uploaded orders.
+	newOrdersChannel = "orders_new"
+	// listenRetryDelay is the delay before reconnecting the lost listening connection.
+	listenRetryDelay = time.Second
+)
+
+// ListenNewOrders listens to the notifications about the uploaded orders until the context is done,
+// then the returned channel is closed. The notifications coming before the previous one is received
+// are merged into one. The listening connection is opened aside from the pool and restored if it is lost,
+// with a notification after reconnecting, as the uploads meanwhile are missed.
+func (db *OrderStore) ListenNewOrders(ctx context.Context) (<-chan struct{}, error) {
+	conn, err := db.listen(ctx, newOrdersChannel)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for {
+			err := waitNotifications(ctx, conn, ch)
+			conn.Close(context.WithoutCancel(ctx))
+			if ctx.Err() != nil {
+				return
+			}
+			db.logger.Errorf("listening to new orders failed, reconnecting: %v", err)
+			for conn, err = nil, nil; conn == nil; {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(listenRetryDelay):
+				}
+				if conn, err = db.listen(ctx, newOrdersChannel); err != nil {
+					db.logger.Errorf("failed to listen to new orders: %v", err)
+				}
+			}
+			notify(ch)
+		}
+	}()
+	return ch, nil
+}
+
+// listen opens a connection with the settings of the pool listening to the channel.
+func (db *DB) listen(ctx context.Context, channel string) (*pgx.Conn, error) {
+	conn, err := pgx.ConnectConfig(ctx, db.pool.Config().ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a listening connection: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to listen to %s: %w", channel, err)
+	}
+	return conn, nil
+}
+
+// waitNotifications passes the notifications of the connection to the channel until the connection fails
+// or the context is done.
+func waitNotifications(ctx context.Context, conn *pgx.Conn, ch chan<- struct{}) error {
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		notify(ch)
+	}
+}
+
+// notify sends to the channel unless it already has a pending value.
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the database.
+type Option func(*DB)
+
+// WithLogger sets the database logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(db *DB) {
+		db.logger = logger
+	}
+}
+
+// WithMetrics sets the registry for the database metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(db *DB) {
+		db.metrics = reg
+	}
+}
+
+// WithSlowQueryThreshold sets the duration after which the queries are logged as slow, 0 disables it.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(db *DB) {
+		db.slowQuery = d
+	}
+}
+
+// WithClock sets the clock deciding the day of the daily withdrawal caps and when they reset,
+// and stamping the webhook events.
+func WithClock(c clock.Clock) Option {
+	return func(db *DB) {
+		db.clock = c
+	}
+}
+
+// WithDailyWithdrawalLimits sets the per-user and the global daily withdrawal caps, 0 disables a cap.
+func WithDailyWithdrawalLimits(perUser, global models.Money) Option {
+	return func(db *DB) {
+		db.dailyLimit = perUser
+		db.globalDailyLimit = global
+	}
+}
+
+// WithAutoMigrate sets whether the pending migrations are applied on connecting, true by default.
+// The operators disabling it apply them with the migrate command.
+func WithAutoMigrate(auto bool) Option {
+	return func(db *DB) {
+		db.autoMigrate = auto
+	}
+}
+
+// WithMigrationLockTimeout sets how long the auto-migration waits for another instance applying the migrations,
+// 0 doesn't wait. The instance going on without the lock needs the schema up to date.
+func WithMigrationLockTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.migrationLock = d
+	}
+}
+
+// WithPoolSettings sets the connection pool settings, the zero fields keep the values of the DSN.
+func WithPoolSettings(s PoolSettings) Option {
+	return func(db *DB) {
+		db.poolSettings = s
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+)
+
+// GetOrdersPage gets the page of the user's orders matching the filter. The page continues the ordering
+// of the filter after the cursor by the (uploaded_at, order_number) keyset, or (accrual, order_number)
+// if sorted by the accrual, so the following pages are served by the indexes without skipping rows.
+func (db *OrderStore) GetOrdersPage(ctx context.Context, userID int64, filter models.OrderFilter, page models.Page) (*models.OrdersPage, error) {
+	db.logger.Debugf("Getting orders page for user %d", userID)
+	if page.Limit <= 0 {
+		return nil, errors.New("page limit must be positive")
+	}
+	// Request one more order to know if there is the next page
+	limit := page.Limit
+	page.Limit++
+	orders, err := db.queryOrders(ctx, userID, filter, page)
+	if err != nil {
+		return nil, err
+	}
+	result := &models.OrdersPage{Orders: orders}
+	if len(orders) > limit {
+		result.Orders = orders[:limit]
+		next := orderCursor(orders[limit-1], filter.Sort)
+		result.Next = &next
+	}
+	return result, nil
+}
+
+// GetWithdrawalsPage gets the page of the user's withdrawals selected by the query, which must have a limit.
+// The page continues after the cursor of the query by the (processed_at, order_number) keyset,
+// or (summ, order_number) if sorted by the sum.
+func (db *WithdrawalStore) GetWithdrawalsPage(ctx context.Context, userID int64, q models.WithdrawalQuery) (*models.WithdrawalsPage, error) {
+	db.logger.Debugf("Getting withdrawals page for user %d", userID)
+	if q.Limit <= 0 {
+		return nil, errors.New("page limit must be positive")
+	}
+	// Request one more withdrawal to know if there is the next page
+	limit := q.Limit
+	q.Limit++
+	withdrawals, err := db.GetWithdrawals(ctx, userID, q)
+	if err != nil {
+		return nil, err
+	}
+	result := &models.WithdrawalsPage{Withdrawals: withdrawals}
+	if len(withdrawals) > limit {
+		result.Withdrawals = withdrawals[:limit]
+		next := withdrawalCursor(withdrawals[limit-1], q.Sort)
+		result.Next = &next
+	}
+	return result, nil
+}
+
+// orderCursor returns the cursor of the page after the order in the ordering of the filter.
+func orderCursor(o models.Order, s models.Sort) models.Cursor {
+	c := models.Cursor{At: o.UploadedAt, Key: o.Number}
+	if s.Field == models.SortAccrual {
+		accrual := o.Accrual
+		c.Value = &accrual
+	}
+	return c
+}
+
+// withdrawalCursor returns the cursor of the page after the withdrawal in the ordering of the query.
+func withdrawalCursor(w models.Withdrawal, s models.Sort) models.Cursor {
+	c := models.Cursor{At: w.ProcessedAt, Key: w.Order}
+	if s.Field == models.SortSum {
+		sum := w.Sum
+		c.Value = &sum
+	}
+	return c
+}
+
+// cursorValue returns the position of the cursor in the sort column: the time, or the value
+// if the list is sorted by a number.
+func cursorValue(c *models.Cursor, byValue bool) (any, error) {
+	if !byValue {
+		return c.At, nil
+	}
+	if c.Value == nil {
+		return nil, errors.New("cursor has no value")
+	}
+	return *c.Value, nil
+}
+
+// keysetCond returns the condition continuing the (column, order_number) ordering in its direction
+// after the position and the key in the last two arguments.
+func keysetCond(column, dir string, nargs int) string {
+	op := "<"
+	if dir == "ASC" {
+		op = ">"
+	}
+	return fmt.Sprintf("(%s, order_number) %s ($%d, $%d)", column, op, nargs-1, nargs)
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// pollerLockKey is the advisory lock held by the instance polling the unprocessed orders,
+// the second key is 0. The two-key lock space does not overlap the user locks.
+const pollerLockKey = 4
+
+// pollerLockCheck is the interval of checking the connection holding the poller lock.
+const pollerLockCheck = 5 * time.Second
+
+// TryLockPoller takes the lock of the instance polling the unprocessed orders and reports whether it is taken,
+// false if another instance holds it. The session lock is held on a connection opened aside from the pool
+// until the context is done or the connection is lost, then the returned channel is closed.
+func (db *OrderStore) TryLockPoller(ctx context.Context) (<-chan struct{}, bool, error) {
+	conn, err := pgx.ConnectConfig(ctx, db.pool.Config().ConnConfig)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open the poller lock connection: %w", err)
+	}
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1, 0)", pollerLockKey).Scan(&locked); err != nil {
+		conn.Close(context.WithoutCancel(ctx))
+		return nil, false, fmt.Errorf("failed to acquire the poller lock: %w", err)
+	}
+	if !locked {
+		conn.Close(context.WithoutCancel(ctx))
+		return nil, false, nil
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		// the lock is released with the connection
+		defer conn.Close(context.WithoutCancel(ctx))
+		t := time.NewTicker(pollerLockCheck)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			pingCtx, cancel := context.WithTimeout(ctx, pollerLockCheck)
+			err := conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					db.logger.Errorf("the poller lock connection is lost: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	return lost, true, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats returns the statistics of the connection pool.
+func (db *DB) Stats() models.PoolStats {
+	s := db.pool.Stat()
+	return models.PoolStats{
+		MaxConns:             s.MaxConns(),
+		TotalConns:           s.TotalConns(),
+		AcquiredConns:        s.AcquiredConns(),
+		IdleConns:            s.IdleConns(),
+		AcquireCount:         s.AcquireCount(),
+		EmptyAcquireCount:    s.EmptyAcquireCount(),
+		CanceledAcquireCount: s.CanceledAcquireCount(),
+		AcquireDuration:      s.AcquireDuration(),
+	}
+}
+
+// Ping checks a connection of the pool is available and the database answers.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
+}
+
+// poolCollector exports the statistics of the connection pool when the metrics are scraped.
+type poolCollector struct {
+	db *DB
+
+	maxConns        *prometheus.Desc
+	totalConns      *prometheus.Desc
+	acquiredConns   *prometheus.Desc
+	idleConns       *prometheus.Desc
+	acquires        *prometheus.Desc
+	emptyAcquires   *prometheus.Desc
+	canceledAcquire *prometheus.Desc
+	acquireDuration *prometheus.Desc
+}
+
+// registerPoolCollector registers the collector of the pool statistics in the registry, replacing the one
+// of the repository opened before on the same registry.
+func registerPoolCollector(db *DB, reg *metrics.Registry) {
+	name := func(n string) string { return prometheus.BuildFQName(metrics.Namespace, "db_pool", n) }
+	c := &poolCollector{
+		db:              db,
+		maxConns:        prometheus.NewDesc(name("max_conns"), "Maximum number of connections of the pool.", nil, nil),
+		totalConns:      prometheus.NewDesc(name("total_conns"), "Open connections of the pool.", nil, nil),
+		acquiredConns:   prometheus.NewDesc(name("acquired_conns"), "Connections of the pool in use.", nil, nil),
+		idleConns:       prometheus.NewDesc(name("idle_conns"), "Idle connections of the pool.", nil, nil),
+		acquires:        prometheus.NewDesc(name("acquires_total"), "Connections acquired from the pool.", nil, nil),
+		emptyAcquires:   prometheus.NewDesc(name("empty_acquires_total"), "Acquires waited for a connection as the pool was empty.", nil, nil),
+		canceledAcquire: prometheus.NewDesc(name("canceled_acquires_total"), "Acquires canceled while waiting for a connection.", nil, nil),
+		acquireDuration: prometheus.NewDesc(name("acquire_duration_seconds_total"), "Total time of acquiring the connections.", nil, nil),
+	}
+	reg = reg.OrDiscard()
+	var are prometheus.AlreadyRegisteredError
+	if err := reg.Register(c); errors.As(err, &are) {
+		reg.Unregister(are.ExistingCollector)
+		reg.MustRegister(c)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxConns
+	ch <- c.totalConns
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.acquires
+	ch <- c.emptyAcquires
+	ch <- c.canceledAcquire
+	ch <- c.acquireDuration
+}
+
+// Collect implements prometheus.Collector.
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(s.MaxConns))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(s.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(s.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(s.AcquireCount))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquire, prometheus.CounterValue, float64(s.CanceledAcquireCount))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, s.AcquireDuration.Seconds())
+}
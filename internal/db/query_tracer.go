@@ -2,14 +2,79 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/tracing"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-// queryTracer implements the pgx.Tracer interface to log query execution details.
+// queryTracer implements the pgx.Tracer and pgx.CopyFromTracer interfaces to log query execution details
+// and the slow queries, record the duration and the errors of the queries by their name and trace every query
+// in a span named after it.
 type queryTracer struct {
-	logger *zap.SugaredLogger
+	logger    *zap.SugaredLogger
+	slowQuery time.Duration // queries running longer are logged as slow, 0 disables it
+	duration  *prometheus.HistogramVec
+	errors    *prometheus.CounterVec
+}
+
+// newQueryTracer creates the query tracer logging the queries running longer than slowQuery
+// and registers its metrics in the registry.
+func newQueryTracer(logger *zap.SugaredLogger, reg *metrics.Registry, slowQuery time.Duration) *queryTracer {
+	t := &queryTracer{
+		logger:    logger,
+		slowQuery: slowQuery,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "db",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of the database queries by the query name.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"query"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "db",
+			Name:      "query_errors_total",
+			Help:      "Database queries failed by the query name.",
+		}, []string{"query"}),
+	}
+	// the repository may be opened again on the same registry
+	var are prometheus.AlreadyRegisteredError
+	if err := reg.OrDiscard().Register(t.duration); errors.As(err, &are) {
+		t.duration = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	if err := reg.OrDiscard().Register(t.errors); errors.As(err, &are) {
+		t.errors = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	return t
+}
+
+// queryTraceKey is the context key of the trace of the running query.
+type queryTraceKey struct{}
+
+// queryTrace is the name, the statement, the start time and the span of the running query.
+type queryTrace struct {
+	name  string
+	sql   string
+	start time.Time
+	span  trace.Span
+}
+
+// startTrace starts the trace of the query in the context. The statement is traced without the arguments,
+// as they may hold the users' data.
+func startTrace(ctx context.Context, sql string) context.Context {
+	name := queryName()
+	ctx, span := tracing.Start(ctx, name, trace.SpanKindClient, semconv.DBSystemNamePostgreSQL, semconv.DBQueryText(sql))
+	return context.WithValue(ctx, queryTraceKey{}, queryTrace{name: name, sql: sql, start: time.Now(), span: span})
 }
 
 // TraceQueryStart logs the start of a query execution.
@@ -19,10 +84,74 @@ func (t *queryTracer) TraceQueryStart(
 	data pgx.TraceQueryStartData,
 ) context.Context {
 	t.logger.Debugf("Running query %s (%v)", data.SQL, data.Args)
-	return ctx
+	return startTrace(ctx, data.SQL)
 }
 
-// TraceQueryEnd logs the end of a query execution.
-func (t *queryTracer) TraceQueryEnd(_ context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+// TraceQueryEnd logs the end of a query execution and records its metrics.
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
 	t.logger.Debugf("%v", data.CommandTag)
+	t.observe(ctx, data.Err)
+}
+
+// TraceCopyFromStart logs the start of a copy.
+func (t *queryTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	t.logger.Debugf("Copying to %s (%v)", data.TableName.Sanitize(), data.ColumnNames)
+	sql := fmt.Sprintf("COPY %s (%s) FROM STDIN", data.TableName.Sanitize(), strings.Join(data.ColumnNames, ", "))
+	return startTrace(ctx, sql)
+}
+
+// TraceCopyFromEnd logs the end of a copy and records its metrics.
+func (t *queryTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.logger.Debugf("%v", data.CommandTag)
+	t.observe(ctx, data.Err)
+}
+
+// observe records the duration of the query of the context and its error if it failed, logs it if it is slow
+// and ends its span.
+// The statement is logged without the arguments, as they may hold the users' data.
+func (t *queryTracer) observe(ctx context.Context, err error) {
+	trace, ok := ctx.Value(queryTraceKey{}).(queryTrace)
+	if !ok {
+		return
+	}
+	tracing.End(trace.span, err)
+	elapsed := time.Since(trace.start)
+	t.duration.WithLabelValues(trace.name).Observe(elapsed.Seconds())
+	if err != nil {
+		t.errors.WithLabelValues(trace.name).Inc()
+	}
+	if t.slowQuery > 0 && elapsed > t.slowQuery {
+		t.logger.Warnf("slow query %s took %s: %s", trace.name, elapsed, strings.Join(strings.Fields(trace.sql), " "))
+	}
+}
+
+// dbPackage is the prefix of the functions of the package in the stack.
+const dbPackage = "loyaltySys/internal/db."
+
+// queryName names the query by the method of the package running it, e.g. OrderStore.queryOrders,
+// skipping the tracer and the retries. The queries run outside of the package, e.g. the pool pings, are "other".
+func queryName() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if name, ok := strings.CutPrefix(frame.Function, dbPackage); ok && !isTracingFrame(name) {
+			// the closures are named after the method declaring them
+			if i := strings.Index(name, ".func"); i >= 0 {
+				name = name[:i]
+			}
+			return strings.NewReplacer("(*", "", ")", "").Replace(name)
+		}
+		if !more {
+			return "other"
+		}
+	}
+}
+
+// isTracingFrame reports whether the function of the package only passes the query on.
+func isTracingFrame(name string) bool {
+	return strings.HasPrefix(name, "(*queryTracer)") ||
+		strings.HasPrefix(name, "(*retryPool)") ||
+		strings.HasPrefix(name, "(*retryRow)") ||
+		strings.HasPrefix(name, "(*DB).retry")
 }
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// reportLockKey is the advisory lock taken by the instance refreshing the reporting views,
+// the second key is 0. The two-key lock space does not overlap the user locks.
+const reportLockKey = 3
+
+// RefreshBalanceReport recomputes the balance_report view from the ledger and reports whether it was refreshed,
+// false if another instance is refreshing it. The view is refreshed concurrently with the reads of the reports;
+// the refresh isn't limited by the statement timeout, as it sums the whole ledger.
+func (db *WithdrawalStore) RefreshBalanceReport(ctx context.Context) (bool, error) {
+	db.logger.Debug("Refreshing balance report")
+	var locked bool
+	err := db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// The replicas don't refresh the view one after another
+		if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1, 0)", reportLockKey).Scan(&locked); err != nil {
+			return fmt.Errorf("failed to acquire the report lock: %w", err)
+		}
+		if !locked {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+			return fmt.Errorf("failed to disable the statement timeout: %w", err)
+		}
+		if _, err := tx.Exec(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY balance_report"); err != nil {
+			return fmt.Errorf("failed to refresh balance report: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
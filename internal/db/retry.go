@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// retryPolicy sets how the operations failed with a transient error are retried.
+type retryPolicy struct {
+	attempts int           // the number of attempts, 1 disables the retries
+	base     time.Duration // the delay before the first retry, doubled with every attempt
+	max      time.Duration // caps the delay between the attempts
+}
+
+// defaultRetryPolicy rides out a failover or a burst of lock conflicts within a request.
+var defaultRetryPolicy = retryPolicy{attempts: 3, base: 50 * time.Millisecond, max: time.Second}
+
+// delay returns the delay after the attempt: the exponential backoff with a random half of it as the jitter,
+// so the operations failed together don't retry together.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.base
+	for i := 1; i < attempt && d < p.max; i++ {
+		d *= 2
+	}
+	d = min(d, p.max)
+	return d/2 + rand.N(d/2+1)
+}
+
+// RetryError is returned when the operation still fails with a transient error after all the attempts.
+type RetryError struct {
+	Attempts int
+	Err      error // the error of the last attempt
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("database operation failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient reports whether the operation failed without taking effect and may succeed if retried:
+// a connection exception, a serialization failure or a deadlock, or a connection error before the query was sent.
+func isTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// withTimeout returns the context of a storage call ending after the statement timeout,
+// so a runaway query or a wait for a connection doesn't hold the caller forever.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.poolSettings.StatementTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.poolSettings.StatementTimeout)
+}
+
+// retry runs the operation with the context of the storage call until it succeeds, fails with a permanent error,
+// the attempts run out or the call times out, then the last error is returned as RetryError.
+// The transactions are retried as a whole, the calls nested in a transaction of WithTx are run once.
+func (db *DB) retry(ctx context.Context, op func(ctx context.Context) error) error {
+	// The call nested in a transaction of WithTx fails it, the transaction is retried by its caller
+	if inTx(ctx) {
+		return op(ctx)
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt >= db.retries.attempts {
+			return &RetryError{Attempts: attempt, Err: err}
+		}
+		delay := db.retries.delay(attempt)
+		db.logger.Warnf("transient database error, attempt %d, retrying in %s: %v", attempt, delay, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &RetryError{Attempts: attempt, Err: err}
+		case <-t.C:
+		}
+	}
+}
+
+// retryPool is the connection pool retrying the single statements run outside of the transactions.
+type retryPool struct {
+	*pgxpool.Pool
+	db *DB
+}
+
+// Exec runs the statement with the retries.
+func (p *retryPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := p.db.retry(ctx, func(ctx context.Context) (err error) {
+		tag, err = p.Pool.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+// Query runs the query with the retries, the errors reading the rows are not retried.
+// The rows are read within the deadline of the call, it ends when they are closed.
+func (p *retryPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	ctx, cancel := p.db.withTimeout(ctx)
+	var rows pgx.Rows
+	// The rows outlive the operation, so they are queried with the context of the call, not of the retries
+	err := p.db.retry(ctx, func(context.Context) (err error) {
+		rows, err = p.Pool.Query(ctx, sql, args...)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+// timeoutRows are the rows of Query ending the deadline of the call when closed.
+type timeoutRows struct {
+	pgx.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRows) Close() {
+	r.Rows.Close()
+	r.cancel()
+}
+
+// QueryRow returns the row running the query with the retries when it is scanned.
+func (p *retryPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &retryRow{ctx: ctx, pool: p, sql: sql, args: args}
+}
+
+// retryRow is the row of QueryRow, the query is run again if the scan fails with a transient error.
+type retryRow struct {
+	ctx  context.Context
+	pool *retryPool
+	sql  string
+	args []any
+}
+
+func (r *retryRow) Scan(dest ...any) error {
+	return r.pool.db.retry(r.ctx, func(ctx context.Context) error {
+		return r.pool.Pool.QueryRow(ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// seedPeriod is how far back the generated users are registered.
+const seedPeriod = 90 * 24 * time.Hour
+
+// seedDescriptions are the notes of the generated withdrawals.
+var seedDescriptions = []string{"", "", "Coffee", "Gift card", "Cinema tickets", "Delivery"}
+
+// SeedOptions configures the dataset generated by Seed.
+type SeedOptions struct {
+	Users              int    // users to create
+	OrdersPerUser      int    // orders of every user, in all the statuses, mostly processed
+	WithdrawalsPerUser int    // withdrawals of every user spending a part of the accrued points
+	LoginPrefix        string // the logins are the prefix followed by the number of the user
+	PasswordHash       string // bcrypt hash of the password of all the users
+	RandSeed           int64  // seed of the generator, the same seed generates the same dataset
+}
+
+// SeedResult counts the generated rows.
+type SeedResult struct {
+	Users       int
+	Orders      int
+	Withdrawals int
+}
+
+// Seed fills the tenant of the context with the generated users, their orders in all the statuses with
+// the processing history and their withdrawals, for the local development and the load tests.
+// The balances match the generated rows. Everything is copied in a single transaction, so a failed seed
+// leaves nothing behind; ErrUserAlreadyExists is returned if a login with the prefix is taken.
+// Being a bulk one-off load, the seed runs without the statement timeout and the retries of the storage calls.
+func (db *DB) Seed(ctx context.Context, opts SeedOptions) (*SeedResult, error) {
+	db.logger.Debugf("Seeding %d users with %d orders and %d withdrawals each", opts.Users, opts.OrdersPerUser, opts.WithdrawalsPerUser)
+	if opts.Users <= 0 || opts.OrdersPerUser < 0 || opts.WithdrawalsPerUser < 0 {
+		return nil, errors.New("invalid seed volume: the number of users must be positive, the numbers of orders and withdrawals not negative")
+	}
+	rng := rand.New(rand.NewSource(opts.RandSeed))
+	tenantID, now := tenant.FromContext(ctx), time.Now()
+
+	var result *SeedResult
+	err := db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Create the users registered over the seed period
+		rows, err := tx.Query(ctx, `
+			INSERT INTO users (tenant_id, login, password, created_at)
+			SELECT $1, $2 || i, $3, $4::timestamptz - random() * $5::interval FROM generate_series(1, $6::integer) i
+			RETURNING id, created_at`,
+			tenantID, opts.LoginPrefix, opts.PasswordHash, now, seedPeriod, opts.Users)
+		if err != nil {
+			return fmt.Errorf("failed to create users: %w", err)
+		}
+		type seedUser struct {
+			id        int64
+			createdAt time.Time
+		}
+		users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (seedUser, error) {
+			var u seedUser
+			return u, row.Scan(&u.id, &u.createdAt)
+		})
+		if err != nil {
+			if isErrorDuplicate(err) {
+				return fmt.Errorf("%w: logins with the prefix %q are taken", ErrUserAlreadyExists, opts.LoginPrefix)
+			}
+			return fmt.Errorf("failed to create users: %w", err)
+		}
+
+		// Generate the orders and the withdrawals of every user, the withdrawals spend up to the half
+		// of the accrued points after the last accrual
+		numbers := make(map[string]bool)
+		var (
+			orders      [][]any
+			history     [][]any
+			withdrawals [][]any
+			balances    [][]any
+		)
+		for _, u := range users {
+			var accrued models.Money
+			lastAccrual := u.createdAt
+			for i := 0; i < opts.OrdersPerUser; i++ {
+				number, status := seedOrderNumber(rng, numbers), seedStatus(rng)
+				uploadedAt := u.createdAt.Add(time.Duration(rng.Int63n(int64(now.Sub(u.createdAt)) + 1)))
+				var accrual any
+				history = append(history, []any{number, models.StatusNew, nil, uploadedAt})
+				if status != models.StatusNew {
+					history = append(history, []any{number, models.StatusProcessing, nil, uploadedAt.Add(time.Minute)})
+				}
+				switch status {
+				case models.StatusProcessed:
+					sum := models.Money(100 + rng.Int63n(50000))
+					accrual, accrued = sum, accrued+sum
+					if at := uploadedAt.Add(2 * time.Minute); at.After(lastAccrual) {
+						lastAccrual = at
+					}
+					history = append(history, []any{number, status, sum, uploadedAt.Add(2 * time.Minute)})
+				case models.StatusInvalid:
+					history = append(history, []any{number, status, nil, uploadedAt.Add(2 * time.Minute)})
+				}
+				orders = append(orders, []any{number, u.id, tenantID, status, accrual, uploadedAt})
+			}
+
+			var withdrawn models.Money
+			if opts.WithdrawalsPerUser > 0 {
+				share := accrued / 2 / models.Money(opts.WithdrawalsPerUser)
+				for i := 0; share > 0 && i < opts.WithdrawalsPerUser; i++ {
+					sum := 1 + models.Money(rng.Int63n(int64(share)))
+					at := lastAccrual.Add(time.Duration(rng.Int63n(int64(now.Sub(lastAccrual)) + 1)))
+					withdrawals = append(withdrawals, []any{seedOrderNumber(rng, numbers), u.id, tenantID, sum, at,
+						seedDescriptions[rng.Intn(len(seedDescriptions))]})
+					withdrawn += sum
+				}
+			}
+			balances = append(balances, []any{u.id, accrued - withdrawn, withdrawn})
+		}
+
+		// Copy the generated rows, the balances are kept with them like changeBalance does
+		for _, c := range []struct {
+			table   string
+			columns []string
+			rows    [][]any
+		}{
+			{"orders", []string{"order_number", "user_id", "tenant_id", "status", "accrual", "uploaded_at"}, orders},
+			{"order_history", []string{"order_number", "status", "accrual", "changed_at"}, history},
+			{"withdrawals", []string{"order_number", "user_id", "tenant_id", "summ", "processed_at", "description"}, withdrawals},
+			{"balances", []string{"user_id", "current", "withdrawn"}, balances},
+		} {
+			if _, err := tx.CopyFrom(ctx, pgx.Identifier{c.table}, c.columns, pgx.CopyFromRows(c.rows)); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", c.table, err)
+			}
+		}
+		result = &SeedResult{Users: len(users), Orders: len(orders), Withdrawals: len(withdrawals)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// seedStatus returns a random order status: 70% of the orders are processed, 10% of each other status.
+func seedStatus(rng *rand.Rand) models.OrderStatus {
+	switch rng.Intn(10) {
+	case 0:
+		return models.StatusNew
+	case 1:
+		return models.StatusProcessing
+	case 2:
+		return models.StatusInvalid
+	default:
+		return models.StatusProcessed
+	}
+}
+
+// seedOrderNumber returns a random 12-digit number passing the Luhn check, unique among the generated ones.
+func seedOrderNumber(rng *rand.Rand, used map[string]bool) string {
+	for {
+		digits := []byte(strconv.FormatInt(1e10+rng.Int63n(9e10), 10))
+		sum := 0
+		// the check digit is appended, so the doubling starts from the last digit of the payload
+		for i := len(digits) - 1; i >= 0; i -= 2 {
+			d := int(digits[i]-'0') * 2
+			if d > 9 {
+				d -= 9
+			}
+			sum += d
+			if i > 0 {
+				sum += int(digits[i-1] - '0')
+			}
+		}
+		number := string(append(digits, byte('0'+(10-sum%10)%10)))
+		if !used[number] {
+			used[number] = true
+			return number
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/models"
+	"time"
+)
+
+// snapshotDayLayout is the format of the snapshot day.
+const snapshotDayLayout = "2006-01-02"
+
+// SnapshotBalances records the balances of all the users at the end of the day (UTC) and returns the number of
+// the recorded snapshots. The balance is calculated from the ledger, so a past day can be recorded later,
+// the snapshots already recorded for the day are kept.
+func (db *WithdrawalStore) SnapshotBalances(ctx context.Context, day time.Time) (int64, error) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	db.logger.Debugf("Taking balance snapshots for %s", day.Format(snapshotDayLayout))
+	// an accrual takes place when the order is processed
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO balance_snapshots (user_id, day, current, withdrawn)
+		SELECT u.id, $1::date, COALESCE(a.sum, 0) + COALESCE(adj.sum, 0) - COALESCE(w.sum, 0), COALESCE(w.sum, 0)
+		FROM users u
+		LEFT JOIN LATERAL (
+			SELECT SUM(o.accrual) AS sum FROM orders o
+			WHERE o.user_id = u.id AND o.status = 'PROCESSED' AND o.deleted_at IS NULL
+				AND COALESCE((SELECT MAX(h.changed_at) FROM order_history h
+					WHERE h.order_number = o.order_number AND h.status = 'PROCESSED'), o.uploaded_at) < $2
+		) a ON true
+		LEFT JOIN LATERAL (
+			SELECT SUM(summ) AS sum FROM withdrawals WHERE user_id = u.id AND processed_at < $2
+		) w ON true
+		LEFT JOIN LATERAL (
+			SELECT SUM(amount) AS sum FROM balance_adjustments WHERE user_id = u.id AND created_at < $2
+		) adj ON true
+		WHERE u.created_at < $2 AND u.deleted_at IS NULL
+		ON CONFLICT (user_id, day) DO NOTHING`, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to take balance snapshots: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetLastSnapshotDay returns the last day the balances were recorded for, the zero time if there is none.
+func (db *WithdrawalStore) GetLastSnapshotDay(ctx context.Context) (time.Time, error) {
+	db.logger.Debug("Getting last balance snapshot day")
+	var day *time.Time
+	if err := db.pool.QueryRow(ctx, "SELECT MAX(day) FROM balance_snapshots").Scan(&day); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last snapshot day: %w", err)
+	}
+	if day == nil {
+		return time.Time{}, nil
+	}
+	return *day, nil
+}
+
+// GetBalanceHistory returns the user's daily balances between the days of from and to, oldest first.
+// The zero from and to don't limit the range.
+func (db *WithdrawalStore) GetBalanceHistory(ctx context.Context, userID int64, from, to time.Time) ([]models.BalanceSnapshot, error) {
+	db.logger.Debugf("Getting balance history for user %d", userID)
+	args := []any{userID}
+	query := "SELECT day, current, withdrawn FROM balance_snapshots WHERE user_id = $1"
+	if !from.IsZero() {
+		args = append(args, from.UTC().Format(snapshotDayLayout))
+		query += fmt.Sprintf(" AND day >= $%d::date", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to.UTC().Format(snapshotDayLayout))
+		query += fmt.Sprintf(" AND day <= $%d::date", len(args))
+	}
+	rows, err := db.pool.Query(ctx, query+" ORDER BY day", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance history: %w", err)
+	}
+	defer rows.Close()
+	history := []models.BalanceSnapshot{}
+	for rows.Next() {
+		var day time.Time
+		s := models.BalanceSnapshot{}
+		if err := rows.Scan(&day, &s.Current, &s.Withdrawn); err != nil {
+			return nil, fmt.Errorf("failed to scan balance snapshot: %w", err)
+		}
+		s.Date = day.Format(snapshotDayLayout)
+		history = append(history, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get balance history: %w", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/tenant"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DeleteUser soft-deletes the user's account: the user can't log in anymore and the orders of the user
+// are no longer processed, while the rows referenced by the orders, the withdrawals and the audit are kept.
+func (db *UserStore) DeleteUser(ctx context.Context, userID int64) error {
+	db.logger.Debugf("Deleting user %d", userID)
+	return db.setUserDeleted(ctx, userID, true)
+}
+
+// RestoreUser restores the soft-deleted user's account with its orders and balance.
+func (db *UserStore) RestoreUser(ctx context.Context, userID int64) error {
+	db.logger.Debugf("Restoring user %d", userID)
+	return db.setUserDeleted(ctx, userID, false)
+}
+
+// setUserDeleted marks the active user deleted or the deleted user active,
+// ErrUserNotFound is returned if there is no such user.
+func (db *UserStore) setUserDeleted(ctx context.Context, userID int64, deleted bool) error {
+	query := "UPDATE users SET deleted_at = now() WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL"
+	if !deleted {
+		query = "UPDATE users SET deleted_at = NULL WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL"
+	}
+	tag, err := db.pool.Exec(ctx, query, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to update a user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RemoveOrder soft-deletes the order of any user in any status for moderation,
+// the accrual of the processed order is taken back from the user's balance.
+func (db *OrderStore) RemoveOrder(ctx context.Context, number string) error {
+	db.logger.Debugf("Removing order %s", number)
+	return db.retry(ctx, func(ctx context.Context) error { return db.setOrderDeleted(ctx, number, true) })
+}
+
+// RestoreOrder restores the soft-deleted order, the accrual of the processed order is credited again.
+func (db *OrderStore) RestoreOrder(ctx context.Context, number string) error {
+	db.logger.Debugf("Restoring order %s", number)
+	return db.retry(ctx, func(ctx context.Context) error { return db.setOrderDeleted(ctx, number, false) })
+}
+
+// setOrderDeleted runs the transaction of RemoveOrder and RestoreOrder.
+func (db *OrderStore) setOrderDeleted(ctx context.Context, number string, deleted bool) error {
+	return db.WithTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		// Lock the order, so the accrual service can't change it meanwhile
+		query := "SELECT user_id, status, COALESCE(accrual, 0) FROM orders WHERE order_number = $1 AND tenant_id = $2 AND deleted_at IS NULL FOR UPDATE"
+		if !deleted {
+			query = "SELECT user_id, status, COALESCE(accrual, 0) FROM orders WHERE order_number = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL FOR UPDATE"
+		}
+		var (
+			userID  int64
+			status  models.OrderStatus
+			accrual models.Money
+		)
+		err := tx.QueryRow(ctx, query, number, tenant.FromContext(ctx)).Scan(&userID, &status, &accrual)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get an order status: %w", err)
+		}
+
+		if status == models.StatusProcessed && accrual > 0 {
+			credit := accrual
+			if deleted {
+				// Serialize with the user's withdrawals, the points may be spent already
+				if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", userID); err != nil {
+					return fmt.Errorf("failed to acquire advisory lock for user %d: %w", userID, err)
+				}
+				balance, err := db.loadBalance(ctx, tx, userID)
+				if err != nil {
+					return err
+				}
+				if balance.Current < accrual {
+					db.logger.Debugf("insufficient balance: %s < %s", balance.Current, accrual)
+					return ErrInsufficientBalance
+				}
+				credit = -accrual
+			}
+			if err := db.changeBalance(ctx, tx, userID, credit, 0); err != nil {
+				return err
+			}
+		}
+
+		query = "UPDATE orders SET deleted_at = now() WHERE order_number = $1"
+		if !deleted {
+			query = "UPDATE orders SET deleted_at = NULL WHERE order_number = $1"
+		}
+		if _, err := tx.Exec(ctx, query, number); err != nil {
+			return fmt.Errorf("failed to update an order: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"fmt"
+	"loyaltySys/internal/models"
+)
+
+// The sort fields of the lists mapped to their SQL expressions, only these get into ORDER BY.
+var (
+	orderSortColumns = map[string]string{
+		"":                    "uploaded_at",
+		models.SortUploadedAt: "uploaded_at",
+		models.SortAccrual:    "COALESCE(accrual, 0)",
+	}
+	withdrawalSortColumns = map[string]string{
+		"":                     "processed_at",
+		models.SortProcessedAt: "processed_at",
+		models.SortSum:         "summ",
+	}
+)
+
+// sortColumn returns the SQL expression of the sort field and the direction, descending by default.
+func sortColumn(columns map[string]string, s models.Sort) (column, dir string, err error) {
+	column, ok := columns[s.Field]
+	if !ok {
+		return "", "", fmt.Errorf("unknown sort field %q", s.Field)
+	}
+	switch s.Order {
+	case "", models.SortDesc:
+		return column, "DESC", nil
+	case models.SortAsc:
+		return column, "ASC", nil
+	}
+	return "", "", fmt.Errorf("unknown sort order %q", s.Order)
+}
@@ -0,0 +1,36 @@
+package db
+
+// The storage methods are grouped by the domain into the stores sharing the connection pool of DB,
+// so their users depend on the methods of their domain only.
+
+// UserStore stores the users, their phone numbers and the one-time login codes.
+type UserStore struct{ *DB }
+
+// OrderStore stores the orders and their processing history.
+type OrderStore struct{ *DB }
+
+// WithdrawalStore stores the balances, the withdrawals, the adjustments and the daily balance snapshots.
+type WithdrawalStore struct{ *DB }
+
+// WebhookStore stores the users' webhooks and the queue of their deliveries.
+type WebhookStore struct{ *DB }
+
+// Users returns the store of the users.
+func (db *DB) Users() *UserStore {
+	return &UserStore{db}
+}
+
+// Orders returns the store of the orders.
+func (db *DB) Orders() *OrderStore {
+	return &OrderStore{db}
+}
+
+// Withdrawals returns the store of the balances and the withdrawals.
+func (db *DB) Withdrawals() *WithdrawalStore {
+	return &WithdrawalStore{db}
+}
+
+// Webhooks returns the store of the webhooks.
+func (db *DB) Webhooks() *WebhookStore {
+	return &WebhookStore{db}
+}
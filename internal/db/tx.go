@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// txKey is the context key of the transaction WithTx runs the function in.
+type txKey struct{}
+
+// WithTx runs the function in a transaction, committed if the function returns nil and rolled back otherwise;
+// the error of the function is returned as it is. The context passed to the function carries the transaction:
+// WithTx called with it runs the nested function in a savepoint of the same transaction, so the operations
+// built on WithTx compose into a single transaction that is committed by the outermost one.
+func (db *DB) WithTx(ctx context.Context, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	begin := db.pool.Begin
+	if outer, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		begin = outer.Begin
+	}
+	// Begin a new transaction
+	tx, err := begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			db.logger.Errorf("failed to rollback a transaction: %v", err)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, txKey{}, tx), tx); err != nil {
+		return err
+	}
+
+	// Commit the transaction, the nested one releases its savepoint
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit a transaction: %w", err)
+	}
+	return nil
+}
+
+// inTx reports whether the context carries the transaction of WithTx.
+func inTx(ctx context.Context) bool {
+	_, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return ok
+}
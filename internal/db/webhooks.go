@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateWebhook registers the webhook unless the user already has the limit of them.
+func (db *WebhookStore) CreateWebhook(ctx context.Context, webhook *models.Webhook, limit int) error {
+	db.logger.Debugf("Creating webhook for user %d", webhook.UserID)
+	// Insert the webhook only if the user has less than the limit of them
+	err := db.pool.QueryRow(ctx, `
+		INSERT INTO webhooks (user_id, url, secret, events)
+		SELECT $1, $2, $3, $4
+		WHERE (SELECT count(*) FROM webhooks WHERE user_id = $1) < $5
+		RETURNING id, created_at`,
+		webhook.UserID, webhook.URL, webhook.Secret, webhook.Events, limit).Scan(&webhook.ID, &webhook.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTooManyWebhooks
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create a webhook: %w", err)
+	}
+	return nil
+}
+
+// GetWebhooks gets the user's webhooks without the secrets and returns them.
+func (db *WebhookStore) GetWebhooks(ctx context.Context, userID int64) ([]models.Webhook, error) {
+	db.logger.Debugf("Getting webhooks for user %d", userID)
+	rows, err := db.pool.Query(ctx, "SELECT id, url, events, created_at FROM webhooks WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+	// Scan the webhooks
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		w := models.Webhook{UserID: userID}
+		if err := rows.Scan(&w.ID, &w.URL, &w.Events, &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the user's webhook with its deliveries and returns an error if it is not found.
+func (db *WebhookStore) DeleteWebhook(ctx context.Context, userID, webhookID int64) error {
+	db.logger.Debugf("Deleting webhook %d of user %d", webhookID, userID)
+	tag, err := db.pool.Exec(ctx, "DELETE FROM webhooks WHERE id = $1 AND user_id = $2", webhookID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete a webhook: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// GetWebhookDeliveries gets the latest deliveries of the user's webhook and returns an error if it is not found.
+func (db *WebhookStore) GetWebhookDeliveries(ctx context.Context, userID, webhookID int64, limit int) ([]models.WebhookDelivery, error) {
+	db.logger.Debugf("Getting deliveries of webhook %d of user %d", webhookID, userID)
+	// Check the webhook belongs to the user
+	var exists bool
+	if err := db.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND user_id = $2)", webhookID, userID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to get a webhook: %w", err)
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, webhook_id, event, payload, status, attempts, COALESCE(response_code, 0), COALESCE(last_error, ''),
+		       created_at, next_attempt_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	// Scan the deliveries
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError,
+			&d.CreatedAt, &d.NextAttemptAt, &d.DeliveredAt); err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// ClaimWebhookDeliveries takes the due pending deliveries for the lease, so other workers skip them
+// until the lease expires, and returns them with the webhook URLs and secrets.
+func (db *WebhookStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	db.logger.Debug("Claiming webhook deliveries")
+	rows, err := db.pool.Query(ctx, `
+		WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'PENDING' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + make_interval(secs => $2)
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.created_at, w.url, w.secret`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	// Scan the deliveries
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret); err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery records the outcome of the delivery attempt.
+func (db *WebhookStore) UpdateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	db.logger.Debugf("Updating webhook delivery %d", d.ID)
+	_, err := db.pool.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_code = NULLIF($4, 0), last_error = NULLIF($5, ''),
+		    next_attempt_at = $6, delivered_at = $7
+		WHERE id = $1`,
+		d.ID, d.Status, d.Attempts, d.ResponseCode, d.LastError, d.NextAttemptAt, d.DeliveredAt)
+	if err != nil {
+		return fmt.Errorf("failed to update a webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// enqueueWebhookEvent queues the event for delivery to the user's webhooks subscribed to it
+// within the transaction that caused it.
+func (db *DB) enqueueWebhookEvent(ctx context.Context, tx pgx.Tx, userID int64, event string, at time.Time, data any) error {
+	payload, err := json.Marshal(models.WebhookPayload{Event: event, At: at, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode a webhook payload: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $2, $3 FROM webhooks WHERE user_id = $1 AND $2 = ANY(events)`,
+		userID, event, payload); err != nil {
+		return fmt.Errorf("failed to enqueue a webhook event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package dispatch
+
+import "loyaltySys/internal/models"
+
+// DefaultSize is the number of the uploaded orders the queue holds for the accrual service.
+const DefaultSize = 1024
+
+// Queue hands the orders uploaded to this instance over to the accrual service, so they are requested
+// at once instead of on the next poll. The hand-over is best-effort: the orders pushed to the full queue
+// are dropped and left for the poll, which stays the fallback sweeping all the unprocessed orders.
+type Queue struct {
+	ch chan models.Order
+}
+
+// NewQueue creates a queue holding up to size orders.
+func NewQueue(size int) *Queue {
+	return &Queue{ch: make(chan models.Order, size)}
+}
+
+// Push adds the order to the queue without blocking and reports whether it was queued.
+func (q *Queue) Push(order models.Order) bool {
+	select {
+	case q.ch <- order:
+		return true
+	default:
+		return false
+	}
+}
+
+// C returns the channel the queued orders are received from.
+func (q *Queue) C() <-chan models.Order {
+	return q.ch
+}
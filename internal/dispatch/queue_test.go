@@ -0,0 +1,20 @@
+package dispatch
+
+import (
+	"loyaltySys/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(2)
+	assert.True(t, q.Push(models.Order{Number: "1"}))
+	assert.True(t, q.Push(models.Order{Number: "2"}))
+	// the full queue doesn't block the uploads, the order is left for the poll
+	assert.False(t, q.Push(models.Order{Number: "3"}))
+
+	assert.Equal(t, "1", (<-q.C()).Number)
+	assert.Equal(t, "2", (<-q.C()).Number)
+	assert.Empty(t, q.C())
+}
@@ -0,0 +1,67 @@
+package docs
+
+import (
+	_ "embed"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	swaggerFiles "github.com/swaggo/files"
+)
+
+var (
+	//go:embed openapi.yaml
+	spec []byte
+	//go:embed index.html
+	index []byte
+)
+
+// startedAt is the modification time reported for the embedded files.
+var startedAt = time.Now()
+
+// NewRouter creates the router serving the OpenAPI document and the Swagger UI,
+// it is meant to be mounted at /api/docs.
+func NewRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", serveIndex)
+	r.Get("/openapi.yaml", serveSpec)
+	r.Get("/*", serveAsset)
+	return r
+}
+
+// serveIndex serves the Swagger UI page loading the OpenAPI document.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	// the page refers to the assets by relative paths
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(index)
+}
+
+// serveSpec serves the OpenAPI document.
+func serveSpec(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(spec)
+}
+
+// serveAsset serves the Swagger UI scripts, styles and images.
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + chi.URLParam(r, "*"))
+	f, err := swaggerFiles.HTTP.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, startedAt, f)
+}
@@ -0,0 +1,92 @@
+package docs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewRouter(t *testing.T) {
+	r := chi.NewRouter()
+	r.Mount("/api/docs", NewRouter())
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	tests := []struct {
+		name            string
+		path            string
+		wantCode        int
+		wantContentType string
+	}{
+		{name: "index", path: "/api/docs/", wantCode: http.StatusOK, wantContentType: "text/html; charset=utf-8"},
+		{name: "index_redirect", path: "/api/docs", wantCode: http.StatusMovedPermanently},
+		{name: "spec", path: "/api/docs/openapi.yaml", wantCode: http.StatusOK, wantContentType: "application/yaml"},
+		{name: "asset", path: "/api/docs/swagger-ui-bundle.js", wantCode: http.StatusOK, wantContentType: "text/javascript; charset=utf-8"},
+		{name: "unknown_asset", path: "/api/docs/missing.js", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get(srv.URL + tt.path)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantContentType != "" {
+				assert.Equal(t, tt.wantContentType, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSpec(t *testing.T) {
+	var doc struct {
+		OpenAPI string                    `yaml:"openapi"`
+		Paths   map[string]map[string]any `yaml:"paths"`
+	}
+	require.NoError(t, yaml.Unmarshal(spec, &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	// the routes of the API router have to be documented
+	routes := map[string][]string{
+		"/api/meta":                          {"get"},
+		"/api/graphql":                       {"post"},
+		"/api/user/register":                 {"post"},
+		"/api/user/login":                    {"post"},
+		"/api/user/otp":                      {"post"},
+		"/api/user/login/otp":                {"post"},
+		"/api/user/phone":                    {"put"},
+		"/api/user/tokens/readonly":          {"post"},
+		"/api/user/orders":                   {"get", "post"},
+		"/api/user/orders/events":            {"get"},
+		"/api/user/orders/{number}":          {"get", "delete"},
+		"/api/user/orders/status":            {"post"},
+		"/api/user/balance":                  {"get"},
+		"/api/user/balance/history":          {"get"},
+		"/api/user/balance/withdraw":         {"post"},
+		"/api/user/balance/withdraw/batch":   {"post"},
+		"/api/user/withdrawals":              {"get"},
+		"/api/user/transactions":             {"get"},
+		"/api/user/ws":                       {"get"},
+		"/api/user/webhooks":                 {"get", "post"},
+		"/api/user/webhooks/{id}":            {"delete"},
+		"/api/user/webhooks/{id}/deliveries": {"get"},
+		"/api/admin/users":                   {"get"},
+		"/api/admin/users/{id}":              {"get"},
+		"/api/admin/users/{id}/orders":       {"get"},
+		"/api/admin/users/{id}/balance":      {"get"},
+		"/api/admin/users/{id}/withdrawals":  {"get"},
+		"/api/admin/users/{id}/adjustments":  {"post"},
+		"/api/admin/orders/{number}/requeue": {"post"},
+		"/api/admin/stats":                   {"get"},
+	}
+	for path, methods := range routes {
+		for _, m := range methods {
+			assert.Contains(t, doc.Paths[path], m, "%s %s is not documented", m, path)
+		}
+	}
+}
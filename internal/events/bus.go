@@ -0,0 +1,58 @@
+package events
+
+import (
+	"loyaltySys/internal/models"
+	"sync"
+)
+
+// subscriberBuffer is the number of events buffered for a slow subscriber before they are dropped.
+const subscriberBuffer = 16
+
+// Bus delivers the events published by the accrual service and the handlers to the subscribed users' streams.
+// Delivery is best-effort: the events are not persisted and are dropped for subscribers that don't keep up.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[int64]map[chan models.Event]struct{}
+}
+
+// NewBus creates an empty event bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int64]map[chan models.Event]struct{})}
+}
+
+// Publish sends the event to the subscribers of its recipient without blocking.
+func (b *Bus) Publish(e models.Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs[e.Recipient()] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the channel of the user's events and the function to unsubscribe,
+// which closes the channel.
+func (b *Bus) Subscribe(userID int64) (<-chan models.Event, func()) {
+	ch := make(chan models.Event, subscriberBuffer)
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan models.Event]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs[userID], ch)
+			if len(b.subs[userID]) == 0 {
+				delete(b.subs, userID)
+			}
+			close(ch)
+		})
+	}
+}
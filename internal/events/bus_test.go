@@ -0,0 +1,42 @@
+package events
+
+import (
+	"loyaltySys/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	ch1, cancel1 := b.Subscribe(1)
+	ch2, cancel2 := b.Subscribe(1)
+	other, cancelOther := b.Subscribe(2)
+	defer cancelOther()
+
+	e := models.OrderEvent{UserID: 1, Number: "9278923470", Status: models.StatusProcessed}
+	b.Publish(e)
+	assert.Equal(t, models.Event(e), <-ch1)
+	assert.Equal(t, models.Event(e), <-ch2)
+	w := models.WithdrawalEvent{UserID: 1, Order: "2377225624", Sum: models.MoneyFromFloat(100)}
+	b.Publish(w)
+	assert.Equal(t, models.Event(w), <-ch1)
+	assert.Equal(t, models.Event(w), <-ch2)
+	assert.Empty(t, other, "events of other users must not be delivered")
+
+	// unsubscribing closes the channel and is idempotent
+	cancel1()
+	cancel1()
+	_, ok := <-ch1
+	assert.False(t, ok)
+	b.Publish(e)
+	assert.Equal(t, models.Event(e), <-ch2)
+
+	// a slow subscriber doesn't block the publisher
+	for i := 0; i < subscriberBuffer*2; i++ {
+		b.Publish(e)
+	}
+	assert.Len(t, ch2, subscriberBuffer)
+	cancel2()
+	assert.Empty(t, b.subs[1])
+}
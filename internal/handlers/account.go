@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/problem"
+	"net/http"
+)
+
+// RequireActiveUser is a middleware rejecting the tokens of the deleted accounts,
+// so the account deletion takes effect at once instead of when the tokens expire.
+func (h *Handler) RequireActiveUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		if _, err := h.users.GetUserRole(r.Context(), userID); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				log.Warnf("user %d is deleted, access to %s is denied", userID, r.URL.Path)
+				h.httpError(w, r, "User not found", http.StatusUnauthorized, problem.Unauthorized)
+				return
+			}
+			log.Error("failed to get user role: ", err)
+			h.storageError(w, r, "Failed to get user", err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DeleteAccount deletes the user's own account, the orders and the withdrawals are kept for the audit.
+func (h *Handler) DeleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Deleting account request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		if err := h.users.DeleteUser(r.Context(), userID); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				log.Error("user not found: ", err)
+				h.httpError(w, r, "User not found", http.StatusNotFound, problem.UserNotFound)
+				return
+			}
+			log.Error("failed to delete user: ", err)
+			h.storageError(w, r, "Failed to delete account", err)
+			return
+		}
+		log.Infof("user %d deleted the account", userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
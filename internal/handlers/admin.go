@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxAdminReason is the maximum length of the reason of an admin's change in characters.
+const maxAdminReason = 255
+
+// RequireAdmin is a middleware rejecting requests of the users without the admin role.
+// The role is checked in the database, so a demoted admin loses the access at once.
+func (h *Handler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		role, err := h.users.GetUserRole(r.Context(), userID)
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+			log.Error("failed to get user role: ", err)
+			h.storageError(w, r, "Failed to get user role", err)
+			return
+		}
+		if role != models.RoleAdmin {
+			log.Warnf("user %d is not an admin, access to %s is denied", userID, r.URL.Path)
+			h.httpError(w, r, "Admin role is required", http.StatusForbidden, problem.AdminRequired)
+			return
+		}
+		// Keep a trail of the admins' access to the users' data
+		log.Infof("admin %d: %s %s", userID, r.Method, r.URL.RequestURI())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminGetUsers returns a page of the users, latest first, optionally filtered by the login,
+// the deleted users are listed with deleted=true.
+func (h *Handler) AdminGetUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting users request")
+
+		// Parse the page and the filter from the query
+		q := r.URL.Query()
+		uq := models.UserQuery{Login: q.Get("login")}
+		var err error
+		if v := q.Get("deleted"); v != "" {
+			if uq.Deleted, err = strconv.ParseBool(v); err != nil {
+				log.Error("invalid deleted filter: ", err)
+				h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+				return
+			}
+		}
+		if uq.Limit, err = parseLimit(q); err != nil {
+			log.Error("invalid users limit: ", err)
+			h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if uq.Limit == 0 {
+			uq.Limit = maxPageLimit
+		}
+		if v := q.Get("cursor"); v != "" {
+			if uq.After, err = decodeCursor(v); err != nil {
+				log.Error("invalid users cursor: ", err)
+				h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+				return
+			}
+			if _, err := strconv.ParseInt(uq.After.Key, 10, 64); err != nil {
+				log.Error("invalid users cursor key: ", err)
+				h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+				return
+			}
+		}
+		// Request one more user to know if there is the next page
+		limit := uq.Limit
+		uq.Limit++
+		users, err := h.users.SearchUsers(r.Context(), uq)
+		if err != nil {
+			log.Error("failed to search users: ", err)
+			h.storageError(w, r, "Failed to get users", err)
+			return
+		}
+		if len(users) > limit {
+			users = users[:limit]
+			last := users[limit-1]
+			w.Header().Set(nextCursorHeader, encodeCursor(models.Cursor{At: last.CreatedAt, Key: strconv.FormatInt(last.ID, 10)}))
+		}
+		// Return 204 if no users found - no content
+		if len(users) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, users)
+	}
+}
+
+// AdminGetUser returns the user's account.
+func (h *Handler) AdminGetUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting user request")
+
+		user, ok := h.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, user)
+	}
+}
+
+// AdminGetUserOrders returns the user's orders, latest first, with the same filter and page as the user's own list.
+func (h *Handler) AdminGetUserOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting user orders request")
+
+		// Parse the filter and the page from the query
+		filter, err := parseOrderFilter(r.URL.Query())
+		if err != nil {
+			log.Error("invalid orders filter: ", err)
+			h.httpError(w, r, "Invalid filter", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		page, err := parseOrderPage(r.URL.Query(), filter.Sort)
+		if err != nil {
+			log.Error("invalid orders page: ", err)
+			h.httpError(w, r, "Invalid filter", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		user, ok := h.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		orders, err := h.getOrders(w, r, user.ID, filter, page)
+		if err != nil {
+			log.Error("failed to get orders: ", err)
+			h.storageError(w, r, "Failed to get orders", err)
+			return
+		}
+		if len(orders) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, orders)
+	}
+}
+
+// AdminGetUserBalance returns the user's balance.
+func (h *Handler) AdminGetUserBalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting user balance request")
+
+		user, ok := h.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		balance, err := h.withdrawals.GetBalance(r.Context(), user.ID)
+		if err != nil {
+			log.Error("failed to get balance: ", err)
+			h.storageError(w, r, "Failed to get balance", err)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, balance)
+	}
+}
+
+// AdminGetUserWithdrawals returns a page of the user's withdrawals, latest first,
+// with the same query as the user's own list.
+func (h *Handler) AdminGetUserWithdrawals() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting user withdrawals request")
+
+		// Parse the page and the filter from the query
+		q, err := parseWithdrawalQuery(r.URL.Query())
+		if err != nil {
+			log.Error("invalid withdrawals query: ", err)
+			h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		user, ok := h.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		withdrawals, err := h.getWithdrawals(w, r, user.ID, q)
+		if err != nil {
+			log.Error("failed to get withdrawals: ", err)
+			h.storageError(w, r, "Failed to get withdrawals", err)
+			return
+		}
+		if len(withdrawals) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, withdrawals)
+	}
+}
+
+// AdminGetStats returns the operational summary for the dashboards.
+func (h *Handler) AdminGetStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting stats request")
+
+		stats, err := h.orders.GetStats(r.Context())
+		if err != nil {
+			log.Error("failed to get stats: ", err)
+			h.storageError(w, r, "Failed to get stats", err)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, stats)
+	}
+}
+
+// AdminGetOrderAccrualResponses returns the raw responses of the accrual service about the order, oldest first,
+// to investigate the disputes about the awarded points.
+func (h *Handler) AdminGetOrderAccrualResponses() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting order accrual responses request")
+
+		number := chi.URLParam(r, "number")
+		if ok, err := auth.ValidateOrderNumber(number); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
+			return
+		}
+		responses, err := h.orders.GetAccrualResponses(r.Context(), number)
+		if err != nil {
+			if errors.Is(err, db.ErrOrderNotFound) {
+				log.Error("order not found: ", err)
+				h.httpError(w, r, "Order not found", http.StatusNotFound, problem.OrderNotFound)
+				return
+			}
+			log.Error("failed to get accrual responses: ", err)
+			h.storageError(w, r, "Failed to get accrual responses", err)
+			return
+		}
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, responses)
+	}
+}
+
+// AdminGetDeadLetterOrders returns a page of the orders the accrual service gave up on, latest first,
+// with the reasons of the failures, for the manual handling.
+func (h *Handler) AdminGetDeadLetterOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin getting dead-lettered orders request")
+
+		// Parse the page from the query
+		q := r.URL.Query()
+		var page models.Page
+		var err error
+		if page.Limit, err = parseLimit(q); err != nil {
+			log.Error("invalid dead-lettered orders limit: ", err)
+			h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if page.Limit == 0 {
+			page.Limit = maxPageLimit
+		}
+		if v := q.Get("cursor"); v != "" {
+			if page.After, err = decodeCursor(v); err != nil {
+				log.Error("invalid dead-lettered orders cursor: ", err)
+				h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+				return
+			}
+		}
+		// Request one more order to know if there is the next page
+		limit := page.Limit
+		page.Limit++
+		orders, err := h.orders.GetDeadLetterOrders(r.Context(), page)
+		if err != nil {
+			log.Error("failed to get dead-lettered orders: ", err)
+			h.storageError(w, r, "Failed to get dead-lettered orders", err)
+			return
+		}
+		if len(orders) > limit {
+			orders = orders[:limit]
+			last := orders[limit-1]
+			w.Header().Set(nextCursorHeader, encodeCursor(models.Cursor{At: last.DeadLetteredAt, Key: last.Number}))
+		}
+		if len(orders) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, orders)
+	}
+}
+
+// AdminCreateAdjustment credits or debits the user's balance with the reason of the correction.
+func (h *Handler) AdminCreateAdjustment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin adjusting user balance request")
+
+		// Get the admin ID from the context
+		adminID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid user ID: ", err)
+			h.httpError(w, r, "Invalid user ID", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Decode the request body into an Adjustment struct
+		adj := models.Adjustment{}
+		if err := json.NewDecoder(r.Body).Decode(&adj); err != nil {
+			log.Error("failed to decode adjustment: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Check the amount and the reason
+		if adj.Amount == 0 {
+			log.Error("zero adjustment amount")
+			h.httpError(w, r, "Amount must not be zero", http.StatusUnprocessableEntity, problem.ValidationFailed)
+			return
+		}
+		adj.Reason = strings.TrimSpace(adj.Reason)
+		if !h.validAdminReason(w, r, adj.Reason) {
+			return
+		}
+		adj.ID, adj.UserID, adj.AdminID = 0, userID, adminID
+		// Record the adjustment
+		if err := h.withdrawals.CreateAdjustment(r.Context(), &adj); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				log.Error("user not found: ", err)
+				h.httpError(w, r, "User not found", http.StatusNotFound, problem.UserNotFound)
+				return
+			}
+			if errors.Is(err, db.ErrInsufficientBalance) {
+				log.Error("insufficient balance: ", err)
+				h.httpError(w, r, "Insufficient balance", http.StatusPaymentRequired, problem.InsufficientBalance)
+				return
+			}
+			log.Error("failed to create adjustment: ", err)
+			h.storageError(w, r, "Failed to adjust balance", err)
+			return
+		}
+		log.Infof("admin %d adjusted balance of user %d by %.2f: %s", adminID, userID, adj.Amount.Float64(), adj.Reason)
+		h.respondJSON(w, r, http.StatusCreated, adj)
+	}
+}
+
+// AdminRequeueOrder sends the invalid or stuck order back to the accrual service with the reason of the retry.
+func (h *Handler) AdminRequeueOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Admin requeueing order request")
+
+		// Get the admin ID from the context
+		adminID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		number := chi.URLParam(r, "number")
+		if ok, err := auth.ValidateOrderNumber(number); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
+			return
+		}
+		// Decode the reason from the request body
+		rq := models.OrderRequeue{}
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			log.Error("failed to decode requeue: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		rq.Reason = strings.TrimSpace(rq.Reason)
+		if !h.validAdminReason(w, r, rq.Reason) {
+			return
+		}
+		rq = models.OrderRequeue{Order: number, AdminID: adminID, Reason: rq.Reason}
+		// Reset the order
+		if err := h.orders.RequeueOrder(r.Context(), &rq); err != nil {
+			if errors.Is(err, db.ErrOrderNotFound) {
+				log.Error("order not found: ", err)
+				h.httpError(w, r, "Order not found", http.StatusNotFound, problem.OrderNotFound)
+				return
+			}
+			if errors.Is(err, db.ErrOrderNotRequeueable) {
+				log.Error("order can't be requeued: ", err)
+				h.httpError(w, r, "Only invalid or processing orders can be requeued", http.StatusConflict, problem.OrderNotRequeueable)
+				return
+			}
+			log.Error("failed to requeue order: ", err)
+			h.storageError(w, r, "Failed to requeue order", err)
+			return
+		}
+		log.Infof("admin %d requeued order %s from %s: %s", adminID, number, rq.PreviousStatus, rq.Reason)
+		h.respondJSON(w, r, http.StatusOK, rq)
+	}
+}
+
+// AdminDeleteUser soft-deletes the user's account for moderation.
+func (h *Handler) AdminDeleteUser() http.HandlerFunc {
+	return h.adminSetUserDeleted(true)
+}
+
+// AdminRestoreUser restores the soft-deleted user's account.
+func (h *Handler) AdminRestoreUser() http.HandlerFunc {
+	return h.adminSetUserDeleted(false)
+}
+
+// adminSetUserDeleted returns the handler deleting or restoring the user of the {id} path parameter.
+func (h *Handler) adminSetUserDeleted(deleted bool) http.HandlerFunc {
+	action := "restored"
+	if deleted {
+		action = "deleted"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debugf("Admin %s user request", action)
+
+		// Get the admin ID from the context
+		adminID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid user ID: ", err)
+			h.httpError(w, r, "Invalid user ID", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		update := h.users.RestoreUser
+		if deleted {
+			update = h.users.DeleteUser
+		}
+		if err := update(r.Context(), userID); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				log.Error("user not found: ", err)
+				h.httpError(w, r, "User not found", http.StatusNotFound, problem.UserNotFound)
+				return
+			}
+			log.Error("failed to update user: ", err)
+			h.storageError(w, r, "Failed to update user", err)
+			return
+		}
+		log.Infof("admin %d %s user %d", adminID, action, userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AdminRemoveOrder soft-deletes the order of any user in any status for moderation,
+// the accrual of the processed order is taken back.
+func (h *Handler) AdminRemoveOrder() http.HandlerFunc {
+	return h.adminSetOrderDeleted(true)
+}
+
+// AdminRestoreOrder restores the soft-deleted order, the accrual of the processed order is credited again.
+func (h *Handler) AdminRestoreOrder() http.HandlerFunc {
+	return h.adminSetOrderDeleted(false)
+}
+
+// adminSetOrderDeleted returns the handler deleting or restoring the order of the {number} path parameter.
+func (h *Handler) adminSetOrderDeleted(deleted bool) http.HandlerFunc {
+	action := "restored"
+	if deleted {
+		action = "removed"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debugf("Admin %s order request", action)
+
+		// Get the admin ID from the context
+		adminID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		number := chi.URLParam(r, "number")
+		if ok, err := auth.ValidateOrderNumber(number); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
+			return
+		}
+		update := h.orders.RestoreOrder
+		if deleted {
+			update = h.orders.RemoveOrder
+		}
+		if err := update(r.Context(), number); err != nil {
+			switch {
+			case errors.Is(err, db.ErrOrderNotFound):
+				log.Error("order not found: ", err)
+				h.httpError(w, r, "Order not found", http.StatusNotFound, problem.OrderNotFound)
+			case errors.Is(err, db.ErrInsufficientBalance):
+				log.Error("insufficient balance: ", err)
+				h.httpError(w, r, "Accrual of the order is already spent", http.StatusPaymentRequired, problem.InsufficientBalance)
+			default:
+				log.Error("failed to update order: ", err)
+				h.storageError(w, r, "Failed to update order", err)
+			}
+			return
+		}
+		log.Infof("admin %d %s order %s", adminID, action, number)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validAdminReason checks the reason of an admin's change, it replies with the error and returns false if it is invalid.
+func (h *Handler) validAdminReason(w http.ResponseWriter, r *http.Request, reason string) bool {
+	log := h.log(r)
+	if reason == "" {
+		log.Error("empty reason")
+		h.httpError(w, r, "Reason is required", http.StatusUnprocessableEntity, problem.ValidationFailed)
+		return false
+	}
+	if utf8.RuneCountInString(reason) > maxAdminReason {
+		log.Errorf("reason is longer than %d characters", maxAdminReason)
+		h.httpError(w, r, fmt.Sprintf("Reason is longer than %d characters", maxAdminReason), http.StatusUnprocessableEntity, problem.ValidationFailed)
+		return false
+	}
+	return true
+}
+
+// adminTargetUser gets the user of the {id} path parameter, it replies with the error and returns false if there is none.
+func (h *Handler) adminTargetUser(w http.ResponseWriter, r *http.Request) (*models.UserInfo, bool) {
+	log := h.log(r)
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		log.Error("invalid user ID: ", err)
+		h.httpError(w, r, "Invalid user ID", http.StatusBadRequest, problem.InvalidRequest)
+		return nil, false
+	}
+	user, err := h.users.GetUserInfo(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			log.Error("user not found: ", err)
+			h.httpError(w, r, "User not found", http.StatusNotFound, problem.UserNotFound)
+			return nil, false
+		}
+		log.Error("failed to get user: ", err)
+		h.storageError(w, r, "Failed to get user", err)
+		return nil, false
+	}
+	return user, true
+}
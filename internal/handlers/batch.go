@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+)
+
+// maxWithdrawalBatch is the maximum number of withdrawals in one batch request.
+const maxWithdrawalBatch = 100
+
+// maxOrderBatch is the maximum number of order numbers in one batch upload.
+const maxOrderBatch = 10000
+
+// OrderResult is the outcome of an order of a batch upload: the HTTP status the upload
+// would get on its own, with the error code and the message if it failed.
+type OrderResult struct {
+	Order  string       `json:"order"`
+	Status int          `json:"status"`
+	Code   problem.Code `json:"code,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+}
+
+// CreateOrders uploads several order numbers at once and replies 207 Multi-Status with the result
+// of every number in the request order. The invalid numbers are skipped, the rest are stored in one transaction.
+func (h *Handler) CreateOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Creating orders batch request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Decode the order numbers
+		var numbers []string
+		if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+			log.Error("failed to decode order numbers: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Check the number of orders
+		if len(numbers) == 0 || len(numbers) > maxOrderBatch {
+			log.Error("invalid number of orders: ", len(numbers))
+			h.httpError(w, r, fmt.Sprintf("From 1 to %d order numbers are expected", maxOrderBatch), http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+
+		// Validate the numbers, only the valid ones go to the storage
+		results := make([]OrderResult, len(numbers))
+		valid := make([]string, 0, len(numbers))
+		index := make([]int, 0, len(numbers)) // request positions of the valid numbers
+		seen := make(map[string]bool, len(numbers))
+		for i, number := range numbers {
+			number = auth.NormalizeOrderNumber(number)
+			results[i].Order = number
+			if ok, _ := auth.ValidateOrderNumber(number); !ok {
+				results[i].Status, results[i].Code, results[i].Detail = http.StatusUnprocessableEntity, problem.InvalidOrderNumber, "Invalid order number"
+				continue
+			}
+			if seen[number] {
+				results[i].Status, results[i].Detail = http.StatusOK, "Order number is repeated in the batch"
+				continue
+			}
+			seen[number] = true
+			valid = append(valid, number)
+			index = append(index, i)
+		}
+
+		if len(valid) > 0 {
+			errs, err := h.orders.CreateOrders(r.Context(), userID, valid)
+			if err != nil {
+				log.Error("failed to create orders batch: ", err)
+				h.storageError(w, r, "Failed to create orders", err)
+				return
+			}
+			for j, err := range errs {
+				res := &results[index[j]]
+				res.Status, res.Code, res.Detail = orderResult(err)
+				if err == nil {
+					h.dispatchOrder(models.NewOrder(valid[j], userID))
+				}
+			}
+			log.Debugf("Uploaded a batch of %d orders", len(valid))
+		}
+		h.respondJSON(w, r, http.StatusMultiStatus, results)
+	}
+}
+
+// orderResult maps the storage error of an order of a batch upload to its status, code and message.
+func orderResult(err error) (int, problem.Code, string) {
+	switch {
+	case err == nil:
+		return http.StatusAccepted, "", ""
+	case errors.Is(err, db.ErrOrderAlreadyExists):
+		return http.StatusOK, "", "Order already uploaded by the user"
+	case errors.Is(err, db.ErrOrderAlreadyAdded):
+		return http.StatusConflict, problem.OrderOwnedByOther, "Order already added by another user"
+	default:
+		status, code := storageStatus(err)
+		return status, code, "Failed to create order"
+	}
+}
+
+// WithdrawalResult is the outcome of a withdrawal of a batch: the HTTP status the withdrawal
+// would get on its own, with the error code and the message if it failed.
+type WithdrawalResult struct {
+	Order  string               `json:"order"`
+	Status int                  `json:"status"`
+	Code   problem.Code         `json:"code,omitempty"`
+	Detail string               `json:"detail,omitempty"`
+	Errors []problem.FieldError `json:"errors,omitempty"` // violations of the fields of the invalid withdrawal
+}
+
+// WithdrawBatch withdraws the balance for several orders in one transaction and replies 207 Multi-Status
+// with the result of every withdrawal in the request order. The withdrawals are applied in order,
+// the invalid ones and the ones the balance is not enough for are skipped, the rest are completed.
+func (h *Handler) WithdrawBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Withdrawing balance batch request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Decode the withdrawals
+		var withdrawals []models.Withdrawal
+		if err := json.NewDecoder(r.Body).Decode(&withdrawals); err != nil {
+			log.Error("failed to decode withdrawals: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Check the number of withdrawals
+		if len(withdrawals) == 0 || len(withdrawals) > maxWithdrawalBatch {
+			log.Error("invalid number of withdrawals: ", len(withdrawals))
+			h.httpError(w, r, fmt.Sprintf("From 1 to %d withdrawals are expected", maxWithdrawalBatch), http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+
+		// Validate the withdrawals, only the valid ones go to the storage; the sums are checked against
+		// the minimum of the tenant
+		ctx := withMinWithdrawal(r.Context(), h.minWithdrawalFor(r.Context()))
+		results := make([]WithdrawalResult, len(withdrawals))
+		valid := make([]models.Withdrawal, 0, len(withdrawals))
+		index := make([]int, 0, len(withdrawals)) // request positions of the valid withdrawals
+		seen := make(map[string]bool, len(withdrawals))
+		for i := range withdrawals {
+			withdrawal := &withdrawals[i]
+			normalizeWithdrawal(withdrawal)
+			results[i].Order = withdrawal.Order
+			if errs := h.fieldErrors(ctx, withdrawal); errs != nil {
+				results[i].Status, results[i].Code, results[i].Detail = http.StatusUnprocessableEntity, ruleCode(errs[0]), errs[0].Message
+				results[i].Errors = errs
+				continue
+			}
+			if seen[withdrawal.Order] {
+				results[i].Status, results[i].Code, results[i].Detail = http.StatusConflict, problem.WithdrawalExists, "Order number is repeated in the batch"
+				continue
+			}
+			seen[withdrawal.Order] = true
+			valid = append(valid, *withdrawal)
+			index = append(index, i)
+		}
+
+		if len(valid) > 0 {
+			errs, err := h.withdrawals.WithdrawBatch(r.Context(), userID, valid)
+			if err != nil {
+				log.Error("failed to withdraw balance batch: ", err)
+				h.storageError(w, r, "Failed to withdraw balance", err)
+				return
+			}
+			now := h.clock.Now()
+			for j, err := range errs {
+				res := &results[index[j]]
+				res.Status, res.Code, res.Detail = withdrawalResult(err)
+				if err != nil {
+					log.Debugf("withdrawal for order %s failed: %v", res.Order, err)
+					continue
+				}
+				// Notify the user's live connections about the balance change
+				if h.events != nil {
+					h.events.Publish(models.WithdrawalEvent{UserID: userID, Order: valid[j].Order, Sum: valid[j].Sum, At: now})
+				}
+			}
+		}
+		h.respondJSON(w, r, http.StatusMultiStatus, results)
+	}
+}
+
+// withdrawalResult maps the storage error of a withdrawal of a batch to its status, code and message.
+func withdrawalResult(err error) (int, problem.Code, string) {
+	var limitErr *db.DailyLimitError
+	switch {
+	case err == nil:
+		return http.StatusOK, "", ""
+	case errors.Is(err, db.ErrInsufficientBalance):
+		return http.StatusPaymentRequired, problem.InsufficientBalance, "Insufficient balance"
+	case errors.Is(err, db.ErrOrderAlreadyExists):
+		return http.StatusConflict, problem.WithdrawalExists, "Withdrawal order number already exists"
+	case errors.Is(err, db.ErrOrderNumberUsed):
+		return http.StatusConflict, problem.OrderNumberUsed, "Order number is already used by another order"
+	case errors.As(err, &limitErr):
+		return http.StatusTooManyRequests, problem.DailyLimitExceeded, dailyLimitDetail(limitErr)
+	default:
+		status, code := storageStatus(err)
+		return status, code, "Failed to withdraw balance"
+	}
+}
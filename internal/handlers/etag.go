@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// makeETag returns the entity tag of the response built from the data version. The representation also
+// depends on the query and the negotiated format, so they are a part of the tag.
+func makeETag(version string, r *http.Request) string {
+	format := "json"
+	if wantsXML(r) {
+		format = "xml"
+	}
+	sum := sha256.Sum256([]byte(version + "\n" + r.URL.RawQuery + "\n" + format))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the ETag header and reports whether the client's copy matches it,
+// replying with 304 Not Modified in that case.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether the If-None-Match header matches the entity tag using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
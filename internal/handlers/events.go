@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"time"
+)
+
+// eventsHeartbeat is the interval of the comments keeping idle event streams open through proxies.
+const eventsHeartbeat = 15 * time.Second
+
+// CloseStreams ends the open event streams, which would otherwise hold the server shutdown.
+func (h *Handler) CloseStreams() {
+	h.closeStreams.Do(func() { close(h.streamsDone) })
+}
+
+// OrderEvents streams the user's order status changes as server-sent events
+func (h *Handler) OrderEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Order events request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Error("response writer doesn't support flushing")
+			h.httpError(w, r, "Streaming is not supported", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+
+		// the stream outlives the write timeout of the server, the heartbeats notice a gone client
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			log.Debugf("failed to lift the write deadline of the order events stream: %v", err)
+		}
+
+		// Subscribe to the user's order events
+		events, unsubscribe := h.events.Subscribe(userID)
+		defer unsubscribe()
+		heartbeat := h.clock.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Debug("order events stream closed")
+				return
+			case <-h.streamsDone:
+				log.Debug("order events stream closed on shutdown")
+				return
+			case <-heartbeat.C():
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					log.Debug("failed to write heartbeat: ", err)
+					return
+				}
+			case e := <-events:
+				// Only the order events are streamed
+				if _, ok := e.(models.OrderEvent); !ok {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Error("failed to encode order event: ", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: order\ndata: %s\n\n", data); err != nil {
+					log.Debug("failed to write order event: ", err)
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
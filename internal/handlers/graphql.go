@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/middleware"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+const (
+	gqlMaxDepth       = 5  // gqlMaxDepth is the maximum nesting of the selections in a query.
+	gqlMaxParallelism = 10 // gqlMaxParallelism is the maximum number of fields resolved at once in a query.
+)
+
+//go:embed schema.graphql
+var gqlSchema string
+
+// gqlRequest is the GraphQL query sent in the request body.
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// GraphQL serves the read-only GraphQL API over the user's data, the queries are resolved
+// with the same storage calls as the REST handlers.
+func (h *Handler) GraphQL() http.HandlerFunc {
+	schema := graphql.MustParseSchema(gqlSchema, &gqlResolver{h: h},
+		graphql.MaxDepth(gqlMaxDepth),
+		graphql.MaxParallelism(gqlMaxParallelism),
+		graphql.Logger(gqlLogger{h: h}),
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("GraphQL request")
+
+		// Decode the query
+		req := gqlRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("failed to decode GraphQL request: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if req.Query == "" {
+			log.Error("empty GraphQL query")
+			h.httpError(w, r, "Query is required", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Execute the query, the errors are a part of the response
+		resp := schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+		if len(resp.Errors) > 0 {
+			log.Debug("GraphQL errors: ", resp.Errors)
+		}
+		h.respondJSON(w, r, http.StatusOK, resp)
+	}
+}
+
+// gqlLogger logs the panics in the resolvers with the request ID.
+type gqlLogger struct {
+	h *Handler
+}
+
+// LogPanic logs the recovered panic of a resolver.
+func (l gqlLogger) LogPanic(ctx context.Context, value any) {
+	l.h.logger.With("request_id", middleware.GetRequestID(ctx)).Errorf("GraphQL resolver panic: %v", value)
+}
+
+// gqlResolver is the root of the GraphQL schema.
+type gqlResolver struct {
+	h *Handler
+}
+
+// gqlError logs the storage error and returns the message safe to show to the client.
+func (res *gqlResolver) gqlError(ctx context.Context, msg string, err error) error {
+	res.h.logger.With("request_id", middleware.GetRequestID(ctx)).Errorf("%s: %v", msg, err)
+	return errors.New(msg)
+}
+
+// User resolves the authenticated user.
+func (res *gqlResolver) User(ctx context.Context) (*gqlUser, error) {
+	userID, err := auth.GetUserIDFromCtx(ctx)
+	if err != nil {
+		return nil, errors.New("user is not authenticated")
+	}
+	return &gqlUser{res: res, id: userID}, nil
+}
+
+// gqlUser resolves the data of the user.
+type gqlUser struct {
+	res *gqlResolver
+	id  int64
+}
+
+// ID resolves the user ID.
+func (u *gqlUser) ID() graphql.ID {
+	return graphql.ID(fmt.Sprint(u.id))
+}
+
+// Balance resolves the user's balance.
+func (u *gqlUser) Balance(ctx context.Context) (*gqlBalance, error) {
+	balance, err := u.res.h.withdrawals.GetBalance(ctx, u.id)
+	if err != nil {
+		return nil, u.res.gqlError(ctx, "failed to get balance", err)
+	}
+	return &gqlBalance{balance: balance}, nil
+}
+
+// Orders resolves the user's orders matching the filter.
+func (u *gqlUser) Orders(ctx context.Context, args struct {
+	Status *[]string
+	From   *graphql.Time
+	To     *graphql.Time
+}) ([]*gqlOrder, error) {
+	filter := models.OrderFilter{From: gqlTime(args.From), To: gqlTime(args.To)}
+	if args.Status != nil {
+		for _, s := range *args.Status {
+			filter.Statuses = append(filter.Statuses, models.OrderStatus(s))
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.From.After(filter.To) {
+		return nil, errors.New("from is after to")
+	}
+	orders, err := u.res.h.orders.GetOrders(ctx, u.id, filter)
+	if err != nil {
+		return nil, u.res.gqlError(ctx, "failed to get orders", err)
+	}
+	result := make([]*gqlOrder, 0, len(orders))
+	for _, o := range orders {
+		result = append(result, &gqlOrder{user: u, order: o})
+	}
+	return result, nil
+}
+
+// Order resolves the user's order with its history, nil if it is not found.
+func (u *gqlUser) Order(ctx context.Context, args struct{ Number string }) (*gqlOrder, error) {
+	if ok, _ := auth.ValidateOrderNumber(args.Number); !ok {
+		return nil, errors.New("invalid order number")
+	}
+	order, err := u.res.h.orders.GetOrder(ctx, u.id, args.Number)
+	if errors.Is(err, db.ErrOrderNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, u.res.gqlError(ctx, "failed to get order", err)
+	}
+	return &gqlOrder{user: u, order: order.Order, history: order.History}, nil
+}
+
+// Withdrawals resolves a page of the user's withdrawals.
+func (u *gqlUser) Withdrawals(ctx context.Context, args struct {
+	From  *graphql.Time
+	To    *graphql.Time
+	First *int32
+	After *string
+}) ([]*gqlWithdrawal, error) {
+	q := models.WithdrawalQuery{From: gqlTime(args.From), To: gqlTime(args.To)}
+	if !q.From.IsZero() && !q.To.IsZero() && q.From.After(q.To) {
+		return nil, errors.New("from is after to")
+	}
+	if args.First != nil {
+		if *args.First < 1 || *args.First > maxPageLimit {
+			return nil, fmt.Errorf("first must be between 1 and %d", maxPageLimit)
+		}
+		q.Limit = int(*args.First)
+	}
+	if args.After != nil {
+		after, err := decodeCursor(*args.After)
+		if err != nil {
+			return nil, err
+		}
+		q.After = after
+	}
+	withdrawals, err := u.res.h.withdrawals.GetWithdrawals(ctx, u.id, q)
+	if err != nil {
+		return nil, u.res.gqlError(ctx, "failed to get withdrawals", err)
+	}
+	result := make([]*gqlWithdrawal, 0, len(withdrawals))
+	for _, w := range withdrawals {
+		result = append(result, &gqlWithdrawal{withdrawal: w})
+	}
+	return result, nil
+}
+
+// gqlOrder resolves an order, the history is loaded on demand for the orders of a list.
+type gqlOrder struct {
+	user    *gqlUser
+	order   models.Order
+	history []models.OrderStatusChange
+}
+
+func (o *gqlOrder) Number() string           { return o.order.Number }
+func (o *gqlOrder) Status() string           { return string(o.order.Status) }
+func (o *gqlOrder) Accrual() *float64        { return gqlAmount(o.order.Accrual) }
+func (o *gqlOrder) UploadedAt() graphql.Time { return graphql.Time{Time: o.order.UploadedAt} }
+
+// History resolves the status changes of the order.
+func (o *gqlOrder) History(ctx context.Context) ([]*gqlOrderStatusChange, error) {
+	if o.history == nil {
+		order, err := o.user.res.h.orders.GetOrder(ctx, o.user.id, o.order.Number)
+		if err != nil {
+			return nil, o.user.res.gqlError(ctx, "failed to get order history", err)
+		}
+		o.history = order.History
+	}
+	result := make([]*gqlOrderStatusChange, 0, len(o.history))
+	for _, c := range o.history {
+		result = append(result, &gqlOrderStatusChange{change: c})
+	}
+	return result, nil
+}
+
+// gqlOrderStatusChange resolves an entry of the order history.
+type gqlOrderStatusChange struct {
+	change models.OrderStatusChange
+}
+
+func (c *gqlOrderStatusChange) Status() string    { return string(c.change.Status) }
+func (c *gqlOrderStatusChange) Accrual() *float64 { return gqlAmount(c.change.Accrual) }
+func (c *gqlOrderStatusChange) ChangedAt() graphql.Time {
+	return graphql.Time{Time: c.change.ChangedAt}
+}
+
+// gqlBalance resolves the balance.
+type gqlBalance struct {
+	balance *models.Balance
+}
+
+func (b *gqlBalance) Current() float64   { return b.balance.Current.Float64() }
+func (b *gqlBalance) Withdrawn() float64 { return b.balance.Withdrawn.Float64() }
+
+// gqlWithdrawal resolves a withdrawal.
+type gqlWithdrawal struct {
+	withdrawal models.Withdrawal
+}
+
+func (w *gqlWithdrawal) Order() string { return w.withdrawal.Order }
+func (w *gqlWithdrawal) Sum() float64  { return w.withdrawal.Sum.Float64() }
+func (w *gqlWithdrawal) ProcessedAt() graphql.Time {
+	return graphql.Time{Time: w.withdrawal.ProcessedAt}
+}
+
+// Description resolves the note of the withdrawal, null if there is none.
+func (w *gqlWithdrawal) Description() *string {
+	if w.withdrawal.Description == "" {
+		return nil
+	}
+	return &w.withdrawal.Description
+}
+
+// Cursor resolves the position of the withdrawal to request the next page after it.
+func (w *gqlWithdrawal) Cursor() string {
+	return encodeCursor(models.Cursor{At: w.withdrawal.ProcessedAt, Key: w.withdrawal.Order})
+}
+
+// gqlTime converts the optional time argument, the zero time if it is not set.
+func gqlTime(t *graphql.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// gqlAmount converts the amount that is omitted when it is zero, like in the JSON responses.
+func gqlAmount(v models.Money) *float64 {
+	if v == 0 {
+		return nil
+	}
+	f := v.Float64()
+	return &f
+}
@@ -1,51 +1,183 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"loyaltySys/internal/auth"
+	"loyaltySys/internal/captcha"
+	"loyaltySys/internal/clock"
 	"loyaltySys/internal/db"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/middleware"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/sms"
+	"loyaltySys/internal/tenant"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// Storage interface for the handler
-type Storage interface {
-	CreateUser(ctx context.Context, user *models.User) (int64, error)
-	GetUser(ctx context.Context, login string) (*models.User, error)
-	CreateOrder(ctx context.Context, order *models.Order) error
-	GetOrders(ctx context.Context, userID int64) ([]models.Order, error)
-	GetBalance(ctx context.Context, userID int64) (*models.Balance, error)
-	GetWithdrawals(ctx context.Context, userID int64) ([]models.Withdrawal, error)
-	Withdraw(ctx context.Context, withdrawal *models.Withdrawal) error
-}
+// maxOrdersStatusQuery is the maximum number of orders in one bulk status request.
+const maxOrdersStatusQuery = 100
 
-// NewStorage creates a new storage for the handler
-func NewStorage(ctx context.Context, dsn string, logger *zap.SugaredLogger) Storage {
-	db, err := db.NewDB(ctx, dsn, logger)
-	if err != nil {
-		logger.Fatal("failed to create storage", err)
-		return nil
-	}
-	return db
-}
+// balanceCacheControl lets the client and the private caches reuse the balance for a few seconds
+// while polling, then revalidate it with the ETag.
+const balanceCacheControl = "private, max-age=5"
+
+// captchaHeader is the request header carrying the CAPTCHA challenge token.
+const captchaHeader = "X-Captcha-Token"
+
+// storageRetryAfter is the delay the clients are told to retry after while the storage is unavailable.
+const storageRetryAfter = time.Second
 
 // Handler struct for the handler
 type Handler struct {
-	storage Storage
-	logger  *zap.SugaredLogger
+	users         repository.UserStore
+	orders        repository.OrderStore
+	withdrawals   repository.WithdrawalStore
+	webhooks      repository.WebhookStore
+	health        repository.HealthStore
+	captcha       captcha.Verifier
+	sms           sms.Sender
+	events        *events.Bus
+	accrualQueue  *dispatch.Queue
+	streamsDone   chan struct{}
+	closeStreams  sync.Once
+	otpTTL        time.Duration
+	passwords     *auth.PasswordHasher
+	minWithdrawal models.Money
+	// tenantMinWithdrawals override the minimum withdrawal for the tenants
+	tenantMinWithdrawals map[string]models.Money
+	trustedProxies       middleware.TrustedProxies
+	cors                 func(http.Handler) http.Handler
+	tenant               func(http.Handler) http.Handler
+	userRateLimit        middleware.RateLimit
+	ipRateLimit          middleware.RateLimit
+	clock                clock.Clock
+	metrics              *metrics.Registry
+	pprof                bool
+	adminMetrics         bool
+	hashMetrics          *passwordMetrics
+	logger               *zap.SugaredLogger
+	validate             *validator.Validate
 }
 
 // NewHandler creates a new handler
-func NewHandler(s Storage, logger *zap.SugaredLogger) *Handler {
-	return &Handler{
-		storage: s,
-		logger:  logger,
+func NewHandler(repo *repository.Repository, opts ...Option) *Handler {
+	h := &Handler{
+		users:       repo.Users,
+		orders:      repo.Orders,
+		withdrawals: repo.Withdrawals,
+		webhooks:    repo.Webhooks,
+		health:      repo.Health,
+		streamsDone: make(chan struct{}),
+		otpTTL:      defaultOTPTTL,
+		passwords:   auth.DefaultPasswordHasher,
+		clock:       clock.New(),
+		logger:      zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.validate = newValidator()
+	h.hashMetrics = newPasswordMetrics(h.metrics)
+	return h
+}
+
+// log returns the handler logger annotated with the request ID.
+func (h *Handler) log(r *http.Request) *zap.SugaredLogger {
+	if id := middleware.GetRequestID(r.Context()); id != "" {
+		return h.logger.With("request_id", id)
+	}
+	return h.logger
+}
+
+// httpError replies to the request with the problem details of the error: the message,
+// the stable error code the clients branch on and the request ID.
+func (h *Handler) httpError(w http.ResponseWriter, r *http.Request, msg string, status int, code problem.Code) {
+	problem.Write(w, r, status, code, msg)
+}
+
+// storageError replies to the request with the problem of the storage failure the handler has no specific reply for,
+// by the kind of the failure: the client may retry when the storage is unavailable, the conflicts and the missing data
+// are the client errors, the rest is the internal error.
+func (h *Handler) storageError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	status, code := storageStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(storageRetryAfter.Seconds())))
+	}
+	h.httpError(w, r, msg, status, code)
+}
+
+// storageStatus maps the kind of the storage failure to the status and the code of the reply.
+func storageStatus(err error) (int, problem.Code) {
+	switch db.Classify(err) {
+	case db.Retryable:
+		return http.StatusServiceUnavailable, problem.Unavailable
+	case db.Conflict:
+		return http.StatusConflict, problem.Conflict
+	case db.NotFound:
+		return http.StatusNotFound, problem.NotFound
+	default:
+		return http.StatusInternalServerError, problem.Internal
+	}
+}
+
+// retryError replies 429 Too Many Requests with the problem details of the error
+// and the time the client may retry at, both in the Retry-After header and in the body.
+func (h *Handler) retryError(w http.ResponseWriter, r *http.Request, msg string, code problem.Code, retryAt time.Time) {
+	problem.WriteRetry(w, r, code, msg, h.clock.Now(), retryAt)
+}
+
+// respondJSON replies to the request with the value encoded in JSON. The value is encoded before
+// anything is written, so an encoding failure is still reported to the client as an error.
+func (h *Handler) respondJSON(w http.ResponseWriter, r *http.Request, code int, v any) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		h.log(r).Error("failed to encode response: ", err)
+		h.httpError(w, r, "Failed to encode response", http.StatusInternalServerError, problem.Internal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		h.log(r).Error("failed to write response: ", err)
+	}
+}
+
+// minWithdrawalFor returns the minimum withdrawal of the tenant of the context: its own one if it is set,
+// the global one otherwise.
+func (h *Handler) minWithdrawalFor(ctx context.Context) models.Money {
+	if minWithdrawal, ok := h.tenantMinWithdrawals[tenant.FromContext(ctx)]; ok {
+		return minWithdrawal
+	}
+	return h.minWithdrawal
+}
+
+// GetMeta returns the public program parameters clients need before calling the API.
+func (h *Handler) GetMeta() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting meta request")
+
+		meta := models.Meta{MinWithdrawal: h.minWithdrawalFor(r.Context())}
+		h.respondJSON(w, r, http.StatusOK, meta)
 	}
 }
 
@@ -53,50 +185,63 @@ func NewHandler(s Storage, logger *zap.SugaredLogger) *Handler {
 // It authenticates the user and generates a token for them.
 func (h *Handler) CreateUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Creating user request")
+		log := h.log(r)
+		log.Debug("Creating user request")
+
+		// Verify the CAPTCHA challenge if enabled
+		if h.captcha != nil {
+			if err := h.captcha.Verify(r.Context(), r.Header.Get(captchaHeader), middleware.RemoteIP(r)); err != nil {
+				if errors.Is(err, captcha.ErrInvalidToken) {
+					log.Error("invalid captcha token: ", err)
+					h.httpError(w, r, "Invalid captcha token", http.StatusForbidden, problem.CaptchaFailed)
+					return
+				}
+				log.Error("failed to verify captcha: ", err)
+				h.httpError(w, r, "Failed to verify captcha", http.StatusInternalServerError, problem.Internal)
+				return
+			}
+		}
 
 		// Decode the request body into a User struct
-		h.logger.Debug("Decoding user")
+		log.Debug("Decoding user")
 		user := models.User{}
 		err := json.NewDecoder(r.Body).Decode(&user)
 		if err != nil {
-			h.logger.Error("failed to decode user", err)
-			http.Error(w, "Failed to decode user", http.StatusBadRequest)
+			log.Error("failed to decode user", err)
+			h.httpError(w, r, "Failed to decode user", http.StatusBadRequest, problem.InvalidRequest)
 			return
 		}
 		// Validate the user
-		if ok, err := auth.ValidateUser(user); !ok {
-			h.logger.Error("invalid user", err)
-			http.Error(w, "Invalid user", http.StatusBadRequest)
+		if !h.validRequest(w, r, &user, http.StatusBadRequest) {
 			return
 		}
 		// Hash the password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		hashedPassword, err := h.passwords.Hash(user.Password)
 		if err != nil {
-			h.logger.Error("failed to hash password", err)
-			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			log.Error("failed to hash password", err)
+			h.httpError(w, r, "Failed to hash password", http.StatusInternalServerError, problem.Internal)
 			return
 		}
-		user.Password = string(hashedPassword)
+		user.Password = hashedPassword
 
 		// Create the user in the database
-		userID, err := h.storage.CreateUser(r.Context(), &user)
+		userID, err := h.users.CreateUser(r.Context(), &user)
 		if err != nil {
 			if errors.Is(err, db.ErrUserAlreadyExists) {
-				h.logger.Error(err)
-				http.Error(w, "User already exists", http.StatusConflict)
+				log.Error(err)
+				h.httpError(w, r, "User already exists", http.StatusConflict, problem.UserExists)
 				return
 			}
-			h.logger.Error("failed to create user: ", err)
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			log.Error("failed to create user: ", err)
+			h.storageError(w, r, "Failed to create user", err)
 			return
 		}
 
 		// Generate a token for the user
-		token, err := auth.GenerateToken(userID)
+		token, err := auth.GenerateTenantToken(h.clock.Now(), tenant.FromContext(r.Context()), userID, auth.ScopeRead, auth.ScopeWrite)
 		if err != nil {
-			h.logger.Error("failed to generate token: ", err)
-			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			log.Error("failed to generate token: ", err)
+			h.httpError(w, r, "Failed to generate token", http.StatusInternalServerError, problem.Internal)
 			return
 		}
 		// Set the token in the response header
@@ -108,49 +253,76 @@ func (h *Handler) CreateUser() http.HandlerFunc {
 // LoginUser authenticates a user and generates a token for them.
 func (h *Handler) LoginUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Login user request")
+		log := h.log(r)
+		log.Debug("Login user request")
 
 		// Decode the request body into a User struct
-		h.logger.Debug("Decoding user")
+		log.Debug("Decoding user")
 		user := models.User{}
 		err := json.NewDecoder(r.Body).Decode(&user)
 		if err != nil {
-			h.logger.Error("failed to decode user: ", err)
-			http.Error(w, "Failed to decode user", http.StatusBadRequest)
+			log.Error("failed to decode user: ", err)
+			h.httpError(w, r, "Failed to decode user", http.StatusBadRequest, problem.InvalidRequest)
 			return
 		}
 		// Validate the user
-		if ok, err := auth.ValidateUser(user); !ok {
-			h.logger.Error("invalid user: ", err)
-			http.Error(w, "Invalid user", http.StatusBadRequest)
+		if !h.validRequest(w, r, &user, http.StatusBadRequest) {
 			return
 		}
 		// Search the user in the database and compare the password
-		h.logger.Debug("Searching user in the database")
-		registeredUser, err := h.storage.GetUser(r.Context(), user.Login)
+		log.Debug("Searching user in the database")
+		registeredUser, err := h.users.GetUser(r.Context(), user.Login)
 		if err != nil {
 			if errors.Is(err, db.ErrUserNotFound) {
-				h.logger.Error("user not found: ", err)
-				http.Error(w, "Invalid login or password", http.StatusUnauthorized)
+				log.Error("user not found: ", err)
+				h.httpError(w, r, "Invalid login or password", http.StatusUnauthorized, problem.InvalidCredentials)
 				return
 			}
-			h.logger.Error("failed to get user: ", err)
-			http.Error(w, "Failed to get user", http.StatusInternalServerError)
+			log.Error("failed to get user: ", err)
+			h.storageError(w, r, "Failed to get user", err)
 			return
 		}
 		// Compare the password
-		h.logger.Debug("Comparing password")
-		if err := bcrypt.CompareHashAndPassword([]byte(registeredUser.Password), []byte(user.Password)); err != nil {
-			h.logger.Error("invalid password: ", err)
-			http.Error(w, "Invalid password", http.StatusUnauthorized)
+		log.Debug("Comparing password")
+		if err := h.passwords.Compare(registeredUser.Password, user.Password); err != nil {
+			log.Error("invalid password: ", err)
+			h.httpError(w, r, "Invalid password", http.StatusUnauthorized, problem.InvalidCredentials)
 			return
 		}
+		// Rewrite the hash made with the outdated parameters
+		h.upgradePassword(r, registeredUser, user.Password)
 		// Generate a token for the user
-		h.logger.Debug("Generating token for user: ", registeredUser.ID)
-		token, err := auth.GenerateToken(registeredUser.ID)
+		log.Debug("Generating token for user: ", registeredUser.ID)
+		token, err := auth.GenerateTenantToken(h.clock.Now(), tenant.FromContext(r.Context()), registeredUser.ID, auth.ScopeRead, auth.ScopeWrite)
+		if err != nil {
+			log.Error("failed to generate token: ", err)
+			h.httpError(w, r, "Failed to generate token", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+		// Set the token in the response header
+		w.Header().Set("Authorization", "Bearer "+token)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// IssueReadOnlyToken generates a token for the user allowing to view orders, balance and withdrawals only.
+func (h *Handler) IssueReadOnlyToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Issuing read-only token request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Generate a read-only token for the user
+		token, err := auth.GenerateTenantToken(h.clock.Now(), tenant.FromContext(r.Context()), userID, auth.ScopeRead)
 		if err != nil {
-			h.logger.Error("failed to generate token: ", err)
-			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			log.Error("failed to generate token: ", err)
+			h.httpError(w, r, "Failed to generate token", http.StatusInternalServerError, problem.Internal)
 			return
 		}
 		// Set the token in the response header
@@ -162,203 +334,554 @@ func (h *Handler) LoginUser() http.HandlerFunc {
 // CreateOrder creates a new order for a user.
 func (h *Handler) CreateOrder() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Creating order request")
+		log := h.log(r)
+		log.Debug("Creating order request")
 
-		// Check if the order number is valid
-		orderNumber, err := io.ReadAll(r.Body)
+		// Read the order number in the plain text or JSON body
+		orderNumber, err := readOrderNumber(r)
 		if err != nil {
-			h.logger.Error("failed to read order number: ", err)
-			http.Error(w, "Failed to read order number", http.StatusBadRequest)
+			if errors.Is(err, errUnsupportedMediaType) {
+				log.Error("unsupported order content type: ", err)
+				w.Header().Set("Accept-Post", orderUploadTypes)
+				h.httpError(w, r, "Content-Type must be text/plain or application/json", http.StatusUnsupportedMediaType, problem.UnsupportedMediaType)
+				return
+			}
+			log.Error("failed to read order number: ", err)
+			h.httpError(w, r, "Failed to read order number", http.StatusBadRequest, problem.InvalidRequest)
 			return
 		}
-		// Check if the order number is valid
-		h.logger.Debug("Order number: ", string(orderNumber))
-		if ok, err := auth.ValidateOrderNumber(string(orderNumber)); !ok {
-			h.logger.Error("invalid order number: ", err)
-			http.Error(w, "Invalid order number", http.StatusUnprocessableEntity)
+		// Check if the order number is valid, it is stored in the canonical form
+		orderNumber = auth.NormalizeOrderNumber(orderNumber)
+		log.Debug("Order number: ", orderNumber)
+		if ok, err := auth.ValidateOrderNumber(orderNumber); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
 			return
 		}
 		// Get the user ID from the context
 		userID, err := auth.GetUserIDFromCtx(r.Context())
 		if err != nil {
-			h.logger.Error("failed to get user ID: ", err)
-			http.Error(w, "Failed to get user ID", http.StatusUnauthorized)
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
 			return
 		}
-		h.logger.Debug("User ID: ", userID)
+		log.Debug("User ID: ", userID)
 		// Create the order in the database
-		err = h.storage.CreateOrder(r.Context(), models.NewOrder(string(orderNumber), userID))
+		order := models.NewOrder(orderNumber, userID)
+		err = h.orders.CreateOrder(r.Context(), order)
 		if err != nil {
 			// Check if the order already added by another user - return 409
 			if errors.Is(err, db.ErrOrderAlreadyAdded) {
-				h.logger.Error("order already added by another user: ", err)
-				http.Error(w, "Order already added by another user", http.StatusConflict)
+				log.Error("order already added by another user: ", err)
+				h.httpError(w, r, "Order already added by another user", http.StatusConflict, problem.OrderOwnedByOther)
 				return
 				// Check if the order already added by this user - return 200
 			} else if errors.Is(err, db.ErrOrderAlreadyExists) {
-				h.logger.Error("order already added by this user: ", err)
+				log.Error("order already added by this user: ", err)
 				w.WriteHeader(http.StatusOK)
 				return
 			}
 			// Return 500
-			h.logger.Error("failed to create order: ", err)
-			http.Error(w, "Failed to create order", http.StatusInternalServerError)
+			log.Error("failed to create order: ", err)
+			h.storageError(w, r, "Failed to create order", err)
 			return
 		}
 
+		// Hand the order over to the accrual service at once
+		h.dispatchOrder(order)
 		// Return 202 if the order is accepted for processing
-		h.logger.Debug("Order accepted for processing")
+		log.Debug("Order accepted for processing")
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-// GetOrders returns all orders for a user.
+// dispatchOrder queues the created order for the accrual service if the queue is set,
+// the order dropped from the full queue is requested on the next poll.
+func (h *Handler) dispatchOrder(order *models.Order) {
+	if h.accrualQueue != nil && !h.accrualQueue.Push(*order) {
+		h.logger.Debugf("accrual queue is full, order %s is left for the poll", order.Number)
+	}
+}
+
+// orderUploadTypes are the content types of the order upload body.
+const orderUploadTypes = "text/plain, application/json"
+
+// errUnsupportedMediaType is returned for a request body of an unsupported content type.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// orderUpload is the JSON body of the order upload.
+type orderUpload struct {
+	Order string `json:"order"`
+}
+
+// readOrderNumber reads the order number from the text/plain body or the {"order": "..."} JSON body.
+func readOrderNumber(r *http.Request) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errUnsupportedMediaType, r.Header.Get("Content-Type"))
+	}
+	switch mediaType {
+	case "text/plain":
+		number, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		return string(number), nil
+	case "application/json":
+		upload := orderUpload{}
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			return "", err
+		}
+		return upload.Order, nil
+	}
+	return "", fmt.Errorf("%w: %s", errUnsupportedMediaType, mediaType)
+}
+
+// GetOrders returns the user's orders matching the filter, a page of them if the limit is set.
 func (h *Handler) GetOrders() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Getting orders request")
+		log := h.log(r)
+		log.Debug("Getting orders request")
 
 		// Get the user ID from the context
 		userID, err := auth.GetUserIDFromCtx(r.Context())
 		if err != nil {
-			h.logger.Error("failed to get user ID: ", err)
-			http.Error(w, "Failed to get user ID", http.StatusUnauthorized)
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Parse the filter and the page from the query
+		filter, err := parseOrderFilter(r.URL.Query())
+		if err != nil {
+			log.Error("invalid orders filter: ", err)
+			h.httpError(w, r, "Invalid filter", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		page, err := parseOrderPage(r.URL.Query(), filter.Sort)
+		if err != nil {
+			log.Error("invalid orders page: ", err)
+			h.httpError(w, r, "Invalid filter", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Reply 304 if the client already has the current orders
+		version, err := h.orders.GetOrdersVersion(r.Context(), userID)
+		if err != nil {
+			log.Error("failed to get orders version: ", err)
+			h.storageError(w, r, "Failed to get orders", err)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		if notModified(w, r, makeETag(version, r)) {
+			log.Debug("Orders not modified for user: ", userID)
 			return
 		}
-		h.logger.Debug("User ID: ", userID)
 		// Get the orders from the database
-		orders, err := h.storage.GetOrders(r.Context(), userID)
+		orders, err := h.getOrders(w, r, userID, filter, page)
 		if err != nil {
-			h.logger.Error("failed to get orders: ", err)
-			http.Error(w, "Failed to get orders", http.StatusInternalServerError)
+			log.Error("failed to get orders: ", err)
+			h.storageError(w, r, "Failed to get orders", err)
 			return
 			// Return 204 if no orders found for user - no content
 		} else if len(orders) == 0 {
-			h.logger.Debug("No orders found for user: ", userID)
+			log.Debug("No orders found for user: ", userID)
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		h.logger.Debug("Orders found for user: ", userID)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		log.Debug("Orders found for user: ", userID)
+		// Return the orders in XML if the client prefers it
+		if wantsXML(r) {
+			h.writeXML(w, r, http.StatusOK, xmlOrders{Orders: orders})
+			return
+		}
 		// Return the orders
-		if err := json.NewEncoder(w).Encode(orders); err != nil {
-			h.logger.Error("failed to encode orders: ", err)
+		h.respondJSON(w, r, http.StatusOK, orders)
+	}
+}
+
+// GetOrder returns the user's order with its processing history.
+func (h *Handler) GetOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting order request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Validate the order number
+		number := chi.URLParam(r, "number")
+		if ok, err := auth.ValidateOrderNumber(number); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
+			return
+		}
+		// Get the order, the orders of other users are reported as not found
+		order, err := h.orders.GetOrder(r.Context(), userID, number)
+		if err != nil {
+			if errors.Is(err, db.ErrOrderNotFound) {
+				log.Error("order not found: ", err)
+				h.httpError(w, r, "Order not found", http.StatusNotFound, problem.OrderNotFound)
+				return
+			}
+			log.Error("failed to get order: ", err)
+			h.storageError(w, r, "Failed to get order", err)
+			return
+		}
+		// Return the order in XML if the client prefers it
+		w.Header().Add("Vary", "Accept")
+		if wantsXML(r) {
+			h.writeXML(w, r, http.StatusOK, order)
+			return
+		}
+		// Return the order
+		h.respondJSON(w, r, http.StatusOK, order)
+	}
+}
+
+// DeleteOrder deletes the user's order that the accrual system hasn't started to process yet.
+func (h *Handler) DeleteOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Deleting order request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Validate the order number
+		number := chi.URLParam(r, "number")
+		if ok, err := auth.ValidateOrderNumber(number); !ok {
+			log.Error("invalid order number: ", err)
+			h.httpError(w, r, "Invalid order number", http.StatusUnprocessableEntity, problem.InvalidOrderNumber)
+			return
+		}
+		// Delete the order, the orders of other users are reported as not found
+		if err := h.orders.DeleteOrder(r.Context(), userID, number); err != nil {
+			switch {
+			case errors.Is(err, db.ErrOrderNotFound):
+				log.Error("order not found: ", err)
+				h.httpError(w, r, "Order not found", http.StatusNotFound, problem.OrderNotFound)
+			case errors.Is(err, db.ErrOrderNotNew):
+				log.Error("order is already processed: ", err)
+				h.httpError(w, r, "Order processing has started", http.StatusConflict, problem.OrderNotNew)
+			default:
+				log.Error("failed to delete order: ", err)
+				h.storageError(w, r, "Failed to delete order", err)
+			}
+			return
+		}
+		log.Debug("Order deleted: ", number)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// parseOrderFilter parses the status, from, to, sort and order query parameters of the orders list.
+// The statuses may be repeated or comma-separated, the dates are in the RFC 3339 format.
+func parseOrderFilter(q url.Values) (models.OrderFilter, error) {
+	filter := models.OrderFilter{}
+	for _, v := range q["status"] {
+		for _, st := range strings.Split(v, ",") {
+			status := models.OrderStatus(strings.ToUpper(strings.TrimSpace(st)))
+			if !status.Valid() {
+				return filter, fmt.Errorf("unknown order status %q", st)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	var err error
+	if filter.From, filter.To, err = parseTimeRange(q); err != nil {
+		return filter, err
+	}
+	if filter.Sort, err = parseSort(q, models.SortUploadedAt, models.SortAccrual); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// GetOrdersStatus returns the statuses of the requested orders of a user in one response.
+func (h *Handler) GetOrdersStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting orders status request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Decode the list of order numbers
+		var numbers []string
+		if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+			log.Error("failed to decode order numbers: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
+			return
 		}
+		// Check the number of requested orders
+		if len(numbers) == 0 || len(numbers) > maxOrdersStatusQuery {
+			log.Error("invalid number of orders: ", len(numbers))
+			h.httpError(w, r, fmt.Sprintf("From 1 to %d order numbers are expected", maxOrdersStatusQuery), http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Get the orders from the database
+		orders, err := h.orders.GetOrdersByNumbers(r.Context(), userID, numbers)
+		if err != nil {
+			log.Error("failed to get orders: ", err)
+			h.storageError(w, r, "Failed to get orders", err)
+			return
+		}
+		log.Debugf("Found %d of %d requested orders", len(orders), len(numbers))
+		// Return the orders
+		h.respondJSON(w, r, http.StatusOK, orders)
 	}
 }
 
 // GetBalance returns the balance for a user.
 func (h *Handler) GetBalance() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Getting balance request")
+		log := h.log(r)
+		log.Debug("Getting balance request")
 
 		// Get the user ID from the context
 		userID, err := auth.GetUserIDFromCtx(r.Context())
 		if err != nil {
-			h.logger.Error("failed to get user ID: ", err)
-			http.Error(w, "Failed to get user ID", http.StatusUnauthorized)
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Reply 304 if the client already has the current balance
+		version, err := h.withdrawals.GetBalanceVersion(r.Context(), userID)
+		if err != nil {
+			log.Error("failed to get balance version: ", err)
+			h.storageError(w, r, "Failed to get balance", err)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Cache-Control", balanceCacheControl)
+		if notModified(w, r, makeETag(version, r)) {
+			log.Debug("Balance not modified for user: ", userID)
 			return
 		}
-		h.logger.Debug("User ID: ", userID)
 		// Get the balance from the database
-		balance, err := h.storage.GetBalance(r.Context(), userID)
+		balance, err := h.withdrawals.GetBalance(r.Context(), userID)
 		if err != nil {
-			h.logger.Error("failed to get balance: ", err)
-			http.Error(w, "Failed to get balance", http.StatusInternalServerError)
+			log.Error("failed to get balance: ", err)
+			h.storageError(w, r, "Failed to get balance", err)
+			return
+		}
+		log.Debug("Balance: ", balance)
+		// Return the balance in XML if the client prefers it
+		if wantsXML(r) {
+			h.writeXML(w, r, http.StatusOK, balance)
 			return
 		}
-		h.logger.Debug("Balance: ", balance)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
 		// Return the balance
-		if err := json.NewEncoder(w).Encode(balance); err != nil {
-			h.logger.Error("failed to encode balance: ", err)
+		h.respondJSON(w, r, http.StatusOK, balance)
+	}
+}
+
+// GetBalanceHistory returns the user's balance at the end of every day, oldest first.
+func (h *Handler) GetBalanceHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting balance history request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Parse the date range from the query
+		from, to, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			log.Error("invalid balance history range: ", err)
+			h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
+			return
 		}
+		// Get the history from the database
+		history, err := h.withdrawals.GetBalanceHistory(r.Context(), userID, from, to)
+		if err != nil {
+			log.Error("failed to get balance history: ", err)
+			h.storageError(w, r, "Failed to get balance history", err)
+			return
+		}
+		// Return 204 if there are no snapshots yet - no content
+		if len(history) == 0 {
+			log.Debug("No balance history for user: ", userID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.respondJSON(w, r, http.StatusOK, history)
 	}
 }
 
 // WithdrawBalance withdraws bonus points of user from balance.
 func (h *Handler) Withdraw() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Withdrawing balance request")
+		log := h.log(r)
+		log.Debug("Withdrawing balance request")
 
 		// Get the user ID from the context
 		userID, err := auth.GetUserIDFromCtx(r.Context())
 		if err != nil {
-			h.logger.Error("failed to get user ID: ", err)
-			http.Error(w, "Failed to get user ID", http.StatusUnauthorized)
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
 			return
 		}
-		h.logger.Debug("User ID: ", userID)
+		log.Debug("User ID: ", userID)
 		// Decode the request body into a Withdrawal struct
-		h.logger.Debug("Decoding withdrawal")
+		log.Debug("Decoding withdrawal")
 		withdrawal := models.Withdrawal{}
 		err = json.NewDecoder(r.Body).Decode(&withdrawal)
 		if err != nil {
-			h.logger.Error("failed to decode withdrawal: ", err)
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			log.Error("failed to decode withdrawal: ", err)
+			h.httpError(w, r, "Invalid request", http.StatusBadRequest, problem.InvalidRequest)
 			return
 		}
-		// Check if the withdrawal is valid
-		if ok, err := auth.ValidateOrderNumber(withdrawal.Order); !ok {
-			h.logger.Error("invalid order number: ", err)
-			http.Error(w, "Invalid order number", http.StatusUnprocessableEntity)
+		// Check if the withdrawal is valid, the sum against the minimum of the tenant
+		normalizeWithdrawal(&withdrawal)
+		r = r.WithContext(withMinWithdrawal(r.Context(), h.minWithdrawalFor(r.Context())))
+		if !h.validRequest(w, r, &withdrawal, http.StatusUnprocessableEntity) {
 			return
 		}
 		withdrawal.UserID = userID
 		// Withdraw the balance
-		err = h.storage.Withdraw(r.Context(), &withdrawal)
+		err = h.withdrawals.Withdraw(r.Context(), &withdrawal)
 		if err != nil {
 			if errors.Is(err, db.ErrInsufficientBalance) {
-				h.logger.Error("insufficient balance: ", err)
-				http.Error(w, "Insufficient balance", http.StatusPaymentRequired)
+				log.Error("insufficient balance: ", err)
+				h.httpError(w, r, "Insufficient balance", http.StatusPaymentRequired, problem.InsufficientBalance)
+				return
+			}
+			var limitErr *db.DailyLimitError
+			if errors.As(err, &limitErr) {
+				log.Error("daily withdrawal limit exceeded: ", err)
+				h.retryError(w, r, dailyLimitDetail(limitErr), problem.DailyLimitExceeded, limitErr.ResetAt)
 				return
 			}
 			if errors.Is(err, db.ErrOrderAlreadyExists) {
-				h.logger.Error("withdrawal order number already exists: ", err)
-				http.Error(w, "Withdrawal order number already exists", http.StatusConflict)
+				log.Error("withdrawal order number already exists: ", err)
+				h.httpError(w, r, "Withdrawal order number already exists", http.StatusConflict, problem.WithdrawalExists)
+				return
+			}
+			if errors.Is(err, db.ErrOrderNumberUsed) {
+				log.Error("withdrawal order number is used: ", err)
+				h.httpError(w, r, "Order number is already used by another order", http.StatusConflict, problem.OrderNumberUsed)
 				return
 			}
-			h.logger.Error("failed to withdraw balance: ", err)
-			http.Error(w, "Failed to withdraw balance", http.StatusInternalServerError)
+			log.Error("failed to withdraw balance: ", err)
+			h.storageError(w, r, "Failed to withdraw balance", err)
 			return
 		}
+		// Notify the user's live connections about the balance change
+		if h.events != nil {
+			h.events.Publish(models.WithdrawalEvent{UserID: userID, Order: withdrawal.Order, Sum: withdrawal.Sum, At: h.clock.Now()})
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+// normalizeWithdrawal brings the withdrawal to the canonical form before it is validated:
+// the order number without the separators and the trimmed description.
+func normalizeWithdrawal(withdrawal *models.Withdrawal) {
+	withdrawal.Order = auth.NormalizeOrderNumber(withdrawal.Order)
+	withdrawal.Description = strings.TrimSpace(withdrawal.Description)
+}
+
+// dailyLimitDetail describes the exceeded daily withdrawal cap and when it resets.
+func dailyLimitDetail(e *db.DailyLimitError) string {
+	scope := "Daily"
+	if e.Global {
+		scope = "Global daily"
+	}
+	return fmt.Sprintf("%s withdrawal limit of %.2f exceeded, %.2f already withdrawn, resets at %s",
+		scope, e.Limit.Float64(), e.Used.Float64(), e.ResetAt.UTC().Format(time.RFC3339))
+}
+
 // GetWithdrawals returns all withdrawals for a user.
 func (h *Handler) GetWithdrawals() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Debug("Getting withdrawals request")
+		log := h.log(r)
+		log.Debug("Getting withdrawals request")
 
 		// Get the user ID from the context
 		userID, err := auth.GetUserIDFromCtx(r.Context())
 		if err != nil {
-			h.logger.Error("failed to get user ID: ", err)
-			http.Error(w, "Failed to get user ID", http.StatusUnauthorized)
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		log.Debug("User ID: ", userID)
+		// Parse the page and the filter from the query
+		q, err := parseWithdrawalQuery(r.URL.Query())
+		if err != nil {
+			log.Error("invalid withdrawals query: ", err)
+			h.httpError(w, r, "Invalid query", http.StatusBadRequest, problem.InvalidRequest)
 			return
 		}
-		h.logger.Debug("User ID: ", userID)
 		// Get the withdrawals from the database
-		withdrawals, err := h.storage.GetWithdrawals(r.Context(), userID)
+		withdrawals, err := h.getWithdrawals(w, r, userID, q)
 		if err != nil {
-			h.logger.Error("failed to get withdrawals: ", err)
-			http.Error(w, "Failed to get withdrawals", http.StatusInternalServerError)
+			log.Error("failed to get withdrawals: ", err)
+			h.storageError(w, r, "Failed to get withdrawals", err)
 			return
 		}
-		h.logger.Debug("Withdrawals: ", withdrawals)
+		log.Debug("Withdrawals: ", withdrawals)
 		// Return 204 if no withdrawals found for user - no content
 		if len(withdrawals) == 0 {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
-		// Return the withdrawals
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(withdrawals); err != nil {
-			h.logger.Error("failed to encode withdrawals: ", err)
+		// Return the withdrawals in XML if the client prefers it
+		w.Header().Add("Vary", "Accept")
+		if wantsXML(r) {
+			h.writeXML(w, r, http.StatusOK, xmlWithdrawals{Withdrawals: withdrawals})
+			return
 		}
+		h.respondJSON(w, r, http.StatusOK, withdrawals)
+	}
+}
+
+// GetTransactions returns the user's ledger of accruals and withdrawals with the running balance.
+func (h *Handler) GetTransactions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting transactions request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Get the transactions from the database
+		transactions, err := h.withdrawals.GetTransactions(r.Context(), userID)
+		if err != nil {
+			log.Error("failed to get transactions: ", err)
+			h.storageError(w, r, "Failed to get transactions", err)
+			return
+		}
+		// Return 204 if the user has no transactions
+		if len(transactions) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Return the transactions
+		h.respondJSON(w, r, http.StatusOK, transactions)
 	}
 }
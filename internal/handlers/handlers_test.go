@@ -4,41 +4,91 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
 	"loyaltySys/internal/auth"
-	"loyaltySys/internal/handlers/mocks"
+	"loyaltySys/internal/captcha"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/middleware"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/repository/mocks"
+	"loyaltySys/internal/tenant"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"loyaltySys/internal/db"
+	"loyaltySys/internal/dispatch"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/go-resty/resty/v2"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func testEnv(t *testing.T) (*httptest.Server, *mocks.Storage, *chi.Mux, *Handler) {
+// stores are the mocked stores of the handler.
+type stores struct {
+	users       *mocks.UserStore
+	orders      *mocks.OrderStore
+	withdrawals *mocks.WithdrawalStore
+	webhooks    *mocks.WebhookStore
+	health      *mocks.HealthStore
+}
+
+func testEnv(t *testing.T, opts ...Option) (*httptest.Server, *stores, *chi.Mux, *Handler) {
 	t.Helper()
 	logger := zap.NewNop().Sugar()
 
 	t.Setenv("AUTH_SECRET", "test-secret")
 	auth.InitJWTFromEnv(logger)
 
-	st := mocks.NewStorage(t)
-	h := NewHandler(st, logger)
+	st := &stores{
+		users:       mocks.NewUserStore(t),
+		orders:      mocks.NewOrderStore(t),
+		withdrawals: mocks.NewWithdrawalStore(t),
+		webhooks:    mocks.NewWebhookStore(t),
+		health:      mocks.NewHealthStore(t),
+	}
+	repo := &repository.Repository{Users: st.users, Orders: st.orders, Withdrawals: st.withdrawals, Webhooks: st.webhooks, Health: st.health}
+	h := NewHandler(repo, append([]Option{WithLogger(logger)}, opts...)...)
 	r := chi.NewRouter()
 	srv := httptest.NewServer(r)
 
 	return srv, st, r, h
 }
 
+// respBody returns the response body, or the detail of the problem of an error response.
+func respBody(t *testing.T, resp *resty.Response) string {
+	t.Helper()
+	if resp.Header().Get("Content-Type") != problem.ContentType {
+		return resp.String()
+	}
+	p := problem.Problem{}
+	assert.NoError(t, json.Unmarshal(resp.Body(), &p))
+	assert.Equal(t, resp.StatusCode(), p.Status)
+	assert.NotEmpty(t, p.Code)
+	return p.Detail
+}
+
 // Injects a JWT token with the user_id claim into the request context.
 func injectUserID(r *http.Request, id int64) *http.Request {
 	token := jwtauth.New("HS256", []byte("test-secret"), nil)
@@ -68,13 +118,13 @@ func TestHandler_CreateUser(t *testing.T) {
 		{
 			name:         "add_user",
 			requestBody:  testUser,
-			EXPECT:       st.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(testUserID, nil).Once(),
+			EXPECT:       st.users.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(testUserID, nil).Once(),
 			expectedCode: http.StatusOK,
 		},
 		{
 			name:         "user_exists",
 			requestBody:  testUser,
-			EXPECT:       st.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(int64(-1), db.ErrUserAlreadyExists).Once(),
+			EXPECT:       st.users.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(int64(-1), db.ErrUserAlreadyExists).Once(),
 			expectedCode: http.StatusConflict,
 		},
 		{
@@ -101,6 +151,60 @@ func TestHandler_CreateUser(t *testing.T) {
 
 }
 
+// captchaStub accepts only the "solved" token.
+type captchaStub struct{}
+
+func (captchaStub) Verify(_ context.Context, token, _ string) error {
+	if token != "solved" {
+		return captcha.ErrInvalidToken
+	}
+	return nil
+}
+
+func TestHandler_CreateUser_Captcha(t *testing.T) {
+	srv, st, r, h := testEnv(t, WithCaptcha(captchaStub{}))
+	defer srv.Close()
+
+	r.Post("/api/user/register", h.CreateUser())
+
+	var tests = []struct {
+		name         string
+		captchaToken string
+		EXPECT       *mock.Call
+		expectedCode int
+	}{
+		{
+			name:         "valid_captcha",
+			captchaToken: "solved",
+			EXPECT:       st.users.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(int64(1), nil).Once(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid_captcha",
+			captchaToken: "wrong",
+			EXPECT:       nil,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "missing_captcha",
+			captchaToken: "",
+			EXPECT:       nil,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("X-Captcha-Token", tt.captchaToken).
+				SetBody(&models.User{Login: "test1", Password: "test1"}).
+				Post(srv.URL + "/api/user/register")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+		})
+	}
+}
+
 func TestHandler_LoginUser(t *testing.T) {
 	srv, st, r, h := testEnv(t)
 	defer srv.Close()
@@ -122,13 +226,13 @@ func TestHandler_LoginUser(t *testing.T) {
 		{
 			name:         "login_user",
 			requestBody:  testUser,
-			EXPECT:       st.EXPECT().GetUser(mock.Anything, mock.Anything).Return(registeredUser, nil).Once(),
+			EXPECT:       st.users.EXPECT().GetUser(mock.Anything, mock.Anything).Return(registeredUser, nil).Once(),
 			expectedCode: http.StatusOK,
 		},
 		{
 			name:         "user_not_found",
 			requestBody:  testUser,
-			EXPECT:       st.EXPECT().GetUser(mock.Anything, mock.Anything).Return(nil, db.ErrUserNotFound).Once(),
+			EXPECT:       st.users.EXPECT().GetUser(mock.Anything, mock.Anything).Return(nil, db.ErrUserNotFound).Once(),
 			expectedCode: http.StatusUnauthorized,
 		},
 		{
@@ -155,12 +259,54 @@ func TestHandler_LoginUser(t *testing.T) {
 
 }
 
+func TestHandler_LoginUser_PasswordUpgrade(t *testing.T) {
+	passwords, err := auth.NewPasswordHasher(bcrypt.MinCost + 1)
+	assert.NoError(t, err)
+	srv, st, r, h := testEnv(t, WithPasswordHasher(passwords), WithMetrics(metrics.NewRegistry()))
+	defer srv.Close()
+	r.Post("/api/user/login", h.LoginUser())
+
+	oldHash, err := bcrypt.GenerateFromPassword([]byte("test1"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	currentHash, err := passwords.Hash("test1")
+	assert.NoError(t, err)
+	login := func() int {
+		resp, err := resty.New().R().SetBody(&models.User{Login: "test1", Password: "test1"}).Post(srv.URL + "/api/user/login")
+		assert.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	// the hash of the old cost is rewritten with the configured one
+	st.users.EXPECT().GetUser(mock.Anything, "test1").Return(&models.User{ID: 1, Login: "test1", Password: string(oldHash)}, nil).Once()
+	st.users.EXPECT().UpdatePasswordHash(mock.Anything, int64(1), string(oldHash), mock.Anything).
+		RunAndReturn(func(_ context.Context, _ int64, _, newHash string) error {
+			assert.NoError(t, passwords.Compare(newHash, "test1"))
+			assert.False(t, passwords.NeedsRehash(newHash))
+			return nil
+		}).Once()
+	assert.Equal(t, http.StatusOK, login())
+
+	// the failed upgrade doesn't fail the login
+	st.users.EXPECT().GetUser(mock.Anything, "test1").Return(&models.User{ID: 1, Login: "test1", Password: string(oldHash)}, nil).Once()
+	st.users.EXPECT().UpdatePasswordHash(mock.Anything, int64(1), string(oldHash), mock.Anything).Return(assert.AnError).Once()
+	assert.Equal(t, http.StatusOK, login())
+
+	// the current hash is kept
+	st.users.EXPECT().GetUser(mock.Anything, "test1").Return(&models.User{ID: 1, Login: "test1", Password: currentHash}, nil).Once()
+	assert.Equal(t, http.StatusOK, login())
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(h.hashMetrics.logins.WithLabelValues("true")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.hashMetrics.logins.WithLabelValues("false")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.hashMetrics.upgrades.WithLabelValues(upgradeUpgraded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.hashMetrics.upgrades.WithLabelValues(upgradeFailed)))
+}
+
 func TestHandler_CreateOrder(t *testing.T) {
 	srv, st, r, h := testEnv(t)
 	defer srv.Close()
 
 	userID := int64(1)
-	token, err := auth.GenerateToken(userID)
+	token, err := auth.GenerateToken(time.Now(), userID)
 	assert.NoError(t, err)
 
 	r.Group(func(r chi.Router) {
@@ -171,6 +317,7 @@ func TestHandler_CreateOrder(t *testing.T) {
 
 	var tests = []struct {
 		name         string
+		contentType  string
 		order        string
 		token        string
 		EXPECT       *mock.Call
@@ -180,21 +327,21 @@ func TestHandler_CreateOrder(t *testing.T) {
 			name:         "valid_order",
 			order:        "12345678903",
 			token:        token,
-			EXPECT:       st.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(nil).Once(),
+			EXPECT:       st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(nil).Once(),
 			expectedCode: http.StatusAccepted,
 		},
 		{
 			name:         "order_already_added",
 			order:        "12345678903",
 			token:        token,
-			EXPECT:       st.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyAdded).Once(),
+			EXPECT:       st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyAdded).Once(),
 			expectedCode: http.StatusConflict,
 		},
 		{
 			name:         "order_already_added_by_this_user",
 			order:        "12345678903",
 			token:        token,
-			EXPECT:       st.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyExists).Once(),
+			EXPECT:       st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyExists).Once(),
 			expectedCode: http.StatusOK,
 		},
 		{
@@ -211,6 +358,60 @@ func TestHandler_CreateOrder(t *testing.T) {
 			EXPECT:       nil,
 			expectedCode: http.StatusUnprocessableEntity,
 		},
+		{
+			name:  "separated_order_number",
+			order: " 1234 5678-903\n",
+			token: token,
+			EXPECT: st.orders.EXPECT().CreateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool {
+				return o.Number == "12345678903"
+			})).Return(nil).Once(),
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "non_digit_order_number",
+			order:        "1234567890a",
+			token:        token,
+			EXPECT:       nil,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "valid_order_json",
+			contentType: "application/json; charset=utf-8",
+			order:       `{"order":"79927398713"}`,
+			token:       token,
+			EXPECT: st.orders.EXPECT().CreateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool {
+				return o.Number == "79927398713" && o.UserID == userID
+			})).Return(nil).Once(),
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "invalid_order_number_json",
+			contentType:  "application/json",
+			order:        `{"order":"1234567890123"}`,
+			token:        token,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "invalid_json",
+			contentType:  "application/json",
+			order:        `12345678903`,
+			token:        token,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unsupported_content_type",
+			contentType:  "application/xml",
+			order:        `<order>12345678903</order>`,
+			token:        token,
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:         "form_content_type",
+			contentType:  "application/x-www-form-urlencoded",
+			order:        "12345678903",
+			token:        token,
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
 		{
 			name:         "user_not_authenticated",
 			order:        "12345678903",
@@ -222,13 +423,20 @@ func TestHandler_CreateOrder(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "text/plain"
+			}
 			resp, err := resty.New().R().
 				SetHeader("Authorization", "Bearer "+tt.token).
-				SetHeader("Content-Type", "text/plain").
+				SetHeader("Content-Type", contentType).
 				SetBody(tt.order).
 				Post(srv.URL + "/api/user/orders")
 			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			if tt.expectedCode == http.StatusUnsupportedMediaType {
+				assert.Equal(t, "text/plain, application/json", resp.Header().Get("Accept-Post"))
+			}
 		})
 	}
 }
@@ -238,7 +446,7 @@ func TestHandler_GetOrders(t *testing.T) {
 	defer srv.Close()
 
 	userID := int64(1)
-	token, err := auth.GenerateToken(userID)
+	token, err := auth.GenerateToken(time.Now(), userID)
 	assert.NoError(t, err)
 
 	r.Group(func(r chi.Router) {
@@ -246,6 +454,7 @@ func TestHandler_GetOrders(t *testing.T) {
 		r.Use(jwtauth.Authenticator(auth.TokenAuth))
 		r.Get("/api/user/orders", h.GetOrders())
 	})
+	st.orders.EXPECT().GetOrdersVersion(mock.Anything, userID).Return("1-1", nil).Maybe()
 
 	uploadedAt, err := time.Parse("2006-01-02T15:04:05-07:00", "2020-12-10T15:15:45+03:00")
 	assert.NoError(t, err)
@@ -271,27 +480,112 @@ func TestHandler_GetOrders(t *testing.T) {
 		},
 	}
 
+	cursor := models.Cursor{At: uploadedAt, Key: "12345678903"}
+
 	var tests = []struct {
-		name         string
-		token        string
-		EXPECT       *mock.Call
-		expectedCode int
-		expectedBody string
+		name           string
+		token          string
+		query          string
+		EXPECT         *mock.Call
+		expectedCode   int
+		expectedBody   string
+		expectedCursor string
 	}{
 		{
 			name:         "successful_request",
 			token:        token,
-			EXPECT:       st.EXPECT().GetOrders(mock.Anything, mock.Anything).Return(orders, nil).Once(),
+			EXPECT:       st.orders.EXPECT().GetOrders(mock.Anything, mock.Anything, models.OrderFilter{}).Return(orders, nil).Once(),
 			expectedCode: http.StatusOK,
 			expectedBody: `[{"number":"9278923470","status":"PROCESSED","uploaded_at":"2020-12-10T15:15:45+03:00"},{"number":"12345678903","status":"PROCESSING","uploaded_at":"2020-12-10T15:15:45+03:00"},{"number":"346436439","status":"INVALID","uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
 		},
 		{
 			name:         "no_orders",
 			token:        token,
-			EXPECT:       st.EXPECT().GetOrders(mock.Anything, mock.Anything).Return([]models.Order{}, nil).Once(),
+			EXPECT:       st.orders.EXPECT().GetOrders(mock.Anything, mock.Anything, models.OrderFilter{}).Return([]models.Order{}, nil).Once(),
 			expectedCode: http.StatusNoContent,
 			expectedBody: "",
 		},
+		{
+			name:  "filtered_orders",
+			token: token,
+			query: "?status=PROCESSED,invalid&from=2020-12-01T00:00:00Z&to=2020-12-31T00:00:00Z",
+			EXPECT: st.orders.EXPECT().GetOrders(mock.Anything, mock.Anything, models.OrderFilter{
+				Statuses: []models.OrderStatus{models.StatusProcessed, models.StatusInvalid},
+				From:     time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+				To:       time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC),
+			}).Return(orders[:1], nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"number":"9278923470","status":"PROCESSED","uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "sorted_by_accrual",
+			token: token,
+			query: "?sort=accrual&order=desc",
+			EXPECT: st.orders.EXPECT().GetOrders(mock.Anything, mock.Anything, models.OrderFilter{
+				Sort: models.Sort{Field: models.SortAccrual, Order: models.SortDesc},
+			}).Return(orders[:1], nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"number":"9278923470","status":"PROCESSED","uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "first_page",
+			token: token,
+			query: "?limit=2&status=PROCESSED,PROCESSING",
+			EXPECT: st.orders.EXPECT().GetOrdersPage(mock.Anything, mock.Anything,
+				models.OrderFilter{Statuses: []models.OrderStatus{models.StatusProcessed, models.StatusProcessing}},
+				models.Page{Limit: 2},
+			).Return(&models.OrdersPage{Orders: orders[:2], Next: &cursor}, nil).Once(),
+			expectedCode:   http.StatusOK,
+			expectedBody:   `[{"number":"9278923470","status":"PROCESSED","uploaded_at":"2020-12-10T15:15:45+03:00"},{"number":"12345678903","status":"PROCESSING","uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedCursor: encodeCursor(cursor),
+		},
+		{
+			name:  "last_page",
+			token: token,
+			query: "?limit=2&cursor=" + encodeCursor(cursor),
+			EXPECT: st.orders.EXPECT().GetOrdersPage(mock.Anything, mock.Anything, models.OrderFilter{}, mock.MatchedBy(func(p models.Page) bool {
+				return p.Limit == 2 && p.After != nil && p.After.At.Equal(cursor.At) && p.After.Key == cursor.Key
+			})).Return(&models.OrdersPage{Orders: orders[2:]}, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"number":"346436439","status":"INVALID","uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:         "cursor_without_limit",
+			token:        token,
+			query:        "?cursor=" + encodeCursor(cursor),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid filter",
+		},
+		{
+			name:         "sort_does_not_match_cursor",
+			token:        token,
+			query:        "?limit=2&sort=accrual&cursor=" + encodeCursor(cursor),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid filter",
+		},
+		{
+			name:         "unknown_sort",
+			token:        token,
+			query:        "?sort=status",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid filter",
+		},
+		{
+			name:         "unknown_status",
+			token:        token,
+			query:        "?status=DONE",
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid filter",
+		},
+		{
+			name:         "invalid_date_range",
+			token:        token,
+			query:        "?from=2020-12-31T00:00:00Z&to=2020-12-01T00:00:00Z",
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid filter",
+		},
 		{
 			name:         "user_not_authenticated",
 			token:        "wrong_token",
@@ -305,229 +599,2993 @@ func TestHandler_GetOrders(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			resp, err := resty.New().R().
 				SetHeader("Authorization", "Bearer "+tt.token).
-				Get(srv.URL + "/api/user/orders")
+				Get(srv.URL + "/api/user/orders" + tt.query)
 			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedCode, resp.StatusCode())
-			assert.Equal(t, tt.expectedBody, resp.String())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			assert.Equal(t, tt.expectedCursor, resp.Header().Get("X-Next-Cursor"))
 		})
 	}
 }
 
-func TestHandler_GetBalance(t *testing.T) {
+func TestHandler_GetOrder(t *testing.T) {
 	srv, st, r, h := testEnv(t)
 	defer srv.Close()
 
-	userID := int64(1)
-	token, err := auth.GenerateToken(userID)
+	token, err := auth.GenerateToken(time.Now(), 1)
 	assert.NoError(t, err)
 
 	r.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(auth.TokenAuth))
 		r.Use(jwtauth.Authenticator(auth.TokenAuth))
-		r.Get("/api/user/balance", h.GetBalance())
+		r.Get("/api/user/orders/{number}", h.GetOrder())
 	})
 
+	uploadedAt, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	processedAt := uploadedAt.Add(time.Minute)
+	order := &models.OrderDetail{
+		Order: models.Order{Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), UploadedAt: uploadedAt},
+		History: []models.OrderStatusChange{
+			{Status: models.StatusNew, ChangedAt: uploadedAt},
+			{Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), ChangedAt: processedAt},
+		},
+	}
+
 	var tests = []struct {
 		name         string
-		token        string
+		number       string
 		EXPECT       *mock.Call
 		expectedCode int
 		expectedBody string
 	}{
 		{
-			name:  "successful_request",
-			token: token,
-			EXPECT: st.EXPECT().GetBalance(mock.Anything, mock.Anything).Return(&models.Balance{
-				Current:   500.5,
-				Withdrawn: 42.0,
-			}, nil).Once(),
+			name:         "order_found",
+			number:       "9278923470",
+			EXPECT:       st.orders.EXPECT().GetOrder(mock.Anything, int64(1), "9278923470").Return(order, nil).Once(),
 			expectedCode: http.StatusOK,
-			expectedBody: `{"current":500.5,"withdrawn":42}`,
+			expectedBody: `{"number":"9278923470","status":"PROCESSED","accrual":500,"uploaded_at":"2020-12-10T15:15:45+03:00","history":[{"status":"NEW","changed_at":"2020-12-10T15:15:45+03:00"},{"status":"PROCESSED","accrual":500,"changed_at":"2020-12-10T15:16:45+03:00"}]}`,
 		},
 		{
-			name:         "user_not_authenticated",
-			token:        "wrong_token",
+			name:         "order_of_another_user",
+			number:       "12345678903",
+			EXPECT:       st.orders.EXPECT().GetOrder(mock.Anything, int64(1), "12345678903").Return(nil, db.ErrOrderNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Order not found",
+		},
+		{
+			name:         "invalid_number",
+			number:       "12345",
 			EXPECT:       nil,
-			expectedCode: http.StatusUnauthorized,
-			expectedBody: "token is unauthorized",
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid order number",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			resp, err := resty.New().R().
-				SetHeader("Authorization", "Bearer "+tt.token).
-				Get(srv.URL + "/api/user/balance")
+				SetHeader("Authorization", "Bearer "+token).
+				Get(srv.URL + "/api/user/orders/" + tt.number)
 			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedCode, resp.StatusCode())
-			assert.Equal(t, tt.expectedBody, resp.String())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
 		})
 	}
 }
 
-func TestHandler_Withdraw(t *testing.T) {
-
+func TestHandler_DeleteOrder(t *testing.T) {
 	srv, st, r, h := testEnv(t)
 	defer srv.Close()
 
-	userID := int64(1)
-	token, err := auth.GenerateToken(userID)
+	token, err := auth.GenerateToken(time.Now(), 1)
 	assert.NoError(t, err)
 
 	r.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(auth.TokenAuth))
 		r.Use(jwtauth.Authenticator(auth.TokenAuth))
-		r.Post("/api/user/balance/withdraw", h.Withdraw())
+		r.Delete("/api/user/orders/{number}", h.DeleteOrder())
 	})
 
 	var tests = []struct {
 		name         string
-		withdraw     *models.Withdrawal
-		token        string
+		number       string
 		EXPECT       *mock.Call
 		expectedCode int
+		expectedBody string
 	}{
 		{
-			name: "successful_withdraw",
-			withdraw: &models.Withdrawal{
-				Order: "9278923470",
-				Sum:   10.0,
-			},
-			token:        token,
-			EXPECT:       st.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(nil).Once(),
-			expectedCode: http.StatusOK,
+			name:         "new_order",
+			number:       "9278923470",
+			EXPECT:       st.orders.EXPECT().DeleteOrder(mock.Anything, int64(1), "9278923470").Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+			expectedBody: "",
 		},
 		{
-			name: "incuficient_balance",
-			withdraw: &models.Withdrawal{
-				Order: "12345678903",
-				Sum:   10.0,
-			},
-			token:        token,
-			EXPECT:       st.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(db.ErrInsufficientBalance).Once(),
-			expectedCode: http.StatusPaymentRequired,
+			name:         "processed_order",
+			number:       "12345678903",
+			EXPECT:       st.orders.EXPECT().DeleteOrder(mock.Anything, int64(1), "12345678903").Return(db.ErrOrderNotNew).Once(),
+			expectedCode: http.StatusConflict,
+			expectedBody: "Order processing has started",
 		},
 		{
-			name: "invalid_order_number",
-			withdraw: &models.Withdrawal{
-				Order: "1234567890123",
-				Sum:   10.0,
-			},
-			token:        token,
-			EXPECT:       nil,
-			expectedCode: http.StatusUnprocessableEntity,
+			name:         "order_of_another_user",
+			number:       "79927398713",
+			EXPECT:       st.orders.EXPECT().DeleteOrder(mock.Anything, int64(1), "79927398713").Return(db.ErrOrderNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Order not found",
 		},
 		{
-			name: "invalid_request",
-			withdraw: &models.Withdrawal{
-				Order: "",
-				Sum:   10.0,
-			},
-			token:        token,
+			name:         "invalid_number",
+			number:       "12345",
 			EXPECT:       nil,
 			expectedCode: http.StatusUnprocessableEntity,
-		},
-		{
-			name: "user_not_authenticated",
-			withdraw: &models.Withdrawal{
-				Order: "12345678903",
-				Sum:   10.0,
-			},
-			token:        "wrong_token",
-			EXPECT:       nil,
-			expectedCode: http.StatusUnauthorized,
+			expectedBody: "Invalid order number",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			resp, err := resty.New().R().
-				SetHeader("Authorization", "Bearer "+tt.token).
-				SetHeader("Content-Type", "application/json").
-				SetBody(tt.withdraw).
-				Post(srv.URL + "/api/user/balance/withdraw")
+				SetHeader("Authorization", "Bearer "+token).
+				Delete(srv.URL + "/api/user/orders/" + tt.number)
 			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
 		})
 	}
 }
 
-func TestHandler_GetWithdrawals(t *testing.T) {
+func TestHandler_GetOrdersStatus(t *testing.T) {
 	srv, st, r, h := testEnv(t)
 	defer srv.Close()
 
 	userID := int64(1)
-	token, err := auth.GenerateToken(userID)
+	token, err := auth.GenerateToken(time.Now(), userID)
 	assert.NoError(t, err)
 
 	r.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(auth.TokenAuth))
 		r.Use(jwtauth.Authenticator(auth.TokenAuth))
-		r.Get("/api/user/withdrawals", h.GetWithdrawals())
+		r.Post("/api/user/orders/status", h.GetOrdersStatus())
 	})
 
 	uploadedAt, err := time.Parse("2006-01-02T15:04:05-07:00", "2020-12-10T15:15:45+03:00")
 	assert.NoError(t, err)
-
-	withdrawals := []models.Withdrawal{
-		{
-			UserID:      1,
-			Order:       "9278923470",
-			Sum:         10.0,
-			ProcessedAt: uploadedAt,
-		},
-		{
-			UserID:      1,
-			Order:       "12345678903",
-			Sum:         15.0,
-			ProcessedAt: uploadedAt,
-		},
-		{
-			UserID:      1,
-			Order:       "346436439",
-			Sum:         20.0,
-			ProcessedAt: uploadedAt,
-		},
+	tooMany := make([]string, 101)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i)
 	}
 
 	var tests = []struct {
 		name         string
-		token        string
+		body         any
 		EXPECT       *mock.Call
 		expectedCode int
 		expectedBody string
 	}{
 		{
-			name:         "successful_request",
-			token:        token,
-			EXPECT:       st.EXPECT().GetWithdrawals(mock.Anything, mock.Anything).Return(withdrawals, nil).Once(),
+			name: "successful_request",
+			body: []string{"9278923470", "12345678903"},
+			EXPECT: st.orders.EXPECT().GetOrdersByNumbers(mock.Anything, userID, []string{"9278923470", "12345678903"}).Return([]models.Order{
+				{Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), UploadedAt: uploadedAt},
+			}, nil).Once(),
 			expectedCode: http.StatusOK,
-			expectedBody: `[{"order":"9278923470","sum":10,"processed_at":"2020-12-10T15:15:45+03:00"},{"order":"12345678903","sum":15,"processed_at":"2020-12-10T15:15:45+03:00"},{"order":"346436439","sum":20,"processed_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedBody: `[{"number":"9278923470","status":"PROCESSED","accrual":500,"uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
 		},
 		{
-			name:         "no_withdrawals",
-			token:        token,
-			EXPECT:       st.EXPECT().GetWithdrawals(mock.Anything, mock.Anything).Return([]models.Withdrawal{}, nil).Once(),
-			expectedCode: http.StatusNoContent,
-			expectedBody: "",
+			name:         "empty_list",
+			body:         []string{},
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
 		},
 		{
-			name:         "user_not_authenticated",
-			token:        "wrong_token",
+			name:         "too_many_orders",
+			body:         tooMany,
 			EXPECT:       nil,
-			expectedCode: http.StatusUnauthorized,
-			expectedBody: "token is unauthorized",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid_body",
+			body:         map[string]string{"order": "9278923470"},
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			resp, err := resty.New().R().
-				SetHeader("Authorization", "Bearer "+tt.token).
-				Get(srv.URL + "/api/user/withdrawals")
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/user/orders/status")
 			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedCode, resp.StatusCode())
-			assert.Equal(t, tt.expectedBody, resp.String())
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			}
 		})
 	}
 }
+
+func TestHandler_GetBalance(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	userID := int64(1)
+	token, err := auth.GenerateToken(time.Now(), userID)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/balance", h.GetBalance())
+	})
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, userID).Return("1-1-0", nil).Maybe()
+
+	var tests = []struct {
+		name               string
+		token              string
+		EXPECT             *mock.Call
+		expectedCode       int
+		expectedBody       string
+		expectedRetryAfter string
+	}{
+		{
+			name:  "successful_request",
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().GetBalance(mock.Anything, mock.Anything).Return(&models.Balance{
+				Current:   models.MoneyFromFloat(500.5),
+				Withdrawn: models.MoneyFromFloat(42),
+			}, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"current":500.5,"withdrawn":42}`,
+		},
+		{
+			name:         "user_not_authenticated",
+			token:        "wrong_token",
+			EXPECT:       nil,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "token is unauthorized",
+		},
+		{
+			name:  "storage_unavailable",
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().GetBalance(mock.Anything, mock.Anything).
+				Return(nil, &db.RetryError{Attempts: 3, Err: &pgconn.PgError{Code: pgerrcode.AdminShutdown}}).Once(),
+			expectedCode:       http.StatusServiceUnavailable,
+			expectedBody:       "Failed to get balance",
+			expectedRetryAfter: "1",
+		},
+		{
+			name:  "storage_timeout",
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().GetBalance(mock.Anything, mock.Anything).
+				Return(nil, fmt.Errorf("failed to get balance: %w", context.DeadlineExceeded)).Once(),
+			expectedCode:       http.StatusServiceUnavailable,
+			expectedBody:       "Failed to get balance",
+			expectedRetryAfter: "1",
+		},
+		{
+			name:  "user_deleted",
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().GetBalance(mock.Anything, mock.Anything).
+				Return(nil, fmt.Errorf("failed to get balance: %w", db.ErrUserNotFound)).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Failed to get balance",
+		},
+		{
+			name:         "storage_failed",
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().GetBalance(mock.Anything, mock.Anything).Return(nil, &pgconn.PgError{Code: pgerrcode.UndefinedTable}).Once(),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to get balance",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+tt.token).
+				Get(srv.URL + "/api/user/balance")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			assert.Equal(t, tt.expectedRetryAfter, resp.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestHandler_GetBalanceHistory(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/balance/history", h.GetBalanceHistory())
+	})
+
+	from, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	assert.NoError(t, err)
+	history := []models.BalanceSnapshot{
+		{Date: "2024-01-01", Current: models.MoneyFromFloat(500), Withdrawn: models.MoneyFromFloat(0)},
+		{Date: "2024-01-02", Current: models.MoneyFromFloat(379.5), Withdrawn: models.MoneyFromFloat(120.5)},
+	}
+
+	var tests = []struct {
+		name         string
+		query        string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "history",
+			EXPECT:       st.withdrawals.EXPECT().GetBalanceHistory(mock.Anything, int64(1), time.Time{}, time.Time{}).Return(history, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"date":"2024-01-01","current":500,"withdrawn":0},{"date":"2024-01-02","current":379.5,"withdrawn":120.5}]`,
+		},
+		{
+			name:         "no_snapshots_in_range",
+			query:        "?from=2024-01-01T00:00:00Z",
+			EXPECT:       st.withdrawals.EXPECT().GetBalanceHistory(mock.Anything, int64(1), from, time.Time{}).Return([]models.BalanceSnapshot{}, nil).Once(),
+			expectedCode: http.StatusNoContent,
+			expectedBody: "",
+		},
+		{
+			name:         "invalid_range",
+			query:        "?from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z",
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Get(srv.URL + "/api/user/balance/history" + tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_Withdraw(t *testing.T) {
+
+	srv, st, r, h := testEnv(t, WithMinWithdrawal(models.MoneyFromFloat(1)))
+	defer srv.Close()
+
+	userID := int64(1)
+	token, err := auth.GenerateToken(time.Now(), userID)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/balance/withdraw", h.Withdraw())
+	})
+
+	var tests = []struct {
+		name         string
+		withdraw     *models.Withdrawal
+		token        string
+		EXPECT       *mock.Call
+		expectedCode int
+	}{
+		{
+			name: "successful_withdraw",
+			withdraw: &models.Withdrawal{
+				Order: "9278923470",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(nil).Once(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "incuficient_balance",
+			withdraw: &models.Withdrawal{
+				Order: "12345678903",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(db.ErrInsufficientBalance).Once(),
+			expectedCode: http.StatusPaymentRequired,
+		},
+		{
+			name: "order_number_used",
+			withdraw: &models.Withdrawal{
+				Order: "12345678903",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(db.ErrOrderNumberUsed).Once(),
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name: "invalid_order_number",
+			withdraw: &models.Withdrawal{
+				Order: "1234567890123",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        token,
+			EXPECT:       nil,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "invalid_request",
+			withdraw: &models.Withdrawal{
+				Order: "",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        token,
+			EXPECT:       nil,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "with_description",
+			withdraw: &models.Withdrawal{
+				Order:       "79927398713",
+				Sum:         models.MoneyFromFloat(10),
+				Description: "  Coffee ",
+			},
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.MatchedBy(func(w *models.Withdrawal) bool {
+				return w.Order == "79927398713" && w.Description == "Coffee"
+			})).Return(nil).Once(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "separated_order_number",
+			withdraw: &models.Withdrawal{
+				Order: "7992-7398-713",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token: token,
+			EXPECT: st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.MatchedBy(func(w *models.Withdrawal) bool {
+				return w.Order == "79927398713"
+			})).Return(nil).Once(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "description_too_long",
+			withdraw: &models.Withdrawal{
+				Order:       "79927398713",
+				Sum:         models.MoneyFromFloat(10),
+				Description: strings.Repeat("ы", 256),
+			},
+			token:        token,
+			EXPECT:       nil,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "below_minimum",
+			withdraw: &models.Withdrawal{
+				Order: "9278923470",
+				Sum:   models.MoneyFromFloat(0.5),
+			},
+			token:        token,
+			EXPECT:       nil,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "user_not_authenticated",
+			withdraw: &models.Withdrawal{
+				Order: "12345678903",
+				Sum:   models.MoneyFromFloat(10),
+			},
+			token:        "wrong_token",
+			EXPECT:       nil,
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+tt.token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.withdraw).
+				Post(srv.URL + "/api/user/balance/withdraw")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+		})
+	}
+}
+
+func TestHandler_WithdrawBatch(t *testing.T) {
+	srv, st, r, h := testEnv(t, WithMinWithdrawal(models.MoneyFromFloat(1)))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/balance/withdraw/batch", h.WithdrawBatch())
+	})
+
+	var tests = []struct {
+		name            string
+		body            any
+		EXPECT          *mock.Call
+		expectedCode    int
+		expectedResults []WithdrawalResult
+	}{
+		{
+			name: "mixed_results",
+			body: []models.Withdrawal{
+				{Order: "9278923470", Sum: models.MoneyFromFloat(10)},
+				{Order: "12345678903", Sum: models.MoneyFromFloat(500)},
+				{Order: "1234567890123", Sum: models.MoneyFromFloat(10)},
+				{Order: "79927398713", Sum: models.MoneyFromFloat(10)},
+				{Order: "9278923470", Sum: models.MoneyFromFloat(5)},
+				{Order: "4111111111111111", Sum: models.MoneyFromFloat(0.5)},
+				{Order: "4012888888881881", Sum: models.MoneyFromFloat(10)},
+			},
+			EXPECT: st.withdrawals.EXPECT().WithdrawBatch(mock.Anything, int64(1), mock.MatchedBy(func(ws []models.Withdrawal) bool {
+				return len(ws) == 4 && ws[0].Order == "9278923470" && ws[1].Order == "12345678903" && ws[2].Order == "79927398713" && ws[3].Order == "4012888888881881"
+			})).Return([]error{nil, db.ErrInsufficientBalance, db.ErrOrderAlreadyExists, db.ErrOrderNumberUsed}, nil).Once(),
+			expectedCode: http.StatusMultiStatus,
+			expectedResults: []WithdrawalResult{
+				{Order: "9278923470", Status: http.StatusOK},
+				{Order: "12345678903", Status: http.StatusPaymentRequired, Code: problem.InsufficientBalance, Detail: "Insufficient balance"},
+				{Order: "1234567890123", Status: http.StatusUnprocessableEntity, Code: problem.InvalidOrderNumber, Detail: "Invalid order number",
+					Errors: []problem.FieldError{{Field: "order", Rule: "luhn", Message: "Invalid order number"}}},
+				{Order: "79927398713", Status: http.StatusConflict, Code: problem.WithdrawalExists, Detail: "Withdrawal order number already exists"},
+				{Order: "9278923470", Status: http.StatusConflict, Code: problem.WithdrawalExists, Detail: "Order number is repeated in the batch"},
+				{Order: "4111111111111111", Status: http.StatusUnprocessableEntity, Code: problem.WithdrawalTooSmall, Detail: "Withdrawal sum is less than the minimum amount of 1.00",
+					Errors: []problem.FieldError{{Field: "sum", Rule: "min_withdrawal", Message: "Withdrawal sum is less than the minimum amount of 1.00"}}},
+				{Order: "4012888888881881", Status: http.StatusConflict, Code: problem.OrderNumberUsed, Detail: "Order number is already used by another order"},
+			},
+		},
+		{
+			name:         "all_invalid",
+			body:         []models.Withdrawal{{Order: "123", Sum: models.MoneyFromFloat(10)}},
+			expectedCode: http.StatusMultiStatus,
+			expectedResults: []WithdrawalResult{
+				{Order: "123", Status: http.StatusUnprocessableEntity, Code: problem.InvalidOrderNumber, Detail: "Invalid order number",
+					Errors: []problem.FieldError{{Field: "order", Rule: "luhn", Message: "Invalid order number"}}},
+			},
+		},
+		{
+			name:         "empty_batch",
+			body:         []models.Withdrawal{},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "too_many",
+			body:         make([]models.Withdrawal, maxWithdrawalBatch+1),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid_request",
+			body:         `{"order":"9278923470"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "storage_error",
+			body:         []models.Withdrawal{{Order: "9278923470", Sum: models.MoneyFromFloat(10)}},
+			EXPECT:       st.withdrawals.EXPECT().WithdrawBatch(mock.Anything, int64(1), mock.Anything).Return(nil, assert.AnError).Once(),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/user/balance/withdraw/batch")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			if tt.expectedResults != nil {
+				var results []WithdrawalResult
+				assert.NoError(t, json.Unmarshal(resp.Body(), &results))
+				assert.Equal(t, tt.expectedResults, results)
+			}
+		})
+	}
+}
+
+func TestHandler_CreateOrder_Dispatch(t *testing.T) {
+	q := dispatch.NewQueue(4)
+	srv, st, r, h := testEnv(t, WithAccrualQueue(q))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/orders", h.CreateOrder())
+		r.Post("/api/user/orders/batch", h.CreateOrders())
+	})
+	st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+	st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyExists).Once()
+	st.orders.EXPECT().CreateOrders(mock.Anything, int64(1), []string{"9278923470", "79927398713"}).
+		Return([]error{nil, db.ErrOrderAlreadyAdded}, nil).Once()
+
+	// only the created orders are handed over to the accrual service
+	for _, number := range []string{"12345678903", "12345678903"} {
+		_, err := resty.New().R().SetHeader("Authorization", "Bearer "+token).SetHeader("Content-Type", "text/plain").
+			SetBody(number).Post(srv.URL + "/api/user/orders")
+		assert.NoError(t, err)
+	}
+	_, err = resty.New().R().SetHeader("Authorization", "Bearer "+token).SetHeader("Content-Type", "application/json").
+		SetBody([]string{"9278923470", "79927398713"}).Post(srv.URL + "/api/user/orders/batch")
+	assert.NoError(t, err)
+
+	if !assert.Len(t, q.C(), 2) {
+		return
+	}
+	order := <-q.C()
+	assert.Equal(t, "12345678903", order.Number)
+	assert.Equal(t, int64(1), order.UserID)
+	assert.Equal(t, models.StatusNew, order.Status)
+	assert.Equal(t, "9278923470", (<-q.C()).Number)
+}
+
+func TestHandler_CreateOrders(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/orders/batch", h.CreateOrders())
+	})
+
+	var tests = []struct {
+		name            string
+		body            any
+		EXPECT          *mock.Call
+		expectedCode    int
+		expectedResults []OrderResult
+	}{
+		{
+			name: "mixed_results",
+			body: []string{"12345678903", "9278923470", "1234567890123", "79927398713", "1234 5678-903", "4111 1111 1111 1111"},
+			EXPECT: st.orders.EXPECT().CreateOrders(mock.Anything, int64(1), []string{"12345678903", "9278923470", "79927398713", "4111111111111111"}).
+				Return([]error{nil, db.ErrOrderAlreadyExists, db.ErrOrderAlreadyAdded, nil}, nil).Once(),
+			expectedCode: http.StatusMultiStatus,
+			expectedResults: []OrderResult{
+				{Order: "12345678903", Status: http.StatusAccepted},
+				{Order: "9278923470", Status: http.StatusOK, Detail: "Order already uploaded by the user"},
+				{Order: "1234567890123", Status: http.StatusUnprocessableEntity, Code: problem.InvalidOrderNumber, Detail: "Invalid order number"},
+				{Order: "79927398713", Status: http.StatusConflict, Code: problem.OrderOwnedByOther, Detail: "Order already added by another user"},
+				{Order: "12345678903", Status: http.StatusOK, Detail: "Order number is repeated in the batch"},
+				{Order: "4111111111111111", Status: http.StatusAccepted},
+			},
+		},
+		{
+			name:         "all_invalid",
+			body:         []string{"123"},
+			expectedCode: http.StatusMultiStatus,
+			expectedResults: []OrderResult{
+				{Order: "123", Status: http.StatusUnprocessableEntity, Code: problem.InvalidOrderNumber, Detail: "Invalid order number"},
+			},
+		},
+		{
+			name:         "empty_batch",
+			body:         []string{},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "too_many",
+			body:         make([]string, maxOrderBatch+1),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid_request",
+			body:         `{"order":"12345678903"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "storage_error",
+			body:         []string{"12345678903"},
+			EXPECT:       st.orders.EXPECT().CreateOrders(mock.Anything, int64(1), mock.Anything).Return(nil, assert.AnError).Once(),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/user/orders/batch")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			if tt.expectedResults != nil {
+				var results []OrderResult
+				assert.NoError(t, json.Unmarshal(resp.Body(), &results))
+				assert.Equal(t, tt.expectedResults, results)
+			}
+		})
+	}
+}
+
+func TestHandler_Validation(t *testing.T) {
+	srv, _, r, h := testEnv(t, WithMinWithdrawal(models.MoneyFromFloat(1)))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Post("/api/user/register", h.CreateUser())
+	r.Post("/api/user/login", h.LoginUser())
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/balance/withdraw", h.Withdraw())
+	})
+
+	var tests = []struct {
+		name           string
+		path           string
+		body           string
+		expectedCode   int
+		expectedErr    problem.Code
+		expectedFields []problem.FieldError
+	}{
+		{
+			name:         "register_without_credentials",
+			path:         "/api/user/register",
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  problem.ValidationFailed,
+			expectedFields: []problem.FieldError{
+				{Field: "login", Rule: "required", Message: "Login is required"},
+				{Field: "password", Rule: "required", Message: "Password is required"},
+			},
+		},
+		{
+			name:           "login_without_password",
+			path:           "/api/user/login",
+			body:           `{"login":"user"}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedErr:    problem.ValidationFailed,
+			expectedFields: []problem.FieldError{{Field: "password", Rule: "required", Message: "Password is required"}},
+		},
+		{
+			name:         "withdraw_all_fields_invalid",
+			path:         "/api/user/balance/withdraw",
+			body:         `{"order":"123","sum":0.5,"description":"` + strings.Repeat("ы", 256) + `"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedErr:  problem.InvalidOrderNumber,
+			expectedFields: []problem.FieldError{
+				{Field: "order", Rule: "luhn", Message: "Invalid order number"},
+				{Field: "sum", Rule: "min_withdrawal", Message: "Withdrawal sum is less than the minimum amount of 1.00"},
+				{Field: "description", Rule: "max", Message: "Description is longer than 255 characters"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			var p problem.Problem
+			assert.NoError(t, json.Unmarshal(resp.Body(), &p))
+			assert.Equal(t, tt.expectedErr, p.Code)
+			assert.Equal(t, tt.expectedFields[0].Message, p.Detail)
+			assert.Equal(t, tt.expectedFields, p.Errors)
+		})
+	}
+}
+
+func TestHandler_WithdrawDailyLimit(t *testing.T) {
+	now := time.Date(2026, 3, 1, 22, 30, 0, 0, time.UTC)
+	srv, st, r, h := testEnv(t, WithClock(clock.NewMock(now)))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/balance/withdraw", h.Withdraw())
+	})
+
+	resetAt := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name         string
+		limitErr     *db.DailyLimitError
+		expectedBody string
+	}{
+		{
+			name:         "user_limit",
+			limitErr:     &db.DailyLimitError{Limit: models.MoneyFromFloat(100), Used: models.MoneyFromFloat(95), ResetAt: resetAt},
+			expectedBody: "Daily withdrawal limit of 100.00 exceeded, 95.00 already withdrawn, resets at 2026-03-02T00:00:00Z",
+		},
+		{
+			name:         "global_limit",
+			limitErr:     &db.DailyLimitError{Global: true, Limit: models.MoneyFromFloat(1000), Used: models.MoneyFromFloat(1000), ResetAt: resetAt},
+			expectedBody: "Global daily withdrawal limit of 1000.00 exceeded, 1000.00 already withdrawn, resets at 2026-03-02T00:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(tt.limitErr).Once()
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(&models.Withdrawal{Order: "9278923470", Sum: models.MoneyFromFloat(10)}).
+				Post(srv.URL + "/api/user/balance/withdraw")
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+			assert.Equal(t, "5400", resp.Header().Get("Retry-After"))
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			var p problem.Problem
+			assert.NoError(t, json.Unmarshal(resp.Body(), &p))
+			assert.Equal(t, problem.DailyLimitExceeded, p.Code)
+			assert.Equal(t, 5400, p.RetryAfter)
+			if assert.NotNil(t, p.RetryAt) {
+				assert.Equal(t, resetAt, *p.RetryAt)
+			}
+		})
+	}
+}
+
+func TestHandler_GetWithdrawals(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	userID := int64(1)
+	token, err := auth.GenerateToken(time.Now(), userID)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/withdrawals", h.GetWithdrawals())
+	})
+
+	uploadedAt, err := time.Parse("2006-01-02T15:04:05-07:00", "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+
+	withdrawals := []models.Withdrawal{
+		{
+			UserID:      1,
+			Order:       "9278923470",
+			Sum:         models.MoneyFromFloat(10),
+			ProcessedAt: uploadedAt,
+			Description: "Coffee",
+		},
+		{
+			UserID:      1,
+			Order:       "12345678903",
+			Sum:         models.MoneyFromFloat(15),
+			ProcessedAt: uploadedAt,
+		},
+		{
+			UserID:      1,
+			Order:       "346436439",
+			Sum:         models.MoneyFromFloat(20),
+			ProcessedAt: uploadedAt,
+		},
+	}
+
+	cursor := models.Cursor{At: uploadedAt, Key: "12345678903"}
+	sum := withdrawals[1].Sum
+	sumCursor := models.Cursor{At: uploadedAt, Key: "12345678903", Value: &sum}
+
+	var tests = []struct {
+		name           string
+		token          string
+		query          string
+		EXPECT         *mock.Call
+		expectedCode   int
+		expectedBody   string
+		expectedCursor string
+	}{
+		{
+			name:         "successful_request",
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().GetWithdrawals(mock.Anything, mock.Anything, models.WithdrawalQuery{}).Return(withdrawals, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"order":"9278923470","sum":10,"processed_at":"2020-12-10T15:15:45+03:00","description":"Coffee"},{"order":"12345678903","sum":15,"processed_at":"2020-12-10T15:15:45+03:00"},{"order":"346436439","sum":20,"processed_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:         "no_withdrawals",
+			token:        token,
+			EXPECT:       st.withdrawals.EXPECT().GetWithdrawals(mock.Anything, mock.Anything, models.WithdrawalQuery{}).Return([]models.Withdrawal{}, nil).Once(),
+			expectedCode: http.StatusNoContent,
+			expectedBody: "",
+		},
+		{
+			name:  "first_page",
+			token: token,
+			query: "?limit=2&from=2020-12-01T00:00:00Z",
+			EXPECT: st.withdrawals.EXPECT().GetWithdrawalsPage(mock.Anything, mock.Anything, models.WithdrawalQuery{
+				From:  time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+				Limit: 2,
+			}).Return(&models.WithdrawalsPage{Withdrawals: withdrawals[:2], Next: &cursor}, nil).Once(),
+			expectedCode:   http.StatusOK,
+			expectedBody:   `[{"order":"9278923470","sum":10,"processed_at":"2020-12-10T15:15:45+03:00","description":"Coffee"},{"order":"12345678903","sum":15,"processed_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedCursor: encodeCursor(cursor),
+		},
+		{
+			name:  "last_page",
+			token: token,
+			query: "?limit=2&cursor=" + encodeCursor(cursor),
+			EXPECT: st.withdrawals.EXPECT().GetWithdrawalsPage(mock.Anything, mock.Anything, mock.MatchedBy(func(q models.WithdrawalQuery) bool {
+				return q.Limit == 2 && q.After != nil && q.After.At.Equal(cursor.At) && q.After.Key == cursor.Key
+			})).Return(&models.WithdrawalsPage{Withdrawals: withdrawals[2:]}, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"order":"346436439","sum":20,"processed_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "sorted_by_sum_first_page",
+			token: token,
+			query: "?limit=2&sort=sum&order=asc",
+			EXPECT: st.withdrawals.EXPECT().GetWithdrawalsPage(mock.Anything, mock.Anything, models.WithdrawalQuery{
+				Limit: 2,
+				Sort:  models.Sort{Field: models.SortSum, Order: models.SortAsc},
+			}).Return(&models.WithdrawalsPage{Withdrawals: withdrawals[:2], Next: &sumCursor}, nil).Once(),
+			expectedCode:   http.StatusOK,
+			expectedBody:   `[{"order":"9278923470","sum":10,"processed_at":"2020-12-10T15:15:45+03:00","description":"Coffee"},{"order":"12345678903","sum":15,"processed_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedCursor: encodeCursor(sumCursor),
+		},
+		{
+			name:         "sort_does_not_match_cursor",
+			token:        token,
+			query:        "?limit=2&sort=sum&cursor=" + encodeCursor(cursor),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:         "invalid_sort",
+			token:        token,
+			query:        "?sort=description",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:         "invalid_order",
+			token:        token,
+			query:        "?sort=sum&order=up",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:         "invalid_limit",
+			token:        token,
+			query:        "?limit=1000",
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:         "invalid_cursor",
+			token:        token,
+			query:        "?cursor=not-a-cursor",
+			EXPECT:       nil,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:         "user_not_authenticated",
+			token:        "wrong_token",
+			EXPECT:       nil,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "token is unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+tt.token).
+				Get(srv.URL + "/api/user/withdrawals" + tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			assert.Equal(t, tt.expectedCursor, resp.Header().Get("X-Next-Cursor"))
+		})
+	}
+}
+
+func TestHandler_GetMeta(t *testing.T) {
+	srv, _, r, h := testEnv(t, WithMinWithdrawal(models.MoneyFromFloat(50)))
+	defer srv.Close()
+
+	r.Get("/api/meta", h.GetMeta())
+
+	resp, err := resty.New().R().Get(srv.URL + "/api/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, `{"min_withdrawal":50}`, resp.String())
+}
+
+func TestHandler_TenantMinWithdrawals(t *testing.T) {
+	tenantMW, err := middleware.NewTenant([]string{"acme", "globex"})
+	assert.NoError(t, err)
+	srv, st, r, h := testEnv(t, WithMinWithdrawal(models.MoneyFromFloat(1)),
+		WithTenantMinWithdrawals(map[string]models.Money{"globex": models.MoneyFromFloat(100)}))
+	defer srv.Close()
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	r.Group(func(r chi.Router) {
+		r.Use(tenantMW)
+		r.Get("/api/meta", h.GetMeta())
+		r.Group(func(r chi.Router) {
+			r.Use(jwtauth.Verifier(auth.TokenAuth))
+			r.Use(jwtauth.Authenticator(auth.TokenAuth))
+			r.Post("/api/user/balance/withdraw", h.Withdraw())
+			r.Post("/api/user/balance/withdraw/batch", h.WithdrawBatch())
+		})
+	})
+
+	// the tenant with its own minimum publishes it, the other one the global minimum
+	resp, err := resty.New().R().SetHeader(middleware.TenantHeader, "globex").Get(srv.URL + "/api/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"min_withdrawal":100}`, resp.String())
+	resp, err = resty.New().R().SetHeader(middleware.TenantHeader, "acme").Get(srv.URL + "/api/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"min_withdrawal":1}`, resp.String())
+
+	// the same sum is too small for one tenant and enough for the other
+	withdrawal := &models.Withdrawal{Order: "9278923470", Sum: models.MoneyFromFloat(50)}
+	resp, err = resty.New().R().SetAuthToken(token).SetHeader(middleware.TenantHeader, "globex").
+		SetBody(withdrawal).Post(srv.URL + "/api/user/balance/withdraw")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode())
+	assert.Equal(t, "Withdrawal sum is less than the minimum amount of 100.00", respBody(t, resp))
+	st.withdrawals.EXPECT().Withdraw(mock.Anything, mock.Anything).Return(nil).Once()
+	resp, err = resty.New().R().SetAuthToken(token).SetHeader(middleware.TenantHeader, "acme").
+		SetBody(withdrawal).Post(srv.URL + "/api/user/balance/withdraw")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	// the batch is checked against the minimum of the tenant too
+	resp, err = resty.New().R().SetAuthToken(token).SetHeader(middleware.TenantHeader, "globex").
+		SetBody([]*models.Withdrawal{withdrawal}).Post(srv.URL + "/api/user/balance/withdraw/batch")
+	assert.NoError(t, err)
+	var results []WithdrawalResult
+	assert.NoError(t, json.Unmarshal(resp.Body(), &results))
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, http.StatusUnprocessableEntity, results[0].Status)
+		assert.Equal(t, problem.WithdrawalTooSmall, results[0].Code)
+	}
+}
+
+func TestHandler_IssueReadOnlyToken(t *testing.T) {
+	srv, _, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.With(auth.RequireScope(auth.ScopeWrite)).Post("/api/user/tokens/readonly", h.IssueReadOnlyToken())
+		r.With(auth.RequireScope(auth.ScopeWrite)).Post("/api/user/balance/withdraw", h.Withdraw())
+	})
+
+	// issue a read-only token
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+token).
+		Post(srv.URL + "/api/user/tokens/readonly")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	readOnly := resp.Header().Get("Authorization")
+	assert.Contains(t, readOnly, "Bearer ")
+
+	// the read-only token can't withdraw
+	resp, err = resty.New().R().
+		SetHeader("Authorization", readOnly).
+		SetBody(&models.Withdrawal{Order: "9278923470", Sum: models.MoneyFromFloat(10)}).
+		Post(srv.URL + "/api/user/balance/withdraw")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+}
+
+// smsStub records the last message sent.
+type smsStub struct {
+	phone, text string
+}
+
+func (s *smsStub) Send(_ context.Context, phone, text string) error {
+	s.phone, s.text = phone, text
+	return nil
+}
+
+func TestHandler_SendOTP(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sender := &smsStub{}
+	srv, st, r, h := testEnv(t, WithSMS(sender, time.Minute), WithClock(clock.NewMock(now)))
+	defer srv.Close()
+
+	r.Post("/api/user/otp", h.SendOTP())
+
+	var tests = []struct {
+		name           string
+		phone          string
+		EXPECT         []*mock.Call
+		expectedCode   int
+		expectedRetry  string
+		expectedSMSFor string
+	}{
+		{
+			name:  "send_code",
+			phone: "+79161234567",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, "+79161234567").Return(nil, db.ErrOTPNotFound).Once(),
+				st.users.EXPECT().SaveOTP(mock.Anything, mock.MatchedBy(func(o *models.OTP) bool {
+					return o.Phone == "+79161234567" && o.CreatedAt.Equal(now) && o.ExpiresAt.Equal(now.Add(time.Minute))
+				})).Return(nil).Once(),
+			},
+			expectedCode:   http.StatusAccepted,
+			expectedSMSFor: "+79161234567",
+		},
+		{
+			name:  "sent_recently",
+			phone: "+79161234568",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, "+79161234568").Return(&models.OTP{CreatedAt: now.Add(-10 * time.Second)}, nil).Once(),
+			},
+			expectedCode:  http.StatusTooManyRequests,
+			expectedRetry: "50",
+		},
+		{
+			name:         "invalid_phone",
+			phone:        "89161234567",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*sender = smsStub{}
+			resp, err := resty.New().R().
+				SetBody(&models.PhoneLogin{Phone: tt.phone}).
+				Post(srv.URL + "/api/user/otp")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedRetry, resp.Header().Get("Retry-After"))
+			assert.Equal(t, tt.expectedSMSFor, sender.phone)
+			if tt.expectedSMSFor != "" {
+				assert.Regexp(t, `[0-9]{6}$`, sender.text)
+			}
+		})
+	}
+}
+
+func TestHandler_LoginOTP(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	srv, st, r, h := testEnv(t, WithSMS(&smsStub{}, 0), WithClock(clock.NewMock(now)))
+	defer srv.Close()
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.DefaultCost)
+	assert.NoError(t, err)
+	otp := &models.OTP{Phone: "+79161234567", CodeHash: string(hashed), CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	r.Post("/api/user/login/otp", h.LoginOTP())
+
+	var tests = []struct {
+		name         string
+		code         string
+		EXPECT       []*mock.Call
+		expectedCode int
+	}{
+		{
+			name: "login",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(otp, nil).Once(),
+				st.users.EXPECT().DeleteOTP(mock.Anything, otp.Phone).Return(nil).Once(),
+				st.users.EXPECT().GetUserByPhone(mock.Anything, otp.Phone).Return(&models.User{ID: 1}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "wrong_code",
+			code: "654321",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(otp, nil).Once(),
+				st.users.EXPECT().IncOTPAttempts(mock.Anything, otp.Phone).Return(nil).Once(),
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name: "expired_code",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(&models.OTP{CodeHash: otp.CodeHash, ExpiresAt: now}, nil).Once(),
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name: "attempts_exhausted",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(&models.OTP{CodeHash: otp.CodeHash, ExpiresAt: otp.ExpiresAt, Attempts: maxOTPAttempts}, nil).Once(),
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name: "phone_not_registered",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(otp, nil).Once(),
+				st.users.EXPECT().DeleteOTP(mock.Anything, otp.Phone).Return(nil).Once(),
+				st.users.EXPECT().GetUserByPhone(mock.Anything, otp.Phone).Return(nil, db.ErrUserNotFound).Once(),
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "missing_code",
+			code:         "",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetBody(&models.PhoneLogin{Phone: otp.Phone, Code: tt.code}).
+				Post(srv.URL + "/api/user/login/otp")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			if tt.expectedCode == http.StatusOK {
+				assert.Contains(t, resp.Header().Get("Authorization"), "Bearer ")
+			}
+		})
+	}
+}
+
+func TestHandler_SetPhone(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	srv, st, r, h := testEnv(t, WithSMS(&smsStub{}, 0), WithClock(clock.NewMock(now)))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	hashed, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.DefaultCost)
+	assert.NoError(t, err)
+	otp := &models.OTP{Phone: "+79161234567", CodeHash: string(hashed), CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Put("/api/user/phone", h.SetPhone())
+	})
+
+	var tests = []struct {
+		name         string
+		code         string
+		EXPECT       []*mock.Call
+		expectedCode int
+	}{
+		{
+			name: "set_phone",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(otp, nil).Once(),
+				st.users.EXPECT().DeleteOTP(mock.Anything, otp.Phone).Return(nil).Once(),
+				st.users.EXPECT().SetUserPhone(mock.Anything, int64(1), otp.Phone).Return(nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "phone_of_another_user",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(otp, nil).Once(),
+				st.users.EXPECT().DeleteOTP(mock.Anything, otp.Phone).Return(nil).Once(),
+				st.users.EXPECT().SetUserPhone(mock.Anything, int64(1), otp.Phone).Return(db.ErrPhoneAlreadyExists).Once(),
+			},
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name: "code_already_used",
+			code: "123456",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetOTP(mock.Anything, otp.Phone).Return(nil, db.ErrOTPNotFound).Once(),
+			},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetBody(&models.PhoneLogin{Phone: otp.Phone, Code: tt.code}).
+				Put(srv.URL + "/api/user/phone")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+		})
+	}
+}
+
+func TestHandler_RequestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	trusted, err := middleware.ParseTrustedProxies([]string{"127.0.0.1"})
+	assert.NoError(t, err)
+	srv, st, _, h := testEnv(t, WithLogger(zap.New(core).Sugar()), WithTrustedProxies(trusted))
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	// the tokens are of an active user
+	st.users.EXPECT().GetUserRole(mock.Anything, mock.Anything).Return(models.RoleUser, nil).Maybe()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+token).
+		SetHeader("X-Request-ID", "client-req-1").
+		Get(api.URL + "/api/user/orders?status=DONE")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, "client-req-1", resp.Header().Get("X-Request-ID"))
+	assert.Equal(t, problem.ContentType, resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid filter","code":"INVALID_REQUEST","request_id":"client-req-1"}`, resp.String())
+
+	entries := logs.FilterField(zap.String("request_id", "client-req-1")).All()
+	assert.NotEmpty(t, entries, "handler logs must carry the request ID")
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	srv, st, _, h := testEnv(t, WithMetrics(metrics.NewRegistry()), WithAdminMetrics())
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil)
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(2)).Return(models.RoleUser, nil)
+	adminToken, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	userToken, err := auth.GenerateToken(time.Now(), 2)
+	assert.NoError(t, err)
+
+	// the registry shared with the storage and the services is exposed to the admins
+	resp, err := resty.New().R().SetAuthToken(adminToken).Get(api.URL + "/api/admin/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, resp.String(), "gophermart_http_panics_total")
+	// the scrape itself is counted by its route
+	resp, err = resty.New().R().SetAuthToken(adminToken).Get(api.URL + "/api/admin/metrics")
+	assert.NoError(t, err)
+	assert.Contains(t, resp.String(), `gophermart_http_requests_total{code="200",method="GET",route="/api/admin/metrics"} 1`)
+
+	// and to no one else
+	resp, err = resty.New().R().SetAuthToken(userToken).Get(api.URL + "/api/admin/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+	resp, err = resty.New().R().Get(api.URL + "/api/admin/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	resp, err = resty.New().R().Get(api.URL + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	// without the option the metrics are left to the server of the metrics address
+	srv2, st2, _, h := testEnv(t, WithMetrics(metrics.NewRegistry()))
+	defer srv2.Close()
+	api2 := httptest.NewServer(h.NewRouter())
+	defer api2.Close()
+	st2.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil)
+	resp, err = resty.New().R().SetAuthToken(adminToken).Get(api2.URL + "/api/admin/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+	assert.NotNil(t, h.MetricsHandler())
+
+	// without the registry there is no endpoint
+	srv3, _, _, h := testEnv(t, WithAdminMetrics())
+	defer srv3.Close()
+	assert.Nil(t, h.MetricsHandler())
+}
+
+func TestHandler_Readiness(t *testing.T) {
+	srv, st, _, h := testEnv(t)
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+
+	stats := models.PoolStats{MaxConns: 20, TotalConns: 5, AcquiredConns: 4, IdleConns: 1, AcquireCount: 100, EmptyAcquireCount: 3}
+	st.health.EXPECT().Stats().Return(stats)
+	statsBody := `"db":{"max_conns":20,"total_conns":5,"acquired_conns":4,"idle_conns":1,"acquire_count":100,"empty_acquire_count":3,"canceled_acquire_count":0}`
+
+	// the pool statistics are reported with the state of the database
+	st.health.EXPECT().Ping(mock.Anything).Return(nil).Once()
+	resp, err := resty.New().R().Get(api.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `{"status":"ok",`+statsBody+`}`, resp.String())
+
+	// the service is not ready while the database doesn't answer
+	st.health.EXPECT().Ping(mock.Anything).Return(context.DeadlineExceeded).Once()
+	resp, err = resty.New().R().Get(api.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode())
+	assert.JSONEq(t, `{"status":"unavailable",`+statsBody+`}`, resp.String())
+}
+
+func TestHandler_RateLimits(t *testing.T) {
+	limit := middleware.RateLimit{RPS: 0.01, Burst: 1}
+	srv, st, _, h := testEnv(t, WithRateLimits(limit, limit))
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	// the tokens are of an active user
+	st.users.EXPECT().GetUserRole(mock.Anything, mock.Anything).Return(models.RoleUser, nil).Maybe()
+
+	// the anonymous clients are limited by the address
+	for _, want := range []int{http.StatusBadRequest, http.StatusTooManyRequests} {
+		resp, err := resty.New().R().SetBody("{").Post(api.URL + "/api/user/login")
+		assert.NoError(t, err)
+		assert.Equal(t, want, resp.StatusCode())
+	}
+	resp, err := resty.New().R().SetBody("{").Post(api.URL + "/api/user/register")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.Equal(t, "100", resp.Header().Get("Retry-After"))
+
+	// the users are limited by the token, not by the address
+	for userID, wants := range map[int64][]int{1: {http.StatusBadRequest, http.StatusTooManyRequests}, 2: {http.StatusBadRequest}} {
+		token, err := auth.GenerateToken(time.Now(), userID)
+		assert.NoError(t, err)
+		for _, want := range wants {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Get(api.URL + "/api/user/orders?status=DONE")
+			assert.NoError(t, err)
+			assert.Equal(t, want, resp.StatusCode())
+		}
+	}
+}
+
+func TestHandler_GetTransactions(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/transactions", h.GetTransactions())
+	})
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	transactions := []models.Transaction{
+		{Type: models.TransactionAccrual, Order: "9278923470", Amount: models.MoneyFromFloat(500), Balance: models.MoneyFromFloat(500), At: at},
+		{Type: models.TransactionWithdrawal, Order: "2377225624", Amount: models.MoneyFromFloat(-120.5), Balance: models.MoneyFromFloat(379.5), At: at.Add(time.Hour)},
+	}
+
+	var tests = []struct {
+		name         string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "ledger",
+			EXPECT:       st.withdrawals.EXPECT().GetTransactions(mock.Anything, int64(1)).Return(transactions, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"type":"ACCRUAL","order":"9278923470","amount":500,"balance":500,"at":"2020-12-10T15:15:45+03:00"},{"type":"WITHDRAWAL","order":"2377225624","amount":-120.5,"balance":379.5,"at":"2020-12-10T16:15:45+03:00"}]`,
+		},
+		{
+			name:         "no_transactions",
+			EXPECT:       st.withdrawals.EXPECT().GetTransactions(mock.Anything, int64(1)).Return([]models.Transaction{}, nil).Once(),
+			expectedCode: http.StatusNoContent,
+			expectedBody: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Get(srv.URL + "/api/user/transactions")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_OrderEvents(t *testing.T) {
+	bus := events.NewBus()
+	srv, _, r, h := testEnv(t, WithEvents(bus))
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/orders/events", h.OrderEvents())
+	})
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/orders/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// the stream is subscribed once the headers are sent
+	at := time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC)
+	bus.Publish(models.OrderEvent{UserID: 2, Number: "2377225624", Status: models.StatusInvalid, At: at})
+	bus.Publish(models.OrderEvent{UserID: 1, Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), At: at})
+
+	body := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := body.ReadString('\n')
+		assert.NoError(t, err)
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{
+		"event: order\n",
+		`data: {"number":"9278923470","status":"PROCESSED","accrual":500,"at":"2020-12-10T15:15:45Z"}` + "\n",
+		"\n",
+	}, lines)
+
+	// the stream ends on shutdown
+	h.CloseStreams()
+	_, err = io.ReadAll(body)
+	assert.NoError(t, err)
+}
+
+func TestHandler_OrderEvents_WriteTimeout(t *testing.T) {
+	bus := events.NewBus()
+	_, _, r, h := testEnv(t, WithEvents(bus))
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/orders/events", h.OrderEvents())
+	})
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/orders/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// the stream outlives the write timeout of the server
+	time.Sleep(300 * time.Millisecond)
+	bus.Publish(models.OrderEvent{UserID: 1, Number: "9278923470", Status: models.StatusProcessing})
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "event: order\n", line)
+	h.CloseStreams()
+}
+
+func TestHandler_WebSocket(t *testing.T) {
+	bus := events.NewBus()
+	srv, st, _, h := testEnv(t, WithEvents(bus))
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	// the tokens are of an active user
+	st.users.EXPECT().GetUserRole(mock.Anything, mock.Anything).Return(models.RoleUser, nil).Maybe()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	wsURL := "ws" + strings.TrimPrefix(api.URL, "http") + "/api/user/ws"
+
+	// the upgrade requires a token
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// browsers pass the token in the query
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?jwt="+token, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	readMsg := func() string {
+		t.Helper()
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, msg, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		return string(msg)
+	}
+
+	// subscribing to the balance sends the current one
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500), Withdrawn: models.MoneyFromFloat(42)}, nil).Once()
+	assert.NoError(t, conn.WriteJSON(map[string]any{"action": "subscribe", "topics": []string{"balance", "orders"}}))
+	assert.JSONEq(t, `{"type":"balance","data":{"current":500,"withdrawn":42}}`, readMsg())
+
+	assert.NoError(t, conn.WriteJSON(map[string]any{"action": "subscribe", "topics": []string{"bonuses"}}))
+	assert.JSONEq(t, `{"type":"error","data":{"message":"unknown topic \"bonuses\""}}`, readMsg())
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	assert.JSONEq(t, `{"type":"error","data":{"message":"invalid request"}}`, readMsg())
+
+	// a processed order changes the order status and the balance
+	at := time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC)
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(1000), Withdrawn: models.MoneyFromFloat(42)}, nil).Once()
+	bus.Publish(models.OrderEvent{UserID: 2, Number: "2377225624", Status: models.StatusInvalid, At: at})
+	bus.Publish(models.OrderEvent{UserID: 1, Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), At: at})
+	assert.JSONEq(t, `{"type":"order","data":{"number":"9278923470","status":"PROCESSED","accrual":500,"at":"2020-12-10T15:15:45Z"}}`, readMsg())
+	assert.JSONEq(t, `{"type":"balance","data":{"current":1000,"withdrawn":42}}`, readMsg())
+
+	// after unsubscribing from the orders only the balance updates are sent
+	assert.NoError(t, conn.WriteJSON(map[string]any{"action": "unsubscribe", "topics": []string{"orders"}}))
+	assert.NoError(t, conn.WriteJSON(map[string]any{"action": "resubscribe"}))
+	assert.JSONEq(t, `{"type":"error","data":{"message":"unknown action \"resubscribe\""}}`, readMsg())
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(900), Withdrawn: models.MoneyFromFloat(142)}, nil).Once()
+	bus.Publish(models.OrderEvent{UserID: 1, Number: "12345678903", Status: models.StatusInvalid, At: at})
+	bus.Publish(models.WithdrawalEvent{UserID: 1, Order: "2377225624", Sum: models.MoneyFromFloat(100), At: at})
+	assert.JSONEq(t, `{"type":"balance","data":{"current":900,"withdrawn":142}}`, readMsg())
+
+	// the connection is closed on shutdown
+	h.CloseStreams()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+}
+
+func TestHandler_CreateWebhook(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/user/webhooks", h.CreateWebhook())
+	})
+
+	createdAt, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	created := func(_ context.Context, w *models.Webhook, _ int) error {
+		w.ID, w.CreatedAt = 5, createdAt
+		return nil
+	}
+	isWebhook := func(url string, events ...string) any {
+		return mock.MatchedBy(func(w *models.Webhook) bool {
+			return w.UserID == 1 && w.URL == url && assert.ObjectsAreEqual(events, w.Events) && len(w.Secret) == 64
+		})
+	}
+
+	var tests = []struct {
+		name         string
+		body         string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "created",
+			body:         `{"url":"https://example.com/hook","events":["order.processed","withdrawal.completed","order.processed"]}`,
+			EXPECT:       st.webhooks.EXPECT().CreateWebhook(mock.Anything, isWebhook("https://example.com/hook", "order.processed", "withdrawal.completed"), maxWebhooks).RunAndReturn(created).Once(),
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "too_many_webhooks",
+			body:         `{"url":"https://example.com/other","events":["order.processed"]}`,
+			EXPECT:       st.webhooks.EXPECT().CreateWebhook(mock.Anything, isWebhook("https://example.com/other", "order.processed"), maxWebhooks).Return(db.ErrTooManyWebhooks).Once(),
+			expectedCode: http.StatusConflict,
+			expectedBody: "A user can have at most 10 webhooks",
+		},
+		{
+			name:         "relative_url",
+			body:         `{"url":"/hook","events":["order.processed"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid webhook: url must be an absolute http or https URL without credentials",
+		},
+		{
+			name:         "unknown_event",
+			body:         `{"url":"https://example.com/hook","events":["order.created"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: `Invalid webhook: unknown event "order.created"`,
+		},
+		{
+			name:         "no_events",
+			body:         `{"url":"https://example.com/hook"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid webhook: no events",
+		},
+		{
+			name:         "malformed_body",
+			body:         `{"url":`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Failed to decode webhook",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/user/webhooks")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			if tt.expectedCode != http.StatusCreated {
+				assert.Equal(t, tt.expectedBody, respBody(t, resp))
+				return
+			}
+			// the secret is returned on creation
+			var got models.Webhook
+			assert.NoError(t, json.Unmarshal(resp.Body(), &got))
+			assert.Equal(t, int64(5), got.ID)
+			assert.Len(t, got.Secret, 64)
+			assert.Equal(t, []string{"order.processed", "withdrawal.completed"}, got.Events)
+		})
+	}
+}
+
+func TestHandler_DeleteWebhook(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Delete("/api/user/webhooks/{id}", h.DeleteWebhook())
+	})
+
+	var tests = []struct {
+		name         string
+		id           string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "deleted",
+			id:           "5",
+			EXPECT:       st.webhooks.EXPECT().DeleteWebhook(mock.Anything, int64(1), int64(5)).Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "webhook_of_another_user",
+			id:           "6",
+			EXPECT:       st.webhooks.EXPECT().DeleteWebhook(mock.Anything, int64(1), int64(6)).Return(db.ErrWebhookNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Webhook not found",
+		},
+		{
+			name:         "invalid_id",
+			id:           "abc",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid webhook ID",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Delete(srv.URL + "/api/user/webhooks/" + tt.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_GetWebhookDeliveries(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/webhooks/{id}/deliveries", h.GetWebhookDeliveries())
+	})
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	deliveries := []models.WebhookDelivery{{
+		ID: 7, WebhookID: 5, Event: models.WebhookOrderProcessed, Payload: json.RawMessage(`{"event":"order.processed"}`),
+		Status: models.DeliveryPending, Attempts: 1, ResponseCode: 500, LastError: "unexpected status 500 Internal Server Error",
+		CreatedAt: at, NextAttemptAt: at.Add(30 * time.Second), URL: "https://example.com/hook", Secret: "secret",
+	}}
+
+	var tests = []struct {
+		name         string
+		query        string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "deliveries",
+			query:        "5/deliveries",
+			EXPECT:       st.webhooks.EXPECT().GetWebhookDeliveries(mock.Anything, int64(1), int64(5), defaultWebhookDeliveries).Return(deliveries, nil).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":7,"webhook_id":5,"event":"order.processed","payload":{"event":"order.processed"},"status":"PENDING","attempts":1,"response_code":500,"last_error":"unexpected status 500 Internal Server Error","created_at":"2020-12-10T15:15:45+03:00","next_attempt_at":"2020-12-10T15:16:15+03:00"}]`,
+		},
+		{
+			name:         "no_deliveries",
+			query:        "5/deliveries?limit=10",
+			EXPECT:       st.webhooks.EXPECT().GetWebhookDeliveries(mock.Anything, int64(1), int64(5), 10).Return([]models.WebhookDelivery{}, nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "webhook_of_another_user",
+			query:        "6/deliveries",
+			EXPECT:       st.webhooks.EXPECT().GetWebhookDeliveries(mock.Anything, int64(1), int64(6), defaultWebhookDeliveries).Return(nil, db.ErrWebhookNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Webhook not found",
+		},
+		{
+			name:         "invalid_limit",
+			query:        "5/deliveries?limit=1000",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid limit",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Get(srv.URL + "/api/user/webhooks/" + tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_XML(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/orders", h.GetOrders())
+		r.Get("/api/user/orders/{number}", h.GetOrder())
+		r.Get("/api/user/balance", h.GetBalance())
+		r.Get("/api/user/withdrawals", h.GetWithdrawals())
+	})
+	st.orders.EXPECT().GetOrdersVersion(mock.Anything, int64(1)).Return("1-1", nil).Maybe()
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, int64(1)).Return("1-1-0", nil).Maybe()
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	order := models.Order{Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), UploadedAt: at}
+
+	var tests = []struct {
+		name         string
+		path         string
+		accept       string
+		EXPECT       *mock.Call
+		expectedType string
+		expectedBody string
+	}{
+		{
+			name:         "orders",
+			path:         "/api/user/orders",
+			accept:       "application/xml",
+			EXPECT:       st.orders.EXPECT().GetOrders(mock.Anything, int64(1), models.OrderFilter{}).Return([]models.Order{order}, nil).Once(),
+			expectedType: "application/xml; charset=utf-8",
+			expectedBody: xml.Header + `<orders><order><number>9278923470</number><status>PROCESSED</status><accrual>500</accrual><uploaded_at>2020-12-10T15:15:45+03:00</uploaded_at></order></orders>`,
+		},
+		{
+			name:   "order",
+			path:   "/api/user/orders/9278923470",
+			accept: "text/xml",
+			EXPECT: st.orders.EXPECT().GetOrder(mock.Anything, int64(1), "9278923470").
+				Return(&models.OrderDetail{Order: order, History: []models.OrderStatusChange{{Status: models.StatusNew, ChangedAt: at}}}, nil).Once(),
+			expectedType: "application/xml; charset=utf-8",
+			expectedBody: xml.Header + `<order><number>9278923470</number><status>PROCESSED</status><accrual>500</accrual><uploaded_at>2020-12-10T15:15:45+03:00</uploaded_at><history><change><status>NEW</status><changed_at>2020-12-10T15:15:45+03:00</changed_at></change></history></order>`,
+		},
+		{
+			name:         "balance",
+			path:         "/api/user/balance",
+			accept:       "application/json;q=0.5, application/xml",
+			EXPECT:       st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once(),
+			expectedType: "application/xml; charset=utf-8",
+			expectedBody: xml.Header + `<balance><current>500.5</current><withdrawn>42</withdrawn></balance>`,
+		},
+		{
+			name:         "withdrawals",
+			path:         "/api/user/withdrawals",
+			accept:       "application/xml",
+			EXPECT:       st.withdrawals.EXPECT().GetWithdrawals(mock.Anything, int64(1), models.WithdrawalQuery{}).Return([]models.Withdrawal{{Order: "2377225624", Sum: models.MoneyFromFloat(751), ProcessedAt: at}}, nil).Once(),
+			expectedType: "application/xml; charset=utf-8",
+			expectedBody: xml.Header + `<withdrawals><withdrawal><order>2377225624</order><sum>751</sum><processed_at>2020-12-10T15:15:45+03:00</processed_at></withdrawal></withdrawals>`,
+		},
+		{
+			name:         "json_wins_ties",
+			path:         "/api/user/balance",
+			accept:       "application/xml, */*",
+			EXPECT:       st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once(),
+			expectedType: "application/json",
+			expectedBody: `{"current":500.5,"withdrawn":42}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Accept", tt.accept).
+				Get(srv.URL + tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode())
+			assert.Equal(t, tt.expectedType, resp.Header().Get("Content-Type"))
+			assert.Equal(t, "Accept", resp.Header().Get("Vary"))
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_ETag(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Get("/api/user/orders", h.GetOrders())
+		r.Get("/api/user/balance", h.GetBalance())
+	})
+
+	get := func(path, ifNoneMatch string) *resty.Response {
+		req := resty.New().R().SetHeader("Authorization", "Bearer "+token)
+		if ifNoneMatch != "" {
+			req.SetHeader("If-None-Match", ifNoneMatch)
+		}
+		resp, err := req.Get(srv.URL + path)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// The first request returns the balance with its tag
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, int64(1)).Return("2-7-1", nil).Times(3)
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once()
+	resp := get("/api/user/balance", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, balanceCacheControl, resp.Header().Get("Cache-Control"))
+
+	// The same version is not sent again, a weak or listed tag matches too
+	resp = get("/api/user/balance", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode())
+	assert.Equal(t, etag, resp.Header().Get("ETag"))
+	assert.Empty(t, resp.String())
+	assert.Equal(t, balanceCacheControl, resp.Header().Get("Cache-Control"))
+	resp = get("/api/user/balance", `"other", W/`+etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode())
+
+	// A new version makes the old tag stale
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, int64(1)).Return("2-8-1", nil).Once()
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(600.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once()
+	resp = get("/api/user/balance", etag)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEqual(t, etag, resp.Header().Get("ETag"))
+	assert.Equal(t, `{"current":600.5,"withdrawn":42}`, resp.String())
+
+	// The tag of the orders depends on the query
+	st.orders.EXPECT().GetOrdersVersion(mock.Anything, int64(1)).Return("2-7", nil).Times(3)
+	st.orders.EXPECT().GetOrders(mock.Anything, int64(1), models.OrderFilter{}).Return([]models.Order{}, nil).Once()
+	resp = get("/api/user/orders", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	etag = resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	resp = get("/api/user/orders", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode())
+	st.orders.EXPECT().GetOrders(mock.Anything, int64(1), models.OrderFilter{Statuses: []models.OrderStatus{models.StatusNew}}).Return([]models.Order{}, nil).Once()
+	resp = get("/api/user/orders?status=NEW", etag)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	// A failure to get the version is reported
+	st.orders.EXPECT().GetOrdersVersion(mock.Anything, int64(1)).Return("", assert.AnError).Once()
+	resp = get("/api/user/orders", etag)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode())
+}
+
+func TestHandler_Head(t *testing.T) {
+	srv, st, _, h := testEnv(t)
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	// the tokens are of an active user
+	st.users.EXPECT().GetUserRole(mock.Anything, mock.Anything).Return(models.RoleUser, nil).Maybe()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	// HEAD of a GET route has the headers of GET without the body
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, int64(1)).Return("2-7-1", nil).Once()
+	st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once()
+	resp, err := resty.New().R().SetHeader("Authorization", "Bearer "+token).Head(api.URL + "/api/user/balance")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, balanceCacheControl, resp.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, resp.Header().Get("ETag"))
+	assert.Empty(t, resp.Body())
+
+	// the client polls with the tag
+	st.withdrawals.EXPECT().GetBalanceVersion(mock.Anything, int64(1)).Return("2-7-1", nil).Once()
+	resp, err = resty.New().R().SetHeader("Authorization", "Bearer "+token).
+		SetHeader("If-None-Match", resp.Header().Get("ETag")).Head(api.URL + "/api/user/balance")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode())
+
+	// public and POST-only routes
+	resp, err = resty.New().R().Head(api.URL + "/api/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	resp, err = resty.New().R().SetHeader("Authorization", "Bearer "+token).Head(api.URL + "/api/user/balance/withdraw")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode())
+}
+
+func TestHandler_respondJSON(t *testing.T) {
+	srv, _, _, h := testEnv(t)
+	defer srv.Close()
+
+	rec := httptest.NewRecorder()
+	h.respondJSON(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusCreated, models.Meta{MinWithdrawal: models.MoneyFromFloat(1)})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"min_withdrawal":1}`, rec.Body.String())
+
+	// a value that can't be encoded is reported instead of a broken body
+	rec = httptest.NewRecorder()
+	h.respondJSON(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, make(chan int))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+}
+
+func TestHandler_GraphQL(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Post("/api/graphql", h.GraphQL())
+	})
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name         string
+		body         string
+		EXPECT       []*mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "user_data_in_one_request",
+			body: `{"query":"{ user { id balance { current } orders(status: [PROCESSED]) { number accrual uploadedAt } withdrawals(first: 1) { order sum description cursor } } }"}`,
+			EXPECT: []*mock.Call{
+				st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once(),
+				st.orders.EXPECT().GetOrders(mock.Anything, int64(1), models.OrderFilter{Statuses: []models.OrderStatus{models.StatusProcessed}}).
+					Return([]models.Order{{Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), UploadedAt: at}}, nil).Once(),
+				st.withdrawals.EXPECT().GetWithdrawals(mock.Anything, int64(1), models.WithdrawalQuery{Limit: 1}).
+					Return([]models.Withdrawal{{Order: "2377225624", Sum: models.MoneyFromFloat(751), ProcessedAt: at}}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"data":{"user":{"id":"1","balance":{"current":500.5},"orders":[{"number":"9278923470","accrual":500,"uploadedAt":"2020-12-10T15:15:45+03:00"}],"withdrawals":[{"order":"2377225624","sum":751,"description":null,"cursor":"` +
+				encodeCursor(models.Cursor{At: at, Key: "2377225624"}) + `"}]}}}`,
+		},
+		{
+			name: "order_with_history",
+			body: `{"query":"query($n: String!) { user { order(number: $n) { status history { status changedAt } } } }","variables":{"n":"12345678903"}}`,
+			EXPECT: []*mock.Call{
+				st.orders.EXPECT().GetOrder(mock.Anything, int64(1), "12345678903").Return(&models.OrderDetail{
+					Order:   models.Order{Number: "12345678903", Status: models.StatusNew, UploadedAt: at},
+					History: []models.OrderStatusChange{{Status: models.StatusNew, ChangedAt: at}},
+				}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"data":{"user":{"order":{"status":"NEW","history":[{"status":"NEW","changedAt":"2020-12-10T15:15:45+03:00"}]}}}}`,
+		},
+		{
+			name: "order_not_found",
+			body: `{"query":"{ user { order(number: \"79927398713\") { status } } }"}`,
+			EXPECT: []*mock.Call{
+				st.orders.EXPECT().GetOrder(mock.Anything, int64(1), "79927398713").Return(nil, db.ErrOrderNotFound).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"data":{"user":{"order":null}}}`,
+		},
+		{
+			name: "storage_error_is_hidden",
+			body: `{"query":"{ user { balance { current } } }"}`,
+			EXPECT: []*mock.Call{
+				st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(1)).Return(nil, assert.AnError).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"errors":[{"message":"failed to get balance","path":["user","balance"]}],"data":null}`,
+		},
+		{
+			name:         "invalid_query",
+			body:         `{"query":"{ user { password } }"}`,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"errors":[{"message":"Cannot query field \"password\" on type \"User\".","locations":[{"line":1,"column":10}]}]}`,
+		},
+		{
+			name:         "empty_query",
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Query is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/graphql")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_Admin(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	adminToken, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	userToken, err := auth.GenerateToken(time.Now(), 2)
+	assert.NoError(t, err)
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Use(h.RequireAdmin)
+		r.Get("/users", h.AdminGetUsers())
+		r.Get("/users/{id}", h.AdminGetUser())
+		r.Get("/users/{id}/orders", h.AdminGetUserOrders())
+		r.Get("/users/{id}/balance", h.AdminGetUserBalance())
+		r.Get("/users/{id}/withdrawals", h.AdminGetUserWithdrawals())
+		r.Get("/orders/dead-letters", h.AdminGetDeadLetterOrders())
+		r.Get("/orders/{number}/accrual-responses", h.AdminGetOrderAccrualResponses())
+		r.Get("/stats", h.AdminGetStats())
+	})
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	user := &models.UserInfo{ID: 7, Login: "customer", Role: models.RoleUser, CreatedAt: at}
+
+	var tests = []struct {
+		name           string
+		token          string
+		url            string
+		EXPECT         []*mock.Call
+		expectedCode   int
+		expectedBody   string
+		expectedCursor string
+	}{
+		{
+			name:  "not_admin",
+			token: userToken,
+			url:   "/api/admin/users",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(2)).Return(models.RoleUser, nil).Once(),
+			},
+			expectedCode: http.StatusForbidden,
+			expectedBody: "Admin role is required",
+		},
+		{
+			name:  "role_error",
+			token: userToken,
+			url:   "/api/admin/users",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(2)).Return("", assert.AnError).Once(),
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to get user role",
+		},
+		{
+			name:  "search_users_page",
+			token: adminToken,
+			url:   "/api/admin/users?login=cust&limit=1",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().SearchUsers(mock.Anything, models.UserQuery{Login: "cust", Limit: 2}).
+					Return([]models.UserInfo{*user, {ID: 5, Login: "customer2", Role: models.RoleUser, CreatedAt: at}}, nil).Once(),
+			},
+			expectedCode:   http.StatusOK,
+			expectedBody:   `[{"id":7,"login":"customer","role":"user","created_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedCursor: encodeCursor(models.Cursor{At: at, Key: "7"}),
+		},
+		{
+			name:  "search_deleted_users",
+			token: adminToken,
+			url:   "/api/admin/users?deleted=true",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().SearchUsers(mock.Anything, models.UserQuery{Deleted: true, Limit: maxPageLimit + 1}).
+					Return([]models.UserInfo{{ID: 5, Login: "customer2", Role: models.RoleUser, CreatedAt: at, DeletedAt: &at}}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":5,"login":"customer2","role":"user","created_at":"2020-12-10T15:15:45+03:00","deleted_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "search_users_invalid_cursor",
+			token: adminToken,
+			url:   "/api/admin/users?cursor=" + encodeCursor(models.Cursor{At: at, Key: "customer"}),
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:  "get_user",
+			token: adminToken,
+			url:   "/api/admin/users/7",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().GetUserInfo(mock.Anything, int64(7)).Return(user, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":7,"login":"customer","role":"user","created_at":"2020-12-10T15:15:45+03:00"}`,
+		},
+		{
+			name:  "user_not_found",
+			token: adminToken,
+			url:   "/api/admin/users/8/balance",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().GetUserInfo(mock.Anything, int64(8)).Return(nil, db.ErrUserNotFound).Once(),
+			},
+			expectedCode: http.StatusNotFound,
+			expectedBody: "User not found",
+		},
+		{
+			name:  "invalid_user_id",
+			token: adminToken,
+			url:   "/api/admin/users/abc",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid user ID",
+		},
+		{
+			name:  "user_orders",
+			token: adminToken,
+			url:   "/api/admin/users/7/orders?status=PROCESSED",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().GetUserInfo(mock.Anything, int64(7)).Return(user, nil).Once(),
+				st.orders.EXPECT().GetOrders(mock.Anything, int64(7), models.OrderFilter{Statuses: []models.OrderStatus{models.StatusProcessed}}).
+					Return([]models.Order{{Number: "9278923470", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(500), UploadedAt: at}}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"number":"9278923470","status":"PROCESSED","accrual":500,"uploaded_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "user_balance",
+			token: adminToken,
+			url:   "/api/admin/users/7/balance",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().GetUserInfo(mock.Anything, int64(7)).Return(user, nil).Once(),
+				st.withdrawals.EXPECT().GetBalance(mock.Anything, int64(7)).Return(&models.Balance{Current: models.MoneyFromFloat(500.5), Withdrawn: models.MoneyFromFloat(42)}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"current":500.5,"withdrawn":42}`,
+		},
+		{
+			name:  "stats",
+			token: adminToken,
+			url:   "/api/admin/stats",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetStats(mock.Anything).Return(&models.Stats{
+					Users:     3,
+					Orders:    map[models.OrderStatus]int64{models.StatusNew: 2, models.StatusProcessed: 5},
+					Accrued:   models.MoneyFromFloat(1500),
+					Withdrawn: models.MoneyFromFloat(751),
+					Backlog:   models.Backlog{Orders: 2, Oldest: &at},
+					Balances: models.BalanceReport{Users: 2, Current: models.MoneyFromFloat(749), Accrued: models.MoneyFromFloat(1500),
+						Withdrawn: models.MoneyFromFloat(751), RefreshedAt: &at},
+				}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"users":3,"orders":{"NEW":2,"PROCESSED":5},"accrued":1500,"withdrawn":751,"backlog":{"orders":2,"oldest":"2020-12-10T15:15:45+03:00"},` +
+				`"balances":{"users":2,"current":749,"accrued":1500,"adjusted":0,"withdrawn":751,"refreshed_at":"2020-12-10T15:15:45+03:00"}}`,
+		},
+		{
+			name:  "stats_error",
+			token: adminToken,
+			url:   "/api/admin/stats",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetStats(mock.Anything).Return(nil, assert.AnError).Once(),
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to get stats",
+		},
+		{
+			name:  "order_accrual_responses",
+			token: adminToken,
+			url:   "/api/admin/orders/9278923470/accrual-responses",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetAccrualResponses(mock.Anything, "9278923470").Return([]models.AccrualResponse{
+					{ID: 1, Order: "9278923470", StatusCode: http.StatusTooManyRequests, Body: "No more than 60 requests per minute allowed", ReceivedAt: at},
+					{ID: 2, Order: "9278923470", StatusCode: http.StatusOK, Body: `{"order":"9278923470","status":"PROCESSED","accrual":500}`, ReceivedAt: at},
+				}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":1,"order":"9278923470","status_code":429,"body":"No more than 60 requests per minute allowed","received_at":"2020-12-10T15:15:45+03:00"},` +
+				`{"id":2,"order":"9278923470","status_code":200,"body":"{\"order\":\"9278923470\",\"status\":\"PROCESSED\",\"accrual\":500}","received_at":"2020-12-10T15:15:45+03:00"}]`,
+		},
+		{
+			name:  "order_accrual_responses_empty",
+			token: adminToken,
+			url:   "/api/admin/orders/9278923470/accrual-responses",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetAccrualResponses(mock.Anything, "9278923470").Return([]models.AccrualResponse{}, nil).Once(),
+			},
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:  "order_accrual_responses_not_found",
+			token: adminToken,
+			url:   "/api/admin/orders/9278923470/accrual-responses",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetAccrualResponses(mock.Anything, "9278923470").Return(nil, db.ErrOrderNotFound).Once(),
+			},
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Order not found",
+		},
+		{
+			name:  "order_accrual_responses_invalid_number",
+			token: adminToken,
+			url:   "/api/admin/orders/123/accrual-responses",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+			},
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid order number",
+		},
+		{
+			name:  "dead_letter_orders_page",
+			token: adminToken,
+			url:   "/api/admin/orders/dead-letters?limit=1",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetDeadLetterOrders(mock.Anything, models.Page{Limit: 2}).Return([]models.DeadLetterOrder{
+					{Number: "12345678903", UserID: 7, Attempts: 20, Reason: "failed 20 times", UploadedAt: at, DeadLetteredAt: at},
+					{Number: "4111111111111111", UserID: 7, Attempts: 3, Reason: "not registered", UploadedAt: at, DeadLetteredAt: at},
+				}, nil).Once(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"number":"12345678903","user_id":7,"attempts":20,"reason":"failed 20 times",` +
+				`"uploaded_at":"2020-12-10T15:15:45+03:00","dead_lettered_at":"2020-12-10T15:15:45+03:00"}]`,
+			expectedCursor: encodeCursor(models.Cursor{At: at, Key: "12345678903"}),
+		},
+		{
+			name:  "dead_letter_orders_empty",
+			token: adminToken,
+			url:   "/api/admin/orders/dead-letters?cursor=" + encodeCursor(models.Cursor{At: at, Key: "12345678903"}),
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.orders.EXPECT().GetDeadLetterOrders(mock.Anything, mock.MatchedBy(func(p models.Page) bool {
+					return p.Limit == maxPageLimit+1 && p.After != nil && p.After.Key == "12345678903" && p.After.At.Equal(at)
+				})).Return([]models.DeadLetterOrder{}, nil).Once(),
+			},
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:  "dead_letter_orders_invalid_limit",
+			token: adminToken,
+			url:   "/api/admin/orders/dead-letters?limit=0",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid query",
+		},
+		{
+			name:  "user_withdrawals_empty",
+			token: adminToken,
+			url:   "/api/admin/users/7/withdrawals",
+			EXPECT: []*mock.Call{
+				st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Once(),
+				st.users.EXPECT().GetUserInfo(mock.Anything, int64(7)).Return(user, nil).Once(),
+				st.withdrawals.EXPECT().GetWithdrawals(mock.Anything, int64(7), models.WithdrawalQuery{}).Return([]models.Withdrawal{}, nil).Once(),
+			},
+			expectedCode: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+tt.token).
+				Get(srv.URL + tt.url)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+			assert.Equal(t, tt.expectedCursor, resp.Header().Get("X-Next-Cursor"))
+		})
+	}
+}
+
+func TestHandler_AdminCreateAdjustment(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Use(h.RequireAdmin)
+		r.Post("/api/admin/users/{id}/adjustments", h.AdminCreateAdjustment())
+	})
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Maybe()
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+	created := func(id int64) func(context.Context, *models.Adjustment) error {
+		return func(_ context.Context, adj *models.Adjustment) error {
+			adj.ID, adj.CreatedAt = id, at
+			return nil
+		}
+	}
+
+	var tests = []struct {
+		name         string
+		userID       string
+		body         string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:   "credit",
+			userID: "7",
+			body:   `{"amount":100.5,"reason":" lost accrual for order 12345678903 "}`,
+			EXPECT: st.withdrawals.EXPECT().CreateAdjustment(mock.Anything, &models.Adjustment{UserID: 7, AdminID: 1, Amount: models.MoneyFromFloat(100.5), Reason: "lost accrual for order 12345678903"}).
+				RunAndReturn(created(3)).Once(),
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":3,"user_id":7,"admin_id":1,"amount":100.5,"reason":"lost accrual for order 12345678903","created_at":"2020-12-10T15:15:45+03:00"}`,
+		},
+		{
+			name:   "debit_insufficient_balance",
+			userID: "7",
+			body:   `{"amount":-1000,"reason":"duplicate accrual"}`,
+			EXPECT: st.withdrawals.EXPECT().CreateAdjustment(mock.Anything, &models.Adjustment{UserID: 7, AdminID: 1, Amount: models.MoneyFromFloat(-1000), Reason: "duplicate accrual"}).
+				Return(db.ErrInsufficientBalance).Once(),
+			expectedCode: http.StatusPaymentRequired,
+			expectedBody: "Insufficient balance",
+		},
+		{
+			name:   "user_not_found",
+			userID: "8",
+			body:   `{"amount":10,"reason":"goodwill"}`,
+			EXPECT: st.withdrawals.EXPECT().CreateAdjustment(mock.Anything, &models.Adjustment{UserID: 8, AdminID: 1, Amount: models.MoneyFromFloat(10), Reason: "goodwill"}).
+				Return(db.ErrUserNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "User not found",
+		},
+		{
+			name:   "storage_error",
+			userID: "7",
+			body:   `{"amount":10,"reason":"goodwill"}`,
+			EXPECT: st.withdrawals.EXPECT().CreateAdjustment(mock.Anything, &models.Adjustment{UserID: 7, AdminID: 1, Amount: models.MoneyFromFloat(10), Reason: "goodwill"}).
+				Return(assert.AnError).Once(),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to adjust balance",
+		},
+		{
+			name:         "zero_amount",
+			userID:       "7",
+			body:         `{"amount":0,"reason":"goodwill"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Amount must not be zero",
+		},
+		{
+			name:         "no_reason",
+			userID:       "7",
+			body:         `{"amount":10,"reason":"  "}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Reason is required",
+		},
+		{
+			name:         "long_reason",
+			userID:       "7",
+			body:         `{"amount":10,"reason":"` + strings.Repeat("я", maxAdminReason+1) + `"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Reason is longer than 255 characters",
+		},
+		{
+			name:         "invalid_user_id",
+			userID:       "abc",
+			body:         `{"amount":10,"reason":"goodwill"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid user ID",
+		},
+		{
+			name:         "invalid_body",
+			userID:       "7",
+			body:         `{"amount":"ten"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/admin/users/" + tt.userID + "/adjustments")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_AdminRequeueOrder(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Use(h.RequireAdmin)
+		r.Post("/api/admin/orders/{number}/requeue", h.AdminRequeueOrder())
+	})
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Maybe()
+
+	at, err := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name         string
+		number       string
+		body         string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:   "requeue_invalid_order",
+			number: "12345678903",
+			body:   `{"reason":"accrual system outage"}`,
+			EXPECT: st.orders.EXPECT().RequeueOrder(mock.Anything, &models.OrderRequeue{Order: "12345678903", AdminID: 1, Reason: "accrual system outage"}).
+				RunAndReturn(func(_ context.Context, rq *models.OrderRequeue) error {
+					rq.ID, rq.PreviousStatus, rq.RequeuedAt = 4, models.StatusInvalid, at
+					return nil
+				}).Once(),
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":4,"order":"12345678903","admin_id":1,"previous_status":"INVALID","reason":"accrual system outage","requeued_at":"2020-12-10T15:15:45+03:00"}`,
+		},
+		{
+			name:   "order_not_found",
+			number: "79927398713",
+			body:   `{"reason":"retry"}`,
+			EXPECT: st.orders.EXPECT().RequeueOrder(mock.Anything, &models.OrderRequeue{Order: "79927398713", AdminID: 1, Reason: "retry"}).
+				Return(db.ErrOrderNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Order not found",
+		},
+		{
+			name:   "processed_order",
+			number: "9278923470",
+			body:   `{"reason":"retry"}`,
+			EXPECT: st.orders.EXPECT().RequeueOrder(mock.Anything, &models.OrderRequeue{Order: "9278923470", AdminID: 1, Reason: "retry"}).
+				Return(db.ErrOrderNotRequeueable).Once(),
+			expectedCode: http.StatusConflict,
+			expectedBody: "Only invalid or processing orders can be requeued",
+		},
+		{
+			name:   "storage_error",
+			number: "9278923470",
+			body:   `{"reason":"retry"}`,
+			EXPECT: st.orders.EXPECT().RequeueOrder(mock.Anything, &models.OrderRequeue{Order: "9278923470", AdminID: 1, Reason: "retry"}).
+				Return(assert.AnError).Once(),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to requeue order",
+		},
+		{
+			name:         "no_reason",
+			number:       "9278923470",
+			body:         `{}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Reason is required",
+		},
+		{
+			name:         "invalid_number",
+			number:       "12345",
+			body:         `{"reason":"retry"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid order number",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				SetHeader("Content-Type", "application/json").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/admin/orders/" + tt.number + "/requeue")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_AdminSoftDelete(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Use(h.RequireAdmin)
+		r.Delete("/users/{id}", h.AdminDeleteUser())
+		r.Post("/users/{id}/restore", h.AdminRestoreUser())
+		r.Delete("/orders/{number}", h.AdminRemoveOrder())
+		r.Post("/orders/{number}/restore", h.AdminRestoreOrder())
+	})
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil).Maybe()
+
+	var tests = []struct {
+		name         string
+		method       string
+		url          string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "delete_user",
+			method:       http.MethodDelete,
+			url:          "/api/admin/users/7",
+			EXPECT:       st.users.EXPECT().DeleteUser(mock.Anything, int64(7)).Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "delete_deleted_user",
+			method:       http.MethodDelete,
+			url:          "/api/admin/users/8",
+			EXPECT:       st.users.EXPECT().DeleteUser(mock.Anything, int64(8)).Return(db.ErrUserNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "User not found",
+		},
+		{
+			name:         "restore_user",
+			method:       http.MethodPost,
+			url:          "/api/admin/users/7/restore",
+			EXPECT:       st.users.EXPECT().RestoreUser(mock.Anything, int64(7)).Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "restore_user_error",
+			method:       http.MethodPost,
+			url:          "/api/admin/users/7/restore",
+			EXPECT:       st.users.EXPECT().RestoreUser(mock.Anything, int64(7)).Return(assert.AnError).Once(),
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Failed to update user",
+		},
+		{
+			name:         "invalid_user_id",
+			method:       http.MethodDelete,
+			url:          "/api/admin/users/abc",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "Invalid user ID",
+		},
+		{
+			name:         "remove_order",
+			method:       http.MethodDelete,
+			url:          "/api/admin/orders/9278923470",
+			EXPECT:       st.orders.EXPECT().RemoveOrder(mock.Anything, "9278923470").Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "remove_spent_order",
+			method:       http.MethodDelete,
+			url:          "/api/admin/orders/12345678903",
+			EXPECT:       st.orders.EXPECT().RemoveOrder(mock.Anything, "12345678903").Return(db.ErrInsufficientBalance).Once(),
+			expectedCode: http.StatusPaymentRequired,
+			expectedBody: "Accrual of the order is already spent",
+		},
+		{
+			name:         "restore_order",
+			method:       http.MethodPost,
+			url:          "/api/admin/orders/9278923470/restore",
+			EXPECT:       st.orders.EXPECT().RestoreOrder(mock.Anything, "9278923470").Return(nil).Once(),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "restore_order_not_found",
+			method:       http.MethodPost,
+			url:          "/api/admin/orders/79927398713/restore",
+			EXPECT:       st.orders.EXPECT().RestoreOrder(mock.Anything, "79927398713").Return(db.ErrOrderNotFound).Once(),
+			expectedCode: http.StatusNotFound,
+			expectedBody: "Order not found",
+		},
+		{
+			name:         "invalid_number",
+			method:       http.MethodDelete,
+			url:          "/api/admin/orders/12345",
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: "Invalid order number",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetHeader("Authorization", "Bearer "+token).
+				Execute(tt.method, srv.URL+tt.url)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, tt.expectedBody, respBody(t, resp))
+		})
+	}
+}
+
+func TestHandler_DeleteAccount(t *testing.T) {
+	srv, st, r, h := testEnv(t)
+	defer srv.Close()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator(auth.TokenAuth))
+		r.Use(h.RequireActiveUser)
+		r.Delete("/api/user", h.DeleteAccount())
+		r.Get("/api/user/balance", h.GetBalance())
+	})
+
+	// the account is deleted
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleUser, nil).Once()
+	st.users.EXPECT().DeleteUser(mock.Anything, int64(1)).Return(nil).Once()
+	resp, err := resty.New().R().SetHeader("Authorization", "Bearer "+token).Delete(srv.URL + "/api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	// and its tokens are rejected at once
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return("", db.ErrUserNotFound).Once()
+	resp, err = resty.New().R().SetHeader("Authorization", "Bearer "+token).Get(srv.URL + "/api/user/balance")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	assert.Equal(t, "User not found", respBody(t, resp))
+
+	// the storage errors are not mistaken for the deleted account
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return("", assert.AnError).Once()
+	resp, err = resty.New().R().SetHeader("Authorization", "Bearer "+token).Delete(srv.URL + "/api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode())
+	assert.Equal(t, "Failed to get user", respBody(t, resp))
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	tenantMW, err := middleware.NewTenant([]string{"acme", "globex"})
+	assert.NoError(t, err)
+	srv, st, _, h := testEnv(t, WithTenant(tenantMW))
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	inTenant := func(id string) any {
+		return mock.MatchedBy(func(ctx context.Context) bool { return tenant.FromContext(ctx) == id })
+	}
+
+	// the user is registered in the tenant of the header and gets a token of it
+	st.users.EXPECT().CreateUser(inTenant("globex"), mock.Anything).Return(int64(7), nil).Once()
+	resp, err := resty.New().R().SetHeader(middleware.TenantHeader, "globex").
+		SetBody(&models.User{Login: "tenant", Password: "secret"}).Post(api.URL + "/api/user/register")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	token := strings.TrimPrefix(resp.Header().Get("Authorization"), "Bearer ")
+	parsed, err := auth.TokenAuth.Decode(token)
+	assert.NoError(t, err)
+	claim, _ := parsed.Get("tenant")
+	assert.Equal(t, "globex", claim)
+
+	// the unknown tenant is rejected
+	resp, err = resty.New().R().SetHeader(middleware.TenantHeader, "initech").
+		SetBody(&models.User{Login: "tenant", Password: "secret"}).Post(api.URL + "/api/user/register")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	// the tenant of the token wins over the header
+	st.users.EXPECT().GetUserRole(inTenant("globex"), int64(7)).Return(models.RoleUser, nil).Once()
+	st.withdrawals.EXPECT().GetBalanceVersion(inTenant("globex"), int64(7)).Return("0-0-0", nil).Once()
+	st.withdrawals.EXPECT().GetBalance(inTenant("globex"), int64(7)).Return(&models.Balance{}, nil).Once()
+	resp, err = resty.New().R().SetHeader(middleware.TenantHeader, "acme").
+		SetHeader("Authorization", "Bearer "+token).Get(api.URL + "/api/user/balance")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+}
+
+func TestHandler_ErrorCodes(t *testing.T) {
+	srv, st, _, h := testEnv(t)
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	// the tokens are of an active user
+	st.users.EXPECT().GetUserRole(mock.Anything, mock.Anything).Return(models.RoleUser, nil).Maybe()
+
+	token, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	readOnly, err := auth.GenerateScopedToken(time.Now(), 1, auth.ScopeRead)
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name         string
+		token        string
+		method       string
+		url          string
+		body         string
+		EXPECT       *mock.Call
+		expectedCode int
+		expectedErr  problem.Code
+	}{
+		{
+			name:         "no_token",
+			method:       http.MethodGet,
+			url:          "/api/user/balance",
+			expectedCode: http.StatusUnauthorized,
+			expectedErr:  problem.Unauthorized,
+		},
+		{
+			name:         "read_only_token",
+			token:        readOnly,
+			method:       http.MethodPost,
+			url:          "/api/user/orders",
+			body:         "12345678903",
+			expectedCode: http.StatusForbidden,
+			expectedErr:  problem.InsufficientScope,
+		},
+		{
+			name:         "invalid_order_number",
+			token:        token,
+			method:       http.MethodPost,
+			url:          "/api/user/orders",
+			body:         "12345",
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedErr:  problem.InvalidOrderNumber,
+		},
+		{
+			name:         "order_owned_by_other",
+			token:        token,
+			method:       http.MethodPost,
+			url:          "/api/user/orders",
+			body:         "12345678903",
+			EXPECT:       st.orders.EXPECT().CreateOrder(mock.Anything, mock.Anything).Return(db.ErrOrderAlreadyAdded).Once(),
+			expectedCode: http.StatusConflict,
+			expectedErr:  problem.OrderOwnedByOther,
+		},
+		{
+			name:         "user_exists",
+			method:       http.MethodPost,
+			url:          "/api/user/register",
+			body:         `{"login":"test1","password":"test1"}`,
+			EXPECT:       st.users.EXPECT().CreateUser(mock.Anything, mock.Anything).Return(int64(-1), db.ErrUserAlreadyExists).Once(),
+			expectedCode: http.StatusConflict,
+			expectedErr:  problem.UserExists,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R().SetHeader("Content-Type", "text/plain").SetBody(tt.body)
+			if tt.token != "" {
+				req.SetHeader("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := req.Execute(tt.method, api.URL+tt.url)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, problem.ContentType, resp.Header().Get("Content-Type"))
+			p := problem.Problem{}
+			assert.NoError(t, json.Unmarshal(resp.Body(), &p))
+			assert.Equal(t, tt.expectedErr, p.Code)
+			assert.Equal(t, tt.expectedCode, p.Status)
+			assert.Equal(t, resp.Header().Get("X-Request-ID"), p.RequestID)
+		})
+	}
+}
+
+func TestHandler_Pprof(t *testing.T) {
+	srv, st, _, h := testEnv(t, WithPprof())
+	defer srv.Close()
+	api := httptest.NewServer(h.NewRouter())
+	defer api.Close()
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil)
+	st.users.EXPECT().GetUserRole(mock.Anything, int64(2)).Return(models.RoleUser, nil)
+
+	adminToken, err := auth.GenerateToken(time.Now(), 1)
+	assert.NoError(t, err)
+	userToken, err := auth.GenerateToken(time.Now(), 2)
+	assert.NoError(t, err)
+
+	// the profiles are served to the admins only
+	resp, err := resty.New().R().SetAuthToken(adminToken).Get(api.URL + "/api/admin/debug/pprof/cmdline")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	resp, err = resty.New().R().SetAuthToken(userToken).Get(api.URL + "/api/admin/debug/pprof/cmdline")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+	resp, err = resty.New().R().Get(api.URL + "/api/admin/debug/pprof/cmdline")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// without the option there are no profiles
+	srv2, st2, _, h := testEnv(t)
+	defer srv2.Close()
+	api2 := httptest.NewServer(h.NewRouter())
+	defer api2.Close()
+	st2.users.EXPECT().GetUserRole(mock.Anything, int64(1)).Return(models.RoleAdmin, nil)
+	resp, err = resty.New().R().SetAuthToken(adminToken).Get(api2.URL + "/api/admin/debug/pprof/cmdline")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
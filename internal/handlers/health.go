@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"loyaltySys/internal/models"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the database check of the readiness probe, so an exhausted pool fails it instead of hanging.
+const readinessTimeout = 2 * time.Second
+
+// Readiness reports whether the service can serve the requests, i.e. the database answers within the timeout.
+// The pool statistics are returned either way, so the operators see the pool running out before the requests time out.
+func (h *Handler) Readiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Readiness request")
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		readiness := models.Readiness{Status: "ok"}
+		status := http.StatusOK
+		if err := h.health.Ping(ctx); err != nil {
+			log.Error("database is unavailable: ", err)
+			readiness.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+		readiness.DB = h.health.Stats()
+		w.Header().Set("Cache-Control", "no-store")
+		h.respondJSON(w, r, status, readiness)
+	}
+}
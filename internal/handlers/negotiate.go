@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"loyaltySys/internal/models"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// xmlOrders is the XML document of the orders list.
+type xmlOrders struct {
+	XMLName xml.Name       `xml:"orders"`
+	Orders  []models.Order `xml:"order"`
+}
+
+// xmlWithdrawals is the XML document of the withdrawals list.
+type xmlWithdrawals struct {
+	XMLName     xml.Name            `xml:"withdrawals"`
+	Withdrawals []models.Withdrawal `xml:"withdrawal"`
+}
+
+// wantsXML reports whether the client prefers XML to JSON in the Accept header.
+// JSON wins the ties, so the clients accepting anything get JSON as before.
+func wantsXML(r *http.Request) bool {
+	var xmlQ, jsonQ float64
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			switch mediaType {
+			case "application/xml", "text/xml":
+				xmlQ = max(xmlQ, q)
+			case "application/json", "application/*", "*/*":
+				jsonQ = max(jsonQ, q)
+			}
+		}
+	}
+	return xmlQ > jsonQ
+}
+
+// writeXML replies with the XML document.
+func (h *Handler) writeXML(w http.ResponseWriter, r *http.Request, code int, v any) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(code)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		h.log(r).Error("failed to write XML: ", err)
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		h.log(r).Error("failed to encode XML: ", err)
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/captcha"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/middleware"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/sms"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the handler.
+type Option func(*Handler)
+
+// WithLogger sets the handler logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// WithClock sets the clock used for issuing tokens and time-dependent responses.
+func WithClock(c clock.Clock) Option {
+	return func(h *Handler) {
+		h.clock = c
+	}
+}
+
+// WithMetrics sets the registry for the HTTP metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(h *Handler) {
+		h.metrics = reg
+	}
+}
+
+// WithPasswordHasher sets the hasher of the passwords, the hashes made with other parameters are upgraded on login.
+func WithPasswordHasher(p *auth.PasswordHasher) Option {
+	return func(h *Handler) {
+		h.passwords = p
+	}
+}
+
+// WithCaptcha enables CAPTCHA verification on registration.
+func WithCaptcha(v captcha.Verifier) Option {
+	return func(h *Handler) {
+		h.captcha = v
+	}
+}
+
+// WithSMS enables the phone login with one-time codes delivered by the sender.
+// A zero codeTTL keeps the default code lifetime.
+func WithSMS(sender sms.Sender, codeTTL time.Duration) Option {
+	return func(h *Handler) {
+		h.sms = sender
+		if codeTTL > 0 {
+			h.otpTTL = codeTTL
+		}
+	}
+}
+
+// WithMinWithdrawal sets the minimum amount of a single withdrawal.
+func WithMinWithdrawal(minWithdrawal models.Money) Option {
+	return func(h *Handler) {
+		h.minWithdrawal = minWithdrawal
+	}
+}
+
+// WithTenantMinWithdrawals sets the minimum amounts of a single withdrawal of the tenants,
+// the other tenants have the one of WithMinWithdrawal.
+func WithTenantMinWithdrawals(minWithdrawals map[string]models.Money) Option {
+	return func(h *Handler) {
+		h.tenantMinWithdrawals = minWithdrawals
+	}
+}
+
+// WithTrustedProxies sets the reverse proxies allowed to set forwarding headers.
+func WithTrustedProxies(proxies middleware.TrustedProxies) Option {
+	return func(h *Handler) {
+		h.trustedProxies = proxies
+	}
+}
+
+// WithCORS sets the middleware allowing the cross-origin requests from browsers.
+func WithCORS(cors func(http.Handler) http.Handler) Option {
+	return func(h *Handler) {
+		h.cors = cors
+	}
+}
+
+// WithTenant sets the middleware selecting the tenant of the requests without a token.
+// Without it every request is served for the default tenant.
+func WithTenant(tenant func(http.Handler) http.Handler) Option {
+	return func(h *Handler) {
+		h.tenant = tenant
+	}
+}
+
+// WithRateLimits throttles the requests of every user on the authenticated routes
+// and of every client IP on the registration and login routes.
+func WithRateLimits(perUser, perIP middleware.RateLimit) Option {
+	return func(h *Handler) {
+		h.userRateLimit = perUser
+		h.ipRateLimit = perIP
+	}
+}
+
+// WithAccrualQueue sets the queue the created orders are handed over to the accrual service through.
+func WithAccrualQueue(q *dispatch.Queue) Option {
+	return func(h *Handler) {
+		h.accrualQueue = q
+	}
+}
+
+// WithEvents enables the order events stream fed from the bus.
+func WithEvents(bus *events.Bus) Option {
+	return func(h *Handler) {
+		h.events = bus
+	}
+}
+
+// WithAdminMetrics mounts the Prometheus metrics of the registry set by WithMetrics at /api/admin/metrics
+// for the admins.
+func WithAdminMetrics() Option {
+	return func(h *Handler) {
+		h.adminMetrics = true
+	}
+}
+
+// WithPprof mounts the profiling endpoints of net/http/pprof under /api/admin/debug for the admins.
+func WithPprof() Option {
+	return func(h *Handler) {
+		h.pprof = true
+	}
+}
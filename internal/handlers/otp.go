@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"loyaltySys/internal/tenant"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultOTPTTL     = 5 * time.Minute // defaultOTPTTL is the default lifetime of a one-time code.
+	otpResendInterval = time.Minute     // otpResendInterval is the minimum interval between the codes sent to a phone.
+	maxOTPAttempts    = 5               // maxOTPAttempts is the number of wrong codes after which the code is rejected.
+)
+
+// errInvalidOTP is returned when the one-time code is wrong, expired or already used.
+var errInvalidOTP = errors.New("invalid one-time code")
+
+// SendOTP generates a one-time code and sends it to the phone in an SMS.
+func (h *Handler) SendOTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Sending one-time code request")
+
+		// Decode the request body
+		req := models.PhoneLogin{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("failed to decode phone: ", err)
+			h.httpError(w, r, "Failed to decode phone", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Validate the phone
+		if ok, err := auth.ValidatePhone(req.Phone); !ok {
+			log.Error("invalid phone: ", err)
+			h.httpError(w, r, "Invalid phone", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+
+		// Throttle the codes sent to the same phone
+		now := h.clock.Now()
+		last, err := h.users.GetOTP(r.Context(), req.Phone)
+		if err != nil && !errors.Is(err, db.ErrOTPNotFound) {
+			log.Error("failed to get one-time code: ", err)
+			h.storageError(w, r, "Failed to send code", err)
+			return
+		}
+		if last != nil {
+			if wait := last.CreatedAt.Add(otpResendInterval).Sub(now); wait > 0 {
+				log.Debugf("code for %s was sent recently", req.Phone)
+				h.retryError(w, r, "Code was sent recently", problem.RateLimited, now.Add(wait))
+				return
+			}
+		}
+
+		// Generate and store the hash of the code
+		code, err := auth.GenerateOTP()
+		if err != nil {
+			log.Error("failed to generate code: ", err)
+			h.httpError(w, r, "Failed to send code", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+		codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			log.Error("failed to hash code: ", err)
+			h.httpError(w, r, "Failed to send code", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+		otp := &models.OTP{
+			Phone:     req.Phone,
+			CodeHash:  string(codeHash),
+			CreatedAt: now,
+			ExpiresAt: now.Add(h.otpTTL),
+		}
+		if err := h.users.SaveOTP(r.Context(), otp); err != nil {
+			log.Error("failed to save code: ", err)
+			h.storageError(w, r, "Failed to send code", err)
+			return
+		}
+
+		// Send the code
+		text := fmt.Sprintf("Your Gophermart login code: %s", code)
+		if err := h.sms.Send(r.Context(), req.Phone, text); err != nil {
+			log.Error("failed to send code: ", err)
+			h.httpError(w, r, "Failed to send code", http.StatusBadGateway, problem.Upstream)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// LoginOTP authenticates the user by the registered phone and the one-time code sent to it.
+func (h *Handler) LoginOTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Login by phone request")
+
+		// Decode the request body
+		req := models.PhoneLogin{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("failed to decode phone login: ", err)
+			h.httpError(w, r, "Failed to decode phone login", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if ok, err := auth.ValidatePhone(req.Phone); !ok || req.Code == "" {
+			log.Error("invalid phone login: ", err)
+			h.httpError(w, r, "Invalid phone or code", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+
+		// Check the code before looking up the user, so the response doesn't reveal registered phones
+		if err := h.verifyOTP(r.Context(), req.Phone, req.Code); err != nil {
+			if errors.Is(err, errInvalidOTP) {
+				log.Error(err)
+				h.httpError(w, r, "Invalid phone or code", http.StatusUnauthorized, problem.InvalidCredentials)
+				return
+			}
+			log.Error("failed to verify code: ", err)
+			h.storageError(w, r, "Failed to verify code", err)
+			return
+		}
+		user, err := h.users.GetUserByPhone(r.Context(), req.Phone)
+		if err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				log.Error("user not found: ", err)
+				h.httpError(w, r, "Invalid phone or code", http.StatusUnauthorized, problem.InvalidCredentials)
+				return
+			}
+			log.Error("failed to get user: ", err)
+			h.storageError(w, r, "Failed to get user", err)
+			return
+		}
+
+		// Generate a token for the user
+		token, err := auth.GenerateTenantToken(h.clock.Now(), tenant.FromContext(r.Context()), user.ID, auth.ScopeRead, auth.ScopeWrite)
+		if err != nil {
+			log.Error("failed to generate token: ", err)
+			h.httpError(w, r, "Failed to generate token", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+		// Set the token in the response header
+		w.Header().Set("Authorization", "Bearer "+token)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// SetPhone registers the phone of the user after checking the one-time code sent to it.
+func (h *Handler) SetPhone() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Setting phone request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Decode the request body
+		req := models.PhoneLogin{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("failed to decode phone: ", err)
+			h.httpError(w, r, "Failed to decode phone", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if ok, err := auth.ValidatePhone(req.Phone); !ok || req.Code == "" {
+			log.Error("invalid phone: ", err)
+			h.httpError(w, r, "Invalid phone or code", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+
+		// Check that the user owns the phone
+		if err := h.verifyOTP(r.Context(), req.Phone, req.Code); err != nil {
+			if errors.Is(err, errInvalidOTP) {
+				log.Error(err)
+				h.httpError(w, r, "Invalid code", http.StatusForbidden, problem.InvalidCredentials)
+				return
+			}
+			log.Error("failed to verify code: ", err)
+			h.storageError(w, r, "Failed to verify code", err)
+			return
+		}
+		if err := h.users.SetUserPhone(r.Context(), userID, req.Phone); err != nil {
+			if errors.Is(err, db.ErrPhoneAlreadyExists) {
+				log.Error(err)
+				h.httpError(w, r, "Phone already registered", http.StatusConflict, problem.PhoneExists)
+				return
+			}
+			log.Error("failed to set phone: ", err)
+			h.storageError(w, r, "Failed to set phone", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// verifyOTP checks the code sent to the phone and consumes it.
+func (h *Handler) verifyOTP(ctx context.Context, phone, code string) error {
+	otp, err := h.users.GetOTP(ctx, phone)
+	if err != nil {
+		if errors.Is(err, db.ErrOTPNotFound) {
+			return errInvalidOTP
+		}
+		return err
+	}
+	// Reject the expired codes and the codes guessed too many times
+	if !h.clock.Now().Before(otp.ExpiresAt) || otp.Attempts >= maxOTPAttempts {
+		return fmt.Errorf("%w: expired or attempts exhausted", errInvalidOTP)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(otp.CodeHash), []byte(code)); err != nil {
+		if err := h.users.IncOTPAttempts(ctx, phone); err != nil {
+			return err
+		}
+		return errInvalidOTP
+	}
+	// The code can be used only once
+	if err := h.users.DeleteOTP(ctx, phone); err != nil {
+		if errors.Is(err, db.ErrOTPNotFound) {
+			return errInvalidOTP
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/models"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	nextCursorHeader = "X-Next-Cursor" // nextCursorHeader is the response header with the cursor of the next page.
+	maxPageLimit     = 100             // maxPageLimit is the maximum number of items in one page.
+)
+
+// encodeCursor encodes the cursor into an opaque URL-safe string.
+func encodeCursor(c models.Cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes the cursor sent by the client.
+func decodeCursor(s string) (*models.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	c := &models.Cursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if c.At.IsZero() {
+		return nil, errors.New("invalid cursor: no position")
+	}
+	return c, nil
+}
+
+// parseLimit parses the limit query parameter, zero if it is not set.
+func parseLimit(q url.Values) (int, error) {
+	v := q.Get("limit")
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// parseTimeRange parses the from and to query parameters in the RFC 3339 format.
+func parseTimeRange(q url.Values) (from, to time.Time, err error) {
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return from, to, errors.New("from is after to")
+	}
+	return from, to, nil
+}
+
+// parseWithdrawalQuery parses the page, the date range and the sort of the withdrawals list.
+func parseWithdrawalQuery(q url.Values) (models.WithdrawalQuery, error) {
+	wq := models.WithdrawalQuery{}
+	var err error
+	if wq.From, wq.To, err = parseTimeRange(q); err != nil {
+		return wq, err
+	}
+	if wq.Limit, err = parseLimit(q); err != nil {
+		return wq, err
+	}
+	if wq.Sort, err = parseSort(q, models.SortProcessedAt, models.SortSum); err != nil {
+		return wq, err
+	}
+	if wq.After, err = parseCursor(q, wq.Sort.Field == models.SortSum); err != nil {
+		return wq, err
+	}
+	return wq, nil
+}
+
+// parseOrderPage parses the limit and the cursor of the orders list sorted by the sort of the filter.
+func parseOrderPage(q url.Values, s models.Sort) (models.Page, error) {
+	page := models.Page{}
+	var err error
+	if page.Limit, err = parseLimit(q); err != nil {
+		return page, err
+	}
+	if page.After, err = parseCursor(q, s.Field == models.SortAccrual); err != nil {
+		return page, err
+	}
+	if page.After != nil && page.Limit == 0 {
+		return page, errors.New("cursor requires a limit")
+	}
+	return page, nil
+}
+
+// parseCursor parses the cursor query parameter, nil if it is not set. The cursor of a list
+// sorted by a number has the value.
+func parseCursor(q url.Values, byValue bool) (*models.Cursor, error) {
+	v := q.Get("cursor")
+	if v == "" {
+		return nil, nil
+	}
+	c, err := decodeCursor(v)
+	if err != nil {
+		return nil, err
+	}
+	if byValue != (c.Value != nil) {
+		return nil, errors.New("invalid cursor: the sort doesn't match")
+	}
+	return c, nil
+}
+
+// parseSort parses the sort and order query parameters, the field has to be one of the fields of the list.
+func parseSort(q url.Values, fields ...string) (models.Sort, error) {
+	s := models.Sort{Field: q.Get("sort"), Order: models.SortOrder(q.Get("order"))}
+	if s.Field != "" && !slices.Contains(fields, s.Field) {
+		return s, fmt.Errorf("sort must be one of %v", fields)
+	}
+	if s.Order != "" && s.Order != models.SortAsc && s.Order != models.SortDesc {
+		return s, fmt.Errorf("order must be %s or %s", models.SortAsc, models.SortDesc)
+	}
+	return s, nil
+}
+
+// getOrders gets the user's orders matching the filter, a page of them if the page has a limit,
+// setting the cursor of the next page in the response.
+func (h *Handler) getOrders(w http.ResponseWriter, r *http.Request, userID int64, filter models.OrderFilter, page models.Page) ([]models.Order, error) {
+	if page.Limit == 0 {
+		return h.orders.GetOrders(r.Context(), userID, filter)
+	}
+	result, err := h.orders.GetOrdersPage(r.Context(), userID, filter, page)
+	if err != nil {
+		return nil, err
+	}
+	if result.Next != nil {
+		w.Header().Set(nextCursorHeader, encodeCursor(*result.Next))
+	}
+	return result.Orders, nil
+}
+
+// getWithdrawals gets the user's withdrawals selected by the query, a page of them if the query has a limit,
+// setting the cursor of the next page in the response.
+func (h *Handler) getWithdrawals(w http.ResponseWriter, r *http.Request, userID int64, q models.WithdrawalQuery) ([]models.Withdrawal, error) {
+	if q.Limit == 0 {
+		return h.withdrawals.GetWithdrawals(r.Context(), userID, q)
+	}
+	result, err := h.withdrawals.GetWithdrawalsPage(r.Context(), userID, q)
+	if err != nil {
+		return nil, err
+	}
+	if result.Next != nil {
+		w.Header().Set(nextCursorHeader, encodeCursor(*result.Next))
+	}
+	return result.Withdrawals, nil
+}
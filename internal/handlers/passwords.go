@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/models"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of the password hash upgrades in the gophermart_password_hash_upgrades_total metric.
+const (
+	upgradeUpgraded = "upgraded"
+	upgradeFailed   = "failed"
+)
+
+// passwordMetrics follow the upgrade of the password hashes to the configured parameters: the logins
+// by whether the stored hash was outdated and the results of the upgrades.
+type passwordMetrics struct {
+	logins   *prometheus.CounterVec
+	upgrades *prometheus.CounterVec
+}
+
+// newPasswordMetrics creates the password metrics and registers them in the registry.
+func newPasswordMetrics(reg *metrics.Registry) *passwordMetrics {
+	m := &passwordMetrics{
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "password",
+			Name:      "logins_total",
+			Help:      "Password logins by whether the stored hash was made with outdated parameters.",
+		}, []string{"outdated"}),
+		upgrades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "password",
+			Name:      "hash_upgrades_total",
+			Help:      "Password hashes rewritten with the configured parameters on login, by result.",
+		}, []string{"result"}),
+	}
+	m.logins = registerCounterVec(reg.OrDiscard(), m.logins)
+	m.upgrades = registerCounterVec(reg.OrDiscard(), m.upgrades)
+	return m
+}
+
+// registerCounterVec registers the counter or returns the one registered before, as the handlers
+// may be created again on the same registry.
+func registerCounterVec(reg *metrics.Registry, c *prometheus.CounterVec) *prometheus.CounterVec {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+	}
+	return c
+}
+
+// upgradePassword rewrites the user's password hash made with outdated parameters once the password is verified.
+// A failed upgrade doesn't fail the login, the hash is upgraded on one of the next logins.
+func (h *Handler) upgradePassword(r *http.Request, user *models.User, password string) {
+	if !h.passwords.NeedsRehash(user.Password) {
+		h.hashMetrics.logins.WithLabelValues("false").Inc()
+		return
+	}
+	h.hashMetrics.logins.WithLabelValues("true").Inc()
+	log := h.log(r)
+	hash, err := h.passwords.Hash(password)
+	if err == nil {
+		err = h.users.UpdatePasswordHash(r.Context(), user.ID, user.Password, hash)
+	}
+	if err != nil {
+		log.Error("failed to upgrade password hash: ", err)
+		h.hashMetrics.upgrades.WithLabelValues(upgradeFailed).Inc()
+		return
+	}
+	log.Debug("Upgraded password hash of user: ", user.ID)
+	h.hashMetrics.upgrades.WithLabelValues(upgradeUpgraded).Inc()
+}
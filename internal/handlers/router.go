@@ -2,11 +2,15 @@ package handlers
 
 import (
 	"loyaltySys/internal/auth"
+	"loyaltySys/internal/docs"
+	"loyaltySys/internal/middleware"
 	"net/http"
+	"strconv"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
+	chiv5mw "github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/jwtauth/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // NewRouter creates a new router for the handler
@@ -14,23 +18,165 @@ func (h *Handler) NewRouter() http.Handler {
 	// Create a new router
 	r := chi.NewRouter()
 	// Use middleware
-	r.Use(middleware.Logger, middleware.Recoverer)
+	r.Use(middleware.Hardening(h.trustedProxies))
+	r.Use(middleware.RealIP(h.trustedProxies))
+	r.Use(middleware.RequestID)
+	// Answer the preflight requests before the authentication
+	if h.cors != nil {
+		r.Use(h.cors)
+	}
+	if h.tenant != nil {
+		r.Use(h.tenant)
+	}
+	// Log the requests and report the panics with the user of the request
+	user := func(r *http.Request) string {
+		userID, err := auth.GetUserIDFromRequest(r)
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatInt(userID, 10)
+	}
+	recoverer := middleware.NewRecoverer(h.logger, h.metrics, user)
+	// the probes would flood the log
+	accessLog := middleware.NewAccessLog(h.logger, user, "/readyz")
+	// Trace and count the requests by route, the panics answered by the recoverer included
+	r.Use(middleware.Tracing)
+	r.Use(middleware.NewHTTPMetrics(h.metrics).Handler)
+	r.Use(accessLog.Handler, recoverer.Handler)
+	// Answer HEAD on the GET routes, the server drops the body. The chi v1 middleware
+	// doesn't see the v5 routing context, so the one of v5 is used
+	r.Use(chiv5mw.GetHead)
+	// Throttle the users by the token and the anonymous clients by the address
+	userLimiter := middleware.NewRateLimiter(h.userRateLimit, func(r *http.Request) string {
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatInt(userID, 10)
+	})
+	ipLimiter := middleware.NewRateLimiter(h.ipRateLimit, middleware.RemoteIP)
 	// Define routes
+	r.Get("/api/meta", h.GetMeta())
+	if h.health != nil {
+		r.Get("/readyz", h.Readiness())
+	}
+	r.Mount("/api/docs", docs.NewRouter())
+	// GraphQL over the user's data, read-only
+	r.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(auth.Authenticator)
+		r.Use(userLimiter.Handler)
+		r.Use(h.RequireActiveUser)
+		r.Use(auth.RequireScope(auth.ScopeRead))
+		r.Post("/api/graphql", h.GraphQL())
+	})
+	// Support routes over any user's data, for the admins only
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(jwtauth.Verifier(auth.TokenAuth))
+		r.Use(auth.Authenticator)
+		r.Use(userLimiter.Handler)
+		r.Use(h.RequireAdmin)
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(auth.ScopeRead))
+			r.Get("/users", h.AdminGetUsers())
+			r.Get("/users/{id}", h.AdminGetUser())
+			r.Get("/users/{id}/orders", h.AdminGetUserOrders())
+			r.Get("/users/{id}/balance", h.AdminGetUserBalance())
+			r.Get("/users/{id}/withdrawals", h.AdminGetUserWithdrawals())
+			r.Get("/orders/dead-letters", h.AdminGetDeadLetterOrders())
+			r.Get("/orders/{number}/accrual-responses", h.AdminGetOrderAccrualResponses())
+			r.Get("/stats", h.AdminGetStats())
+			// the metrics aren't public, they tell the traffic, the queries and the backlog
+			if metrics := h.MetricsHandler(); metrics != nil && h.adminMetrics {
+				r.Handle("/metrics", metrics)
+			}
+			// the live profiles and the execution trace of the process
+			if h.pprof {
+				r.Mount("/debug", chiv5mw.Profiler())
+			}
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(auth.ScopeWrite))
+			r.Post("/users/{id}/adjustments", h.AdminCreateAdjustment())
+			r.Post("/orders/{number}/requeue", h.AdminRequeueOrder())
+			r.Delete("/users/{id}", h.AdminDeleteUser())
+			r.Post("/users/{id}/restore", h.AdminRestoreUser())
+			r.Delete("/orders/{number}", h.AdminRemoveOrder())
+			r.Post("/orders/{number}/restore", h.AdminRestoreOrder())
+		})
+	})
 	r.Route("/api/user", func(r chi.Router) {
 		// Group for authenticated routes
 		r.Group(func(r chi.Router) {
 			r.Use(jwtauth.Verifier(auth.TokenAuth))
-			r.Use(jwtauth.Authenticator(auth.TokenAuth))
-			r.Post("/orders", h.CreateOrder())
-			r.Get("/orders", h.GetOrders())
-			r.Get("/balance", h.GetBalance())
-			r.Post("/balance/withdraw", h.Withdraw())
-			r.Get("/withdrawals", h.GetWithdrawals())
+			r.Use(auth.Authenticator)
+			r.Use(userLimiter.Handler)
+			r.Use(h.RequireActiveUser)
+			// Read-only routes
+			r.Group(func(r chi.Router) {
+				r.Use(auth.RequireScope(auth.ScopeRead))
+				r.Get("/orders", h.GetOrders())
+				if h.events != nil {
+					r.Get("/orders/events", h.OrderEvents())
+				}
+				r.Get("/orders/{number}", h.GetOrder())
+				r.Post("/orders/status", h.GetOrdersStatus())
+				r.Get("/balance", h.GetBalance())
+				r.Get("/balance/history", h.GetBalanceHistory())
+				r.Get("/withdrawals", h.GetWithdrawals())
+				r.Get("/transactions", h.GetTransactions())
+				r.Get("/webhooks", h.GetWebhooks())
+				r.Get("/webhooks/{id}/deliveries", h.GetWebhookDeliveries())
+			})
+			// Routes changing the user's data
+			r.Group(func(r chi.Router) {
+				r.Use(auth.RequireScope(auth.ScopeWrite))
+				r.Delete("/", h.DeleteAccount())
+				r.Post("/orders", h.CreateOrder())
+				r.Post("/orders/batch", h.CreateOrders())
+				r.Delete("/orders/{number}", h.DeleteOrder())
+				r.Post("/balance/withdraw", h.Withdraw())
+				r.Post("/balance/withdraw/batch", h.WithdrawBatch())
+				r.Post("/tokens/readonly", h.IssueReadOnlyToken())
+				r.Post("/webhooks", h.CreateWebhook())
+				r.Delete("/webhooks/{id}", h.DeleteWebhook())
+				if h.sms != nil {
+					r.Put("/phone", h.SetPhone())
+				}
+			})
 		})
+		// Live updates over WebSocket, browsers can't set headers on the upgrade request,
+		// so the token may also be passed in the jwt query parameter
+		if h.events != nil {
+			r.Group(func(r chi.Router) {
+				r.Use(jwtauth.Verify(auth.TokenAuth, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie, jwtauth.TokenFromQuery))
+				r.Use(auth.Authenticator)
+				r.Use(userLimiter.Handler)
+				r.Use(h.RequireActiveUser)
+				r.Use(auth.RequireScope(auth.ScopeRead))
+				r.Get("/ws", h.WebSocket())
+			})
+		}
 		// Routes for unauthenticated users
-		r.Post("/register", h.CreateUser())
-		r.Post("/login", h.LoginUser())
+		r.Group(func(r chi.Router) {
+			r.Use(ipLimiter.Handler)
+			r.Post("/register", h.CreateUser())
+			r.Post("/login", h.LoginUser())
+			// Phone login with one-time codes, if SMS is configured
+			if h.sms != nil {
+				r.Post("/otp", h.SendOTP())
+				r.Post("/login/otp", h.LoginOTP())
+			}
+		})
 	})
 
 	return r
 }
+
+// MetricsHandler returns the handler exposing the Prometheus metrics of the registry, nil without one.
+func (h *Handler) MetricsHandler() http.Handler {
+	if h.metrics == nil {
+		return nil
+	}
+	return promhttp.HandlerFor(h.metrics, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ruleCodes are the problem codes of the validation rules having their own code, the other rules
+// fail with problem.ValidationFailed.
+var ruleCodes = map[string]problem.Code{
+	"luhn":           problem.InvalidOrderNumber,
+	"min_withdrawal": problem.WithdrawalTooSmall,
+}
+
+// minWithdrawalKey is the context key of the minimum withdrawal the min_withdrawal rule checks the sum against.
+type minWithdrawalKey struct{}
+
+// withMinWithdrawal returns the context validating the withdrawals against the minimum.
+func withMinWithdrawal(ctx context.Context, minWithdrawal models.Money) context.Context {
+	return context.WithValue(ctx, minWithdrawalKey{}, minWithdrawal)
+}
+
+// minWithdrawalFrom returns the minimum withdrawal of the context, 0 if there is none.
+func minWithdrawalFrom(ctx context.Context) models.Money {
+	minWithdrawal, _ := ctx.Value(minWithdrawalKey{}).(models.Money)
+	return minWithdrawal
+}
+
+// newValidator returns the validator of the request DTOs by their `validate` struct tags.
+// The fields are named by their JSON names. Besides the built-in rules there are
+// luhn, checking the order number, and min_withdrawal, checking the sum against the minimum withdrawal
+// of the validation context, see withMinWithdrawal.
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	must := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+	must(v.RegisterValidation("luhn", func(fl validator.FieldLevel) bool {
+		ok, _ := auth.ValidateOrderNumber(fl.Field().String())
+		return ok
+	}))
+	must(v.RegisterValidationCtx("min_withdrawal", func(ctx context.Context, fl validator.FieldLevel) bool {
+		return models.Money(fl.Field().Int()) >= minWithdrawalFrom(ctx)
+	}))
+	return v
+}
+
+// fieldErrors checks the request DTO by its validate tags and returns the violations of its fields, nil if it is valid.
+func (h *Handler) fieldErrors(ctx context.Context, v any) []problem.FieldError {
+	err := h.validate.StructCtx(ctx, v)
+	if err == nil {
+		return nil
+	}
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		// the DTO is not a struct, it's a bug
+		panic(fmt.Sprintf("failed to validate %T: %v", v, err))
+	}
+	errs := make([]problem.FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		// the namespace starts with the struct name
+		_, field, _ := strings.Cut(fe.Namespace(), ".")
+		errs = append(errs, problem.FieldError{Field: field, Rule: fe.Tag(), Message: fieldMessage(ctx, fe)})
+	}
+	return errs
+}
+
+// fieldMessage returns the human-readable message of the violation.
+func fieldMessage(ctx context.Context, fe validator.FieldError) string {
+	name := fe.Field()
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+	}
+	switch fe.Tag() {
+	case "required":
+		return name + " is required"
+	case "luhn":
+		return "Invalid order number"
+	case "min_withdrawal":
+		return fmt.Sprintf("Withdrawal sum is less than the minimum amount of %.2f", minWithdrawalFrom(ctx).Float64())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("%s is longer than %s characters", name, fe.Param())
+		}
+		return fmt.Sprintf("%s is greater than %s", name, fe.Param())
+	}
+	return name + " is invalid"
+}
+
+// ruleCode returns the problem code of the violation.
+func ruleCode(fe problem.FieldError) problem.Code {
+	if code, ok := ruleCodes[fe.Rule]; ok {
+		return code
+	}
+	return problem.ValidationFailed
+}
+
+// validRequest checks the request DTO by its validate tags. If it's invalid, the problem of the status
+// is written with the violations of all the fields, its code and detail are the ones of the first violation.
+func (h *Handler) validRequest(w http.ResponseWriter, r *http.Request, v any, status int) bool {
+	errs := h.fieldErrors(r.Context(), v)
+	if errs == nil {
+		return true
+	}
+	h.log(r).Errorf("invalid request: %+v", errs)
+	problem.WriteFields(w, r, status, ruleCode(errs[0]), errs[0].Message, errs)
+	return false
+}
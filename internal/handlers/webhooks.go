@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxWebhooks              = 10   // maxWebhooks is the maximum number of webhooks of a user.
+	maxWebhookURLLength      = 2048 // maxWebhookURLLength is the maximum length of a webhook URL.
+	defaultWebhookDeliveries = 50   // defaultWebhookDeliveries is the number of deliveries listed without the limit.
+)
+
+// CreateWebhook registers the URL the user's events are posted to and returns it with the signing secret.
+func (h *Handler) CreateWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Creating webhook request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Decode the request body
+		webhook := models.Webhook{}
+		if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+			log.Error("failed to decode webhook: ", err)
+			h.httpError(w, r, "Failed to decode webhook", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Validate the webhook
+		if err := validateWebhook(&webhook); err != nil {
+			log.Error("invalid webhook: ", err)
+			h.httpError(w, r, "Invalid webhook: "+err.Error(), http.StatusUnprocessableEntity, problem.ValidationFailed)
+			return
+		}
+		// Generate the signing secret
+		webhook.UserID = userID
+		if webhook.Secret, err = generateWebhookSecret(); err != nil {
+			log.Error("failed to generate webhook secret: ", err)
+			h.httpError(w, r, "Failed to create webhook", http.StatusInternalServerError, problem.Internal)
+			return
+		}
+		// Save the webhook
+		if err := h.webhooks.CreateWebhook(r.Context(), &webhook, maxWebhooks); err != nil {
+			if errors.Is(err, db.ErrTooManyWebhooks) {
+				log.Error("too many webhooks: ", err)
+				h.httpError(w, r, fmt.Sprintf("A user can have at most %d webhooks", maxWebhooks), http.StatusConflict, problem.TooManyWebhooks)
+				return
+			}
+			log.Error("failed to create webhook: ", err)
+			h.storageError(w, r, "Failed to create webhook", err)
+			return
+		}
+
+		// Return the webhook with the secret, it is not shown again
+		h.respondJSON(w, r, http.StatusCreated, webhook)
+	}
+}
+
+// GetWebhooks returns the user's webhooks without the secrets.
+func (h *Handler) GetWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting webhooks request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Get the webhooks from the database
+		webhooks, err := h.webhooks.GetWebhooks(r.Context(), userID)
+		if err != nil {
+			log.Error("failed to get webhooks: ", err)
+			h.storageError(w, r, "Failed to get webhooks", err)
+			return
+		}
+		// Return 204 if the user has no webhooks
+		if len(webhooks) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Return the webhooks
+		h.respondJSON(w, r, http.StatusOK, webhooks)
+	}
+}
+
+// DeleteWebhook deletes the user's webhook and its delivery log.
+func (h *Handler) DeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Deleting webhook request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Parse the webhook ID
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid webhook ID: ", err)
+			h.httpError(w, r, "Invalid webhook ID", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		// Delete the webhook, the webhooks of other users are reported as not found
+		if err := h.webhooks.DeleteWebhook(r.Context(), userID, id); err != nil {
+			if errors.Is(err, db.ErrWebhookNotFound) {
+				log.Error("webhook not found: ", err)
+				h.httpError(w, r, "Webhook not found", http.StatusNotFound, problem.WebhookNotFound)
+				return
+			}
+			log.Error("failed to delete webhook: ", err)
+			h.storageError(w, r, "Failed to delete webhook", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetWebhookDeliveries returns the latest deliveries of the user's webhook.
+func (h *Handler) GetWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("Getting webhook deliveries request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Parse the webhook ID and the limit
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid webhook ID: ", err)
+			h.httpError(w, r, "Invalid webhook ID", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		limit, err := parseLimit(r.URL.Query())
+		if err != nil {
+			log.Error("invalid limit: ", err)
+			h.httpError(w, r, "Invalid limit", http.StatusBadRequest, problem.InvalidRequest)
+			return
+		}
+		if limit == 0 {
+			limit = defaultWebhookDeliveries
+		}
+		// Get the deliveries, the webhooks of other users are reported as not found
+		deliveries, err := h.webhooks.GetWebhookDeliveries(r.Context(), userID, id, limit)
+		if err != nil {
+			if errors.Is(err, db.ErrWebhookNotFound) {
+				log.Error("webhook not found: ", err)
+				h.httpError(w, r, "Webhook not found", http.StatusNotFound, problem.WebhookNotFound)
+				return
+			}
+			log.Error("failed to get webhook deliveries: ", err)
+			h.storageError(w, r, "Failed to get webhook deliveries", err)
+			return
+		}
+		// Return 204 if nothing has been delivered yet
+		if len(deliveries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Return the deliveries
+		h.respondJSON(w, r, http.StatusOK, deliveries)
+	}
+}
+
+// validateWebhook checks the webhook URL and events and removes the duplicate events.
+func validateWebhook(webhook *models.Webhook) error {
+	if len(webhook.URL) > maxWebhookURLLength {
+		return errors.New("url is too long")
+	}
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return errors.New("url must be an absolute http or https URL without credentials")
+	}
+	if len(webhook.Events) == 0 {
+		return errors.New("no events")
+	}
+	events := []string{}
+	for _, e := range webhook.Events {
+		if !slices.Contains(models.WebhookEvents, e) {
+			return fmt.Errorf("unknown event %q", e)
+		}
+		if !slices.Contains(events, e) {
+			events = append(events, e)
+		}
+	}
+	webhook.Events = events
+	return nil
+}
+
+// generateWebhookSecret returns a random secret for signing the webhook payloads.
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
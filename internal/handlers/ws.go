@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"loyaltySys/internal/auth"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// wsPingInterval is the interval of the pings checking the client is alive.
+	wsPingInterval = 30 * time.Second
+	// wsPongWait is the time the client has to answer a ping.
+	wsPongWait = 2 * wsPingInterval
+	// wsWriteWait is the time allowed to write a message to the client.
+	wsWriteWait = 10 * time.Second
+	// wsMaxMessageSize is the maximum size of a client message.
+	wsMaxMessageSize = 512
+)
+
+// WebSocket topics a connection can subscribe to.
+const (
+	wsTopicOrders  = "orders"
+	wsTopicBalance = "balance"
+)
+
+// WebSocket message types sent to the client.
+const (
+	wsTypeOrder   = "order"
+	wsTypeBalance = "balance"
+	wsTypeError   = "error"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsRequest is a message from the client changing the connection subscriptions.
+type wsRequest struct {
+	Action string   `json:"action"`
+	Topics []string `json:"topics"`
+}
+
+// wsMessage is a message pushed to the client.
+type wsMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// wsSubscriptions is the set of topics a connection is subscribed to.
+type wsSubscriptions map[string]bool
+
+// apply changes the subscriptions as requested and returns the newly subscribed topics.
+func (s wsSubscriptions) apply(req wsRequest) ([]string, error) {
+	for _, topic := range req.Topics {
+		if topic != wsTopicOrders && topic != wsTopicBalance {
+			return nil, fmt.Errorf("unknown topic %q", topic)
+		}
+	}
+	var added []string
+	switch req.Action {
+	case "subscribe":
+		for _, topic := range req.Topics {
+			if !s[topic] {
+				s[topic] = true
+				added = append(added, topic)
+			}
+		}
+	case "unsubscribe":
+		for _, topic := range req.Topics {
+			delete(s, topic)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", req.Action)
+	}
+	return added, nil
+}
+
+// wsConn pushes the subscribed user's updates to a WebSocket connection.
+type wsConn struct {
+	h      *Handler
+	conn   *websocket.Conn
+	userID int64
+	subs   wsSubscriptions
+	log    *zap.SugaredLogger
+}
+
+// WebSocket streams the user's balance and order status updates over a WebSocket connection.
+// The client chooses the updates with the subscribe and unsubscribe requests.
+func (h *Handler) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log(r)
+		log.Debug("WebSocket request")
+
+		// Get the user ID from the context
+		userID, err := auth.GetUserIDFromCtx(r.Context())
+		if err != nil {
+			log.Error("failed to get user ID: ", err)
+			h.httpError(w, r, "Failed to get user ID", http.StatusUnauthorized, problem.Unauthorized)
+			return
+		}
+		// Upgrade the connection, the upgrader replies with the error itself
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Error("failed to upgrade connection: ", err)
+			return
+		}
+		defer conn.Close()
+
+		c := &wsConn{h: h, conn: conn, userID: userID, subs: wsSubscriptions{}, log: log}
+		c.serve(r.Context())
+	}
+}
+
+// serve reads the client requests in a goroutine and writes the updates until either side closes the connection.
+func (c *wsConn) serve(ctx context.Context) {
+	events, unsubscribe := c.h.events.Subscribe(c.userID)
+	defer unsubscribe()
+	ping := c.h.clock.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	requests := make(chan []byte)
+	readDone := make(chan struct{})
+	go c.read(requests, readDone)
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.h.streamsDone:
+			c.close(websocket.CloseGoingAway, "server shutdown")
+			return
+		case <-readDone:
+			c.log.Debug("websocket closed by client")
+			return
+		case <-ping.C():
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case req := <-requests:
+			err = c.handleRequest(ctx, req)
+		case e := <-events:
+			err = c.handleEvent(ctx, e)
+		}
+		if err != nil {
+			c.log.Debug("failed to write websocket message: ", err)
+			return
+		}
+	}
+}
+
+// read passes the client requests to the writer until the connection fails.
+func (c *wsConn) read(requests chan<- []byte, done chan<- struct{}) {
+	defer close(done)
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case requests <- msg:
+		case <-c.h.streamsDone:
+			return
+		}
+	}
+}
+
+// handleRequest applies the subscription request and sends the current balance on subscribing to it.
+func (c *wsConn) handleRequest(ctx context.Context, msg []byte) error {
+	var req wsRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return c.write(wsTypeError, map[string]string{"message": "invalid request"})
+	}
+	added, err := c.subs.apply(req)
+	if err != nil {
+		return c.write(wsTypeError, map[string]string{"message": err.Error()})
+	}
+	for _, topic := range added {
+		if topic == wsTopicBalance {
+			return c.writeBalance(ctx)
+		}
+	}
+	return nil
+}
+
+// handleEvent pushes the updates caused by the event to the subscribed topics.
+func (c *wsConn) handleEvent(ctx context.Context, e models.Event) error {
+	switch e := e.(type) {
+	case models.OrderEvent:
+		if c.subs[wsTopicOrders] {
+			if err := c.write(wsTypeOrder, e); err != nil {
+				return err
+			}
+		}
+		// The accrual of a processed order is credited to the balance
+		if c.subs[wsTopicBalance] && e.Status == models.StatusProcessed && e.Accrual > 0 {
+			return c.writeBalance(ctx)
+		}
+	case models.WithdrawalEvent:
+		if c.subs[wsTopicBalance] {
+			return c.writeBalance(ctx)
+		}
+	}
+	return nil
+}
+
+// writeBalance sends the current user's balance.
+func (c *wsConn) writeBalance(ctx context.Context) error {
+	balance, err := c.h.withdrawals.GetBalance(ctx, c.userID)
+	if err != nil {
+		c.log.Error("failed to get balance: ", err)
+		return c.write(wsTypeError, map[string]string{"message": "Failed to get balance"})
+	}
+	return c.write(wsTypeBalance, balance)
+}
+
+// write sends the message to the client.
+func (c *wsConn) write(typ string, data any) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(wsMessage{Type: typ, Data: data})
+}
+
+// close sends the close message to the client.
+func (c *wsConn) close(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait)); err != nil {
+		c.log.Debug("failed to close websocket: ", err)
+	}
+}
@@ -0,0 +1,164 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultTimeout is used when a hook does not define its own start or stop timeout
+// and the lifecycle is not given another one.
+const DefaultTimeout = 5 * time.Second
+
+// ErrHookTimeout is returned when a hook does not finish within its timeout.
+var ErrHookTimeout = errors.New("lifecycle hook timed out")
+
+// Hook is a pair of start/stop callbacks registered by a subsystem.
+// OnStart must not block: long-running work has to be started in a goroutine bound to the passed context.
+// The context isn't canceled with the one of Start, but right before OnStop of the hook, so the subsystem
+// keeps running until it is stopped in its turn.
+type Hook struct {
+	Name         string                          // Name of the subsystem, used in logs and errors
+	OnStart      func(ctx context.Context) error // OnStart is called on application start, may be nil
+	OnStop       func(ctx context.Context) error // OnStop is called on application stop, may be nil
+	StartTimeout time.Duration                   // StartTimeout limits the OnStart call duration
+	StopTimeout  time.Duration                   // StopTimeout limits the OnStop call duration
+}
+
+// Lifecycle is a registry of hooks started in the registration order and stopped in the reverse order.
+type Lifecycle struct {
+	mu             sync.Mutex
+	hooks          []Hook
+	started        int                  // number of hooks successfully started
+	cancels        []context.CancelFunc // cancel the contexts of the started hooks
+	defaultTimeout time.Duration        // timeout of the hooks not defining their own
+	logger         *zap.SugaredLogger
+}
+
+// Option configures the lifecycle.
+type Option func(*Lifecycle)
+
+// WithDefaultTimeout sets the timeout of the hooks not defining their own, a zero one keeps DefaultTimeout.
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(l *Lifecycle) {
+		if timeout > 0 {
+			l.defaultTimeout = timeout
+		}
+	}
+}
+
+// New creates a new empty lifecycle.
+func New(logger *zap.SugaredLogger, opts ...Option) *Lifecycle {
+	l := &Lifecycle{logger: logger, defaultTimeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Append registers a new hook. Hooks must be registered before Start is called.
+func (l *Lifecycle) Append(h Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, h)
+}
+
+// Start runs OnStart of every hook in the registration order.
+// If a hook fails, the already started hooks are stopped in the reverse order and the error is returned.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, h := range l.hooks[l.started:] {
+		l.logger.Debugf("starting %s", h.Name)
+		hookCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		if err := call(hookCtx, h.OnStart, l.timeoutOrDefault(h.StartTimeout)); err != nil {
+			cancel()
+			startErr := fmt.Errorf("failed to start %s: %w", h.Name, err)
+			// rollback the hooks started so far
+			stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), l.defaultTimeout)
+			defer cancel()
+			return errors.Join(startErr, l.stop(stopCtx))
+		}
+		l.started++
+		l.cancels = append(l.cancels, cancel)
+		l.logger.Infof("%s started", h.Name)
+	}
+	return nil
+}
+
+// Stop runs OnStop of every started hook in the reverse order.
+// Every hook is stopped even if the previous one failed, all errors are joined.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stop(ctx)
+}
+
+// stop stops the started hooks, the caller must hold the lock.
+func (l *Lifecycle) stop(ctx context.Context) error {
+	var joined error
+	for ; l.started > 0; l.started-- {
+		h := l.hooks[l.started-1]
+		l.logger.Debugf("stopping %s", h.Name)
+		// the work started by the hook is stopped in its turn, not before
+		l.cancels[l.started-1]()
+		l.cancels = l.cancels[:l.started-1]
+		// unlike OnStart, OnStop gets a context bounded by the timeout
+		timeout := l.timeoutOrDefault(h.StopTimeout)
+		stopCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := call(stopCtx, h.OnStop, timeout)
+		cancel()
+		if err != nil {
+			l.logger.Errorf("failed to stop %s: %v", h.Name, err)
+			joined = errors.Join(joined, fmt.Errorf("failed to stop %s: %w", h.Name, err))
+			continue
+		}
+		l.logger.Infof("%s stopped", h.Name)
+	}
+	return joined
+}
+
+// Run starts all hooks, waits for the context to be done and stops them.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	if err := l.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	l.logger.Info("stopping signal received, shutting down...")
+	// the parent context is already canceled, stop hooks are limited by their own timeouts
+	return l.Stop(context.WithoutCancel(ctx))
+}
+
+// call invokes fn limiting the wait with the timeout. The context passed to fn is not
+// canceled on timeout, so goroutines started by OnStart stay bound to the context of the hook.
+func call(ctx context.Context, fn func(ctx context.Context) error, timeout time.Duration) error {
+	if fn == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return fmt.Errorf("%w after %s", ErrHookTimeout, timeout)
+	}
+}
+
+// timeoutOrDefault returns the timeout or the default one of the lifecycle if it is not set.
+func (l *Lifecycle) timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return l.defaultTimeout
+	}
+	return timeout
+}
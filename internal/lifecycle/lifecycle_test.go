@@ -0,0 +1,158 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// recorder returns a hook appending its start and stop events to the calls slice.
+func recorder(name string, calls *[]string, startErr error) Hook {
+	return Hook{
+		Name: name,
+		OnStart: func(context.Context) error {
+			*calls = append(*calls, "start "+name)
+			return startErr
+		},
+		OnStop: func(context.Context) error {
+			*calls = append(*calls, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycle_Order(t *testing.T) {
+	var calls []string
+	lc := New(zap.NewNop().Sugar())
+	lc.Append(recorder("db", &calls, nil))
+	lc.Append(recorder("worker", &calls, nil))
+	lc.Append(recorder("server", &calls, nil))
+
+	assert.NoError(t, lc.Start(context.Background()))
+	assert.NoError(t, lc.Stop(context.Background()))
+	assert.Equal(t, []string{
+		"start db", "start worker", "start server",
+		"stop server", "stop worker", "stop db",
+	}, calls)
+}
+
+func TestLifecycle_StartFailureRollback(t *testing.T) {
+	var calls []string
+	startErr := errors.New("boom")
+	lc := New(zap.NewNop().Sugar())
+	lc.Append(recorder("db", &calls, nil))
+	lc.Append(recorder("worker", &calls, startErr))
+	lc.Append(recorder("server", &calls, nil))
+
+	err := lc.Start(context.Background())
+	assert.ErrorIs(t, err, startErr)
+	assert.Equal(t, []string{"start db", "start worker", "stop db"}, calls)
+}
+
+func TestLifecycle_Timeouts(t *testing.T) {
+	lc := New(zap.NewNop().Sugar())
+	lc.Append(Hook{
+		Name: "slow",
+		OnStop: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		StopTimeout: 50 * time.Millisecond,
+	})
+	lc.Append(Hook{
+		Name: "stuck",
+		OnStart: func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+		StartTimeout: 50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	err := lc.Start(context.Background())
+	assert.ErrorIs(t, err, ErrHookTimeout)
+	assert.Contains(t, err.Error(), "failed to stop slow", "the started hook must be stopped within its own timeout")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestLifecycle_Run(t *testing.T) {
+	var calls []string
+	lc := New(zap.NewNop().Sugar())
+	lc.Append(recorder("server", &calls, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	assert.NoError(t, lc.Run(ctx))
+	assert.Equal(t, []string{"start server", "stop server"}, calls)
+}
+
+func TestLifecycle_DefaultTimeout(t *testing.T) {
+	stopped := make(chan time.Duration, 1)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	lc := New(zap.NewNop().Sugar(), WithDefaultTimeout(50*time.Millisecond))
+	lc.Append(Hook{
+		Name: "server",
+		OnStop: func(ctx context.Context) error {
+			deadline, _ := ctx.Deadline()
+			stopped <- time.Until(deadline)
+			<-stuck
+			return nil
+		},
+	})
+
+	// the hook without its own timeout is stopped within the default one of the lifecycle
+	assert.NoError(t, lc.Start(context.Background()))
+	start := time.Now()
+	assert.ErrorIs(t, lc.Stop(context.Background()), ErrHookTimeout)
+	assert.LessOrEqual(t, <-stopped, 50*time.Millisecond)
+	assert.Less(t, time.Since(start), DefaultTimeout)
+
+	// a zero timeout keeps the default
+	assert.Equal(t, DefaultTimeout, New(zap.NewNop().Sugar(), WithDefaultTimeout(0)).defaultTimeout)
+}
+
+func TestLifecycle_HookContext(t *testing.T) {
+	var calls []string
+	workerDone := make(chan struct{})
+	lc := New(zap.NewNop().Sugar())
+	lc.Append(Hook{
+		Name: "worker",
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				<-ctx.Done()
+				close(workerDone)
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			<-workerDone
+			calls = append(calls, "stop worker")
+			return nil
+		},
+	})
+	lc.Append(Hook{
+		Name: "server",
+		OnStop: func(context.Context) error {
+			// the worker keeps running while the server drains
+			select {
+			case <-workerDone:
+				calls = append(calls, "worker stopped early")
+			default:
+			}
+			calls = append(calls, "stop server")
+			return nil
+		},
+	})
+
+	// the work started by a hook outlives the signal until the hook is stopped in its turn
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	assert.NoError(t, lc.Run(ctx))
+	assert.Equal(t, []string{"stop server", "stop worker"}, calls)
+}
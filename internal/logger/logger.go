@@ -2,6 +2,7 @@ package logger
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"syscall"
 
@@ -13,8 +14,14 @@ type Logger struct {
 	*zap.SugaredLogger
 }
 
-// Initialize singleton logger.
-func Initialize(level string) (*Logger, error) {
+// Log formats of the entries.
+const (
+	FormatConsole = "console" // human-readable lines, the default
+	FormatJSON    = "json"    // a JSON object per entry for the log collectors
+)
+
+// Initialize singleton logger writing the entries in the format, the console one if empty.
+func Initialize(level, format string) (*Logger, error) {
 	lvl, err := zap.ParseAtomicLevel(level)
 	if err != nil {
 		return nil, err
@@ -28,6 +35,17 @@ func Initialize(level string) (*Logger, error) {
 	cfg.EncoderConfig.MessageKey = "msg"
 	cfg.EncoderConfig.LevelKey = "level"
 	cfg.DisableStacktrace = true
+	switch format {
+	case "", FormatConsole:
+	case FormatJSON:
+		// the collectors parse the ISO 8601 time and the durations in seconds
+		cfg.Encoding = FormatJSON
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		cfg.EncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
+		cfg.EncoderConfig.EncodeDuration = zapcore.SecondsDurationEncoder
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
 
 	// build the logger
 	zl, err := cfg.Build(
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Namespace is the prefix of all application metrics.
+const Namespace = "gophermart"
+
+// Registry is the application metrics registry the subsystems register their collectors in.
+type Registry struct {
+	*prometheus.Registry
+}
+
+// NewRegistry creates a registry with the Go runtime and process collectors.
+func NewRegistry() *Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return &Registry{Registry: reg}
+}
+
+// OrDiscard returns the registry or, if it is nil, a new empty registry that is never exposed,
+// so the subsystems may register their collectors unconditionally.
+func (r *Registry) OrDiscard() *Registry {
+	if r == nil {
+		return &Registry{Registry: prometheus.NewRegistry()}
+	}
+	return r
+}
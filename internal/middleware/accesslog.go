@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	chiv5mw "github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// AccessLog logs every request as an entry with the method, the path, the client address, the status,
+// the latency, the bytes written, the user and the request ID as fields. The server errors are logged at the error level.
+type AccessLog struct {
+	logger *zap.SugaredLogger
+	user   RecovererUser
+	skip   map[string]bool
+}
+
+// NewAccessLog creates the access log. The requests to the skipped paths, e.g. the health checks polled
+// by the orchestrator, aren't logged.
+func NewAccessLog(logger *zap.SugaredLogger, user RecovererUser, skip ...string) *AccessLog {
+	a := &AccessLog{logger: logger, user: user, skip: make(map[string]bool, len(skip))}
+	for _, path := range skip {
+		a.skip[path] = true
+	}
+	return a
+}
+
+// Handler is the middleware logging the requests. It has to be placed after RequestID.
+func (a *AccessLog) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		ww := chiv5mw.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := writtenStatus(ww)
+		log := a.logger.Infow
+		if status >= http.StatusInternalServerError {
+			log = a.logger.Errorw
+		}
+		log("request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_ip", RemoteIP(r),
+			"status", status,
+			"latency", time.Since(start),
+			"bytes", ww.BytesWritten(),
+			"user_id", a.user(r),
+			"request_id", GetRequestID(r.Context()),
+		)
+	})
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	al := NewAccessLog(zap.New(core).Sugar(), func(r *http.Request) string { return r.Header.Get("X-User") }, "/readyz")
+	handler := RequestID(al.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("hello"))
+		}
+	})))
+
+	// the request is logged with its fields
+	req := httptest.NewRequest(http.MethodPost, "/api/user/orders?page=2", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	req.Header.Set("X-User", "42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.Equal(t, 1, logs.Len())
+	entry := logs.TakeAll()[0]
+	assert.Equal(t, zapcore.InfoLevel, entry.Level)
+	fields := entry.ContextMap()
+	assert.Equal(t, http.MethodPost, fields["method"])
+	assert.Equal(t, "/api/user/orders", fields["path"])
+	assert.Equal(t, "192.0.2.1", fields["remote_ip"])
+	assert.EqualValues(t, http.StatusOK, fields["status"])
+	assert.EqualValues(t, 5, fields["bytes"])
+	assert.Equal(t, "42", fields["user_id"])
+	assert.Equal(t, "req-1", fields["request_id"])
+	assert.IsType(t, time.Duration(0), fields["latency"])
+
+	// the server errors are logged at the error level, the anonymous user is empty
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+	require.Equal(t, 1, logs.Len())
+	entry = logs.TakeAll()[0]
+	assert.Equal(t, zapcore.ErrorLevel, entry.Level)
+	assert.EqualValues(t, http.StatusServiceUnavailable, entry.ContextMap()["status"])
+	assert.Equal(t, "", entry.ContextMap()["user_id"])
+
+	// the skipped paths aren't logged
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Zero(t, logs.Len())
+}
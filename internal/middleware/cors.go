@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+// corsMaxAge is the time in seconds browsers may cache the preflight responses.
+const corsMaxAge = 300
+
+// corsMethods are the methods the API routes use.
+var corsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions}
+
+// corsHeaders are the request headers the API reads, always allowed.
+var corsHeaders = []string{"Authorization", "Content-Type", RequestIDHeader, TenantHeader, "X-Captcha-Token", "If-None-Match"}
+
+// corsExposedHeaders are the response headers the browser clients need to read.
+// The login returns the token in the Authorization header.
+var corsExposedHeaders = []string{"Authorization", RequestIDHeader, "X-Next-Cursor", "Retry-After", "ETag"}
+
+// CORSOptions configures the cross-origin requests from browsers.
+type CORSOptions struct {
+	AllowedOrigins   []string // Origins allowed to call the API, "*" allows any, a "*" in the host matches subdomains
+	AllowedHeaders   []string // Request headers allowed in addition to the ones the API reads
+	AllowCredentials bool     // Allow the requests with cookies
+}
+
+// NewCORS returns the middleware answering the preflight requests and setting the CORS headers
+// for the allowed origins, or nil if no origins are allowed.
+func NewCORS(opts CORSOptions) (func(http.Handler) http.Handler, error) {
+	origins := make([]string, 0, len(opts.AllowedOrigins))
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if err := validateOrigin(origin); err != nil {
+			return nil, err
+		}
+		// credentials of any origin would let every site act on behalf of the user
+		if origin == "*" && opts.AllowCredentials {
+			return nil, errors.New("cors: credentials can't be allowed for any origin")
+		}
+		origins = append(origins, origin)
+	}
+	if len(origins) == 0 {
+		return nil, nil
+	}
+
+	headers := append([]string{}, corsHeaders...)
+	for _, header := range opts.AllowedHeaders {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return cors.Handler(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   corsMethods,
+		AllowedHeaders:   headers,
+		ExposedHeaders:   corsExposedHeaders,
+		AllowCredentials: opts.AllowCredentials,
+		MaxAge:           corsMaxAge,
+	}), nil
+}
+
+// validateOrigin checks the origin is "*" or a scheme and a host with an optional port and at most one wildcard.
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	if strings.Count(origin, "*") > 1 {
+		return fmt.Errorf("cors: invalid origin %q: only one wildcard is allowed", origin)
+	}
+	u, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("cors: invalid origin %q: must be a scheme and a host like https://app.example.com", origin)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCORS(t *testing.T) {
+	// no origins disable CORS
+	cors, err := NewCORS(CORSOptions{AllowedOrigins: []string{" "}})
+	require.NoError(t, err)
+	assert.Nil(t, cors)
+
+	for _, opts := range []CORSOptions{
+		{AllowedOrigins: []string{"app.example.com"}},
+		{AllowedOrigins: []string{"https://app.example.com/path"}},
+		{AllowedOrigins: []string{"https://*.*.example.com"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+	} {
+		_, err := NewCORS(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+
+	cors, err = NewCORS(CORSOptions{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedHeaders:   []string{"X-Client-Version"},
+		AllowCredentials: true,
+	})
+	require.NoError(t, err)
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "Bearer token")
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		headers     map[string]string
+		wantHeaders map[string]string
+	}{
+		{
+			name:   "preflight",
+			method: http.MethodOptions,
+			origin: "https://app.example.com",
+			headers: map[string]string{
+				"Access-Control-Request-Method":  http.MethodPost,
+				"Access-Control-Request-Headers": "authorization,x-client-version",
+			},
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     http.MethodPost,
+				"Access-Control-Allow-Headers":     "Authorization, X-Client-Version",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "300",
+			},
+		},
+		{
+			name:   "request_from_subdomain",
+			method: http.MethodGet,
+			origin: "https://shop.example.org",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":   "https://shop.example.org",
+				"Access-Control-Expose-Headers": "Authorization, X-Request-Id, X-Next-Cursor, Retry-After, Etag",
+			},
+		},
+		{
+			name:        "unknown_origin",
+			method:      http.MethodGet,
+			origin:      "https://evil.example.com",
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/user/orders", nil)
+			req.Header.Set("Origin", tt.origin)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			for k, v := range tt.wantHeaders {
+				assert.Equal(t, v, rec.Header().Get(k), k)
+			}
+		})
+	}
+}
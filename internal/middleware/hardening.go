@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"loyaltySys/internal/problem"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// RequestIDHeader is the header carrying the request ID.
+const RequestIDHeader = "X-Request-ID"
+
+// hopByHopHeaders are meaningful only for a single transport-level connection and must not reach handlers.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Hardening protects handlers from request smuggling and header spoofing:
+// it rejects requests with ambiguous message framing, strips hop-by-hop headers and
+// drops the inbound request ID unless the request came from a trusted proxy.
+func Hardening(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validFraming(r) {
+				w.Header().Set("Connection", "close")
+				problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Bad request framing")
+				return
+			}
+			stripHopByHop(r.Header, isWebSocketUpgrade(r))
+			if !proxies.IsTrusted(r.RemoteAddr) {
+				r.Header.Del(RequestIDHeader)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validFraming reports whether the body length of the request is unambiguous.
+func validFraming(r *http.Request) bool {
+	// conflicting Content-Length values
+	lengths := r.Header.Values("Content-Length")
+	for _, l := range lengths[min(1, len(lengths)):] {
+		if strings.TrimSpace(l) != strings.TrimSpace(lengths[0]) {
+			return false
+		}
+	}
+	// the server moves the parsed header to r.TransferEncoding, the raw header is checked
+	// for requests constructed by other means
+	encodings := r.TransferEncoding
+	if len(encodings) == 0 {
+		encodings = r.Header.Values("Transfer-Encoding")
+	}
+	// both Content-Length and Transfer-Encoding
+	if len(encodings) > 0 && len(lengths) > 0 {
+		return false
+	}
+	// only a single chunked coding is accepted
+	for _, te := range encodings {
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return false
+		}
+	}
+	return len(encodings) <= 1
+}
+
+// stripHopByHop removes the hop-by-hop headers and the headers listed in Connection.
+// The upgrade headers are kept for WebSocket handshakes.
+func stripHopByHop(h http.Header, keepUpgrade bool) {
+	if !keepUpgrade {
+		for _, v := range h.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				if name = textproto.TrimString(name); name != "" {
+					h.Del(name)
+				}
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		if keepUpgrade && (name == "Connection" || name == "Upgrade") {
+			continue
+		}
+		h.Del(name)
+	}
+}
+
+// isWebSocketUpgrade reports whether the request is a WebSocket handshake.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHardening(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		headers     map[string][]string
+		te          []string
+		wantCode    int
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "plain_request",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string][]string{"Content-Length": {"2"}},
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "conflicting_content_length",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string][]string{"Content-Length": {"2", "10"}},
+			wantCode:   http.StatusBadRequest,
+		},
+		{
+			name:       "content_length_with_transfer_encoding",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string][]string{"Content-Length": {"2"}},
+			te:         []string{"chunked"},
+			wantCode:   http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported_transfer_encoding",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string][]string{"Transfer-Encoding": {"gzip, chunked"}},
+			wantCode:   http.StatusBadRequest,
+		},
+		{
+			name:       "hop_by_hop_stripped",
+			remoteAddr: "203.0.113.1:1234",
+			headers: map[string][]string{
+				"Connection": {"keep-alive, X-Internal"},
+				"Keep-Alive": {"timeout=5"},
+				"X-Internal": {"secret"},
+				"X-Other":    {"kept"},
+			},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Connection": "", "Keep-Alive": "", "X-Internal": "", "X-Other": "kept"},
+		},
+		{
+			name:       "websocket_upgrade_kept",
+			remoteAddr: "203.0.113.1:1234",
+			headers: map[string][]string{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"websocket"},
+			},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+		},
+		{
+			name:        "request_id_from_untrusted_peer",
+			remoteAddr:  "203.0.113.1:1234",
+			headers:     map[string][]string{RequestIDHeader: {"spoofed"}},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{RequestIDHeader: ""},
+		},
+		{
+			name:        "request_id_from_trusted_proxy",
+			remoteAddr:  "10.1.2.3:1234",
+			headers:     map[string][]string{RequestIDHeader: {"from-proxy"}},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{RequestIDHeader: "from-proxy"},
+		},
+		{
+			name:        "request_id_from_trusted_address",
+			remoteAddr:  "192.168.1.1:1234",
+			headers:     map[string][]string{RequestIDHeader: {"from-proxy"}},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{RequestIDHeader: "from-proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			h := Hardening(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, vv := range tt.headers {
+				for _, v := range vv {
+					req.Header.Add(k, v)
+				}
+			}
+			req.TransferEncoding = tt.te
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			for k, v := range tt.wantHeaders {
+				assert.Equal(t, v, got.Get(k), "header %s", k)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+
+	proxies, err := ParseTrustedProxies([]string{" 172.16.0.0/12 ", "", "::1"})
+	require.NoError(t, err)
+	assert.True(t, proxies.IsTrusted("172.20.0.5:80"))
+	assert.True(t, proxies.IsTrusted("[::1]:80"))
+	assert.False(t, proxies.IsTrusted("8.8.8.8:80"))
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{name: "direct", peer: "8.8.8.8:1234", want: "8.8.8.8"},
+		{name: "spoofed_by_untrusted_peer", peer: "8.8.8.8:1234", forwarded: []string{"1.1.1.1"}, want: "8.8.8.8"},
+		{name: "behind_proxy", peer: "10.0.0.1:1234", forwarded: []string{"1.1.1.1"}, want: "1.1.1.1"},
+		{name: "behind_proxies_with_spoofed_hop", peer: "10.0.0.1:1234", forwarded: []string{"9.9.9.9, 1.1.1.1", "10.0.0.2"}, want: "1.1.1.1"},
+		{name: "proxy_without_header", peer: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "real_ip", peer: "10.0.0.1:1234", realIP: "1.1.1.1", want: "1.1.1.1"},
+		{name: "forwarded_over_real_ip", peer: "10.0.0.1:1234", forwarded: []string{"2.2.2.2"}, realIP: "1.1.1.1", want: "2.2.2.2"},
+		{name: "real_ip_spoofed_by_untrusted_peer", peer: "8.8.8.8:1234", realIP: "1.1.1.1", want: "8.8.8.8"},
+		{name: "invalid_real_ip", peer: "10.0.0.1:1234", realIP: "unknown", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			assert.Equal(t, tt.want, proxies.ClientIP(req))
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	var got string
+	handler := Hardening(proxies)(RealIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RemoteIP(r)
+	})))
+
+	// the client behind the proxy
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "1.1.1.1", got)
+	assert.Equal(t, "1.1.1.1", req.RemoteAddr)
+
+	// the headers of an untrusted peer are ignored
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "8.8.8.8:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "8.8.8.8", got)
+	assert.Equal(t, "8.8.8.8:1234", req.RemoteAddr)
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"errors"
+	"loyaltySys/internal/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chiv5mw "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unmatchedRoute labels the requests matching no route, so the scanned paths don't blow up the label values.
+const unmatchedRoute = "unmatched"
+
+// HTTPMetrics counts the requests in the gophermart_http_requests_total metric by method, route and status code
+// and measures them in gophermart_http_request_duration_seconds by method and route. The route is the chi
+// pattern, e.g. /api/user/orders/{number}, not the path.
+type HTTPMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewHTTPMetrics creates the middleware and registers its metrics in the registry.
+func NewHTTPMetrics(reg *metrics.Registry) *HTTPMetrics {
+	m := &HTTPMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests served by method, route and status code.",
+		}, []string{"method", "route", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the HTTP requests by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+	// the router is built again on the same registry
+	var are prometheus.AlreadyRegisteredError
+	reg = reg.OrDiscard()
+	if err := reg.Register(m.requests); errors.As(err, &are) {
+		m.requests = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	if err := reg.Register(m.duration); errors.As(err, &are) {
+		m.duration = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	return m
+}
+
+// Handler is the middleware recording the requests. It has to be placed on the router before the recoverer,
+// to see the answers to the panics, and the route is known once the request is routed.
+func (m *HTTPMetrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chiv5mw.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route, status := routePattern(r), writtenStatus(ww)
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routePattern returns the route of the routed request, e.g. /api/user/orders/{number}, or unmatchedRoute.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return unmatchedRoute
+}
+
+// writtenStatus returns the status code of the response, 200 if the handler wrote nothing.
+func writtenStatus(ww chiv5mw.WrapResponseWriter) int {
+	if status := ww.Status(); status != 0 {
+		return status
+	}
+	return http.StatusOK
+}
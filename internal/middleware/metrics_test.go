@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"loyaltySys/internal/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewHTTPMetrics(reg)
+	r := chi.NewRouter()
+	r.Use(m.Handler, NewRecoverer(zap.NewNop().Sugar(), reg, func(*http.Request) string { return "" }).Handler)
+	r.Route("/api/user", func(r chi.Router) {
+		r.Get("/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+			if chi.URLParam(r, "number") == "0" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+		r.Get("/panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	})
+
+	for _, path := range []string{"/api/user/orders/1", "/api/user/orders/2", "/api/user/orders/0", "/api/user/panic", "/wp-login.php"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// the requests are labeled with the route, not the path
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "/api/user/orders/{number}", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "/api/user/orders/{number}", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "/api/user/panic", "500")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", unmatchedRoute, "404")))
+	assert.Equal(t, 3, testutil.CollectAndCount(m.duration))
+
+	// the middleware created again on the registry shares the metrics
+	assert.Same(t, m.requests, NewHTTPMetrics(reg).requests)
+}
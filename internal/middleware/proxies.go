@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is the list of networks of the reverse proxies allowed to set forwarding headers.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses the list of CIDRs or single IP addresses.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		// a single address is a network with the full mask
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// Contains reports whether the address belongs to a trusted proxy network.
+func (p TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrusted reports whether the request peer (host:port of r.RemoteAddr) is a trusted proxy.
+func (p TrustedProxies) IsTrusted(remoteAddr string) bool {
+	if len(p) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return p.Contains(addr)
+}
+
+// ClientIP returns the address of the client: the peer of the request or, if the peer is a trusted proxy,
+// the nearest untrusted address in X-Forwarded-For or, without the header, the address in X-Real-IP.
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	host := RemoteIP(r)
+	if !p.IsTrusted(r.RemoteAddr) {
+		return host
+	}
+	if len(r.Header.Values("X-Forwarded-For")) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap().String()
+		}
+		return host
+	}
+	// the proxies append the peer address, so the list is walked from the right
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !p.Contains(addr) {
+			return addr.Unmap().String()
+		}
+	}
+	return host
+}
+
+// RemoteIP returns the host of r.RemoteAddr, the client address once RealIP has run.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RealIP replaces r.RemoteAddr with the address of the client, see ClientIP, so the rate limits and the logs
+// see the client instead of the load balancer. It has to be placed after Hardening, which checks the peer.
+func RealIP(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if proxies.IsTrusted(r.RemoteAddr) {
+				r.RemoteAddr = proxies.ClientIP(r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
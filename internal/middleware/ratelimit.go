@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"loyaltySys/internal/problem"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitSweepInterval is how often the buckets of the idle clients are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is the token bucket of a single client: the sustained rate and the burst on top of it.
+type RateLimit struct {
+	RPS   float64 // Requests per second, zero disables the limit
+	Burst int     // Requests allowed at once
+}
+
+// RateLimitKey returns the client the request is counted for, the requests with an empty key are not limited.
+type RateLimitKey func(r *http.Request) string
+
+// RateLimiter throttles the requests of every client with its own token bucket
+// and replies 429 Too Many Requests with Retry-After once the bucket is empty.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	key   RateLimitKey
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+// rateBucket is the limiter of a client with the time it was used last.
+type rateBucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// NewRateLimiter creates the limiter, it returns nil if the limit is disabled.
+func NewRateLimiter(limit RateLimit, key RateLimitKey) *RateLimiter {
+	if limit.RPS <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		limit:   rate.Limit(limit.RPS),
+		burst:   max(limit.Burst, 1),
+		key:     key,
+		now:     time.Now,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// Handler is the middleware applying the limit, a nil limiter passes all the requests.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := l.now()
+		if wait := l.reserve(key, now); wait > 0 {
+			problem.WriteRetry(w, r, problem.RateLimited, "Too many requests", now, now.Add(wait))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reserve takes a token from the client's bucket and returns zero,
+// or the time until the next token if the bucket is empty.
+func (l *RateLimiter) reserve(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+	res := b.limiter.ReserveN(now, 1)
+	if wait := res.DelayFrom(now); wait > 0 {
+		// the request is rejected, so the token is given back
+		res.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+// sweep drops the buckets that have been refilled since they were used last,
+// a new bucket is the same as them.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(RateLimit{}, nil), "zero rate disables the limit")
+
+	limiter := NewRateLimiter(RateLimit{RPS: 0.5, Burst: 2}, func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	})
+	require.NotNil(t, limiter)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	handler := limiter.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	do := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Client", client)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the burst is allowed, then the client waits for the next token
+	assert.Equal(t, http.StatusOK, do("a").Code)
+	assert.Equal(t, http.StatusOK, do("a").Code)
+	rec := do("a")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), `"retry_after":2,"retry_at":"2024-01-01T12:00:02Z"`)
+	// the rejected requests don't take the tokens
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, do("a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do("a").Code)
+
+	// other clients have their own buckets, the requests without a key are not limited
+	assert.Equal(t, http.StatusOK, do("b").Code)
+	for range 5 {
+		assert.Equal(t, http.StatusOK, do("").Code)
+	}
+
+	// the idle buckets are dropped
+	now = now.Add(time.Hour)
+	do("c")
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var limiter *RateLimiter
+	rec := httptest.NewRecorder()
+	limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// RecovererUser returns the user of the request for the panic report, empty for an anonymous request.
+// The recoverer runs before the authentication, so the user is not in the request context yet.
+type RecovererUser func(r *http.Request) string
+
+// Recoverer recovers the panics of the handlers: it logs the panic with the stack trace, the request ID
+// and the user, counts it in the gophermart_http_panics_total metric and replies with a 500 problem.
+type Recoverer struct {
+	logger *zap.SugaredLogger
+	user   RecovererUser
+	panics prometheus.Counter
+}
+
+// NewRecoverer creates the recoverer and registers its metric in the registry.
+func NewRecoverer(logger *zap.SugaredLogger, reg *metrics.Registry, user RecovererUser) *Recoverer {
+	panics := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "http",
+		Name:      "panics_total",
+		Help:      "Panics recovered in the HTTP handlers.",
+	})
+	if err := reg.OrDiscard().Register(panics); err != nil {
+		// the router is built again on the same registry
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			panics = are.ExistingCollector.(prometheus.Counter)
+		}
+	}
+	return &Recoverer{logger: logger, user: user, panics: panics}
+}
+
+// Handler is the middleware recovering the panics.
+func (rc *Recoverer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// the handler aborted the response on purpose
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			rc.panics.Inc()
+			rc.logger.Errorw("panic recovered",
+				"panic", rec,
+				"request_id", GetRequestID(r.Context()),
+				"user_id", rc.user(r),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+			// the connection is hijacked for WebSocket, there is no response to write
+			if r.Header.Get("Connection") != "Upgrade" {
+				problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
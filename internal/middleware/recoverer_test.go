@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"encoding/json"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/problem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecoverer(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	reg := metrics.NewRegistry()
+	rc := NewRecoverer(zap.New(core).Sugar(), reg, func(r *http.Request) string { return r.Header.Get("X-User") })
+	handler := RequestID(rc.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	// the requests without a panic pass
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// the panic is reported and answered with a problem
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	req.Header.Set("X-User", "42")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(t, problem.Internal, p.Code)
+	assert.Equal(t, "req-1", p.RequestID)
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "boom", fields["panic"])
+	assert.Equal(t, "req-1", fields["request_id"])
+	assert.Equal(t, "42", fields["user_id"])
+	assert.Equal(t, "/panic", fields["path"])
+	assert.Contains(t, fields["stack"], "recoverer_test.go")
+	assert.Equal(t, 1.0, testutil.ToFloat64(rc.panics))
+
+	// the aborted responses are not recovered
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	})
+	assert.Equal(t, 1.0, testutil.ToFloat64(rc.panics))
+
+	// the router built again counts in the same metric
+	again := NewRecoverer(zap.NewNop().Sugar(), reg, nil)
+	assert.Equal(t, 1.0, testutil.ToFloat64(again.panics))
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	chimw "github.com/go-chi/chi/middleware"
+)
+
+// requestIDPattern limits the accepted request IDs to the characters safe in logs and headers.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID assigns an ID to every request: the one sent in X-Request-ID, if it is well-formed,
+// or a generated one. The ID is stored in the request context and echoed in the response header.
+// The ID is shared with the access log, so it has to be placed before it.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), chimw.RequestIDKey, id)))
+	})
+}
+
+// GetRequestID returns the request ID from the context, empty if there is none.
+func GetRequestID(ctx context.Context) string {
+	return chimw.GetReqID(ctx)
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
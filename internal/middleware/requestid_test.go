@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		inbound  string
+		wantSame bool
+	}{
+		{name: "generated", inbound: "", wantSame: false},
+		{name: "accepted", inbound: "client-req.1", wantSame: true},
+		{name: "malformed_replaced", inbound: "bad id\twith spaces", wantSame: false},
+		{name: "too_long_replaced", inbound: strings.Repeat("a", 129), wantSame: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctxID string
+			h := RequestID(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				ctxID = GetRequestID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.inbound != "" {
+				req.Header.Set(RequestIDHeader, tt.inbound)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.NotEmpty(t, ctxID)
+			assert.Equal(t, ctxID, rec.Header().Get(RequestIDHeader), "response must echo the request ID")
+			assert.Equal(t, tt.wantSame, ctxID == tt.inbound)
+		})
+	}
+}
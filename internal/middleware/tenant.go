@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"loyaltySys/internal/problem"
+	"loyaltySys/internal/tenant"
+	"net/http"
+	"strings"
+)
+
+// TenantHeader is the header selecting the tenant of the requests without a token.
+const TenantHeader = "X-Tenant"
+
+// NewTenant returns the middleware placing the tenant of the X-Tenant header in the request context.
+// Requests without the header belong to the first tenant, the ones naming an unknown tenant are rejected.
+// No tenants serve the default one only. The authenticator replaces the tenant with the one of the token.
+func NewTenant(tenants []string) (func(http.Handler) http.Handler, error) {
+	known := make(map[string]struct{}, len(tenants))
+	fallback := ""
+	for _, id := range tenants {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if err := tenant.Validate(id); err != nil {
+			return nil, err
+		}
+		if fallback == "" {
+			fallback = id
+		}
+		known[id] = struct{}{}
+	}
+	if fallback == "" {
+		fallback = tenant.Default
+		known[fallback] = struct{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(TenantHeader)
+			if id == "" {
+				id = fallback
+			} else if _, ok := known[id]; !ok {
+				problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Unknown tenant")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(tenant.WithTenant(r.Context(), id)))
+		})
+	}, nil
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"loyaltySys/internal/tenant"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTenant(t *testing.T) {
+	_, err := NewTenant([]string{"acme", "Bad Tenant"})
+	assert.Error(t, err)
+
+	tests := []struct {
+		name       string
+		tenants    []string
+		header     string
+		wantStatus int
+		wantTenant string
+	}{
+		{name: "no_tenants_default", tenants: nil, wantStatus: http.StatusOK, wantTenant: tenant.Default},
+		{name: "no_header_first", tenants: []string{" ", "acme", "globex"}, wantStatus: http.StatusOK, wantTenant: "acme"},
+		{name: "header", tenants: []string{"acme", "globex"}, header: "globex", wantStatus: http.StatusOK, wantTenant: "globex"},
+		{name: "unknown", tenants: []string{"acme", "globex"}, header: "initech", wantStatus: http.StatusBadRequest},
+		{name: "default_not_configured", tenants: []string{"acme"}, header: tenant.Default, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw, err := NewTenant(tt.tenants)
+			require.NoError(t, err)
+			var got string
+			h := mw(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = tenant.FromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login", nil)
+			if tt.header != "" {
+				req.Header.Set(TenantHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantTenant, got)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"loyaltySys/internal/tracing"
+	"net/http"
+
+	chiv5mw "github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing serves every request within a server span continuing the trace of the caller from the traceparent
+// header. The span is named after the route once the request is routed, e.g. GET /api/user/orders/{number},
+// and carries the request ID, so it has to be placed after RequestID.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, r.Method, trace.SpanKindServer,
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			attribute.String("request_id", GetRequestID(r.Context())),
+		)
+		defer span.End()
+
+		ww := chiv5mw.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route, status := routePattern(r), writtenStatus(ww)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPResponseStatusCode(status))
+		// the client errors are the client's, the span fails on the server errors only
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
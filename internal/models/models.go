@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
 
 // OrderStatus is a type that represents the status of an order
 type OrderStatus string
@@ -13,21 +17,101 @@ const (
 	StatusProcessed  OrderStatus = "PROCESSED"
 )
 
+// Valid reports whether the status is one of the known order statuses.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case StatusNew, StatusProcessing, StatusInvalid, StatusProcessed:
+		return true
+	}
+	return false
+}
+
 type User struct {
 	ID        int64     `json:"-"`
-	Login     string    `json:"login"`
-	Password  string    `json:"password"`
+	Login     string    `json:"login" validate:"required"`
+	Password  string    `json:"password" validate:"required"`
 	CreatedAt time.Time `json:"-"`
 }
 
+// Role is the role of a user.
+type Role string
+
+// Role constants
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// UserInfo is the user's account as seen by the admins.
+type UserInfo struct {
+	ID        int64      `json:"id"`
+	Login     string     `json:"login"`
+	Phone     string     `json:"phone,omitempty"`
+	Role      Role       `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // set if the account is deleted
+}
+
+// UserQuery selects a page of the users, latest first, the zero fields don't filter.
+type UserQuery struct {
+	Login   string  // substring of the login, case-insensitive
+	Deleted bool    // select the deleted users instead of the active ones
+	After   *Cursor // start after the cursor
+	Limit   int     // maximum number of users, zero for all
+}
+
 type Order struct {
-	Number     string      `json:"number"`
-	UserID     int64       `json:"-"`
-	Status     OrderStatus `json:"status"`
-	Accrual    float64     `json:"accrual,omitempty"`
-	UploadedAt time.Time   `json:"uploaded_at,omitempty"`
+	Number     string      `json:"number" xml:"number"`
+	UserID     int64       `json:"-" xml:"-"`
+	Status     OrderStatus `json:"status" xml:"status"`
+	Accrual    Money       `json:"accrual,omitempty" xml:"accrual,omitempty"`
+	UploadedAt time.Time   `json:"uploaded_at,omitempty" xml:"uploaded_at"`
+	Attempts   int         `json:"-" xml:"-"` // failed accrual attempts, set for the accrual service only
 }
 
+// OrderStatusChange is an entry of the order processing history.
+type OrderStatusChange struct {
+	Status    OrderStatus `json:"status" xml:"status"`
+	Accrual   Money       `json:"accrual,omitempty" xml:"accrual,omitempty"`
+	ChangedAt time.Time   `json:"changed_at" xml:"changed_at"`
+}
+
+// OrderDetail is the order with its processing history.
+type OrderDetail struct {
+	XMLName xml.Name `json:"-" xml:"order"`
+	Order
+	History []OrderStatusChange `json:"history" xml:"history>change"`
+}
+
+// Event is a notification addressed to a user.
+type Event interface {
+	// Recipient returns the ID of the user the event is addressed to.
+	Recipient() int64
+}
+
+// OrderEvent notifies the order owner about the order status change.
+type OrderEvent struct {
+	UserID  int64       `json:"-"`
+	Number  string      `json:"number"`
+	Status  OrderStatus `json:"status"`
+	Accrual Money       `json:"accrual,omitempty"`
+	At      time.Time   `json:"at"`
+}
+
+// Recipient returns the order owner.
+func (e OrderEvent) Recipient() int64 { return e.UserID }
+
+// WithdrawalEvent notifies the user about the withdrawal from the balance.
+type WithdrawalEvent struct {
+	UserID int64     `json:"-"`
+	Order  string    `json:"order"`
+	Sum    Money     `json:"sum"`
+	At     time.Time `json:"at"`
+}
+
+// Recipient returns the user who made the withdrawal.
+func (e WithdrawalEvent) Recipient() int64 { return e.UserID }
+
 // NewOrder creates a new order
 func NewOrder(orderNumber string, userID int64) *Order {
 	return &Order{
@@ -39,14 +123,274 @@ func NewOrder(orderNumber string, userID int64) *Order {
 	}
 }
 
+// SortOrder is the direction of a list ordering.
+type SortOrder string
+
+// SortOrder constants
+const (
+	SortAsc  SortOrder = "asc"
+	SortDesc SortOrder = "desc"
+)
+
+// Sort is the ordering of a list by a field, the zero value is the default ordering of the list.
+type Sort struct {
+	Field string
+	Order SortOrder
+}
+
+// Sort fields of the lists
+const (
+	SortUploadedAt  = "uploaded_at"  // orders by the upload time, the default
+	SortAccrual     = "accrual"      // orders by the accrual
+	SortProcessedAt = "processed_at" // withdrawals by the time, the default
+	SortSum         = "sum"          // withdrawals by the sum
+)
+
+// OrderFilter narrows down the list of the user's orders, the zero fields don't filter.
+type OrderFilter struct {
+	Statuses []OrderStatus
+	From     time.Time // uploaded at or after
+	To       time.Time // uploaded at or before
+	Sort     Sort      // latest first by default
+}
+
 type Withdrawal struct {
-	Order       string    `json:"order"`
-	UserID      int64     `json:"-"`
-	Sum         float64   `json:"sum,omitempty"`
-	ProcessedAt time.Time `json:"processed_at,omitempty"`
+	Order       string    `json:"order" xml:"order" validate:"luhn"`
+	UserID      int64     `json:"-" xml:"-"`
+	Sum         Money     `json:"sum,omitempty" xml:"sum" validate:"min_withdrawal"`
+	ProcessedAt time.Time `json:"processed_at,omitempty" xml:"processed_at"`
+	Description string    `json:"description,omitempty" xml:"description,omitempty" validate:"max=255"` // optional note of the user
+}
+
+// Cursor is the position of the last item of a page in a list ordered by time and key descending,
+// or by the value and key if the list is sorted by a number.
+type Cursor struct {
+	At    time.Time `json:"at"`
+	Key   string    `json:"key"`
+	Value *Money    `json:"value,omitempty"`
+}
+
+// Page selects a page of a list, the zero fields select the whole list.
+type Page struct {
+	After *Cursor // start after the cursor
+	Limit int     // maximum number of items, zero for all
+}
+
+// OrdersPage is a page of the user's orders with the cursor of the next page, nil on the last page.
+type OrdersPage struct {
+	Orders []Order
+	Next   *Cursor
+}
+
+// WithdrawalsPage is a page of the user's withdrawals with the cursor of the next page, nil on the last page.
+type WithdrawalsPage struct {
+	Withdrawals []Withdrawal
+	Next        *Cursor
+}
+
+// WithdrawalQuery selects a page of the user's withdrawals, the zero fields don't filter.
+type WithdrawalQuery struct {
+	From  time.Time // processed at or after
+	To    time.Time // processed at or before
+	After *Cursor   // start after the cursor
+	Limit int       // maximum number of withdrawals, zero for all
+	Sort  Sort      // latest first by default
+}
+
+// TransactionType is the kind of a ledger transaction.
+type TransactionType string
+
+// TransactionType constants
+const (
+	TransactionAccrual    TransactionType = "ACCRUAL"
+	TransactionWithdrawal TransactionType = "WITHDRAWAL"
+	TransactionAdjustment TransactionType = "ADJUSTMENT"
+)
+
+// Transaction is an entry of the user's ledger: a points accrual for an order, a withdrawal
+// or a manual adjustment.
+type Transaction struct {
+	Type    TransactionType `json:"type"`
+	Order   string          `json:"order,omitempty"`  // empty for adjustments
+	Amount  Money           `json:"amount"`           // positive for accruals and credits, negative for withdrawals and debits
+	Balance Money           `json:"balance"`          // balance after the transaction
+	Reason  string          `json:"reason,omitempty"` // reason of an adjustment
+	At      time.Time       `json:"at"`
+}
+
+// Stats is the operational summary of the system for the dashboards.
+type Stats struct {
+	Users     int64                 `json:"users"`
+	Orders    map[OrderStatus]int64 `json:"orders"` // number of the orders by status
+	Accrued   Money                 `json:"accrued"`
+	Withdrawn Money                 `json:"withdrawn"`
+	Backlog   Backlog               `json:"backlog"`
+	Balances  BalanceReport         `json:"balances"`
+}
+
+// BalanceReport is the summary of the users' balances as of the last refresh of the reporting view,
+// it lags behind the live totals of Stats until the next refresh.
+type BalanceReport struct {
+	Users       int64      `json:"users"`                  // users with a non-zero balance
+	Current     Money      `json:"current"`                // total of the current balances
+	Accrued     Money      `json:"accrued"`                // total of the processed orders
+	Adjusted    Money      `json:"adjusted"`               // total of the admin adjustments
+	Withdrawn   Money      `json:"withdrawn"`              // total of the withdrawals
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"` // time of the last refresh, none if the tenant has no users
+}
+
+// Backlog is the queue of the orders waiting for the accrual service.
+type Backlog struct {
+	Orders int64      `json:"orders"`
+	Oldest *time.Time `json:"oldest,omitempty"` // upload time of the oldest waiting order
+}
+
+// AccrualBacklog is the queue of the orders waiting for the accrual service across the tenants.
+type AccrualBacklog struct {
+	New        int64      // waiting orders not answered about yet
+	Processing int64      // waiting orders the accrual system is processing
+	Oldest     *time.Time // upload time of the oldest waiting order
+}
+
+// OrderRequeue is the audit record of an order sent back to the accrual service by an admin.
+type OrderRequeue struct {
+	ID             int64       `json:"id"`
+	Order          string      `json:"order"`
+	AdminID        int64       `json:"admin_id"`
+	PreviousStatus OrderStatus `json:"previous_status"`
+	Reason         string      `json:"reason"`
+	RequeuedAt     time.Time   `json:"requeued_at"`
+}
+
+// AccrualResponse is the raw response of the accrual service about an order, the body is kept as received.
+type AccrualResponse struct {
+	ID         int64     `json:"id"`
+	Order      string    `json:"order"`
+	StatusCode int       `json:"status_code"`
+	Body       string    `json:"body"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// DeadLetterOrder is the order the accrual service gave up on, INVALID with the reason of the failure,
+// for the admins to handle.
+type DeadLetterOrder struct {
+	Number         string    `json:"number"`
+	UserID         int64     `json:"user_id"`
+	Attempts       int       `json:"attempts"`
+	Reason         string    `json:"reason"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+// Adjustment is a manual correction of the user's balance by an admin.
+type Adjustment struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	AdminID   int64     `json:"admin_id"`
+	Amount    Money     `json:"amount"` // positive for a credit, negative for a debit
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Balance struct {
-	Current   float64 `json:"current,omitempty"`
-	Withdrawn float64 `json:"withdrawn,omitempty"`
+	XMLName   xml.Name `json:"-" xml:"balance"`
+	Current   Money    `json:"current,omitempty" xml:"current"`
+	Withdrawn Money    `json:"withdrawn,omitempty" xml:"withdrawn"`
+}
+
+// BalanceSnapshot is the user's balance at the end of a day (UTC).
+type BalanceSnapshot struct {
+	Date      string `json:"date"` // YYYY-MM-DD
+	Current   Money  `json:"current"`
+	Withdrawn Money  `json:"withdrawn"`
+}
+
+// PoolStats are the statistics of the database connection pool, the counters are since the start.
+type PoolStats struct {
+	MaxConns             int32         `json:"max_conns"`
+	TotalConns           int32         `json:"total_conns"`
+	AcquiredConns        int32         `json:"acquired_conns"` // connections in use
+	IdleConns            int32         `json:"idle_conns"`
+	AcquireCount         int64         `json:"acquire_count"`
+	EmptyAcquireCount    int64         `json:"empty_acquire_count"` // acquires waited for a connection
+	CanceledAcquireCount int64         `json:"canceled_acquire_count"`
+	AcquireDuration      time.Duration `json:"-"` // total time of the acquires
+}
+
+// Readiness is the state of the service and its database reported to the readiness probe.
+type Readiness struct {
+	Status string    `json:"status"` // ok or unavailable
+	DB     PoolStats `json:"db"`
+}
+
+// Meta is the set of public program parameters.
+type Meta struct {
+	MinWithdrawal Money `json:"min_withdrawal"`
+}
+
+// PhoneLogin is the request of the phone login, the code is omitted when requesting it.
+type PhoneLogin struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code,omitempty"`
+}
+
+// OTP is the one-time login code sent to the phone.
+type OTP struct {
+	Phone     string
+	CodeHash  string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Webhook event types.
+const (
+	WebhookOrderProcessed      = "order.processed"
+	WebhookWithdrawalCompleted = "withdrawal.completed"
+)
+
+// WebhookEvents are the event types a webhook can subscribe to.
+var WebhookEvents = []string{WebhookOrderProcessed, WebhookWithdrawalCompleted}
+
+// Webhook is the URL the user's events are posted to, signed with the secret.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // returned on creation only
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the body posted to the webhook.
+type WebhookPayload struct {
+	Event string    `json:"event"`
+	At    time.Time `json:"at"`
+	Data  any       `json:"data"`
+}
+
+// WebhookDeliveryStatus is the status of the event delivery to the webhook.
+type WebhookDeliveryStatus string
+
+const (
+	DeliveryPending   WebhookDeliveryStatus = "PENDING"
+	DeliveryDelivered WebhookDeliveryStatus = "DELIVERED"
+	DeliveryFailed    WebhookDeliveryStatus = "FAILED"
+)
+
+// WebhookDelivery is the event queued for delivery to the webhook with the outcome of the last attempt.
+type WebhookDelivery struct {
+	ID            int64                 `json:"id"`
+	WebhookID     int64                 `json:"webhook_id"`
+	Event         string                `json:"event"`
+	Payload       json.RawMessage       `json:"payload"`
+	Status        WebhookDeliveryStatus `json:"status"`
+	Attempts      int                   `json:"attempts"`
+	ResponseCode  int                   `json:"response_code,omitempty"`
+	LastError     string                `json:"last_error,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+	NextAttemptAt time.Time             `json:"next_attempt_at"`
+	DeliveredAt   *time.Time            `json:"delivered_at,omitempty"`
+	URL           string                `json:"-"`
+	Secret        string                `json:"-"`
 }
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Money is an amount of points in hundredths, so the balances add up exactly. It is a number with
+// up to two decimals in JSON, XML and the configuration, and NUMERIC in the database.
+type Money int64
+
+// moneyScale is the number of the hundredths in a point.
+const moneyScale = 100
+
+// MoneyFromFloat converts the amount to Money, rounding it to the hundredths.
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * moneyScale))
+}
+
+// ParseMoney parses the decimal amount, rounding it to the hundredths half away from zero.
+func ParseMoney(s string) (Money, error) {
+	// the rationals like 1/3 are not amounts
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || strings.Contains(s, "/") {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return moneyFromRat(r, s)
+}
+
+// moneyFromRat rounds the amount to the hundredths half away from zero.
+func moneyFromRat(r *big.Rat, s string) (Money, error) {
+	r = new(big.Rat).Mul(r, big.NewRat(moneyScale, 1))
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	// |m| / denom >= 1/2
+	if m.Abs(m).Lsh(m, 1).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("amount %s is out of range", s)
+	}
+	return Money(q.Int64()), nil
+}
+
+// Float64 returns the amount in points.
+func (m Money) Float64() float64 {
+	return float64(m) / moneyScale
+}
+
+// String returns the amount in points without the trailing zeros, e.g. 12, 12.5 or 12.34.
+func (m Money) String() string {
+	sign := ""
+	u := uint64(m)
+	if m < 0 {
+		sign, u = "-", -u
+	}
+	s := sign + strconv.FormatUint(u/moneyScale, 10)
+	if frac := u % moneyScale; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%02d", frac), "0")
+	}
+	return s
+}
+
+// MarshalJSON encodes the amount as a JSON number.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON decodes the amount from a JSON number, null leaves it unchanged.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("amount %s is not a number", s)
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// MarshalText encodes the amount for XML.
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText decodes the amount from XML or the environment.
+func (m *Money) UnmarshalText(text []byte) error {
+	v, err := ParseMoney(string(text))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// ScanNumeric scans the amount from a NUMERIC column, rounding it to the hundredths.
+func (m *Money) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		return errors.New("cannot scan NULL into Money")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return errors.New("cannot scan a non-finite number into Money")
+	}
+	r := new(big.Rat).SetInt(n.Int)
+	pow := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(n.Exp, -n.Exp))), nil))
+	if n.Exp >= 0 {
+		r.Mul(r, pow)
+	} else {
+		r.Quo(r, pow)
+	}
+	v, err := moneyFromRat(r, r.FloatString(2))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// NumericValue returns the amount as a NUMERIC parameter.
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -2, Valid: true}, nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "12", want: 1200},
+		{in: "12.5", want: 1250},
+		{in: "0.01", want: 1},
+		{in: "-120.5", want: -12050},
+		{in: "1e2", want: 10000},
+		{in: "12.345", want: 1235},
+		{in: "-12.345", want: -1235},
+		{in: "0.004", want: 0},
+		{in: "1/3", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "1e30", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMoney(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	assert.Equal(t, "0", Money(0).String())
+	assert.Equal(t, "500", Money(50000).String())
+	assert.Equal(t, "500.5", Money(50050).String())
+	assert.Equal(t, "0.07", Money(7).String())
+	assert.Equal(t, "-120.05", Money(-12005).String())
+	assert.Equal(t, 500.5, Money(50050).Float64())
+	// the float sums are rounded to the hundredths
+	assert.Equal(t, Money(30), MoneyFromFloat(0.1+0.2))
+}
+
+func TestMoney_JSON(t *testing.T) {
+	b, err := json.Marshal(Balance{Current: 50050, Withdrawn: 4200})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"current":500.5,"withdrawn":42}`, string(b))
+
+	var w Withdrawal
+	require.NoError(t, json.Unmarshal([]byte(`{"order":"2377225624","sum":729.98}`), &w))
+	assert.Equal(t, Money(72998), w.Sum)
+	// the amounts are numbers
+	assert.Error(t, json.Unmarshal([]byte(`{"sum":"729.98"}`), &w))
+
+	b, err = xml.Marshal(Balance{Current: 50050, Withdrawn: 4200})
+	require.NoError(t, err)
+	assert.Equal(t, `<balance><current>500.5</current><withdrawn>42</withdrawn></balance>`, string(b))
+}
+
+func TestMoney_Numeric(t *testing.T) {
+	m := pgtype.NewMap()
+	for _, format := range []int16{pgtype.TextFormatCode, pgtype.BinaryFormatCode} {
+		for _, want := range []Money{0, 1, -1, 50050, 1000000} {
+			buf, err := m.Encode(pgtype.NumericOID, format, want, nil)
+			require.NoError(t, err)
+			var got Money
+			require.NoError(t, m.Scan(pgtype.NumericOID, format, buf, &got))
+			assert.Equal(t, want, got)
+		}
+
+		// the sums with more decimals are rounded
+		buf, err := m.Encode(pgtype.NumericOID, format, pgtype.Numeric{Int: big.NewInt(123456), Exp: -4, Valid: true}, nil)
+		require.NoError(t, err)
+		var got Money
+		require.NoError(t, m.Scan(pgtype.NumericOID, format, buf, &got))
+		assert.Equal(t, Money(1235), got)
+
+		// NULL is scanned into a pointer only
+		var ptr *Money
+		require.NoError(t, m.Scan(pgtype.NumericOID, format, nil, &ptr))
+		assert.Nil(t, ptr)
+		assert.Error(t, m.Scan(pgtype.NumericOID, format, nil, &got))
+	}
+}
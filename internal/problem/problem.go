@@ -0,0 +1,130 @@
+package problem
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	chimw "github.com/go-chi/chi/middleware"
+)
+
+// ContentType is the media type of the error responses.
+const ContentType = "application/problem+json"
+
+// Code is the stable machine-readable code of an API error, the clients branch on it instead of the message.
+type Code string
+
+// Generic codes of the errors without a more specific one.
+const (
+	InvalidRequest       Code = "INVALID_REQUEST"
+	Unauthorized         Code = "UNAUTHORIZED"
+	Forbidden            Code = "FORBIDDEN"
+	NotFound             Code = "NOT_FOUND"
+	Conflict             Code = "CONFLICT"
+	UnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	ValidationFailed     Code = "VALIDATION_FAILED"
+	RateLimited          Code = "RATE_LIMITED"
+	Internal             Code = "INTERNAL_ERROR"
+	Upstream             Code = "UPSTREAM_ERROR"
+	Unavailable          Code = "UNAVAILABLE"
+)
+
+// Codes of the specific failures.
+const (
+	UserExists          Code = "USER_EXISTS"
+	UserNotFound        Code = "USER_NOT_FOUND"
+	InvalidCredentials  Code = "INVALID_CREDENTIALS"
+	CaptchaFailed       Code = "CAPTCHA_FAILED"
+	PhoneExists         Code = "PHONE_EXISTS"
+	InsufficientScope   Code = "INSUFFICIENT_SCOPE"
+	AdminRequired       Code = "ADMIN_REQUIRED"
+	InvalidOrderNumber  Code = "INVALID_ORDER_NUMBER"
+	OrderOwnedByOther   Code = "ORDER_OWNED_BY_OTHER"
+	OrderNotFound       Code = "ORDER_NOT_FOUND"
+	OrderNotNew         Code = "ORDER_NOT_NEW"
+	OrderNotRequeueable Code = "ORDER_NOT_REQUEUEABLE"
+	InsufficientBalance Code = "INSUFFICIENT_BALANCE"
+	WithdrawalExists    Code = "WITHDRAWAL_EXISTS"
+	OrderNumberUsed     Code = "ORDER_NUMBER_USED"
+	WithdrawalTooSmall  Code = "WITHDRAWAL_TOO_SMALL"
+	WebhookNotFound     Code = "WEBHOOK_NOT_FOUND"
+	TooManyWebhooks     Code = "TOO_MANY_WEBHOOKS"
+	DailyLimitExceeded  Code = "DAILY_LIMIT_EXCEEDED"
+)
+
+// Problem is the RFC 9457 problem details of an error response extended with the error code
+// and the request ID, so the client can quote it when reporting the problem.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Code      Code   `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// The time to retry a rejected request at, set on 429 Too Many Requests only
+	RetryAfter int        `json:"retry_after,omitempty"` // seconds, the same as the Retry-After header
+	RetryAt    *time.Time `json:"retry_at,omitempty"`
+
+	// The violations of the request fields, set if the request is invalid
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a violation of a request field: the JSON path of the field,
+// the failed validation rule and the human-readable message.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Write replies to the request with the problem of the status with the code and the human-readable detail.
+func Write(w http.ResponseWriter, r *http.Request, status int, code Code, detail string) {
+	write(w, newProblem(r, status, code, detail))
+}
+
+// WriteRetry replies 429 Too Many Requests with the problem telling the client exactly when to retry:
+// the Retry-After header and the retry_after seconds and the retry_at time of the body.
+func WriteRetry(w http.ResponseWriter, r *http.Request, code Code, detail string, now, retryAt time.Time) {
+	// the whole seconds are rounded up, so the client retrying on time is not rejected again
+	seconds := max(int(math.Ceil(retryAt.Sub(now).Seconds())), 1)
+	at := now.Add(time.Duration(seconds) * time.Second).UTC()
+	p := newProblem(r, http.StatusTooManyRequests, code, detail)
+	p.RetryAfter = seconds
+	p.RetryAt = &at
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	write(w, p)
+}
+
+// WriteFields replies to the request with the problem of the invalid request with the violations of its fields.
+func WriteFields(w http.ResponseWriter, r *http.Request, status int, code Code, detail string, errs []FieldError) {
+	p := newProblem(r, status, code, detail)
+	p.Errors = errs
+	write(w, p)
+}
+
+// newProblem returns the problem of the status with the code, the detail and the request ID.
+func newProblem(r *http.Request, status int, code Code, detail string) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: chimw.GetReqID(r.Context()),
+	}
+}
+
+// write replies with the problem.
+func write(w http.ResponseWriter, p Problem) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	// the errors are not cached even if the route set the caching of its responses
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
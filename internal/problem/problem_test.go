@@ -0,0 +1,53 @@
+package problem
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chimw "github.com/go-chi/chi/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chimw.RequestIDKey, "req-1"))
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Length", "10")
+
+	Write(rec, r, http.StatusConflict, OrderOwnedByOther, "Order already added by another user")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Empty(t, rec.Header().Get("Content-Length"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Conflict","status":409,"detail":"Order already added by another user","code":"ORDER_OWNED_BY_OTHER","request_id":"req-1"}`, rec.Body.String())
+
+	// the request ID is omitted if there is none
+	rec = httptest.NewRecorder()
+	Write(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusInternalServerError, Internal, "")
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"code":"INTERNAL_ERROR"}`, rec.Body.String())
+}
+
+func TestWriteRetry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rec := httptest.NewRecorder()
+	WriteRetry(rec, httptest.NewRequest(http.MethodGet, "/", nil), RateLimited, "Too many requests", now, now.Add(1500*time.Millisecond))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Too Many Requests","status":429,"detail":"Too many requests","code":"RATE_LIMITED","retry_after":2,"retry_at":"2024-01-01T12:00:02Z"}`, rec.Body.String())
+
+	// the client waits at least a second
+	rec = httptest.NewRecorder()
+	WriteRetry(rec, httptest.NewRequest(http.MethodGet, "/", nil), RateLimited, "", now, now)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+}
+
+func TestWriteFields(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteFields(rec, httptest.NewRequest(http.MethodPost, "/", nil), http.StatusBadRequest, ValidationFailed, "Login is required",
+		[]FieldError{{Field: "login", Rule: "required", Message: "Login is required"}, {Field: "password", Rule: "required", Message: "Password is required"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Login is required","code":"VALIDATION_FAILED",
+		"errors":[{"field":"login","rule":"required","message":"Login is required"},{"field":"password","rule":"required","message":"Password is required"}]}`, rec.Body.String())
+}
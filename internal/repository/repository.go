@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// UserStore stores the users, the phone login codes and the roles.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *models.User) (int64, error)
+	GetUser(ctx context.Context, login string) (*models.User, error)
+	GetUserByPhone(ctx context.Context, phone string) (*models.User, error)
+	SetUserPhone(ctx context.Context, userID int64, phone string) error
+	UpdatePasswordHash(ctx context.Context, userID int64, oldHash, newHash string) error
+	SaveOTP(ctx context.Context, otp *models.OTP) error
+	GetOTP(ctx context.Context, phone string) (*models.OTP, error)
+	IncOTPAttempts(ctx context.Context, phone string) error
+	DeleteOTP(ctx context.Context, phone string) error
+	GetUserRole(ctx context.Context, userID int64) (models.Role, error)
+	GetUserInfo(ctx context.Context, userID int64) (*models.UserInfo, error)
+	SearchUsers(ctx context.Context, q models.UserQuery) ([]models.UserInfo, error)
+	DeleteUser(ctx context.Context, userID int64) error
+	RestoreUser(ctx context.Context, userID int64) error
+}
+
+// OrderQueue is the part of the orders the accrual worker processes.
+type OrderQueue interface {
+	GetUnprocessedOrders(ctx context.Context, limit int, claimFor time.Duration) ([]models.Order, error)
+	ClaimOrder(ctx context.Context, number string, claimFor time.Duration) (bool, error)
+	UpdateOrder(ctx context.Context, order *models.Order) error
+	PostponeOrder(ctx context.Context, number string, attempts int, retryAt time.Time) error
+	DeadLetterOrder(ctx context.Context, number string, attempts int, reason string) error
+}
+
+// OrderNotifier notifies about the uploaded orders, so they are processed without waiting for the next poll.
+type OrderNotifier interface {
+	ListenNewOrders(ctx context.Context) (<-chan struct{}, error)
+}
+
+// PollerLock elects the one of the replicas polling the unprocessed orders.
+type PollerLock interface {
+	TryLockPoller(ctx context.Context) (<-chan struct{}, bool, error)
+}
+
+// OrderBacklog reports the orders waiting for the accrual service.
+type OrderBacklog interface {
+	GetAccrualBacklog(ctx context.Context) (*models.AccrualBacklog, error)
+}
+
+// AccrualAudit records the raw responses of the accrual service.
+type AccrualAudit interface {
+	SaveAccrualResponse(ctx context.Context, resp *models.AccrualResponse) error
+}
+
+// OrderStore stores the orders and their processing history.
+type OrderStore interface {
+	OrderQueue
+	OrderNotifier
+	AccrualAudit
+	PollerLock
+	OrderBacklog
+	CreateOrder(ctx context.Context, order *models.Order) error
+	CreateOrders(ctx context.Context, userID int64, numbers []string) ([]error, error)
+	GetOrders(ctx context.Context, userID int64, filter models.OrderFilter) ([]models.Order, error)
+	GetOrdersPage(ctx context.Context, userID int64, filter models.OrderFilter, page models.Page) (*models.OrdersPage, error)
+	GetOrder(ctx context.Context, userID int64, number string) (*models.OrderDetail, error)
+	DeleteOrder(ctx context.Context, userID int64, number string) error
+	GetOrdersByNumbers(ctx context.Context, userID int64, numbers []string) ([]models.Order, error)
+	GetOrdersVersion(ctx context.Context, userID int64) (string, error)
+	RequeueOrder(ctx context.Context, rq *models.OrderRequeue) error
+	GetDeadLetterOrders(ctx context.Context, page models.Page) ([]models.DeadLetterOrder, error)
+	RemoveOrder(ctx context.Context, number string) error
+	RestoreOrder(ctx context.Context, number string) error
+	GetAccrualResponses(ctx context.Context, number string) ([]models.AccrualResponse, error)
+	GetStats(ctx context.Context) (*models.Stats, error)
+}
+
+// WithdrawalStore stores the balances, the withdrawals and the adjustments.
+type WithdrawalStore interface {
+	GetBalance(ctx context.Context, userID int64) (*models.Balance, error)
+	GetBalanceVersion(ctx context.Context, userID int64) (string, error)
+	GetBalanceHistory(ctx context.Context, userID int64, from, to time.Time) ([]models.BalanceSnapshot, error)
+	GetWithdrawals(ctx context.Context, userID int64, q models.WithdrawalQuery) ([]models.Withdrawal, error)
+	GetWithdrawalsPage(ctx context.Context, userID int64, q models.WithdrawalQuery) (*models.WithdrawalsPage, error)
+	Withdraw(ctx context.Context, withdrawal *models.Withdrawal) error
+	WithdrawBatch(ctx context.Context, userID int64, withdrawals []models.Withdrawal) ([]error, error)
+	GetTransactions(ctx context.Context, userID int64) ([]models.Transaction, error)
+	CreateAdjustment(ctx context.Context, adj *models.Adjustment) error
+}
+
+// SnapshotStore records the daily balances for the snapshot worker.
+type SnapshotStore interface {
+	GetLastSnapshotDay(ctx context.Context) (time.Time, error)
+	SnapshotBalances(ctx context.Context, day time.Time) (int64, error)
+}
+
+// ReportStore refreshes the reporting views for the report worker.
+type ReportStore interface {
+	RefreshBalanceReport(ctx context.Context) (bool, error)
+}
+
+// ExportStore dumps the orders and the withdrawals for the export job.
+type ExportStore interface {
+	Export(ctx context.Context, orders, withdrawals io.Writer) (ordersN, withdrawalsN int64, err error)
+}
+
+// DeliveryQueue is the queue of the webhook deliveries the webhook worker sends.
+type DeliveryQueue interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error
+}
+
+// WebhookStore stores the users' webhooks.
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, webhook *models.Webhook, limit int) error
+	GetWebhooks(ctx context.Context, userID int64) ([]models.Webhook, error)
+	DeleteWebhook(ctx context.Context, userID, webhookID int64) error
+	GetWebhookDeliveries(ctx context.Context, userID, webhookID int64, limit int) ([]models.WebhookDelivery, error)
+}
+
+// HealthStore reports the state of the database to the readiness probe.
+type HealthStore interface {
+	Ping(ctx context.Context) error
+	Stats() models.PoolStats
+}
+
+// Repository holds the stores shared by the HTTP handlers and the background services,
+// every consumer takes the stores of its domain only.
+type Repository struct {
+	Users       UserStore
+	Orders      OrderStore
+	Withdrawals WithdrawalStore
+	Snapshots   SnapshotStore
+	Reports     ReportStore
+	Exports     ExportStore
+	Webhooks    WebhookStore
+	Deliveries  DeliveryQueue
+	Health      HealthStore
+
+	close func() error
+}
+
+// New connects to the database with the provided DSN, checking the schema and applying the migrations once
+// for all the consumers of the repository.
+func New(ctx context.Context, dsn string, logger *zap.SugaredLogger, opts ...db.Option) (*Repository, error) {
+	d, err := db.NewDB(ctx, dsn, append([]db.Option{db.WithLogger(logger)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{
+		Users:       d.Users(),
+		Orders:      d.Orders(),
+		Withdrawals: d.Withdrawals(),
+		Snapshots:   d.Withdrawals(),
+		Reports:     d.Withdrawals(),
+		Exports:     d,
+		Webhooks:    d.Webhooks(),
+		Deliveries:  d.Webhooks(),
+		Health:      d,
+		close:       d.Close,
+	}, nil
+}
+
+// Close closes the connection pool of the stores.
+func (r *Repository) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
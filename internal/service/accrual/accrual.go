@@ -5,77 +5,202 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"loyaltySys/internal/clock"
 	"loyaltySys/internal/db"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository"
 	"loyaltySys/internal/service/accrual/config"
+	"loyaltySys/internal/tracing"
 	"net/http"
-	"strconv"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-// Storage interface for the accrual service
-type Storage interface {
-	GetUnprocessedOrders(ctx context.Context) ([]models.Order, error)
-	UpdateOrder(ctx context.Context, order *models.Order) error
-}
-
-// NewStorage creates a new storage
-func NewStorage(ctx context.Context, dsn string, logger *zap.SugaredLogger) Storage {
-	db, err := db.NewDB(ctx, dsn, logger)
-	if err != nil {
-		logger.Fatal("failed to create storage", err)
-		return nil
-	}
-	return db
-}
-
 // AccrualService is the accrual service
 type AccrualService struct {
-	client  *resty.Client
-	cfg     config.AccrualConfig
-	storage Storage
+	client   *resty.Client
+	cfg      config.AccrualConfig
+	storage  repository.OrderQueue
+	notifier repository.OrderNotifier
+	audit    repository.AccrualAudit
+	backlog  repository.OrderBacklog
+	clock    clock.Clock
+	metrics  *metrics.Registry
+	stats    *accrualMetrics
+	events   *events.Bus
+	queue    *dispatch.Queue
 
 	logger *zap.SugaredLogger
 
-	sendAfter atomic.Uint32
-	wg        sync.WaitGroup
-	errCh     chan error
+	// pollerLock lets one of the replicas poll, lockLost is closed once the lock held by this one is lost
+	pollerLock repository.PollerLock
+	lockLost   <-chan struct{}
+
+	// gate pauses all the requests once the accrual system answers 429
+	gate retryGate
+	// limiter caps the requests in flight of the polled and dispatched orders to the capacity of the accrual system
+	limiter *aimdLimiter
+
+	// done is closed once the workers started by Start return, abort cancels the requests still in flight
+	done      chan struct{}
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+const (
+	// retryBase is the delay before the first retry of the failed order, doubled with every attempt.
+	retryBase = 15 * time.Second
+	// retryMax caps the delay between the retries of the order.
+	retryMax = time.Hour
+	// maxReasonLength caps the length of the recorded reason the order is dead-lettered for.
+	maxReasonLength = 512
+)
+
+// errAccrualFailed marks the failures of the accrual system to answer about the order, the order is retried
+// after a delay growing with its failed attempts.
+var errAccrualFailed = errors.New("accrual request failed")
+
+// errNotRegistered marks the orders the accrual system doesn't know, the order is dead-lettered once
+// it stays unknown for longer than the configured period.
+var errNotRegistered = fmt.Errorf("%w: order not registered in accrual system", errAccrualFailed)
+
+// errRateLimited and errServerFailed mark the answers 429 and 500 of the accrual system,
+// the concurrency of the requests is reduced on them.
+var (
+	errRateLimited  = errors.New("too many requests")
+	errServerFailed = fmt.Errorf("%w: accrual service 500", errAccrualFailed)
+)
+
+// errInconsistentAnswer marks the answers about another order than requested or with a negative accrual,
+// they aren't stored and the order is retried like on any other failure.
+var errInconsistentAnswer = fmt.Errorf("%w: inconsistent answer", errAccrualFailed)
+
+// errStorageUnavailable marks the failures of the storage it may recover from, the batch is stopped on them.
+var errStorageUnavailable = errors.New("storage unavailable")
+
+// storageError wraps the error of the storage operation, marking it if the storage may recover from it.
+func storageError(op string, err error) error {
+	if db.Classify(err) == db.Retryable {
+		return fmt.Errorf("%s: %w: %w", op, errStorageUnavailable, err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
 }
 
 // accrualResp is the structure to store the response from the accrual system
 type accrualResp struct {
-	Order   string   `json:"order"`
-	Status  string   `json:"status"`
-	Accrual *float64 `json:"accrual,omitempty"`
+	Order   string        `json:"order"`
+	Status  string        `json:"status"`
+	Accrual *models.Money `json:"accrual,omitempty"`
 }
 
 // NewAccrualService creates a new accrual service
-func NewAccrualService(accrualURL string, storage Storage, cfg config.AccrualConfig, logger *zap.SugaredLogger) *AccrualService {
-	// create a new client
+func NewAccrualService(accrualURL string, storage repository.OrderQueue, cfg config.AccrualConfig, opts ...Option) *AccrualService {
+	// create a new client, every attempt of a request is limited apart from the processing of the order
+	requestTimeout := cfg.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = time.Duration(cfg.Timeout) * time.Second
+	}
 	client := resty.New().
 		SetBaseURL(accrualURL).
-		SetTimeout(time.Duration(cfg.Timeout) * time.Second)
+		SetTimeout(requestTimeout)
 
 	// create a new accrual service
-	return &AccrualService{
+	s := &AccrualService{
 		client:  client,
 		cfg:     cfg,
 		storage: storage,
-		logger:  logger,
+		clock:   clock.New(),
+		logger:  zap.NewNop().Sugar(),
+		abort:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.stats = newAccrualMetrics(s.metrics)
+	if s.backlog != nil {
+		registerBacklogCollector(s.metrics, s.backlog, s.clock, s.logger)
+	}
+	if cfg.Concurrency > 0 {
+		s.limiter = newAIMDLimiter(cfg.MinConcurrency, cfg.Concurrency, s.stats.concurrency)
+	}
+	s.client.SetLogger(s.logger)
+	// every attempt of a request is traced, passing the trace context on to the accrual system
+	s.client.SetTransport(tracing.Transport(s.client.GetClient().Transport))
+	s.setRetries()
+	s.setAuth()
+	return s
+}
+
+// setRetries makes the client retry the failed requests to the accrual system on the configured conditions
+// within the timeout of the request, so a transient failure doesn't fail the order; 429 is never retried here,
+// all the requests are paused on it instead.
+func (s *AccrualService) setRetries() {
+	if s.cfg.RetryCount <= 0 {
+		return
+	}
+	var onError, on5xx bool
+	for _, on := range s.cfg.RetryOn {
+		switch strings.TrimSpace(on) {
+		case config.RetryOnError:
+			onError = true
+		case config.RetryOn5xx:
+			on5xx = true
+		default:
+			s.logger.Warnf("unknown accrual retry condition %q is ignored", on)
+		}
+	}
+	s.client.SetRetryCount(s.cfg.RetryCount).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			if err != nil {
+				return onError
+			}
+			return on5xx && resp.StatusCode() >= http.StatusInternalServerError
+		})
+	if s.cfg.RetryWait > 0 {
+		s.client.SetRetryWaitTime(s.cfg.RetryWait)
+	}
+	if s.cfg.RetryMaxWait > 0 {
+		s.client.SetRetryMaxWaitTime(s.cfg.RetryMaxWait)
 	}
 }
 
 // Start starts the accrual service
 func (s *AccrualService) Start(ctx context.Context) {
 	// create a new ticker
-	t := time.NewTicker(time.Second*time.Duration(s.cfg.Timeout) + 120*time.Millisecond)
+	t := s.clock.NewTicker(time.Second*time.Duration(s.cfg.Timeout) + 120*time.Millisecond)
+	// listen to the uploaded orders, the ticker is left as the fallback
+	var wake <-chan struct{}
+	if s.notifier != nil {
+		var err error
+		if wake, err = s.notifier.ListenNewOrders(ctx); err != nil {
+			s.logger.Errorf("failed to listen to new orders, polling only: %v", err)
+		}
+	}
+	s.done = make(chan struct{})
+	var running sync.WaitGroup
+	// request the orders uploaded to this instance as soon as they are queued
+	if s.queue != nil {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			s.dispatchOrders(ctx)
+		}()
+	}
 	// create a new goroutine to process the orders
+	running.Add(1)
 	go func() {
+		defer running.Done()
 		defer t.Stop()
 		s.logger.Info("accrual service started")
 		// process the orders
@@ -86,117 +211,539 @@ func (s *AccrualService) Start(ctx context.Context) {
 				s.logger.Info("accrual service stopped")
 				return
 			// process the orders on ticker signal
-			case <-t.C:
-				if err := s.processOrders(ctx); err != nil {
-					s.logger.Errorf("failed to process orders: %v", err)
+			case <-t.C():
+				s.poll(ctx, t)
+			// process the orders as soon as new ones are uploaded
+			case _, ok := <-wake:
+				if !ok {
+					wake = nil
+					continue
 				}
+				s.poll(ctx, t)
 			}
 		}
 	}()
+	go func() {
+		running.Wait()
+		close(s.done)
+	}()
 }
 
-// processOrders loads the unprocessed orders and sending requests to the accrual system
-func (s *AccrualService) processOrders(ctx context.Context) error {
-	// get the unprocessed orders
-	orders, err := s.storage.GetUnprocessedOrders(ctx)
+// poll runs a polling cycle if this instance polls. The tick delivered while the cycle runs is skipped:
+// the cycle has drained the backlog it would poll, so the cycles don't follow each other back to back.
+func (s *AccrualService) poll(ctx context.Context, t clock.Ticker) {
+	if !s.polling(ctx) {
+		return
+	}
+	if err := s.processOrders(ctx); err != nil {
+		s.logger.Errorf("failed to process orders: %v", err)
+	}
+	select {
+	case <-t.C():
+		s.stats.skipped.Inc()
+		s.logger.Debug("the polling cycle outlasted the poll period, the tick is skipped")
+	default:
+	}
+}
+
+// polling reports whether this instance polls the unprocessed orders: without the poller lock every instance
+// polls, with it only the one holding the lock. The lost lock is taken again by the first instance polling next.
+func (s *AccrualService) polling(ctx context.Context) bool {
+	if s.pollerLock == nil {
+		return true
+	}
+	if s.lockLost != nil {
+		select {
+		case <-s.lockLost:
+			s.lockLost = nil
+			s.logger.Warn("lost the poller lock")
+		default:
+			return true
+		}
+	}
+	lost, ok, err := s.pollerLock.TryLockPoller(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get unprocessed orders: %w", err)
+		s.logger.Errorf("failed to take the poller lock: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	s.logger.Info("took the poller lock, polling the unprocessed orders")
+	s.lockLost = lost
+	return true
+}
+
+// Stop waits for the requests in flight to finish once the context passed to Start is done:
+// no new request is sent, but the ones already sent are answered and stored. The requests still
+// in flight when the context is done are canceled, their orders are requested again after the restart.
+func (s *AccrualService) Stop(ctx context.Context) error {
+	// the service wasn't started
+	if s.done == nil {
+		return nil
 	}
-	// if there are no unprocessed orders, return nil
-	if len(orders) == 0 {
+	select {
+	case <-s.done:
 		return nil
+	case <-ctx.Done():
+		s.abortOnce.Do(func() { close(s.abort) })
+		return fmt.Errorf("accrual requests left in flight: %w", ctx.Err())
 	}
+}
 
-	// if there is a Retry-After, sleep for the duration
-	if a := s.sendAfter.Swap(0); a > 0 {
-		s.logger.Infof("respecting Retry-After: sleeping %d seconds", a)
-		time.Sleep(time.Duration(a) * time.Second)
+// detach returns the context of the requests started under the context: it isn't canceled with it,
+// so the requests in flight finish once the service is stopped, but only until Stop gives up on them.
+func (s *AccrualService) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-s.abort:
+			cancel()
+		case <-work.Done():
+		}
+	}()
+	return work, cancel
+}
+
+// processOrders loads the unprocessed orders and sending requests to the accrual system,
+// batch by batch of ClaimLimit orders until the backlog is drained
+func (s *AccrualService) processOrders(ctx context.Context) error {
+	// the orders are claimed for the duration of the requests, the other instances skip them meanwhile
+	claimFor := time.Duration(s.cfg.Timeout) * time.Second
+	start := s.clock.Now()
+	var joined error
+	for {
+		orders, err := s.storage.GetUnprocessedOrders(ctx, s.cfg.ClaimLimit, claimFor)
+		if err != nil {
+			return errors.Join(joined, fmt.Errorf("failed to get unprocessed orders: %w", err))
+		}
+		// if there are no unprocessed orders, return
+		if len(orders) == 0 {
+			break
+		}
+		err = s.processBatch(ctx, orders)
+		joined = errors.Join(joined, err)
+		// the backlog is drained, claimed at once without the limit, or the storage is unavailable
+		if s.cfg.ClaimLimit <= 0 || len(orders) < s.cfg.ClaimLimit || errors.Is(err, errStorageUnavailable) {
+			break
+		}
+		// once the claims of the first batch expire its orders may be claimed again, so the cycle is over;
+		// the next batch isn't claimed once the service is stopped
+		if s.clock.Now().Sub(start) >= claimFor || ctx.Err() != nil {
+			break
+		}
 	}
+	return joined
+}
 
-	// create error channel
-	s.errCh = make(chan error, len(orders))
+// processBatch requests the accrual of the claimed orders at once
+func (s *AccrualService) processBatch(ctx context.Context, orders []models.Order) error {
+	// the requests of the batch report their errors to the batch only, a batch never overlaps another
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(orders))
+	// the batch is stopped once the storage is unavailable, the responses couldn't be stored anyway;
+	// once the service is stopped no new request is sent, the ones in flight are let finish
+	batchCtx, stop := s.detach(ctx)
+	defer stop()
+	schedCtx, unschedule := context.WithCancel(ctx)
+	defer unschedule()
+	defer context.AfterFunc(batchCtx, unschedule)()
 
-	// create requesters
-	for _, order := range orders {
-		// add a new goroutine to process the order
-		s.wg.Add(1)
-		// get the order number
-		orderNum := order.Number
-		// create a new goroutine to process the order
-		go func() {
-			defer s.wg.Done()
+	// fail handles the failed request of the order
+	fail := func(order models.Order, err error) {
+		if errors.Is(err, errStorageUnavailable) {
+			stop()
+		}
+		// the requests of the stopped batch, or canceled by Stop, are left for the next poll
+		if batchCtx.Err() != nil && errors.Is(err, context.Canceled) {
+			return
+		}
+		if errors.Is(err, errAccrualFailed) && batchCtx.Err() == nil {
+			s.recordFailure(batchCtx, order, err)
+		}
+		// send the error to the error channel
+		errCh <- fmt.Errorf("order %s: %w", order.Number, err)
+	}
 
-			// create a new context with timeout
-			reqCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Timeout)*time.Second)
-			defer cancel()
+	// request the orders from the batch endpoint, many at once
+	if s.cfg.BatchPath != "" {
+		for chunk := range slices.Chunk(orders, max(s.cfg.BatchSize, 1)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-			// get the accrual for the order
-			if err := s.getAccrual(reqCtx, orderNum); err != nil {
-				// send the error to the error channel
-				s.errCh <- fmt.Errorf("order %s: %w", orderNum, err)
-			}
-		}()
+				release, err := s.schedule(schedCtx)
+				if err != nil {
+					return
+				}
+				reqCtx, cancel := context.WithTimeout(batchCtx, time.Duration(s.cfg.Timeout)*time.Second)
+				defer cancel()
+
+				errs := s.getAccruals(reqCtx, chunk)
+				release(errors.Join(errs...))
+				for i, err := range errs {
+					if err != nil {
+						fail(chunk[i], err)
+					}
+				}
+			}()
+		}
+	} else {
+		// create requesters
+		for _, order := range orders {
+			// add a new goroutine to process the order
+			wg.Add(1)
+			// create a new goroutine to process the order
+			go func() {
+				defer wg.Done()
+
+				// hold the request while the accrual system asks to retry later or is at capacity,
+				// the orders of the stopped batch or service are left for the next poll
+				release, err := s.schedule(schedCtx)
+				if err != nil {
+					return
+				}
+
+				// create a new context with timeout
+				reqCtx, cancel := context.WithTimeout(batchCtx, time.Duration(s.cfg.Timeout)*time.Second)
+				defer cancel()
+
+				// get the accrual for the order
+				err = s.getAccrual(reqCtx, order)
+				release(err)
+				if err != nil {
+					fail(order, err)
+				}
+			}()
+		}
 	}
 
 	// wait for all the goroutines to finish
-	s.wg.Wait()
+	wg.Wait()
 	// close the error channel
-	close(s.errCh)
+	close(errCh)
 
 	// collect errors
 	var joined error
-	for err := range s.errCh {
+	for err := range errCh {
 		joined = errors.Join(joined, err)
 	}
 	return joined
 }
 
+// schedule holds the request of an order until it may be sent: while the requests in flight are
+// at the capacity of the accrual system and while it asks to retry later. The returned release is called
+// with the outcome of the request.
+func (s *AccrualService) schedule(ctx context.Context) (func(err error), error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.gate.wait(ctx, s.clock); err != nil {
+		release(err)
+		return nil, err
+	}
+	return release, nil
+}
+
+// dispatchOrders requests the accrual of the queued orders one by one until the context is done,
+// the poll sweeping all the unprocessed orders picks up the ones dropped or failed here.
+func (s *AccrualService) dispatchOrders(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case order := <-s.queue.C():
+			s.dispatchOrder(ctx, order)
+		}
+	}
+}
+
+// dispatchOrder claims the queued order and requests its accrual like the polled orders are, the order claimed
+// by a poll meanwhile is left to it. The request in flight is let finish once the service is stopped.
+func (s *AccrualService) dispatchOrder(ctx context.Context, order models.Order) {
+	claimed, err := s.storage.ClaimOrder(ctx, order.Number, time.Duration(s.cfg.Timeout)*time.Second)
+	if err != nil {
+		s.logger.Errorf("failed to claim dispatched order %s: %v", order.Number, err)
+		return
+	}
+	if !claimed {
+		s.logger.Debugf("dispatched order %s is already claimed or processed", order.Number)
+		return
+	}
+
+	// hold the request while the accrual system asks to retry later or is at capacity
+	release, err := s.schedule(ctx)
+	if err != nil {
+		return
+	}
+	work, cancel := s.detach(ctx)
+	defer cancel()
+	reqCtx, cancelReq := context.WithTimeout(work, time.Duration(s.cfg.Timeout)*time.Second)
+	defer cancelReq()
+
+	err = s.getAccrual(reqCtx, order)
+	release(err)
+	// the request canceled by Stop is left for the poll after the restart
+	if err == nil || work.Err() != nil {
+		return
+	}
+	if errors.Is(err, errAccrualFailed) {
+		s.recordFailure(work, order, err)
+	}
+	s.logger.Errorf("failed to process dispatched order %s: %v", order.Number, err)
+}
+
 // getAccrual sends a request to the accrual system to get the accrual for the order
-func (s *AccrualService) getAccrual(ctx context.Context, orderNum string) error {
+func (s *AccrualService) getAccrual(ctx context.Context, order models.Order) (err error) {
+	// the span groups the attempts and the hedges of the request with the storage calls
+	ctx, span := tracing.Start(ctx, "AccrualService.getAccrual", trace.SpanKindInternal, attribute.String("order.number", order.Number))
+	defer func() { tracing.End(span, err) }()
+
 	// send a request to the accrual system to get the accrual for the order
-	resp, err := s.client.R().
-		SetContext(ctx).
-		SetPathParam("order_number", orderNum).
-		Get("/api/orders/{order_number}")
+	resp, err := s.requestOrder(ctx, order.Number)
 	if err != nil {
-		// if the request timed out or was canceled, return an error
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			return fmt.Errorf("request timeout: %w", err)
+		return requestError(err)
+	}
+
+	// record the raw response, so the awarded accrual can be checked later;
+	// the order isn't updated without the record and is requested again on the next poll
+	if err := s.saveResponse(ctx, order.Number, resp.StatusCode(), resp.Body()); err != nil {
+		return err
+	}
+	if err := s.checkStatus(resp); err != nil {
+		return err
+	}
+	// if the order is not registered in the accrual system, return an error
+	if resp.StatusCode() == http.StatusNoContent {
+		return errNotRegistered
+	}
+	return s.applyAccrual(ctx, order, resp.Body())
+}
+
+// requestOrder requests the accrual system about the order. With the hedge delay set, a second request is sent
+// once the first one isn't answered within the delay, and the first answer that isn't a failure is taken,
+// the other request is canceled. Both are limited by the context, the time budget of the order.
+func (s *AccrualService) requestOrder(ctx context.Context, number string) (*resty.Response, error) {
+	type result struct {
+		took time.Duration
+		resp *resty.Response
+		err  error
+	}
+	// the requests are timed by the clock of the hedge delay
+	send := func(ctx context.Context, results chan<- result) {
+		start := s.clock.Now()
+		resp, err := s.client.R().
+			SetContext(ctx).
+			SetPathParam("order_number", number).
+			Get("/api/orders/{order_number}")
+		results <- result{took: s.clock.Now().Sub(start), resp: resp, err: err}
+	}
+	if s.cfg.HedgeDelay <= 0 {
+		results := make(chan result, 1)
+		send(ctx, results)
+		r := <-results
+		s.stats.observeRequest(r.took, r.resp, r.err)
+		return r.resp, r.err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the request not taken writes its result to the buffer and is dropped
+	results := make(chan result, 2)
+	go send(ctx, results)
+	pending := 1
+	hedge := s.clock.After(s.cfg.HedgeDelay)
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			pending++
+			s.stats.hedges.Inc()
+			go send(ctx, results)
+		case r := <-results:
+			pending--
+			s.stats.observeRequest(r.took, r.resp, r.err)
+			rateLimited := r.err == nil && r.resp.StatusCode() == http.StatusTooManyRequests
+			failed := r.err != nil || rateLimited || r.resp.StatusCode() >= http.StatusInternalServerError
+			// the failed request is waited out by the hedge in flight, the one not sent yet isn't sent
+			if !failed || pending == 0 {
+				return r.resp, r.err
+			}
+			// the discarded 429 still pauses the requests of all the workers
+			if rateLimited {
+				if _, err := s.retryLater(r.resp); err != nil {
+					s.logger.Warnf("discarded answer about order %s: %v", number, err)
+				}
+			}
+		}
+	}
+}
+
+// getAccruals requests the accrual of the orders in one request to the batch endpoint of the accrual system.
+// The errors are returned in the order of the orders, the orders missing from the answer aren't registered.
+func (s *AccrualService) getAccruals(ctx context.Context, orders []models.Order) []error {
+	errs := make([]error, len(orders))
+	// fail fails all the orders of the request
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	numbers := make([]string, len(orders))
+	for i, order := range orders {
+		numbers[i] = order.Number
+	}
+	req := s.client.R().SetContext(ctx)
+	var resp *resty.Response
+	var err error
+	start := s.clock.Now()
+	if s.cfg.BatchFormat == config.BatchFormatQuery {
+		resp, err = req.SetQueryParamsFromValues(url.Values{"order": numbers}).Get(s.cfg.BatchPath)
+	} else {
+		resp, err = req.SetBody(numbers).Post(s.cfg.BatchPath)
+	}
+	s.stats.observeRequest(s.clock.Now().Sub(start), resp, err)
+	if err != nil {
+		return fail(requestError(err))
+	}
+
+	// the failed request is recorded for every order of it
+	if err := s.checkStatus(resp); err != nil {
+		for i, order := range orders {
+			if saveErr := s.saveResponse(ctx, order.Number, resp.StatusCode(), resp.Body()); saveErr != nil {
+				errs[i] = saveErr
+				continue
+			}
+			errs[i] = err
+		}
+		return errs
+	}
+
+	// the answers are told apart by the order number, the raw answer is kept for the record
+	answers := make(map[string]json.RawMessage, len(orders))
+	if resp.StatusCode() != http.StatusNoContent {
+		var items []json.RawMessage
+		if err := json.Unmarshal(resp.Body(), &items); err != nil {
+			return fail(fmt.Errorf("%w: unmarshal response: %w", errAccrualFailed, err))
 		}
-		return fmt.Errorf("http request failed: %w", err)
+		for _, item := range items {
+			r := &accrualResp{}
+			if err := json.Unmarshal(item, r); err != nil {
+				s.logger.Warnf("skipping broken accrual answer %s: %v", item, err)
+				continue
+			}
+			answers[r.Order] = item
+		}
+	}
+
+	for i, order := range orders {
+		item, ok := answers[order.Number]
+		// the order missing from the answer is recorded the way the accrual system answers about it alone
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusNoContent
+		}
+		if err := s.saveResponse(ctx, order.Number, code, item); err != nil {
+			errs[i] = err
+			continue
+		}
+		if !ok {
+			errs[i] = errNotRegistered
+			continue
+		}
+		errs[i] = s.applyAccrual(ctx, order, item)
+	}
+	return errs
+}
+
+// requestError wraps the error of the request to the accrual system
+func requestError(err error) error {
+	// if the request timed out or was canceled, return an error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: request timeout: %w", errAccrualFailed, err)
 	}
+	return fmt.Errorf("%w: %w", errAccrualFailed, err)
+}
 
+// saveResponse records the raw response of the accrual system about the order
+func (s *AccrualService) saveResponse(ctx context.Context, number string, code int, body []byte) error {
+	if s.audit == nil {
+		return nil
+	}
+	if err := s.audit.SaveAccrualResponse(ctx, &models.AccrualResponse{
+		Order:      number,
+		StatusCode: code,
+		Body:       string(body),
+	}); err != nil {
+		return storageError("save accrual response", err)
+	}
+	return nil
+}
+
+// checkStatus returns an error if the accrual system refused to answer
+func (s *AccrualService) checkStatus(resp *resty.Response) error {
 	switch resp.StatusCode() {
 	// if the request is a too many requests, return an error
 	case http.StatusTooManyRequests:
-		// get the Retry-After header
-		retryAfter, convErr := strconv.Atoi(resp.Header().Get("Retry-After"))
-		if convErr != nil {
-			// if the Retry-After header is not valid, return an error
-			return fmt.Errorf("429 without valid Retry-After: %w", convErr)
+		retryAfter, err := s.retryLater(resp)
+		if err != nil {
+			return err
 		}
-		// store the Retry-After header
-		s.sendAfter.Store(uint32(retryAfter))
-		return fmt.Errorf("too many requests, retry-after=%d", retryAfter)
-
-	case http.StatusNoContent:
-		// if the order is not registered in the accrual system, return an error
-		return fmt.Errorf("order not registered in accrual system")
+		return fmt.Errorf("%w, retry-after=%s", errRateLimited, retryAfter)
 
 	case http.StatusInternalServerError:
 		// if the accrual service is returning a 500, return an error
-		return fmt.Errorf("accrual service 500")
+		return errServerFailed
 	}
+	return nil
+}
 
+// retryLater pauses the requests of all the workers for the Retry-After of the 429 response, capped at
+// the configured maximum, and returns the pause.
+func (s *AccrualService) retryLater(resp *resty.Response) (time.Duration, error) {
+	s.stats.rateLimited.Inc()
+	// get the Retry-After header
+	now := s.clock.Now()
+	retryAfter, err := parseRetryAfter(resp.Header().Get("Retry-After"), now)
+	if err != nil {
+		// if the Retry-After header is not valid, return an error
+		return 0, fmt.Errorf("429 without valid Retry-After: %w", err)
+	}
+	if s.cfg.RetryAfterMax > 0 && retryAfter > s.cfg.RetryAfterMax {
+		s.logger.Warnf("Retry-After of %s is capped at %s", retryAfter, s.cfg.RetryAfterMax)
+		retryAfter = s.cfg.RetryAfterMax
+	}
+	// pause the requests of all the workers for the duration
+	if s.gate.pause(now.Add(retryAfter)) {
+		s.logger.Infof("respecting Retry-After: pausing the requests for %s", retryAfter)
+	}
+	return retryAfter, nil
+}
+
+// applyAccrual updates the order with the answer of the accrual system about it
+func (s *AccrualService) applyAccrual(ctx context.Context, order models.Order, body []byte) error {
 	// unmarshal the response
 	r := &accrualResp{}
-	if err := json.Unmarshal(resp.Body(), &r); err != nil {
-		return fmt.Errorf("unmarshal response: %w", err)
+	if err := json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("%w: unmarshal response: %w", errAccrualFailed, err)
+	}
+	// the answer is checked against the request, so it is never written to another order
+	if r.Order != order.Number {
+		s.logger.Warnf("rejecting the accrual answer about order %q to the request about order %s", r.Order, order.Number)
+		return fmt.Errorf("%w: answer about order %q", errInconsistentAnswer, r.Order)
+	}
+	if r.Accrual != nil && *r.Accrual < 0 {
+		s.logger.Warnf("rejecting the negative accrual %s of order %s", *r.Accrual, order.Number)
+		return fmt.Errorf("%w: negative accrual %s", errInconsistentAnswer, *r.Accrual)
 	}
 
 	// create a new order
 	gotOrder := &models.Order{
-		Number: r.Order,
+		Number: order.Number,
+		UserID: order.UserID,
 		Status: models.OrderStatus(r.Status),
 	}
 	// if the accrual is not nil, set the accrual
@@ -207,8 +754,81 @@ func (s *AccrualService) getAccrual(ctx context.Context, orderNum string) error
 	// if the order is processed or invalid, update the order
 	if gotOrder.Status == models.StatusProcessed || gotOrder.Status == models.StatusInvalid {
 		if err := s.storage.UpdateOrder(ctx, gotOrder); err != nil {
-			return fmt.Errorf("update order: %w", err)
+			// the order deleted meanwhile isn't processed anymore
+			if db.Classify(err) == db.NotFound {
+				s.logger.Infof("order %s is deleted, the accrual is dropped", gotOrder.Number)
+				return nil
+			}
+			return storageError("update order", err)
+		}
+		if gotOrder.Status != order.Status {
+			s.stats.observeTransition(order, gotOrder.Status, s.clock.Now())
+		}
+		// notify the order owner about the status change
+		if s.events != nil && gotOrder.Status != order.Status {
+			s.events.Publish(models.OrderEvent{
+				UserID:  gotOrder.UserID,
+				Number:  gotOrder.Number,
+				Status:  gotOrder.Status,
+				Accrual: gotOrder.Accrual,
+				At:      s.clock.Now(),
+			})
 		}
 	}
 	return nil
 }
+
+// recordFailure postpones the order the accrual system failed to answer about, so it is requested again
+// after the delay. The order is dead-lettered once the attempts are exhausted or the accrual system
+// doesn't know it long after the upload.
+func (s *AccrualService) recordFailure(ctx context.Context, order models.Order, cause error) {
+	now := s.clock.Now()
+	attempts := order.Attempts + 1
+	var reason string
+	switch {
+	case errors.Is(cause, errNotRegistered) && s.cfg.NotRegisteredTTL > 0 && now.Sub(order.UploadedAt) >= s.cfg.NotRegisteredTTL:
+		reason = fmt.Sprintf("not registered in the accrual system for %s", s.cfg.NotRegisteredTTL)
+	case s.cfg.MaxAttempts > 0 && attempts >= s.cfg.MaxAttempts:
+		reason = fmt.Sprintf("failed %d times: %v", attempts, cause)
+	}
+	if reason == "" {
+		if err := s.storage.PostponeOrder(ctx, order.Number, attempts, now.Add(retryDelay(attempts))); err != nil {
+			if db.Classify(err) != db.NotFound {
+				s.logger.Errorf("failed to postpone order %s: %v", order.Number, err)
+			}
+			return
+		}
+		s.stats.retries.Inc()
+		return
+	}
+
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	if err := s.storage.DeadLetterOrder(ctx, order.Number, attempts, reason); err != nil {
+		if db.Classify(err) != db.NotFound {
+			s.logger.Errorf("failed to dead-letter order %s: %v", order.Number, err)
+		}
+		return
+	}
+	s.logger.Warnf("order %s is dead-lettered: %s", order.Number, reason)
+	s.stats.observeTransition(order, models.StatusInvalid, now)
+	// notify the order owner, the order won't be processed
+	if s.events != nil && order.Status != models.StatusInvalid {
+		s.events.Publish(models.OrderEvent{
+			UserID: order.UserID,
+			Number: order.Number,
+			Status: models.StatusInvalid,
+			At:     now,
+		})
+	}
+}
+
+// retryDelay returns the delay before the retry after the attempt, doubled with every attempt
+func retryDelay(attempt int) time.Duration {
+	delay := retryBase
+	for i := 1; i < attempt && delay < retryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMax)
+}
@@ -0,0 +1,248 @@
+//go:build integration_tests
+// +build integration_tests
+
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/service/accrual/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const (
+	stressUsers  = 100
+	stressOrders = 10000
+	// stressDeadline is the upper bound for draining the whole backlog.
+	stressDeadline = 90 * time.Second
+)
+
+var getDSN func() string
+
+func TestMain(m *testing.M) {
+	code, err := runMain(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
+
+func runMain(m *testing.M) (int, error) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return 1, fmt.Errorf("failed to initialize a pool: %w", err)
+	}
+
+	pg, err := pool.RunWithOptions(
+		&dockertest.RunOptions{
+			Repository: "postgres",
+			Tag:        "17.2",
+			Name:       "accrual-integration-tests",
+			Env: []string{
+				"POSTGRES_USER=postgres",
+				"POSTGRES_PASSWORD=postgres",
+				"POSTGRES_DB=test",
+			},
+			ExposedPorts: []string{"5432/tcp"},
+		},
+		func(config *docker.HostConfig) {
+			config.AutoRemove = true
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		},
+	)
+	if err != nil {
+		return 1, fmt.Errorf("failed to run the postgres container: %w", err)
+	}
+
+	defer func() {
+		if err := pool.Purge(pg); err != nil {
+			log.Printf("failed to purge the postgres container: %v", err)
+		}
+	}()
+
+	hostPort := pg.GetHostPort("5432/tcp")
+	getDSN = func() string {
+		return fmt.Sprintf("postgres://postgres:postgres@%s/test?sslmode=disable", hostPort)
+	}
+
+	pool.MaxWait = 30 * time.Second
+	if err := pool.Retry(func() error {
+		conn, err := pgx.Connect(context.Background(), getDSN())
+		if err != nil {
+			return fmt.Errorf("failed to connect to the DB: %w", err)
+		}
+		return conn.Close(context.Background())
+	}); err != nil {
+		return 1, err
+	}
+
+	return m.Run(), nil
+}
+
+// countingStorage wraps the storage and counts the updates per order.
+type countingStorage struct {
+	repository.OrderQueue
+	mu      sync.Mutex
+	updates map[string]int
+}
+
+// UpdateOrder counts the update and passes it to the wrapped storage.
+func (s *countingStorage) UpdateOrder(ctx context.Context, order *models.Order) error {
+	s.mu.Lock()
+	s.updates[order.Number]++
+	s.mu.Unlock()
+	return s.OrderQueue.UpdateOrder(ctx, order)
+}
+
+// stressAccrual returns the deterministic accrual for the order number.
+func stressAccrual(n int) models.Money {
+	return models.MoneyFromFloat(float64(n%100) + 0.5)
+}
+
+// stressStatus returns the final status for the order number.
+func stressStatus(n int) models.OrderStatus {
+	if n%50 == 0 {
+		return models.StatusInvalid
+	}
+	return models.StatusProcessed
+}
+
+// newStressAccrualServer imitates the accrual system: orders go through PROCESSING first,
+// every 97th request fails with 500 and every 211th request is rate limited.
+func newStressAccrualServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var requests atomic.Int64
+	var seen sync.Map
+
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		switch req := requests.Add(1); {
+		case req%211 == 0:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		case req%97 == 0:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		number := r.PathValue("number")
+		n, err := strconv.Atoi(strings.TrimPrefix(number, "ord"))
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp := map[string]any{"order": number, "status": "PROCESSING"}
+		if _, loaded := seen.LoadOrStore(number, struct{}{}); loaded {
+			resp["status"] = string(stressStatus(n))
+			if stressStatus(n) == models.StatusProcessed {
+				resp["accrual"] = stressAccrual(n)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// seedStressOrders creates the users and NEW orders "ord<N>" owned by user 1 + N % stressUsers.
+func seedStressOrders(ctx context.Context, t *testing.T) {
+	t.Helper()
+	pool, err := pgxpool.New(ctx, getDSN())
+	require.NoError(t, err)
+	defer pool.Close()
+
+	_, err = pool.Exec(ctx, `
+		INSERT INTO users (login, password)
+		SELECT 'stress' || g, 'password' FROM generate_series(1, $1) g`, stressUsers)
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `
+		INSERT INTO orders (order_number, user_id)
+		SELECT 'ord' || g, 1 + g % $1 FROM generate_series(1, $2) g`, stressUsers, stressOrders)
+	require.NoError(t, err)
+}
+
+func TestAccrualService_Stress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zap.NewNop().Sugar()
+
+	storage, err := db.NewDB(ctx, getDSN(), db.WithLogger(logger))
+	require.NoError(t, err)
+	defer storage.Close()
+	seedStressOrders(ctx, t)
+
+	srv := newStressAccrualServer(t)
+	counting := &countingStorage{OrderQueue: storage.Orders(), updates: make(map[string]int)}
+	s := &AccrualService{
+		// limit the connections so the test doesn't depend on the open files limit
+		client:  resty.NewWithClient(&http.Client{Transport: &http.Transport{MaxConnsPerHost: 64}}).SetBaseURL(srv.URL),
+		cfg:     config.AccrualConfig{Timeout: 1, AccrualAddr: srv.URL},
+		storage: counting,
+		clock:   clock.New(),
+		stats:   newAccrualMetrics(nil),
+		logger:  logger,
+	}
+
+	start := time.Now()
+	s.Start(ctx)
+
+	// wait for the backlog to drain, the orders postponed after the failures included
+	pool, err := pgxpool.New(ctx, getDSN())
+	require.NoError(t, err)
+	defer pool.Close()
+	require.Eventually(t, func() bool {
+		var pending int
+		err := pool.QueryRow(ctx, "SELECT count(*) FROM orders WHERE status IN ('NEW', 'PROCESSING')").Scan(&pending)
+		return err == nil && pending == 0
+	}, stressDeadline, 500*time.Millisecond, "backlog was not drained in time")
+	t.Logf("%d orders processed in %s", stressOrders, time.Since(start))
+	cancel()
+
+	// every order is updated exactly once
+	counting.mu.Lock()
+	assert.Len(t, counting.updates, stressOrders)
+	for number, n := range counting.updates {
+		assert.Equal(t, 1, n, "order %s updated %d times", number, n)
+	}
+	counting.mu.Unlock()
+
+	// balances match the accruals awarded by the accrual system
+	want := make(map[int64]models.Money, stressUsers)
+	for n := 1; n <= stressOrders; n++ {
+		if stressStatus(n) == models.StatusProcessed {
+			want[int64(1+n%stressUsers)] += stressAccrual(n)
+		}
+	}
+	for userID := int64(1); userID <= stressUsers; userID++ {
+		balance, err := storage.Withdrawals().GetBalance(context.Background(), userID)
+		require.NoError(t, err)
+		assert.Equal(t, want[userID], balance.Current, "user %d balance", userID)
+	}
+}
@@ -6,30 +6,39 @@ package accrual
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/db"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
 	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/repository/mocks"
 	"loyaltySys/internal/service/accrual/config"
-	"loyaltySys/internal/service/accrual/mocks"
 	"net/http"
 	"net/http/httptest"
-	"sync"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
 )
 
 func TestAccrualService_Start(t *testing.T) {
 	type fields struct {
-		client    *resty.Client
-		cfg       config.AccrualConfig
-		storage   Storage
-		logger    *zap.SugaredLogger
-		sendAfter atomic.Uint32
-		wg        sync.WaitGroup
-		errCh     chan error
+		client  *resty.Client
+		cfg     config.AccrualConfig
+		storage repository.OrderQueue
+		logger  *zap.SugaredLogger
 	}
 	type args struct {
 		ctx context.Context
@@ -42,13 +51,10 @@ func TestAccrualService_Start(t *testing.T) {
 		{
 			name: "successful_start",
 			fields: fields{
-				client:    resty.New(),
-				cfg:       config.AccrualConfig{Timeout: 0, AccrualAddr: "http://localhost:8080"},
-				storage:   nil,
-				logger:    zap.NewNop().Sugar(),
-				sendAfter: atomic.Uint32{},
-				wg:        sync.WaitGroup{},
-				errCh:     make(chan error),
+				client:  resty.New(),
+				cfg:     config.AccrualConfig{Timeout: 0, AccrualAddr: "http://localhost:8080"},
+				storage: nil,
+				logger:  zap.NewNop().Sugar(),
 			},
 			args: args{
 				ctx: context.Background(),
@@ -58,18 +64,17 @@ func TestAccrualService_Start(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &AccrualService{
-				client:    tt.fields.client,
-				cfg:       tt.fields.cfg,
-				storage:   tt.fields.storage,
-				logger:    tt.fields.logger,
-				sendAfter: tt.fields.sendAfter,
-				wg:        tt.fields.wg,
-				errCh:     tt.fields.errCh,
+				client:  tt.fields.client,
+				cfg:     tt.fields.cfg,
+				storage: tt.fields.storage,
+				clock:   clock.New(),
+				stats:   newAccrualMetrics(nil),
+				logger:  tt.fields.logger,
 			}
 
 			// use mock storage to avoid real DB dependency
-			mockStorage := mocks.NewStorage(t)
-			mockStorage.EXPECT().GetUnprocessedOrders(mock.Anything).Return(make([]models.Order, 0), nil)
+			mockStorage := mocks.NewOrderQueue(t)
+			mockStorage.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return(make([]models.Order, 0), nil)
 			s.storage = mockStorage
 			s.Start(tt.args.ctx)
 			time.Sleep(300 * time.Millisecond)
@@ -77,15 +82,339 @@ func TestAccrualService_Start(t *testing.T) {
 	}
 }
 
+func TestAccrualService_Start_Ticker(t *testing.T) {
+	clk := clock.NewMock(time.Unix(0, 0))
+	var calls atomic.Int32
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).RunAndReturn(func(context.Context, int, time.Duration) ([]models.Order, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+
+	s := NewAccrualService("http://localhost:8080", m, config.AccrualConfig{Timeout: 1}, WithClock(clk))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	// nothing is polled until the ticker period elapses
+	clk.Advance(time.Second)
+	assert.Never(t, func() bool { return calls.Load() > 0 }, 50*time.Millisecond, 10*time.Millisecond)
+
+	for want := int32(1); want <= 3; want++ {
+		clk.Advance(120 * time.Millisecond)
+		assert.Eventually(t, func() bool { return calls.Load() == want }, time.Second, 5*time.Millisecond)
+		clk.Advance(time.Second)
+	}
+}
+
+func TestAccrualService_Start_SkipsOverlappingPolls(t *testing.T) {
+	clk := clock.NewMock(time.Unix(0, 0))
+	const period = 1120 * time.Millisecond
+	var calls atomic.Int32
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).RunAndReturn(func(context.Context, int, time.Duration) ([]models.Order, error) {
+		// the first cycle outlasts the poll period
+		if calls.Add(1) == 1 {
+			clk.Advance(period)
+		}
+		return nil, nil
+	})
+
+	s := NewAccrualService("http://localhost:8080", m, config.AccrualConfig{Timeout: 1}, WithClock(clk))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	clk.Advance(period)
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(s.stats.skipped) == 1 }, time.Second, 5*time.Millisecond)
+	// the tick delivered during the cycle doesn't start another one
+	assert.Never(t, func() bool { return calls.Load() > 1 }, 50*time.Millisecond, 10*time.Millisecond)
+
+	clk.Advance(period)
+	assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.skipped))
+}
+
+func TestAccrualService_Start_Notifier(t *testing.T) {
+	clk := clock.NewMock(time.Unix(0, 0))
+	var calls atomic.Int32
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).RunAndReturn(func(context.Context, int, time.Duration) ([]models.Order, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+	wake := make(chan struct{})
+	n := mocks.NewOrderNotifier(t)
+	n.EXPECT().ListenNewOrders(mock.Anything).Return(wake, nil)
+
+	s := NewAccrualService("http://localhost:8080", m, config.AccrualConfig{Timeout: 1}, WithClock(clk), WithNotifier(n))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	// the new orders are processed without waiting for the ticker
+	for want := int32(1); want <= 2; want++ {
+		wake <- struct{}{}
+		assert.Eventually(t, func() bool { return calls.Load() == want }, time.Second, 5*time.Millisecond)
+	}
+
+	// the ticker keeps polling after the notifications stop
+	close(wake)
+	clk.Advance(1120 * time.Millisecond)
+	assert.Eventually(t, func() bool { return calls.Load() == 3 }, time.Second, 5*time.Millisecond)
+}
+
+func TestAccrualService_Start_Queue(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	h.HandleFunc("/api/orders/1", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	now := time.Unix(0, 0)
+	var updated atomic.Int32
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().ClaimOrder(mock.Anything, mock.Anything, time.Second).Return(true, nil).Times(2)
+	m.EXPECT().UpdateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool { return o.Number == "9" })).
+		RunAndReturn(func(context.Context, *models.Order) error {
+			updated.Add(1)
+			return nil
+		}).Once()
+	// the failed order is postponed like the polled ones
+	postponed := make(chan struct{})
+	m.EXPECT().PostponeOrder(mock.Anything, "1", 1, now.Add(retryBase)).
+		RunAndReturn(func(context.Context, string, int, time.Time) error {
+			close(postponed)
+			return nil
+		}).Once()
+	q := dispatch.NewQueue(4)
+
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1}, WithClock(clock.NewMock(now)), WithQueue(q))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	// the queued orders are requested without waiting for the ticker
+	q.Push(models.Order{Number: "9", Status: models.StatusNew, UploadedAt: now})
+	assert.Eventually(t, func() bool { return updated.Load() == 1 }, time.Second, 5*time.Millisecond)
+	q.Push(models.Order{Number: "1", Status: models.StatusNew, UploadedAt: now})
+	select {
+	case <-postponed:
+	case <-time.After(time.Second):
+		t.Fatal("the failed order wasn't postponed")
+	}
+}
+
+func TestAccrualService_dispatchOrder(t *testing.T) {
+	var hits atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	order := models.Order{Number: "9", Status: models.StatusNew, UploadedAt: time.Unix(0, 0)}
+
+	t.Run("races_poll", func(t *testing.T) {
+		// the poll and the dispatch claim the same order, only the one claiming it first requests it
+		hits.Store(0)
+		var claimed atomic.Bool
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, time.Second).
+			RunAndReturn(func(context.Context, int, time.Duration) ([]models.Order, error) {
+				if !claimed.CompareAndSwap(false, true) {
+					return nil, nil
+				}
+				return []models.Order{order}, nil
+			}).Once()
+		m.EXPECT().ClaimOrder(mock.Anything, "9", time.Second).
+			RunAndReturn(func(context.Context, string, time.Duration) (bool, error) {
+				return claimed.CompareAndSwap(false, true), nil
+			}).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool { return o.Number == "9" })).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1})
+		ctx := context.Background()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.dispatchOrder(ctx, order)
+		}()
+		assert.NoError(t, s.processOrders(ctx))
+		<-done
+		assert.Equal(t, int32(1), hits.Load())
+	})
+	t.Run("not_claimed", func(t *testing.T) {
+		// the order claimed by a poll or processed meanwhile isn't requested
+		hits.Store(0)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().ClaimOrder(mock.Anything, "9", time.Second).Return(false, nil).Once()
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1})
+		s.dispatchOrder(context.Background(), order)
+		assert.Zero(t, hits.Load())
+	})
+	t.Run("claim_failed", func(t *testing.T) {
+		// the order is left for the poll when the claim fails
+		hits.Store(0)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().ClaimOrder(mock.Anything, "9", time.Second).Return(false, assert.AnError).Once()
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1})
+		s.dispatchOrder(context.Background(), order)
+		assert.Zero(t, hits.Load())
+	})
+	t.Run("limited", func(t *testing.T) {
+		// the dispatched request waits for the slot of the limiter like the polled ones
+		hits.Store(0)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().ClaimOrder(mock.Anything, "9", time.Second).Return(true, nil).Once()
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, Concurrency: 1})
+		release, err := s.limiter.acquire(context.Background())
+		if !assert.NoError(t, err) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		s.dispatchOrder(ctx, order)
+		release(nil)
+		assert.Zero(t, hits.Load())
+	})
+}
+
+func TestAccrualService_Stop(t *testing.T) {
+	now := time.Unix(0, 0)
+	// serve answers about the order once released, signaling the request is received
+	serve := func(t *testing.T, received chan<- struct{}, release <-chan struct{}) *httptest.Server {
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+			close(received)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+		})
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	t.Run("in_flight", func(t *testing.T) {
+		// the request sent before the stop is answered and stored
+		received, release := make(chan struct{}), make(chan struct{})
+		srv := serve(t, received, release)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().ClaimOrder(mock.Anything, "9", 5*time.Second).Return(true, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+		q := dispatch.NewQueue(4)
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 5}, WithClock(clock.NewMock(now)), WithQueue(q))
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		q.Push(models.Order{Number: "9", Status: models.StatusNew})
+		<-received
+		cancel()
+		close(release)
+
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, s.Stop(stopCtx))
+	})
+	t.Run("deadline", func(t *testing.T) {
+		// the request still in flight is canceled, the order is left as is
+		received := make(chan struct{})
+		srv := serve(t, received, nil)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().ClaimOrder(mock.Anything, "9", 5*time.Second).Return(true, nil).Once()
+		q := dispatch.NewQueue(4)
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 5}, WithClock(clock.NewMock(now)), WithQueue(q))
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		q.Push(models.Order{Number: "9", Status: models.StatusNew})
+		<-received
+		cancel()
+
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer stopCancel()
+		assert.ErrorIs(t, s.Stop(stopCtx), context.DeadlineExceeded)
+		select {
+		case <-s.done:
+		case <-time.After(time.Second):
+			t.Fatal("the request in flight wasn't canceled")
+		}
+	})
+	t.Run("not_started", func(t *testing.T) {
+		s := NewAccrualService("http://127.0.0.1:0", mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1})
+		assert.NoError(t, s.Stop(context.Background()))
+	})
+}
+
+func TestAccrualService_processOrders_Stopped(t *testing.T) {
+	// no request is sent once the service is stopped
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}}, nil).Once()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := NewAccrualService("http://127.0.0.1:0", m, config.AccrualConfig{Timeout: 1})
+	assert.NoError(t, s.processOrders(ctx))
+}
+
+func TestAccrualService_polling(t *testing.T) {
+	ctx := context.Background()
+	// every instance polls without the lock
+	s := NewAccrualService("http://127.0.0.1:0", mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1})
+	assert.True(t, s.polling(ctx))
+
+	l := mocks.NewPollerLock(t)
+	s = NewAccrualService("http://127.0.0.1:0", mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1}, WithPollerLock(l))
+	// another instance holds the lock
+	l.EXPECT().TryLockPoller(mock.Anything).Return(nil, false, nil).Once()
+	assert.False(t, s.polling(ctx))
+	l.EXPECT().TryLockPoller(mock.Anything).Return(nil, false, assert.AnError).Once()
+	assert.False(t, s.polling(ctx))
+
+	// the lock is taken once and held until it is lost
+	lost := make(chan struct{})
+	l.EXPECT().TryLockPoller(mock.Anything).Return(lost, true, nil).Once()
+	assert.True(t, s.polling(ctx))
+	assert.True(t, s.polling(ctx))
+	close(lost)
+	l.EXPECT().TryLockPoller(mock.Anything).Return(nil, false, nil).Once()
+	assert.False(t, s.polling(ctx))
+}
+
+func TestAccrualService_Start_NotifierFailed(t *testing.T) {
+	clk := clock.NewMock(time.Unix(0, 0))
+	var calls atomic.Int32
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).RunAndReturn(func(context.Context, int, time.Duration) ([]models.Order, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+	n := mocks.NewOrderNotifier(t)
+	n.EXPECT().ListenNewOrders(mock.Anything).Return(nil, errors.New("connection refused"))
+
+	s := NewAccrualService("http://localhost:8080", m, config.AccrualConfig{Timeout: 1}, WithClock(clk), WithNotifier(n))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	// falls back to polling
+	clk.Advance(1120 * time.Millisecond)
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 5*time.Millisecond)
+}
+
 func TestAccrualService_processOrders(t *testing.T) {
 	type fields struct {
-		client    *resty.Client
-		cfg       config.AccrualConfig
-		storage   Storage
-		logger    *zap.SugaredLogger
-		sendAfter atomic.Uint32
-		wg        sync.WaitGroup
-		errCh     chan error
+		client  *resty.Client
+		cfg     config.AccrualConfig
+		storage repository.OrderQueue
+		logger  *zap.SugaredLogger
 	}
 	type args struct {
 		ctx context.Context
@@ -101,9 +430,9 @@ func TestAccrualService_processOrders(t *testing.T) {
 			fields: fields{
 				client: resty.New(),
 				cfg:    config.AccrualConfig{Timeout: 0},
-				storage: func() Storage {
-					m := mocks.NewStorage(t)
-					m.EXPECT().GetUnprocessedOrders(mock.Anything).Return([]models.Order{}, nil)
+				storage: func() repository.OrderQueue {
+					m := mocks.NewOrderQueue(t)
+					m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{}, nil)
 					return m
 				}(),
 				logger: zap.NewNop().Sugar(),
@@ -122,10 +451,10 @@ func TestAccrualService_processOrders(t *testing.T) {
 				srv := httptest.NewServer(handler)
 				t.Cleanup(srv.Close)
 
-				m := mocks.NewStorage(t)
-				m.EXPECT().GetUnprocessedOrders(mock.Anything).Return([]models.Order{{Number: "123"}}, nil)
+				m := mocks.NewOrderQueue(t)
+				m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "123"}}, nil)
 				m.EXPECT().UpdateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool {
-					return o.Number == "123" && o.Status == models.StatusProcessed && o.Accrual == 12.5
+					return o.Number == "123" && o.Status == models.StatusProcessed && o.Accrual == models.MoneyFromFloat(12.5)
 				})).Return(nil)
 
 				return fields{
@@ -152,9 +481,10 @@ func TestAccrualService_processOrders(t *testing.T) {
 				srv := httptest.NewServer(handler)
 				t.Cleanup(srv.Close)
 
-				m := mocks.NewStorage(t)
-				m.EXPECT().GetUnprocessedOrders(mock.Anything).Return([]models.Order{{Number: "ok"}, {Number: "err"}}, nil)
+				m := mocks.NewOrderQueue(t)
+				m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "ok"}, {Number: "err"}}, nil)
 				m.EXPECT().UpdateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool { return o.Number == "ok" && o.Status == models.StatusProcessed })).Return(nil)
+				m.EXPECT().PostponeOrder(mock.Anything, "err", 1, mock.Anything).Return(nil)
 
 				return fields{
 					client:  resty.New().SetBaseURL(srv.URL),
@@ -170,13 +500,12 @@ func TestAccrualService_processOrders(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &AccrualService{
-				client:    tt.fields.client,
-				cfg:       tt.fields.cfg,
-				storage:   tt.fields.storage,
-				logger:    tt.fields.logger,
-				sendAfter: tt.fields.sendAfter,
-				wg:        tt.fields.wg,
-				errCh:     tt.fields.errCh,
+				client:  tt.fields.client,
+				cfg:     tt.fields.cfg,
+				storage: tt.fields.storage,
+				clock:   clock.New(),
+				stats:   newAccrualMetrics(nil),
+				logger:  tt.fields.logger,
 			}
 			if err := s.processOrders(tt.args.ctx); (err != nil) != tt.wantErr {
 				t.Errorf("AccrualService.processOrders() error = %v, wantErr %v", err, tt.wantErr)
@@ -185,19 +514,575 @@ func TestAccrualService_processOrders(t *testing.T) {
 	}
 }
 
+func TestAccrualService_processOrders_Claim(t *testing.T) {
+	// the orders are claimed up to the limit for the duration of the requests
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, 50, 10*time.Second).Return([]models.Order{}, nil).Once()
+
+	s := NewAccrualService("http://127.0.0.1:0", m, config.AccrualConfig{Timeout: 10, ClaimLimit: 50})
+	assert.NoError(t, s.processOrders(context.Background()))
+}
+
+func TestAccrualService_processOrders_Drain(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": r.PathValue("number"), "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	t.Run("drained", func(t *testing.T) {
+		// the backlog is claimed batch by batch until a batch comes short
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, 2, 10*time.Second).Return([]models.Order{{Number: "1"}, {Number: "2"}}, nil).Once()
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, 2, 10*time.Second).Return([]models.Order{{Number: "3"}, {Number: "4"}}, nil).Once()
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, 2, 10*time.Second).Return([]models.Order{{Number: "5"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Times(5)
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 10, ClaimLimit: 2})
+		assert.NoError(t, s.processOrders(context.Background()))
+	})
+	t.Run("storage_unavailable", func(t *testing.T) {
+		// the cycle is over once the storage is unavailable
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, 1, 10*time.Second).Return([]models.Order{{Number: "1"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(&db.RetryError{Attempts: 3, Err: context.DeadlineExceeded}).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 10, ClaimLimit: 1})
+		assert.ErrorIs(t, s.processOrders(context.Background()), errStorageUnavailable)
+	})
+	t.Run("claims_expired", func(t *testing.T) {
+		// the orders claimed first may be claimed again after their claims expire
+		clk := clock.NewMock(time.Unix(0, 0))
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, 1, 10*time.Second).Return([]models.Order{{Number: "1"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).RunAndReturn(func(context.Context, *models.Order) error {
+			clk.Advance(10 * time.Second)
+			return nil
+		}).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 10, ClaimLimit: 1}, WithClock(clk))
+		assert.NoError(t, s.processOrders(context.Background()))
+	})
+}
+
+func TestAccrualService_processOrders_Overlap(t *testing.T) {
+	// a cycle overlapping a slow previous one reports the errors of its own orders only
+	started, slow := make(chan struct{}), make(chan struct{})
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-slow
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	h.HandleFunc("/api/orders/fast", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "fast", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "slow"}}, nil).Once()
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "fast"}}, nil).Once()
+	m.EXPECT().PostponeOrder(mock.Anything, "slow", mock.Anything, mock.Anything).Return(nil).Once()
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 10})
+	slowErr := make(chan error, 1)
+	go func() { slowErr <- s.processOrders(context.Background()) }()
+	// the slow cycle holds its order until the fast one is over
+	<-started
+	assert.NoError(t, s.processOrders(context.Background()))
+
+	close(slow)
+	err := <-slowErr
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "order slow")
+}
+
+func TestAccrualService_processOrders_StorageFailures(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	// the accrual system answers about the order after the batch is over
+	h.HandleFunc("/api/orders/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	t.Run("deleted_order", func(t *testing.T) {
+		// the order deleted meanwhile is skipped
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(fmt.Errorf("update: %w", db.ErrOrderNotFound)).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1})
+		assert.NoError(t, s.processOrders(context.Background()))
+	})
+	t.Run("storage_unavailable", func(t *testing.T) {
+		// the batch is stopped at once, the pending requests are left for the next poll
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}, {Number: "slow"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(&db.RetryError{Attempts: 3, Err: context.DeadlineExceeded}).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 5})
+		start := time.Now()
+		err := s.processOrders(context.Background())
+		assert.Less(t, time.Since(start), 2*time.Second)
+		assert.ErrorIs(t, err, errStorageUnavailable)
+		assert.NotContains(t, err.Error(), "order slow")
+	})
+	t.Run("storage_failed", func(t *testing.T) {
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(assert.AnError).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1})
+		err := s.processOrders(context.Background())
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.NotErrorIs(t, err, errStorageUnavailable)
+	})
+}
+
+func TestAccrualService_processOrders_Postpone(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("retried_later", func(t *testing.T) {
+		// the delay doubles with every failed attempt
+		retryAt := now.Add(4 * retryBase)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9", Attempts: 2}}, nil).Once()
+		m.EXPECT().PostponeOrder(mock.Anything, "9", 3, retryAt).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, MaxAttempts: 5}, WithClock(clock.NewMock(now)))
+		assert.ErrorIs(t, s.processOrders(context.Background()), errAccrualFailed)
+	})
+	t.Run("dead_lettered", func(t *testing.T) {
+		// the user is notified the order won't be processed
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9", UserID: 42, Status: models.StatusNew, Attempts: 4}}, nil).Once()
+		m.EXPECT().DeadLetterOrder(mock.Anything, "9", 5, "failed 5 times: accrual request failed: accrual service 500").Return(nil).Once()
+		bus := events.NewBus()
+		ch, cancel := bus.Subscribe(42)
+		defer cancel()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, MaxAttempts: 5}, WithClock(clock.NewMock(now)), WithEvents(bus))
+		assert.Error(t, s.processOrders(context.Background()))
+		assert.Equal(t, models.Event(models.OrderEvent{UserID: 42, Number: "9", Status: models.StatusInvalid, At: now}), <-ch)
+	})
+	t.Run("not_registered", func(t *testing.T) {
+		// the order unknown to the accrual system long after the upload is dead-lettered at once
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+		unknown := httptest.NewServer(h)
+		t.Cleanup(unknown.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{
+			{Number: "old", UploadedAt: now.Add(-73 * time.Hour)},
+			{Number: "recent", UploadedAt: now.Add(-time.Hour)},
+		}, nil).Once()
+		m.EXPECT().DeadLetterOrder(mock.Anything, "old", 1, "not registered in the accrual system for 72h0m0s").Return(nil).Once()
+		m.EXPECT().PostponeOrder(mock.Anything, "recent", 1, now.Add(retryBase)).Return(nil).Once()
+
+		s := NewAccrualService(unknown.URL, m, config.AccrualConfig{Timeout: 1, MaxAttempts: 5, NotRegisteredTTL: 72 * time.Hour}, WithClock(clock.NewMock(now)))
+		assert.ErrorIs(t, s.processOrders(context.Background()), errNotRegistered)
+	})
+	t.Run("storage_failed", func(t *testing.T) {
+		// the failures of the storage aren't counted against the order
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+		})
+		ok := httptest.NewServer(h)
+		t.Cleanup(ok.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}}, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(assert.AnError).Once()
+
+		s := NewAccrualService(ok.URL, m, config.AccrualConfig{Timeout: 1, MaxAttempts: 5})
+		assert.ErrorIs(t, s.processOrders(context.Background()), assert.AnError)
+	})
+}
+
+func TestAccrualService_processOrders_Batch(t *testing.T) {
+	// answer answers about the orders but "1", unknown to the accrual system
+	answer := func(w http.ResponseWriter, numbers []string) {
+		items := []map[string]any{}
+		for _, n := range numbers {
+			if n != "1" {
+				items = append(items, map[string]any{"order": n, "status": "PROCESSED", "accrual": 7})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(items)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	orders := []models.Order{{Number: "9", UploadedAt: now}, {Number: "1", UploadedAt: now}, {Number: "5", UploadedAt: now}}
+
+	t.Run("json", func(t *testing.T) {
+		var requests atomic.Int32
+		h := http.NewServeMux()
+		h.HandleFunc("POST /api/orders/batch", func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			var numbers []string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&numbers))
+			answer(w, numbers)
+		})
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return(orders, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, &models.Order{Number: "9", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(7)}).Return(nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, &models.Order{Number: "5", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(7)}).Return(nil).Once()
+		// the order missing from the answer isn't registered
+		m.EXPECT().PostponeOrder(mock.Anything, "1", 1, now.Add(retryBase)).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, BatchPath: "/api/orders/batch", BatchSize: 2, BatchFormat: config.BatchFormatJSON}, WithClock(clock.NewMock(now)))
+		err := s.processOrders(context.Background())
+		assert.ErrorIs(t, err, errNotRegistered)
+		assert.NotContains(t, err.Error(), "order 9")
+		assert.Equal(t, int32(2), requests.Load())
+	})
+	t.Run("query", func(t *testing.T) {
+		h := http.NewServeMux()
+		h.HandleFunc("GET /api/orders/batch", func(w http.ResponseWriter, r *http.Request) {
+			answer(w, r.URL.Query()["order"])
+		})
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return(orders, nil).Once()
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Twice()
+		m.EXPECT().PostponeOrder(mock.Anything, "1", 1, now.Add(retryBase)).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, BatchPath: "/api/orders/batch", BatchSize: 100, BatchFormat: config.BatchFormatQuery}, WithClock(clock.NewMock(now)))
+		assert.ErrorIs(t, s.processOrders(context.Background()), errNotRegistered)
+	})
+	t.Run("failed", func(t *testing.T) {
+		// all the orders of the failed request are postponed
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/batch", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return(orders, nil).Once()
+		m.EXPECT().PostponeOrder(mock.Anything, mock.Anything, 1, now.Add(retryBase)).Return(nil).Times(3)
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, BatchPath: "/api/orders/batch", BatchSize: 100}, WithClock(clock.NewMock(now)))
+		assert.ErrorIs(t, s.processOrders(context.Background()), errAccrualFailed)
+	})
+	t.Run("audit", func(t *testing.T) {
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/batch", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[{"order":"9","status":"INVALID"}]`))
+		})
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+		a := mocks.NewAccrualAudit(t)
+		// every order is recorded with its own answer
+		a.EXPECT().SaveAccrualResponse(mock.Anything, &models.AccrualResponse{Order: "9", StatusCode: http.StatusOK, Body: `{"order":"9","status":"INVALID"}`}).Return(nil).Once()
+		a.EXPECT().SaveAccrualResponse(mock.Anything, &models.AccrualResponse{Order: "1", StatusCode: http.StatusNoContent}).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, BatchPath: "/api/orders/batch", BatchSize: 100}, WithAudit(a))
+		errs := s.getAccruals(context.Background(), []models.Order{{Number: "9"}, {Number: "1"}})
+		assert.NoError(t, errs[0])
+		assert.ErrorIs(t, errs[1], errNotRegistered)
+	})
+}
+
+func TestAccrualService_Metrics(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	h.HandleFunc("/api/orders/1", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+	h.HandleFunc("/api/orders/2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{
+		{Number: "9", Status: models.StatusNew, UploadedAt: now.Add(-time.Minute)},
+		{Number: "1", Status: models.StatusNew, UploadedAt: now.Add(-time.Minute)},
+	}, nil).Once()
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+	m.EXPECT().PostponeOrder(mock.Anything, "1", 1, now.Add(retryBase)).Return(nil).Once()
+	reg := metrics.NewRegistry()
+
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1, MaxAttempts: 5}, WithClock(clock.NewMock(now)), WithMetrics(reg))
+	assert.Error(t, s.processOrders(context.Background()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.requests.WithLabelValues("200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.requests.WithLabelValues("500")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.retries))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.transitions.WithLabelValues("PROCESSED")))
+	assert.Equal(t, 1, testutil.CollectAndCount(s.stats.latency))
+
+	assert.Error(t, s.getAccrual(context.Background(), models.Order{Number: "2"}))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.rateLimited))
+
+	// the service created again on the registry shares the metrics
+	down := NewAccrualService("http://127.0.0.1:0", m, config.AccrualConfig{Timeout: 1}, WithMetrics(reg))
+	assert.Error(t, down.getAccrual(context.Background(), models.Order{Number: "9"}))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.requests.WithLabelValues(codeError)))
+}
+
+func TestAccrualService_BacklogMetrics(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	oldest := now.Add(-90 * time.Second)
+	b := mocks.NewOrderBacklog(t)
+	b.EXPECT().GetAccrualBacklog(mock.Anything).Return(&models.AccrualBacklog{New: 3, Processing: 2, Oldest: &oldest}, nil).Once()
+	b.EXPECT().GetAccrualBacklog(mock.Anything).Return(nil, assert.AnError).Once()
+	reg := metrics.NewRegistry()
+
+	NewAccrualService("http://127.0.0.1:0", mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1},
+		WithClock(clock.NewMock(now)), WithMetrics(reg), WithBacklog(b))
+	// the backlog is queried on the scrape
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP gophermart_accrual_backlog_oldest_age_seconds Time since the upload of the oldest order waiting for the accrual service, 0 if none waits.
+# TYPE gophermart_accrual_backlog_oldest_age_seconds gauge
+gophermart_accrual_backlog_oldest_age_seconds 90
+# HELP gophermart_accrual_backlog_orders Orders waiting for the accrual service by status.
+# TYPE gophermart_accrual_backlog_orders gauge
+gophermart_accrual_backlog_orders{status="NEW"} 3
+gophermart_accrual_backlog_orders{status="PROCESSING"} 2
+`), "gophermart_accrual_backlog_orders", "gophermart_accrual_backlog_oldest_age_seconds"))
+	// the backlog the storage fails to report is left out of the scrape
+	count, err := testutil.GatherAndCount(reg, "gophermart_accrual_backlog_orders")
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, retryBase, retryDelay(1))
+	assert.Equal(t, 2*retryBase, retryDelay(2))
+	assert.Equal(t, 8*retryBase, retryDelay(4))
+	assert.Equal(t, retryMax, retryDelay(100))
+}
+
+func TestAccrualService_processOrders_RetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/limited", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "limited"}}, nil).Once()
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return([]models.Order{{Number: "9"}}, nil).Once()
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+	clk := clock.NewMock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1}, WithClock(clk))
+
+	// the 429 pauses the requests of all the workers
+	assert.Error(t, s.processOrders(context.Background()))
+	done := make(chan error, 1)
+	go func() { done <- s.processOrders(context.Background()) }()
+	assert.Never(t, func() bool { return requests.Load() > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	// the requests are resumed once the Retry-After passes
+	clk.Advance(10 * time.Second)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the requests weren't resumed after Retry-After")
+	}
+	assert.EqualValues(t, 1, requests.Load())
+}
+
+func TestRetryGate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(now)
+	var g retryGate
+
+	assert.NoError(t, g.wait(context.Background(), clk))
+	assert.True(t, g.pause(now.Add(10*time.Second)))
+	// the shorter pause doesn't shorten the current one
+	assert.False(t, g.pause(now.Add(5*time.Second)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, g.wait(ctx, clk), context.Canceled)
+
+	clk.Advance(10 * time.Second)
+	assert.NoError(t, g.wait(context.Background(), clk))
+}
+
+func TestAIMDLimiter(t *testing.T) {
+	l := newAIMDLimiter(1, 4, prometheus.NewGauge(prometheus.GaugeOpts{Name: "limit"}))
+	ctx := context.Background()
+
+	// the cap is reached
+	releases := make([]func(error), 0, 4)
+	for range 4 {
+		release, err := l.acquire(ctx)
+		assert.NoError(t, err)
+		releases = append(releases, release)
+	}
+	full, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err := l.acquire(full)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the requests sent together halve the cap once
+	releases[0](errRateLimited)
+	releases[1](fmt.Errorf("order 9: %w", errServerFailed))
+	assert.Equal(t, 2.0, l.limit)
+	assert.Equal(t, 2.0, testutil.ToFloat64(l.gauge))
+	// the canceled request doesn't change the cap, the answered one raises it
+	releases[2](context.Canceled)
+	assert.Equal(t, 2.0, l.limit)
+	releases[3](nil)
+	assert.Equal(t, 2.5, l.limit)
+
+	// the cap doesn't go below the min nor above the max
+	for range 5 {
+		release, err := l.acquire(ctx)
+		assert.NoError(t, err)
+		release(errRateLimited)
+	}
+	assert.Equal(t, 1.0, l.limit)
+	for range 100 {
+		release, err := l.acquire(ctx)
+		assert.NoError(t, err)
+		release(nil)
+	}
+	assert.Equal(t, 4.0, l.limit)
+
+	// the waiting request takes the released slot
+	release, err := l.acquire(ctx)
+	assert.NoError(t, err)
+	l.limit = 1
+	got := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx)
+		got <- err
+	}()
+	assert.Never(t, func() bool { return len(got) > 0 }, 30*time.Millisecond, 5*time.Millisecond)
+	release(errNotRegistered)
+	assert.NoError(t, <-got)
+}
+
+func TestAccrualService_processOrders_Concurrency(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	var overloaded atomic.Bool
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		if overloaded.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": r.PathValue("number"), "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	orders := make([]models.Order, 40)
+	for i := range orders {
+		orders[i] = models.Order{Number: strconv.Itoa(i)}
+	}
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().GetUnprocessedOrders(mock.Anything, mock.Anything, mock.Anything).Return(orders, nil)
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil)
+	m.EXPECT().PostponeOrder(mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 10, Concurrency: 8, MinConcurrency: 2})
+	// the requests in flight are capped
+	assert.NoError(t, s.processOrders(context.Background()))
+	assert.LessOrEqual(t, peak.Load(), int32(8))
+	assert.Equal(t, 8.0, testutil.ToFloat64(s.stats.concurrency))
+
+	// the overloaded accrual system gets fewer requests at once
+	overloaded.Store(true)
+	assert.Error(t, s.processOrders(context.Background()))
+	assert.Equal(t, 2.0, testutil.ToFloat64(s.stats.concurrency))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "seconds", header: "120", want: 2 * time.Minute},
+		{name: "http_date", header: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second},
+		{name: "rfc850_date", header: now.Add(time.Minute).Format(time.RFC850), want: time.Minute},
+		{name: "passed_date", header: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "missing", header: "", wantErr: true},
+		{name: "negative", header: "-5", wantErr: true},
+		{name: "garbage", header: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetryAfter(tt.header, now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAccrualService_getAccrual_RetryAfterMax(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", now.Add(24*time.Hour).Format(http.TimeFormat))
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	t.Run("capped", func(t *testing.T) {
+		// the date far in the future pauses the requests for the configured maximum only
+		s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1, RetryAfterMax: time.Minute}, WithClock(clock.NewMock(now)))
+		assert.Error(t, s.getAccrual(context.Background(), models.Order{Number: "9"}))
+		assert.Equal(t, now.Add(time.Minute), s.gate.until)
+	})
+	t.Run("uncapped", func(t *testing.T) {
+		s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1}, WithClock(clock.NewMock(now)))
+		assert.Error(t, s.getAccrual(context.Background(), models.Order{Number: "9"}))
+		assert.Equal(t, now.Add(24*time.Hour), s.gate.until)
+	})
+}
+
 func TestAccrualService_getAccrual(t *testing.T) {
 	type fields struct {
-		client    *resty.Client
-		cfg       config.AccrualConfig
-		storage   Storage
-		logger    *zap.SugaredLogger
-		sendAfter atomic.Uint32
-		wg        sync.WaitGroup
-		errCh     chan error
+		client  *resty.Client
+		cfg     config.AccrualConfig
+		storage repository.OrderQueue
+		logger  *zap.SugaredLogger
 	}
 	type args struct {
-		ctx      context.Context
-		orderNum string
+		ctx   context.Context
+		order models.Order
 	}
 	tests := []struct {
 		name    string
@@ -215,13 +1100,13 @@ func TestAccrualService_getAccrual(t *testing.T) {
 				})
 				s := httptest.NewServer(h)
 				t.Cleanup(s.Close)
-				m := mocks.NewStorage(t)
+				m := mocks.NewOrderQueue(t)
 				m.EXPECT().UpdateOrder(mock.Anything, mock.MatchedBy(func(o *models.Order) bool {
-					return o.Number == "9" && o.Status == models.StatusProcessed && o.Accrual == 7
+					return o.Number == "9" && o.Status == models.StatusProcessed && o.Accrual == models.MoneyFromFloat(7)
 				})).Return(nil)
 				return fields{client: resty.New().SetBaseURL(s.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: m, logger: zap.NewNop().Sugar()}
 			}(),
-			args:    args{ctx: context.Background(), orderNum: "9"},
+			args:    args{ctx: context.Background(), order: models.Order{Number: "9", Status: models.StatusNew}},
 			wantErr: false,
 		},
 		{
@@ -234,9 +1119,9 @@ func TestAccrualService_getAccrual(t *testing.T) {
 				})
 				srv := httptest.NewServer(handler)
 				t.Cleanup(srv.Close)
-				return fields{client: resty.New().SetBaseURL(srv.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewStorage(t), logger: zap.NewNop().Sugar()}
+				return fields{client: resty.New().SetBaseURL(srv.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewOrderQueue(t), logger: zap.NewNop().Sugar()}
 			}(),
-			args:    args{ctx: context.Background(), orderNum: "123"},
+			args:    args{ctx: context.Background(), order: models.Order{Number: "123", Status: models.StatusNew}},
 			wantErr: true,
 		},
 		{
@@ -246,9 +1131,9 @@ func TestAccrualService_getAccrual(t *testing.T) {
 				h.HandleFunc("/api/orders/1", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
 				s := httptest.NewServer(h)
 				t.Cleanup(s.Close)
-				return fields{client: resty.New().SetBaseURL(s.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewStorage(t), logger: zap.NewNop().Sugar()}
+				return fields{client: resty.New().SetBaseURL(s.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewOrderQueue(t), logger: zap.NewNop().Sugar()}
 			}(),
-			args:    args{ctx: context.Background(), orderNum: "1"},
+			args:    args{ctx: context.Background(), order: models.Order{Number: "1", Status: models.StatusNew}},
 			wantErr: true,
 		},
 		{
@@ -258,26 +1143,386 @@ func TestAccrualService_getAccrual(t *testing.T) {
 				h.HandleFunc("/api/orders/2", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
 				s := httptest.NewServer(h)
 				t.Cleanup(s.Close)
-				return fields{client: resty.New().SetBaseURL(s.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewStorage(t), logger: zap.NewNop().Sugar()}
+				return fields{client: resty.New().SetBaseURL(s.URL), cfg: config.AccrualConfig{Timeout: 1}, storage: mocks.NewOrderQueue(t), logger: zap.NewNop().Sugar()}
 			}(),
-			args:    args{ctx: context.Background(), orderNum: "2"},
+			args:    args{ctx: context.Background(), order: models.Order{Number: "2", Status: models.StatusNew}},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &AccrualService{
-				client:    tt.fields.client,
-				cfg:       tt.fields.cfg,
-				storage:   tt.fields.storage,
-				logger:    tt.fields.logger,
-				sendAfter: tt.fields.sendAfter,
-				wg:        tt.fields.wg,
-				errCh:     tt.fields.errCh,
+				client:  tt.fields.client,
+				cfg:     tt.fields.cfg,
+				storage: tt.fields.storage,
+				clock:   clock.New(),
+				stats:   newAccrualMetrics(nil),
+				logger:  tt.fields.logger,
 			}
-			if err := s.getAccrual(tt.args.ctx, tt.args.orderNum); (err != nil) != tt.wantErr {
+			if err := s.getAccrual(tt.args.ctx, tt.args.order); (err != nil) != tt.wantErr {
 				t.Errorf("AccrualService.getAccrual() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestAccrualService_getAccrual_Retries(t *testing.T) {
+	// flaky answers about the order after the failures counted by hits
+	flaky := func(t *testing.T, hits *atomic.Int32, fail func(w http.ResponseWriter)) *httptest.Server {
+		h := http.NewServeMux()
+		h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1) == 1 {
+				fail(w)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+		})
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	// reset drops the connection without an answer
+	reset := func(w http.ResponseWriter) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}
+	serverError := func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }
+	order := models.Order{Number: "9", Status: models.StatusNew}
+	cfg := config.AccrualConfig{Timeout: 1, RetryCount: 2, RetryWait: time.Millisecond, RetryMaxWait: time.Millisecond}
+
+	t.Run("error", func(t *testing.T) {
+		var hits atomic.Int32
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+		cfg := cfg
+		cfg.RetryOn = []string{config.RetryOnError}
+
+		s := NewAccrualService(flaky(t, &hits, reset).URL, m, cfg)
+		assert.NoError(t, s.getAccrual(context.Background(), order))
+		assert.Equal(t, int32(2), hits.Load())
+	})
+	t.Run("5xx", func(t *testing.T) {
+		var hits atomic.Int32
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+		cfg := cfg
+		cfg.RetryOn = []string{config.RetryOnError, config.RetryOn5xx}
+
+		s := NewAccrualService(flaky(t, &hits, serverError).URL, m, cfg)
+		assert.NoError(t, s.getAccrual(context.Background(), order))
+		assert.Equal(t, int32(2), hits.Load())
+	})
+	t.Run("not_retried", func(t *testing.T) {
+		// the server errors are retried only if configured
+		var hits atomic.Int32
+		cfg := cfg
+		cfg.RetryOn = []string{config.RetryOnError}
+
+		s := NewAccrualService(flaky(t, &hits, serverError).URL, mocks.NewOrderQueue(t), cfg)
+		assert.ErrorIs(t, s.getAccrual(context.Background(), order), errAccrualFailed)
+		assert.Equal(t, int32(1), hits.Load())
+	})
+}
+
+func TestAccrualService_getAccrual_RequestTimeout(t *testing.T) {
+	var hits atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt is answered too late
+		if hits.Add(1) == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	order := models.Order{Number: "9", Status: models.StatusNew}
+
+	t.Run("retried", func(t *testing.T) {
+		// the attempt is limited apart from the processing of the order, so it is retried in time
+		hits.Store(0)
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{
+			Timeout: 5, RequestTimeout: 50 * time.Millisecond,
+			RetryCount: 1, RetryWait: time.Millisecond, RetryOn: []string{config.RetryOnError},
+		})
+		assert.NoError(t, s.getAccrual(context.Background(), order))
+		assert.Equal(t, int32(2), hits.Load())
+	})
+	t.Run("timed_out", func(t *testing.T) {
+		hits.Store(0)
+		s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 5, RequestTimeout: 50 * time.Millisecond})
+		start := time.Now()
+		assert.ErrorIs(t, s.getAccrual(context.Background(), order), errAccrualFailed)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}
+
+func TestAccrualService_getAccrual_Audit(t *testing.T) {
+	const body = `{"order":"9","status":"PROCESSED","accrual":7}`
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(body)) })
+	h.HandleFunc("/api/orders/1", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	t.Run("processed", func(t *testing.T) {
+		m := mocks.NewOrderQueue(t)
+		m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+		a := mocks.NewAccrualAudit(t)
+		a.EXPECT().SaveAccrualResponse(mock.Anything, &models.AccrualResponse{Order: "9", StatusCode: http.StatusOK, Body: body}).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1}, WithAudit(a))
+		assert.NoError(t, s.getAccrual(context.Background(), models.Order{Number: "9", Status: models.StatusNew}))
+	})
+	t.Run("not_registered", func(t *testing.T) {
+		a := mocks.NewAccrualAudit(t)
+		a.EXPECT().SaveAccrualResponse(mock.Anything, &models.AccrualResponse{Order: "1", StatusCode: http.StatusNoContent}).Return(nil).Once()
+
+		s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1}, WithAudit(a))
+		assert.Error(t, s.getAccrual(context.Background(), models.Order{Number: "1", Status: models.StatusNew}))
+	})
+	t.Run("save_failed", func(t *testing.T) {
+		// the order isn't updated without the record of the response
+		a := mocks.NewAccrualAudit(t)
+		a.EXPECT().SaveAccrualResponse(mock.Anything, mock.Anything).Return(assert.AnError).Once()
+
+		s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1}, WithAudit(a))
+		assert.ErrorIs(t, s.getAccrual(context.Background(), models.Order{Number: "9", Status: models.StatusNew}), assert.AnError)
+	})
+}
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.AccrualConfig
+		wantErr bool
+	}{
+		{name: "none", cfg: config.AccrualConfig{}},
+		{name: "api_key", cfg: config.AccrualConfig{Auth: config.AuthAPIKey, AuthSecret: "key"}},
+		{name: "api_key_without_secret", cfg: config.AccrualConfig{Auth: config.AuthAPIKey}, wantErr: true},
+		{name: "bearer_without_secret", cfg: config.AccrualConfig{Auth: config.AuthBearer}, wantErr: true},
+		{name: "basic", cfg: config.AccrualConfig{Auth: config.AuthBasic, AuthUser: "shop"}},
+		{name: "basic_without_user", cfg: config.AccrualConfig{Auth: config.AuthBasic, AuthSecret: "pass"}, wantErr: true},
+		{name: "unknown", cfg: config.AccrualConfig{Auth: "digest", AuthSecret: "pass"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAuth(tt.cfg)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAuth)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAccrualService_getAccrual_Auth(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name   string
+		cfg    config.AccrualConfig
+		header string
+		want   string
+	}{
+		{name: "none", cfg: config.AccrualConfig{}, header: "Authorization", want: ""},
+		{name: "api_key", cfg: config.AccrualConfig{Auth: config.AuthAPIKey, AuthSecret: "key"}, header: "X-API-Key", want: "key"},
+		{name: "api_key_header", cfg: config.AccrualConfig{Auth: config.AuthAPIKey, AuthHeader: "X-Shop-Key", AuthSecret: "key"}, header: "X-Shop-Key", want: "key"},
+		{name: "bearer", cfg: config.AccrualConfig{Auth: config.AuthBearer, AuthSecret: "token"}, header: "Authorization", want: "Bearer token"},
+		{name: "basic", cfg: config.AccrualConfig{Auth: config.AuthBasic, AuthUser: "shop", AuthSecret: "pass"}, header: "Authorization", want: "Basic c2hvcDpwYXNz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Timeout = 1
+			s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), tt.cfg)
+			assert.ErrorIs(t, s.getAccrual(context.Background(), models.Order{Number: "9"}), errNotRegistered)
+			assert.Equal(t, tt.want, (<-headers).Get(tt.header))
+		})
+	}
+}
+
+func TestAccrualService_getAccrual_Inconsistent(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"order":"10","status":"PROCESSED","accrual":7}`))
+	})
+	h.HandleFunc("/api/orders/1", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"order":"1","status":"PROCESSED","accrual":-7}`))
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	// the inconsistent answer is rejected without updating any order, the order is retried
+	tests := []struct {
+		name   string
+		number string
+		want   string
+	}{
+		{name: "another_order", number: "9", want: `answer about order "10"`},
+		{name: "negative_accrual", number: "1", want: "negative accrual -7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), config.AccrualConfig{Timeout: 1})
+			err := s.getAccrual(context.Background(), models.Order{Number: tt.number, Status: models.StatusNew})
+			assert.ErrorIs(t, err, errInconsistentAnswer)
+			assert.ErrorIs(t, err, errAccrualFailed)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestAccrualService_getAccrual_PublishesEvent(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	bus := events.NewBus()
+	ch, cancel := bus.Subscribe(42)
+	defer cancel()
+
+	s := NewAccrualService(srv.URL, m, config.AccrualConfig{Timeout: 1}, WithClock(clock.NewMock(now)), WithEvents(bus))
+	assert.NoError(t, s.getAccrual(context.Background(), models.Order{Number: "9", UserID: 42, Status: models.StatusNew}))
+	assert.Equal(t, models.Event(models.OrderEvent{UserID: 42, Number: "9", Status: models.StatusProcessed, Accrual: models.MoneyFromFloat(7), At: now}), <-ch)
+}
+
+func TestAccrualService_getAccrual_Hedged(t *testing.T) {
+	var calls atomic.Int32
+	first := make(chan struct{})
+	canceled := make(chan struct{})
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		// the first request hangs until it is canceled, the hedge is answered at once
+		if calls.Add(1) == 1 {
+			close(first)
+			<-r.Context().Done()
+			close(canceled)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+	clk := clock.NewMock(time.Unix(0, 0))
+	cfg := config.AccrualConfig{Timeout: 5, HedgeDelay: 100 * time.Millisecond}
+	s := NewAccrualService(srv.URL, m, cfg, WithClock(clk), WithMetrics(metrics.NewRegistry()))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.getAccrual(context.Background(), models.Order{Number: "9", Status: models.StatusNew})
+	}()
+	<-first
+	clk.Advance(cfg.HedgeDelay)
+	assert.NoError(t, <-errCh)
+	<-canceled
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.hedges))
+	// the request not taken isn't counted
+	assert.Equal(t, 1, testutil.CollectAndCount(s.stats.requests))
+}
+
+func TestAccrualService_getAccrual_HedgeRateLimited(t *testing.T) {
+	var calls atomic.Int32
+	var s *AccrualService
+	first, hedged := make(chan struct{}), make(chan struct{})
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		// the first request is rate limited once the hedge is sent, the hedge is answered after the 429
+		if calls.Add(1) == 1 {
+			close(first)
+			<-hedged
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		close(hedged)
+		for deadline := time.Now().Add(time.Second); testutil.ToFloat64(s.stats.rateLimited) == 0 && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"order": "9", "status": "PROCESSED", "accrual": 7})
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	m := mocks.NewOrderQueue(t)
+	m.EXPECT().UpdateOrder(mock.Anything, mock.Anything).Return(nil).Once()
+	now := time.Unix(0, 0)
+	clk := clock.NewMock(now)
+	cfg := config.AccrualConfig{Timeout: 5, HedgeDelay: 100 * time.Millisecond}
+	s = NewAccrualService(srv.URL, m, cfg, WithClock(clk), WithMetrics(metrics.NewRegistry()))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.getAccrual(context.Background(), models.Order{Number: "9", Status: models.StatusNew})
+	}()
+	<-first
+	clk.Advance(cfg.HedgeDelay)
+	assert.NoError(t, <-errCh)
+	// the discarded 429 pauses the requests all the same
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.stats.rateLimited))
+	assert.Equal(t, now.Add(cfg.HedgeDelay+30*time.Second), s.gate.until)
+	// the requests are timed by the clock: the first one took the hedge delay, the hedge none
+	expected := `
+		# HELP gophermart_accrual_request_duration_seconds Duration of the requests to the accrual system.
+		# TYPE gophermart_accrual_request_duration_seconds histogram
+		gophermart_accrual_request_duration_seconds_bucket{le="0.005"} 1
+		gophermart_accrual_request_duration_seconds_bucket{le="0.01"} 1
+		gophermart_accrual_request_duration_seconds_bucket{le="0.025"} 1
+		gophermart_accrual_request_duration_seconds_bucket{le="0.05"} 1
+		gophermart_accrual_request_duration_seconds_bucket{le="0.1"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="0.25"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="0.5"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="1"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="2.5"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="5"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="10"} 2
+		gophermart_accrual_request_duration_seconds_bucket{le="+Inf"} 2
+		gophermart_accrual_request_duration_seconds_sum 0.1
+		gophermart_accrual_request_duration_seconds_count 2
+	`
+	assert.NoError(t, testutil.CollectAndCompare(s.stats.duration, strings.NewReader(expected)))
+}
+
+func TestAccrualService_getAccrual_HedgeNotNeeded(t *testing.T) {
+	var calls atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/orders/9", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	// the failure answered within the delay is taken without hedging, the clock is never advanced
+	cfg := config.AccrualConfig{Timeout: 5, HedgeDelay: time.Hour}
+	s := NewAccrualService(srv.URL, mocks.NewOrderQueue(t), cfg, WithClock(clock.NewMock(time.Unix(0, 0))), WithMetrics(metrics.NewRegistry()))
+	assert.ErrorIs(t, s.getAccrual(context.Background(), models.Order{Number: "9"}), errServerFailed)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, 0.0, testutil.ToFloat64(s.stats.hedges))
+}
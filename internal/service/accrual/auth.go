@@ -0,0 +1,60 @@
+package accrual
+
+import (
+	"errors"
+	"fmt"
+	"loyaltySys/internal/service/accrual/config"
+	"strings"
+)
+
+// ErrInvalidAuth is returned for the auth of the accrual system of an unknown type or missing its credentials.
+var ErrInvalidAuth = errors.New("invalid accrual auth")
+
+// defaultAPIKeyHeader is the header of the API key if another one isn't configured.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// ValidateAuth checks the configured auth of the requests to the accrual system has its credentials.
+func ValidateAuth(cfg config.AccrualConfig) error {
+	switch cfg.Auth {
+	case config.AuthNone:
+		return nil
+	case config.AuthAPIKey, config.AuthBearer:
+		if cfg.AuthSecret == "" {
+			return fmt.Errorf("%w: %s auth without ACCRUAL_AUTH_SECRET", ErrInvalidAuth, cfg.Auth)
+		}
+	case config.AuthBasic:
+		if cfg.AuthUser == "" {
+			return fmt.Errorf("%w: basic auth without ACCRUAL_AUTH_USER", ErrInvalidAuth)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidAuth, cfg.Auth)
+	}
+	return nil
+}
+
+// setAuth makes the client send the configured credentials with every request to the accrual system.
+// The auth of an unknown type, rejected by ValidateAuth, is ignored.
+func (s *AccrualService) setAuth() {
+	switch s.cfg.Auth {
+	case config.AuthNone:
+		return
+	case config.AuthAPIKey:
+		header := s.cfg.AuthHeader
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		s.client.SetHeader(header, s.cfg.AuthSecret)
+	case config.AuthBearer:
+		s.client.SetAuthToken(s.cfg.AuthSecret)
+	case config.AuthBasic:
+		s.client.SetBasicAuth(s.cfg.AuthUser, s.cfg.AuthSecret)
+	default:
+		s.logger.Warnf("unknown accrual auth %q is ignored", s.cfg.Auth)
+		return
+	}
+	// the client would warn on every request otherwise
+	s.client.SetDisableWarn(true)
+	if !strings.HasPrefix(s.client.BaseURL, "https://") {
+		s.logger.Warnf("the accrual credentials are sent over plain HTTP to %s", s.client.BaseURL)
+	}
+}
@@ -1,7 +1,49 @@
 package config
 
+import "time"
+
+// Formats of the request to the batch endpoint of the accrual system.
+const (
+	BatchFormatJSON  = "json"  // POST with the JSON array of the order numbers
+	BatchFormatQuery = "query" // GET with an order query parameter per order
+)
+
+// Conditions of the retries of the requests to the accrual system.
+const (
+	RetryOnError = "error" // the request failed without a response, e.g. the connection was reset
+	RetryOn5xx   = "5xx"   // the accrual system answered with a server error
+)
+
+// Auth of the requests to the accrual system.
+const (
+	AuthNone   = ""        // the requests are sent without credentials
+	AuthAPIKey = "api_key" // the secret is sent in the AuthHeader header
+	AuthBearer = "bearer"  // the secret is sent as the bearer token
+	AuthBasic  = "basic"   // the user and the secret are sent as the basic auth
+)
+
 // Accrual service configuration. Timeout is specified in seconds.
 type AccrualConfig struct {
-	AccrualAddr string `env:"ACCRUAL_SYSTEM_ADDRESS"` // Accrual system address
-	Timeout     int    `env:"ACCRUAL_TIMEOUT"`        // Timeout in seconds for accrual requests
+	AccrualAddr      string        `env:"ACCRUAL_SYSTEM_ADDRESS"`            // Accrual system address
+	Timeout          int           `env:"ACCRUAL_TIMEOUT"`                   // Timeout in seconds of the processing of an order with its retries, and the poll period
+	RequestTimeout   time.Duration `env:"ACCRUAL_REQUEST_TIMEOUT"`           // Timeout of a request attempt, 0 uses Timeout
+	MaxAttempts      int           `env:"ACCRUAL_MAX_ATTEMPTS"`              // Failed attempts before the order is dead-lettered, 0 retries forever
+	NotRegisteredTTL time.Duration `env:"ACCRUAL_NOT_REGISTERED_TTL"`        // Age of the order unknown to the accrual system it is dead-lettered at, 0 waits forever
+	ClaimLimit       int           `env:"ACCRUAL_CLAIM_LIMIT"`               // Orders claimed by a poll, 0 claims all the due ones
+	BatchPath        string        `env:"ACCRUAL_BATCH_PATH"`                // Path of the batch endpoint, empty requests the orders one by one
+	BatchSize        int           `env:"ACCRUAL_BATCH_SIZE"`                // Orders requested from the batch endpoint at once
+	BatchFormat      string        `env:"ACCRUAL_BATCH_FORMAT"`              // Format of the batch request: json or query
+	RetryCount       int           `env:"ACCRUAL_RETRY_COUNT"`               // Retries of a failed request before the order fails, 0 doesn't retry
+	RetryWait        time.Duration `env:"ACCRUAL_RETRY_WAIT"`                // Wait before the first retry, doubled with every retry
+	RetryMaxWait     time.Duration `env:"ACCRUAL_RETRY_MAX_WAIT"`            // Cap of the wait between the retries
+	RetryOn          []string      `env:"ACCRUAL_RETRY_ON" envSeparator:","` // Conditions of the retries: error, 5xx
+	RetryAfterMax    time.Duration `env:"ACCRUAL_RETRY_AFTER_MAX"`           // Cap of the pause on 429, 0 pauses for as long as Retry-After says
+	Concurrency      int           `env:"ACCRUAL_CONCURRENCY"`               // Max requests of the polled orders in flight, adapted down on 429 and 500, 0 doesn't cap them
+	MinConcurrency   int           `env:"ACCRUAL_MIN_CONCURRENCY"`           // Requests in flight the adapted cap doesn't go below
+	HedgeDelay       time.Duration `env:"ACCRUAL_HEDGE_DELAY"`               // Delay of the second request about an order not answered yet, 0 doesn't hedge
+	Auth             string        `env:"ACCRUAL_AUTH"`                      // Auth of the requests: api_key, bearer, basic, empty sends no credentials
+	AuthHeader       string        `env:"ACCRUAL_AUTH_HEADER"`               // Header of the API key
+	AuthUser         string        `env:"ACCRUAL_AUTH_USER"`                 // User of the basic auth
+	AuthSecret       string        `env:"ACCRUAL_AUTH_SECRET"`               // API key, bearer token or basic auth password
+	AuthSecretFile   string        `env:"ACCRUAL_AUTH_SECRET_FILE"`          // File containing the auth secret, used if ACCRUAL_AUTH_SECRET is not set
 }
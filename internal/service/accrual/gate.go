@@ -0,0 +1,73 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/clock"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseRetryAfter returns the pause the Retry-After header asks for at the time, given either as the seconds
+// or as the HTTP date; a date already passed asks for no pause.
+func parseRetryAfter(header string, now time.Time) (time.Duration, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, errors.New("no Retry-After")
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("negative Retry-After %d", seconds)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, fmt.Errorf("the Retry-After %q is neither the seconds nor the HTTP date", header)
+	}
+	return max(at.Sub(now), 0), nil
+}
+
+// retryGate holds all the requests to the accrual system until the Retry-After of the last 429 passes.
+// The zero value is open.
+type retryGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pause closes the gate until the time, an earlier time doesn't shorten the pause already set.
+// It reports whether the pause was extended.
+func (g *retryGate) pause(until time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !until.After(g.until) {
+		return false
+	}
+	g.until = until
+	return true
+}
+
+// wait blocks until the gate is open or the context is done, the done context fails it even if the gate is open.
+// The pause may be extended while waiting, so the gate is checked again after every wait.
+func (g *retryGate) wait(ctx context.Context, clk clock.Clock) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		g.mu.Lock()
+		d := g.until.Sub(clk.Now())
+		g.mu.Unlock()
+		if d <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clk.After(d):
+		}
+	}
+}
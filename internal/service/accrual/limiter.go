@@ -0,0 +1,87 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aimdLimiter caps the requests to the accrual system in flight, adapting the cap to its capacity:
+// every request answered without overload raises the cap by one per cap's worth of requests,
+// an overloaded answer halves it. The requests failed otherwise, e.g. canceled, don't change the cap.
+// A nil limiter doesn't cap the requests.
+type aimdLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min, max float64
+	inFlight int
+	// epoch counts the decreases, only the requests started since the last decrease decrease the cap again,
+	// so the requests sent together halve it once
+	epoch uint64
+	// changed is closed once a slot is released or the cap is changed
+	changed chan struct{}
+	gauge   prometheus.Gauge
+}
+
+// newAIMDLimiter creates the limiter starting at the max cap, the cap is never set below min.
+func newAIMDLimiter(minLimit, maxLimit int, gauge prometheus.Gauge) *aimdLimiter {
+	minLimit = min(max(minLimit, 1), maxLimit)
+	l := &aimdLimiter{
+		limit:   float64(maxLimit),
+		min:     float64(minLimit),
+		max:     float64(maxLimit),
+		changed: make(chan struct{}),
+		gauge:   gauge,
+	}
+	l.gauge.Set(l.limit)
+	return l
+}
+
+// acquire takes a slot for a request, blocking while the cap is reached or until the context is done.
+// The returned release gives the slot back with the error of the request.
+func (l *aimdLimiter) acquire(ctx context.Context) (release func(err error), err error) {
+	if l == nil {
+		return func(error) {}, nil
+	}
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			epoch := l.epoch
+			l.mu.Unlock()
+			var once sync.Once
+			return func(err error) {
+				once.Do(func() { l.release(epoch, err) })
+			}, nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release gives back the slot taken in the epoch and adapts the cap to the error of the request.
+func (l *aimdLimiter) release(epoch uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	switch {
+	case errors.Is(err, errRateLimited) || errors.Is(err, errServerFailed):
+		if epoch == l.epoch {
+			l.limit = max(l.limit/2, l.min)
+			l.epoch++
+		}
+	// the unknown order is answered like any other
+	case err == nil || errors.Is(err, errNotRegistered):
+		l.limit = min(l.limit+1/l.limit, l.max)
+	}
+	l.gauge.Set(l.limit)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,205 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// codeError labels the requests to the accrual system failed without a response.
+const codeError = "error"
+
+// accrualMetrics follow the accrual pipeline: the requests to the accrual system by the status code
+// and their duration, the 429 answers, the retried orders, the orders brought to the final status
+// with the time it took since the upload, the polls skipped while the previous cycle ran, the adapted
+// concurrency of the requests and the hedged requests.
+type accrualMetrics struct {
+	requests    *prometheus.CounterVec
+	duration    prometheus.Histogram
+	rateLimited prometheus.Counter
+	retries     prometheus.Counter
+	transitions *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	skipped     prometheus.Counter
+	concurrency prometheus.Gauge
+	hedges      prometheus.Counter
+}
+
+// newAccrualMetrics creates the accrual metrics and registers them in the registry.
+func newAccrualMetrics(reg *metrics.Registry) *accrualMetrics {
+	m := &accrualMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "requests_total",
+			Help:      "Requests to the accrual system by the status code of the response, error if there was none.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests to the accrual system.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "rate_limited_total",
+			Help:      "Answers 429 Too Many Requests of the accrual system.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "retries_total",
+			Help:      "Orders postponed to be requested again after the accrual system failed to answer about them.",
+		}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "orders_transitioned_total",
+			Help:      "Orders brought to the final status by the status.",
+		}, []string{"status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "order_processing_seconds",
+			Help:      "Time from the upload of the order to its final status by the status.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 300, 900, 3600, 4 * 3600, 24 * 3600, 72 * 3600},
+		}, []string{"status"}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "polls_skipped_total",
+			Help:      "Polls of the unprocessed orders skipped since the previous polling cycle was still running.",
+		}),
+		concurrency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "concurrency_limit",
+			Help:      "Cap of the requests of the polled orders in flight adapted to the capacity of the accrual system.",
+		}),
+		hedges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "accrual",
+			Name:      "hedged_requests_total",
+			Help:      "Second requests about an order sent as the first one wasn't answered within the hedge delay.",
+		}),
+	}
+	// the service may be created again on the same registry
+	var are prometheus.AlreadyRegisteredError
+	reg = reg.OrDiscard()
+	if err := reg.Register(m.requests); errors.As(err, &are) {
+		m.requests = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	if err := reg.Register(m.duration); errors.As(err, &are) {
+		m.duration = are.ExistingCollector.(prometheus.Histogram)
+	}
+	if err := reg.Register(m.rateLimited); errors.As(err, &are) {
+		m.rateLimited = are.ExistingCollector.(prometheus.Counter)
+	}
+	if err := reg.Register(m.retries); errors.As(err, &are) {
+		m.retries = are.ExistingCollector.(prometheus.Counter)
+	}
+	if err := reg.Register(m.transitions); errors.As(err, &are) {
+		m.transitions = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	if err := reg.Register(m.latency); errors.As(err, &are) {
+		m.latency = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	if err := reg.Register(m.skipped); errors.As(err, &are) {
+		m.skipped = are.ExistingCollector.(prometheus.Counter)
+	}
+	if err := reg.Register(m.concurrency); errors.As(err, &are) {
+		m.concurrency = are.ExistingCollector.(prometheus.Gauge)
+	}
+	if err := reg.Register(m.hedges); errors.As(err, &are) {
+		m.hedges = are.ExistingCollector.(prometheus.Counter)
+	}
+	return m
+}
+
+// observeRequest records the request to the accrual system that took the duration,
+// answered with the response or failed with the error.
+func (m *accrualMetrics) observeRequest(took time.Duration, resp *resty.Response, err error) {
+	m.duration.Observe(took.Seconds())
+	if err != nil {
+		m.requests.WithLabelValues(codeError).Inc()
+		return
+	}
+	m.requests.WithLabelValues(strconv.Itoa(resp.StatusCode())).Inc()
+}
+
+// observeTransition records the order brought to the final status at the time.
+func (m *accrualMetrics) observeTransition(order models.Order, status models.OrderStatus, at time.Time) {
+	m.transitions.WithLabelValues(string(status)).Inc()
+	// the order without the upload time isn't timed
+	if !order.UploadedAt.IsZero() {
+		m.latency.WithLabelValues(string(status)).Observe(at.Sub(order.UploadedAt).Seconds())
+	}
+}
+
+// backlogTimeout limits the query of the backlog on a scrape.
+const backlogTimeout = 2 * time.Second
+
+// backlogCollector exports the orders waiting for the accrual service when the metrics are scraped,
+// so the backlog is reported even if the pipeline is stuck.
+type backlogCollector struct {
+	backlog repository.OrderBacklog
+	clock   clock.Clock
+	logger  *zap.SugaredLogger
+
+	orders    *prometheus.Desc
+	oldestAge *prometheus.Desc
+}
+
+// registerBacklogCollector registers the collector of the backlog in the registry, replacing the one
+// of the service created before on the same registry.
+func registerBacklogCollector(reg *metrics.Registry, backlog repository.OrderBacklog, clk clock.Clock, logger *zap.SugaredLogger) {
+	name := func(n string) string { return prometheus.BuildFQName(metrics.Namespace, "accrual", n) }
+	c := &backlogCollector{
+		backlog:   backlog,
+		clock:     clk,
+		logger:    logger,
+		orders:    prometheus.NewDesc(name("backlog_orders"), "Orders waiting for the accrual service by status.", []string{"status"}, nil),
+		oldestAge: prometheus.NewDesc(name("backlog_oldest_age_seconds"), "Time since the upload of the oldest order waiting for the accrual service, 0 if none waits.", nil, nil),
+	}
+	reg = reg.OrDiscard()
+	var are prometheus.AlreadyRegisteredError
+	if err := reg.Register(c); errors.As(err, &are) {
+		reg.Unregister(are.ExistingCollector)
+		reg.MustRegister(c)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *backlogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.orders
+	ch <- c.oldestAge
+}
+
+// Collect implements prometheus.Collector. The backlog isn't reported if the storage fails to answer.
+func (c *backlogCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), backlogTimeout)
+	defer cancel()
+	b, err := c.backlog.GetAccrualBacklog(ctx)
+	if err != nil {
+		c.logger.Errorf("failed to collect the accrual backlog: %v", err)
+		return
+	}
+	var age float64
+	if b.Oldest != nil {
+		age = max(c.clock.Now().Sub(*b.Oldest).Seconds(), 0)
+	}
+	ch <- prometheus.MustNewConstMetric(c.orders, prometheus.GaugeValue, float64(b.New), string(models.StatusNew))
+	ch <- prometheus.MustNewConstMetric(c.orders, prometheus.GaugeValue, float64(b.Processing), string(models.StatusProcessing))
+	ch <- prometheus.MustNewConstMetric(c.oldestAge, prometheus.GaugeValue, age)
+}
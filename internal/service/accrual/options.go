@@ -0,0 +1,77 @@
+package accrual
+
+import (
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/dispatch"
+	"loyaltySys/internal/events"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/repository"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the accrual service.
+type Option func(*AccrualService)
+
+// WithLogger sets the accrual service logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *AccrualService) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock driving the polling ticker and the Retry-After pauses.
+func WithClock(c clock.Clock) Option {
+	return func(s *AccrualService) {
+		s.clock = c
+	}
+}
+
+// WithMetrics sets the registry for the accrual metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *AccrualService) {
+		s.metrics = reg
+	}
+}
+
+// WithEvents sets the bus the order status changes are published to.
+func WithEvents(bus *events.Bus) Option {
+	return func(s *AccrualService) {
+		s.events = bus
+	}
+}
+
+// WithAudit sets the store recording the raw responses of the accrual system.
+func WithAudit(a repository.AccrualAudit) Option {
+	return func(s *AccrualService) {
+		s.audit = a
+	}
+}
+
+// WithQueue sets the queue of the orders uploaded to this instance, requested as soon as they are queued.
+func WithQueue(q *dispatch.Queue) Option {
+	return func(s *AccrualService) {
+		s.queue = q
+	}
+}
+
+// WithNotifier sets the notifier waking the service up when new orders are uploaded.
+func WithNotifier(n repository.OrderNotifier) Option {
+	return func(s *AccrualService) {
+		s.notifier = n
+	}
+}
+
+// WithBacklog sets the store reporting the orders waiting for the accrual service, exported with the metrics.
+func WithBacklog(b repository.OrderBacklog) Option {
+	return func(s *AccrualService) {
+		s.backlog = b
+	}
+}
+
+// WithPollerLock sets the lock letting one of the replicas poll the unprocessed orders at a time.
+func WithPollerLock(l repository.PollerLock) Option {
+	return func(s *AccrualService) {
+		s.pollerLock = l
+	}
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// ExportConfig is the data export job configuration. The export is disabled if neither Dir nor S3Bucket is set.
+type ExportConfig struct {
+	Interval    time.Duration `env:"EXPORT_INTERVAL"`      // Interval of the exports, the files of one interval replace each other
+	Dir         string        `env:"EXPORT_DIR"`           // Local directory the files are written to
+	S3Endpoint  string        `env:"EXPORT_S3_ENDPOINT"`   // URL of the S3-compatible storage
+	S3Region    string        `env:"EXPORT_S3_REGION"`     // Region of the bucket
+	S3Bucket    string        `env:"EXPORT_S3_BUCKET"`     // Bucket the files are uploaded to
+	S3Prefix    string        `env:"EXPORT_S3_PREFIX"`     // Prefix of the object keys
+	S3AccessKey string        `env:"EXPORT_S3_ACCESS_KEY"` // Access key ID of the storage
+	S3SecretKey string        `env:"EXPORT_S3_SECRET_KEY"` // Secret access key of the storage
+}
@@ -0,0 +1,167 @@
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/service/export/config"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// stampLayout is the UTC start of the export interval in the names of the files.
+const stampLayout = "20060102T150405Z"
+
+// ExportService dumps the orders and the withdrawals as compressed CSV files for the analytics
+type ExportService struct {
+	cfg     config.ExportConfig
+	storage repository.ExportStore
+	sink    Sink
+	clock   clock.Clock
+	// done is closed once the loop started by Start returns, cancel cancels the cycle still running
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	logger *zap.SugaredLogger
+}
+
+// NewExportService creates a new export service writing the files to the sink
+func NewExportService(storage repository.ExportStore, sink Sink, cfg config.ExportConfig, opts ...Option) *ExportService {
+	s := &ExportService{
+		cfg:     cfg,
+		storage: storage,
+		sink:    sink,
+		clock:   clock.New(),
+		logger:  zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start starts the export service, the current interval is exported right away
+func (s *ExportService) Start(ctx context.Context) {
+	t := s.clock.NewTicker(s.cfg.Interval)
+	// the cycle running when the context is done is finished, Stop waits for it
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.done, s.cancel = make(chan struct{}), cancel
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		defer t.Stop()
+		s.logger.Info("export service started")
+		if err := s.export(work); err != nil {
+			s.logger.Errorf("failed to export data: %v", err)
+		}
+		for {
+			select {
+			// stop the export service
+			case <-ctx.Done():
+				s.logger.Info("export service stopped")
+				return
+			// export the data on ticker signal
+			case <-t.C():
+				if err := s.export(work); err != nil {
+					s.logger.Errorf("failed to export data: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the export running when the context passed to Start is done to be uploaded. It is canceled
+// once the context of Stop is done, the interval is exported again after the restart.
+func (s *ExportService) Stop(ctx context.Context) error {
+	// the service wasn't started
+	if s.done == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("export service cycle left running: %w", ctx.Err())
+	}
+}
+
+// export dumps the orders and the withdrawals into the temporary files and stores them in the sink as
+// orders/orders-<stamp>.csv.gz and withdrawals/withdrawals-<stamp>.csv.gz, the stamp being the start of the interval,
+// so the replicas and the restarts within an interval replace the files instead of adding new ones
+func (s *ExportService) export(ctx context.Context) error {
+	stamp := s.clock.Now().UTC().Truncate(s.cfg.Interval).Format(stampLayout)
+
+	orders, err := newGzipFile()
+	if err != nil {
+		return err
+	}
+	defer orders.remove()
+	withdrawals, err := newGzipFile()
+	if err != nil {
+		return err
+	}
+	defer withdrawals.remove()
+
+	ordersN, withdrawalsN, err := s.storage.Export(ctx, orders.zw, withdrawals.zw)
+	if err != nil {
+		return fmt.Errorf("failed to read the data: %w", err)
+	}
+	for _, f := range []struct {
+		name string
+		file *gzipFile
+	}{
+		{name: "orders/orders-" + stamp + ".csv.gz", file: orders},
+		{name: "withdrawals/withdrawals-" + stamp + ".csv.gz", file: withdrawals},
+	} {
+		size, err := f.file.finish()
+		if err != nil {
+			return err
+		}
+		if err := s.sink.Put(ctx, f.name, f.file.f, size); err != nil {
+			return fmt.Errorf("failed to store %s: %w", f.name, err)
+		}
+	}
+	s.logger.Infof("exported %d orders and %d withdrawals for %s", ordersN, withdrawalsN, stamp)
+	return nil
+}
+
+// gzipFile is a temporary file written through the gzip compressor.
+type gzipFile struct {
+	f  *os.File
+	zw *gzip.Writer
+}
+
+// newGzipFile creates a temporary file to compress the data into.
+func newGzipFile() (*gzipFile, error) {
+	f, err := os.CreateTemp("", "export-*.csv.gz")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	return &gzipFile{f: f, zw: gzip.NewWriter(f)}, nil
+}
+
+// finish flushes the compressor and rewinds the file for reading, returning its size.
+func (g *gzipFile) finish() (int64, error) {
+	if err := g.zw.Close(); err != nil {
+		return 0, fmt.Errorf("failed to compress the data: %w", err)
+	}
+	size, err := g.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the temporary file: %w", err)
+	}
+	if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to read the temporary file: %w", err)
+	}
+	return size, nil
+}
+
+// remove closes and deletes the temporary file.
+func (g *gzipFile) remove() {
+	g.f.Close()
+	os.Remove(g.f.Name())
+}
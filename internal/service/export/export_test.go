@@ -0,0 +1,109 @@
+//go:build mock_tests
+// +build mock_tests
+
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/repository/mocks"
+	"loyaltySys/internal/service/export/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// readGzip returns the decompressed content of the file.
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestExportService_export(t *testing.T) {
+	dir := t.TempDir()
+	st := mocks.NewExportStore(t)
+	st.EXPECT().Export(mock.Anything, mock.Anything, mock.Anything).
+		RunAndReturn(func(_ context.Context, orders, withdrawals io.Writer) (int64, int64, error) {
+			_, _ = io.WriteString(orders, "order_number\n12345678903\n")
+			_, _ = io.WriteString(withdrawals, "order_number\n")
+			return 1, 0, nil
+		}).Twice()
+	sink, err := NewSink(config.ExportConfig{Dir: dir})
+	require.NoError(t, err)
+	clk := clock.NewMock(time.Date(2024, 3, 10, 13, 45, 0, 0, time.UTC))
+	s := NewExportService(st, sink, config.ExportConfig{Interval: 6 * time.Hour}, WithClock(clk))
+
+	// the files are named by the start of the interval
+	require.NoError(t, s.export(context.Background()))
+	assert.Equal(t, "order_number\n12345678903\n", readGzip(t, filepath.Join(dir, "orders", "orders-20240310T120000Z.csv.gz")))
+	assert.Equal(t, "order_number\n", readGzip(t, filepath.Join(dir, "withdrawals", "withdrawals-20240310T120000Z.csv.gz")))
+
+	// the export of the same interval replaces the files
+	clk.Advance(time.Hour)
+	require.NoError(t, s.export(context.Background()))
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestExportService_export_Error(t *testing.T) {
+	dir := t.TempDir()
+	st := mocks.NewExportStore(t)
+	st.EXPECT().Export(mock.Anything, mock.Anything, mock.Anything).Return(0, 0, assert.AnError).Once()
+	sink, err := NewSink(config.ExportConfig{Dir: dir})
+	require.NoError(t, err)
+	s := NewExportService(st, sink, config.ExportConfig{Interval: time.Hour})
+
+	// nothing is stored if the data isn't read
+	assert.ErrorIs(t, s.export(context.Background()), assert.AnError)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestExportService_Stop(t *testing.T) {
+	st := mocks.NewExportStore(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	st.EXPECT().Export(mock.Anything, mock.Anything, mock.Anything).
+		RunAndReturn(func(ctx context.Context, _, _ io.Writer) (int64, int64, error) {
+			close(started)
+			select {
+			case <-release:
+				return 0, 0, nil
+			case <-ctx.Done():
+				return 0, 0, ctx.Err()
+			}
+		}).Once()
+	sink, err := NewSink(config.ExportConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	s := NewExportService(st, sink, config.ExportConfig{Interval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	<-started
+	cancel()
+
+	// the export running when the context of Start is done is uploaded, Stop waits for it
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the export was uploaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-stopped)
+}
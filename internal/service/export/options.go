@@ -0,0 +1,24 @@
+package export
+
+import (
+	"loyaltySys/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the export service.
+type Option func(*ExportService)
+
+// WithLogger sets the export service logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *ExportService) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock driving the job ticker and naming the files.
+func WithClock(c clock.Clock) Option {
+	return func(s *ExportService) {
+		s.clock = c
+	}
+}
@@ -0,0 +1,83 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"loyaltySys/internal/service/export/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrConflictingDestinations is returned if both the directory and the bucket are configured.
+var ErrConflictingDestinations = errors.New("export to a directory and to a bucket are exclusive")
+
+// Sink stores the exported files.
+type Sink interface {
+	// Put stores the file under the slash-separated name, replacing the existing one.
+	Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error
+}
+
+// NewSink creates the sink of the configured destination.
+// It returns nil if the export is disabled.
+func NewSink(cfg config.ExportConfig) (Sink, error) {
+	switch {
+	case cfg.Dir != "" && cfg.S3Bucket != "":
+		return nil, ErrConflictingDestinations
+	case cfg.Dir != "":
+		return &dirSink{dir: cfg.Dir}, nil
+	case cfg.S3Bucket != "":
+		endpoint, err := url.Parse(cfg.S3Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid export S3 endpoint %q", cfg.S3Endpoint)
+		}
+		region := cfg.S3Region
+		if region == "" {
+			region = defaultS3Region
+		}
+		return &s3Sink{
+			client:    &http.Client{Timeout: 5 * time.Minute},
+			endpoint:  endpoint,
+			region:    region,
+			bucket:    cfg.S3Bucket,
+			prefix:    cfg.S3Prefix,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// dirSink writes the files into a local directory.
+type dirSink struct {
+	dir string
+}
+
+// Put writes the file next to its destination and renames it, so the readers never see a partial file.
+func (s *dirSink) Put(_ context.Context, name string, body io.ReadSeeker, _ int64) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create the export directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create the export file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the export file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write the export file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write the export file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package config
+
+import "time"
+
+// ReportConfig is the reporting views refresh job configuration.
+type ReportConfig struct {
+	Interval time.Duration `env:"REPORT_INTERVAL"` // Interval of refreshing the reporting views
+}
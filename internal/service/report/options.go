@@ -0,0 +1,24 @@
+package report
+
+import (
+	"loyaltySys/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the report service.
+type Option func(*ReportService)
+
+// WithLogger sets the report service logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *ReportService) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock driving the job ticker.
+func WithClock(c clock.Clock) Option {
+	return func(s *ReportService) {
+		s.clock = c
+	}
+}
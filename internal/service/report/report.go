@@ -0,0 +1,98 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/service/report/config"
+
+	"go.uber.org/zap"
+)
+
+// ReportService refreshes the reporting views read by the admin stats
+type ReportService struct {
+	cfg     config.ReportConfig
+	storage repository.ReportStore
+	clock   clock.Clock
+	// done is closed once the loop started by Start returns, cancel cancels the cycle still running
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	logger *zap.SugaredLogger
+}
+
+// NewReportService creates a new report service
+func NewReportService(storage repository.ReportStore, cfg config.ReportConfig, opts ...Option) *ReportService {
+	s := &ReportService{
+		cfg:     cfg,
+		storage: storage,
+		clock:   clock.New(),
+		logger:  zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start starts the report service, the views are refreshed right away
+func (s *ReportService) Start(ctx context.Context) {
+	t := s.clock.NewTicker(s.cfg.Interval)
+	// the cycle running when the context is done is finished, Stop waits for it
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.done, s.cancel = make(chan struct{}), cancel
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		defer t.Stop()
+		s.logger.Info("report service started")
+		if err := s.refresh(work); err != nil {
+			s.logger.Errorf("failed to refresh reports: %v", err)
+		}
+		for {
+			select {
+			// stop the report service
+			case <-ctx.Done():
+				s.logger.Info("report service stopped")
+				return
+			// refresh the views on ticker signal
+			case <-t.C():
+				if err := s.refresh(work); err != nil {
+					s.logger.Errorf("failed to refresh reports: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the refresh running when the context passed to Start is done. It is canceled once
+// the context of Stop is done.
+func (s *ReportService) Stop(ctx context.Context) error {
+	// the service wasn't started
+	if s.done == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("report service cycle left running: %w", ctx.Err())
+	}
+}
+
+// refresh refreshes the balance report unless another instance is refreshing it
+func (s *ReportService) refresh(ctx context.Context) error {
+	start := s.clock.Now()
+	refreshed, err := s.storage.RefreshBalanceReport(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh balance report: %w", err)
+	}
+	if !refreshed {
+		s.logger.Debug("balance report is refreshed by another instance")
+		return nil
+	}
+	s.logger.Infof("refreshed balance report in %s", s.clock.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,89 @@
+//go:build mock_tests
+// +build mock_tests
+
+package report
+
+import (
+	"context"
+	"loyaltySys/internal/repository/mocks"
+	"loyaltySys/internal/service/report/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReportService_refresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		refreshed bool
+		err       error
+	}{
+		{name: "refreshed", refreshed: true},
+		{name: "refreshed_by_another_instance", refreshed: false},
+		{name: "error", err: assert.AnError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := mocks.NewReportStore(t)
+			st.EXPECT().RefreshBalanceReport(mock.Anything).Return(tt.refreshed, tt.err).Once()
+
+			s := NewReportService(st, config.ReportConfig{Interval: time.Minute})
+			err := s.refresh(context.Background())
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestReportService_Stop(t *testing.T) {
+	// the service not started is stopped at once
+	assert.NoError(t, NewReportService(mocks.NewReportStore(t), config.ReportConfig{Interval: time.Hour}).Stop(context.Background()))
+
+	// blockedService starts the service with its first refresh blocked until the release or the cancellation
+	blockedService := func(release <-chan struct{}, canceled chan<- struct{}) *ReportService {
+		st := mocks.NewReportStore(t)
+		started := make(chan struct{})
+		st.EXPECT().RefreshBalanceReport(mock.Anything).RunAndReturn(func(ctx context.Context) (bool, error) {
+			close(started)
+			select {
+			case <-release:
+				return true, nil
+			case <-ctx.Done():
+				close(canceled)
+				return false, ctx.Err()
+			}
+		}).Once()
+		s := NewReportService(st, config.ReportConfig{Interval: time.Hour})
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		<-started
+		cancel()
+		return s
+	}
+
+	// the refresh running when the context of Start is done is finished, Stop waits for it
+	release := make(chan struct{})
+	s := blockedService(release, make(chan struct{}))
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the refresh finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-stopped)
+
+	// the refresh outliving the context of Stop is canceled
+	canceled := make(chan struct{})
+	s = blockedService(make(chan struct{}), canceled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Stop(ctx), context.DeadlineExceeded)
+	<-canceled
+}
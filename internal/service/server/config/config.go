@@ -1,5 +1,29 @@
 package config
 
+import "time"
+
 type ServerConfig struct {
-	Host string `env:"RUN_ADDRESS"` // Server address
+	Host                 string        `env:"RUN_ADDRESS"`                           // Server address
+	TrustedProxies       []string      `env:"TRUSTED_PROXIES" envSeparator:","`      // CIDRs of the trusted reverse proxies
+	CORSAllowedOrigins   []string      `env:"CORS_ALLOWED_ORIGINS" envSeparator:","` // Origins of the browser clients, CORS is disabled if empty
+	CORSAllowedHeaders   []string      `env:"CORS_ALLOWED_HEADERS" envSeparator:","` // Extra request headers allowed in the cross-origin requests
+	CORSAllowCredentials bool          `env:"CORS_ALLOW_CREDENTIALS"`                // Allow the cross-origin requests with cookies
+	RateLimitUserRPS     float64       `env:"RATE_LIMIT_USER_RPS"`                   // Requests per second of a user on the authenticated routes, 0 disables the limit
+	RateLimitUserBurst   int           `env:"RATE_LIMIT_USER_BURST"`                 // Requests of a user allowed at once
+	RateLimitIPRPS       float64       `env:"RATE_LIMIT_IP_RPS"`                     // Requests per second from an IP on the registration and login routes, 0 disables the limit
+	RateLimitIPBurst     int           `env:"RATE_LIMIT_IP_BURST"`                   // Requests from an IP allowed at once
+	Tenants              []string      `env:"TENANTS" envSeparator:","`              // Tenants served by the deployment, the first one is used without the X-Tenant header
+	PasswordCost         int           `env:"PASSWORD_BCRYPT_COST"`                  // bcrypt cost of the password hashes, the other hashes are upgraded on login
+	ACMEDomains          []string      `env:"ACME_DOMAINS" envSeparator:","`         // Domains of the Let's Encrypt certificates, plain HTTP is served if empty
+	ACMECacheDir         string        `env:"ACME_CACHE_DIR"`                        // Directory keeping the account key and the certificates across the restarts
+	ACMEEmail            string        `env:"ACME_EMAIL"`                            // Contact of the ACME account notified about the expiring certificates
+	ReadTimeout          time.Duration `env:"HTTP_READ_TIMEOUT"`                     // Time to read a request with its body, 0 doesn't limit it
+	ReadHeaderTimeout    time.Duration `env:"HTTP_READ_HEADER_TIMEOUT"`              // Time to read the request headers, 0 uses the read timeout
+	WriteTimeout         time.Duration `env:"HTTP_WRITE_TIMEOUT"`                    // Time to write a response since the request headers are read, the event streams aside; 0 doesn't limit it
+	IdleTimeout          time.Duration `env:"HTTP_IDLE_TIMEOUT"`                     // Time a keep-alive connection waits for the next request, 0 uses the read timeout
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT"`                      // Time the requests in flight are given to finish on shutdown, also the stop timeout of the subsystems
+	PprofEnabled         bool          `env:"ENABLE_PPROF"`                          // Serve the profiling endpoints of net/http/pprof
+	PprofAddr            string        `env:"PPROF_ADDRESS"`                         // Address of the debug server of the profiling endpoints, empty mounts them under the admin routes
+	ACMEHTTPAddr         string        `env:"ACME_HTTP_ADDRESS"`                     // Address answering the http-01 challenges and redirecting to HTTPS, empty relies on tls-alpn-01
+	MetricsAddr          string        `env:"METRICS_ADDRESS"`                       // Address of the internal server of the Prometheus metrics, empty mounts them under the admin routes
 }
@@ -0,0 +1,13 @@
+package server
+
+import "go.uber.org/zap"
+
+// Option configures the server.
+type Option func(*Server)
+
+// WithLogger sets the server logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
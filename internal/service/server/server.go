@@ -6,56 +6,191 @@ import (
 	"fmt"
 	"loyaltySys/internal/config"
 	"loyaltySys/internal/handlers"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// defaultShutdownTimeout is the time the requests in flight are given on shutdown if another one isn't configured.
+const defaultShutdownTimeout = 5 * time.Second
+
 // Server is a struct that contains the HTTP server and the configuration.
 type Server struct {
 	*http.Server
 	cfg    *config.Config
 	logger *zap.SugaredLogger
+	// aux are the servers run along with this one, stopped before it
+	aux []auxServer
 }
 
-// NewServer creates a new server with the given configuration, handler, and logger.
-func NewServer(cfg *config.Config, h *handlers.Handler, logger *zap.SugaredLogger) *Server {
-	return &Server{
+// auxServer is a server run along with the main one, e.g. answering the ACME challenges.
+type auxServer struct {
+	name string
+	*http.Server
+}
+
+// NewServer creates a new server with the given configuration, handler, and options.
+// With the ACME domains configured, the server serves HTTPS with the certificates obtained from Let's Encrypt,
+// with the pprof address, a debug server of the profiling endpoints is run along, with the metrics address,
+// a server of the Prometheus metrics.
+func NewServer(cfg *config.Config, h *handlers.Handler, opts ...Option) *Server {
+	s := &Server{
 		Server: &http.Server{
 			Addr:    cfg.ServerConfig.Host,
 			Handler: h.NewRouter(),
+			// the connections of the slow clients are closed, the event streams lift the write deadline themselves
+			ReadTimeout:       cfg.ServerConfig.ReadTimeout,
+			ReadHeaderTimeout: cfg.ServerConfig.ReadHeaderTimeout,
+			WriteTimeout:      cfg.ServerConfig.WriteTimeout,
+			IdleTimeout:       cfg.ServerConfig.IdleTimeout,
 		},
 		cfg:    cfg,
-		logger: logger,
+		logger: zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	if len(cfg.ServerConfig.ACMEDomains) > 0 {
+		s.setACME()
+	}
+	// without its own address the profiling endpoints are mounted by the handler under the admin routes
+	if cfg.ServerConfig.PprofEnabled && cfg.ServerConfig.PprofAddr != "" {
+		r := chi.NewRouter()
+		r.Mount("/debug", middleware.Profiler())
+		s.aux = append(s.aux, auxServer{name: "debug", Server: &http.Server{
+			Addr:              cfg.ServerConfig.PprofAddr,
+			Handler:           r,
+			ReadHeaderTimeout: 5 * time.Second,
+		}})
+	}
+	// without its own address the metrics are mounted by the handler under the admin routes
+	if metrics := h.MetricsHandler(); metrics != nil && cfg.ServerConfig.MetricsAddr != "" {
+		r := chi.NewRouter()
+		r.Handle("/metrics", metrics)
+		s.aux = append(s.aux, auxServer{name: "metrics", Server: &http.Server{
+			Addr:              cfg.ServerConfig.MetricsAddr,
+			Handler:           r,
+			ReadHeaderTimeout: 5 * time.Second,
+		}})
+	}
+	s.RegisterOnShutdown(h.CloseStreams)
+	return s
 }
 
-// Start starts the server and listens for incoming requests.
+// setACME makes the server serve HTTPS with the certificates of the configured domains,
+// obtained from Let's Encrypt on the first handshake and renewed before they expire.
+func (s *Server) setACME() {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.cfg.ServerConfig.ACMEDomains...),
+		Email:      s.cfg.ServerConfig.ACMEEmail,
+	}
+	if dir := s.cfg.ServerConfig.ACMECacheDir; dir != "" {
+		m.Cache = autocert.DirCache(dir)
+	} else {
+		s.logger.Warn("ACME certificates aren't cached, they are obtained again on every restart")
+	}
+	s.TLSConfig = m.TLSConfig()
+	if addr := s.cfg.ServerConfig.ACMEHTTPAddr; addr != "" {
+		s.aux = append(s.aux, auxServer{name: "ACME challenge", Server: &http.Server{
+			Addr:              addr,
+			Handler:           m.HTTPHandler(nil),
+			ReadHeaderTimeout: 5 * time.Second,
+		}})
+	}
+}
+
+// Start starts the server and blocks until the context is done, then shuts the server down.
 func (s *Server) Start(ctx context.Context) error {
-	// Start the HTTP server in a goroutine.
-	go func() {
-		// Setart the server and listen for incoming requests.
-		s.logger.Infof("HTTP server listening on %s", s.cfg.ServerConfig.Host)
-		if err := s.ListenAndServe(); err != nil &&
-			!errors.Is(err, http.ErrServerClosed) {
-			s.logger.Fatalf("listen error: %v", err)
-		} else {
-			s.logger.Debug("HTTP server closed")
-		}
-	}()
+	if err := s.Listen(); err != nil {
+		return err
+	}
 
 	// Wait for the context to be done.
 	<-ctx.Done()
 	s.logger.Infof("stopping signal received, shutting down server...")
 
 	// create a context with a timeout.
-	shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout := s.cfg.ServerConfig.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	return s.Stop(shutCtx)
+}
 
-	// Shutdown the server.
-	if err := s.Shutdown(shutCtx); err != nil {
-		return fmt.Errorf("error shutting down the server: %w", err)
+// Listen binds the server address and serves incoming requests in a goroutine.
+func (s *Server) Listen() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
+	}
+	auxLns := make([]net.Listener, 0, len(s.aux))
+	for _, aux := range s.aux {
+		auxLn, err := net.Listen("tcp", aux.Addr)
+		if err != nil {
+			_ = ln.Close()
+			for _, l := range auxLns {
+				_ = l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", aux.Addr, err)
+		}
+		auxLns = append(auxLns, auxLn)
 	}
+	for i, aux := range s.aux {
+		go func() {
+			s.logger.Infof("%s server listening on %s", aux.name, auxLns[i].Addr())
+			if err := aux.Serve(auxLns[i]); err != nil &&
+				!errors.Is(err, http.ErrServerClosed) {
+				s.logger.Fatalf("%s serve error: %v", aux.name, err)
+			}
+		}()
+	}
+
+	// Start the HTTP server in a goroutine.
+	go func() {
+		var err error
+		if s.TLSConfig != nil {
+			s.logger.Infof("HTTPS server listening on %s", ln.Addr())
+			// the certificates come from the TLS config
+			err = s.ServeTLS(ln, "", "")
+		} else {
+			s.logger.Infof("HTTP server listening on %s", ln.Addr())
+			err = s.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Fatalf("serve error: %v", err)
+		} else {
+			s.logger.Debug("HTTP server closed")
+		}
+	}()
 	return nil
 }
+
+// Stop gracefully shuts the server down within the context deadline. All the servers stop accepting
+// the connections at once and close the idle ones, the requests in flight are waited for.
+func (s *Server) Stop(ctx context.Context) error {
+	errs := make([]error, len(s.aux)+1)
+	var wg sync.WaitGroup
+	for i, aux := range s.aux {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := aux.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("error shutting down the %s server: %w", aux.name, err)
+			}
+		}()
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		errs[len(s.aux)] = fmt.Errorf("error shutting down the server: %w", err)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
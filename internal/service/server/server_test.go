@@ -2,22 +2,28 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"loyaltySys/internal/config"
 	"loyaltySys/internal/handlers"
+	"loyaltySys/internal/metrics"
+	"loyaltySys/internal/repository"
 	cfg "loyaltySys/internal/service/server/config"
+	"net"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
 func Test_Start(t *testing.T) {
 	cfg := &config.Config{ServerConfig: cfg.ServerConfig{Host: "127.0.0.1:0"}}
-	h := &handlers.Handler{}
+	h := handlers.NewHandler(&repository.Repository{})
 	logger := zap.NewNop().Sugar()
 
-	s := NewServer(cfg, h, logger)
+	s := NewServer(cfg, h, WithLogger(logger))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -29,3 +35,101 @@ func Test_Start(t *testing.T) {
 
 	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
 }
+
+func Test_ACME(t *testing.T) {
+	// a free port the server listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	cfg := &config.Config{ServerConfig: cfg.ServerConfig{
+		Host:         addr,
+		ACMEDomains:  []string{"loyalty.example.com"},
+		ACMECacheDir: t.TempDir(),
+		ACMEHTTPAddr: "127.0.0.1:0",
+	}}
+	// the streams are closed on the shutdown, the handler is created with its channel
+	s := NewServer(cfg, handlers.NewHandler(&repository.Repository{}))
+	require.NotNil(t, s.TLSConfig)
+	assert.Contains(t, s.TLSConfig.NextProtos, "acme-tls/1")
+	require.Len(t, s.aux, 1)
+
+	require.NoError(t, s.Listen())
+	// the handshake for a host not configured is rejected without asking Let's Encrypt
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "other.example.com", InsecureSkipVerify: true})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Stop(ctx))
+}
+
+func Test_Pprof(t *testing.T) {
+	// a free port the debug server listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	cfg := &config.Config{ServerConfig: cfg.ServerConfig{Host: "127.0.0.1:0", PprofEnabled: true, PprofAddr: addr}}
+	s := NewServer(cfg, handlers.NewHandler(&repository.Repository{}))
+	require.NoError(t, s.Listen())
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NoError(t, s.Stop(ctx))
+	}()
+
+	resp, err := http.Get("http://" + addr + "/debug/pprof/cmdline")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// without the address there is no debug server
+	cfg.ServerConfig.PprofAddr = ""
+	assert.Empty(t, NewServer(cfg, handlers.NewHandler(&repository.Repository{})).aux)
+}
+
+func Test_Metrics(t *testing.T) {
+	// a free port the metrics server listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	cfg := &config.Config{ServerConfig: cfg.ServerConfig{Host: "127.0.0.1:0", MetricsAddr: addr}}
+	s := NewServer(cfg, handlers.NewHandler(&repository.Repository{}, handlers.WithMetrics(metrics.NewRegistry())))
+	require.NoError(t, s.Listen())
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NoError(t, s.Stop(ctx))
+	}()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// without the address or the registry there is no metrics server
+	cfg.ServerConfig.MetricsAddr = ""
+	assert.Empty(t, NewServer(cfg, handlers.NewHandler(&repository.Repository{}, handlers.WithMetrics(metrics.NewRegistry()))).aux)
+	cfg.ServerConfig.MetricsAddr = addr
+	assert.Empty(t, NewServer(cfg, handlers.NewHandler(&repository.Repository{})).aux)
+}
+
+func Test_Timeouts(t *testing.T) {
+	cfg := &config.Config{ServerConfig: cfg.ServerConfig{
+		Host:              "127.0.0.1:0",
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}}
+	s := NewServer(cfg, handlers.NewHandler(&repository.Repository{}))
+	assert.Equal(t, 15*time.Second, s.ReadTimeout)
+	assert.Equal(t, 5*time.Second, s.ReadHeaderTimeout)
+	assert.Equal(t, 30*time.Second, s.WriteTimeout)
+	assert.Equal(t, 2*time.Minute, s.IdleTimeout)
+}
@@ -0,0 +1,9 @@
+package config
+
+import "time"
+
+// SnapshotConfig is the balance snapshot job configuration.
+type SnapshotConfig struct {
+	Interval     time.Duration `env:"SNAPSHOT_INTERVAL"`      // Interval of checking for the days without snapshots
+	BackfillDays int           `env:"SNAPSHOT_BACKFILL_DAYS"` // Past days recorded when there are no snapshots yet
+}
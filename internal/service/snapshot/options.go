@@ -0,0 +1,24 @@
+package snapshot
+
+import (
+	"loyaltySys/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the snapshot service.
+type Option func(*SnapshotService)
+
+// WithLogger sets the snapshot service logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *SnapshotService) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock driving the job ticker and deciding which days are over.
+func WithClock(c clock.Clock) Option {
+	return func(s *SnapshotService) {
+		s.clock = c
+	}
+}
@@ -0,0 +1,109 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/service/snapshot/config"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SnapshotService records the balances of the users at the end of every day
+type SnapshotService struct {
+	cfg     config.SnapshotConfig
+	storage repository.SnapshotStore
+	clock   clock.Clock
+	// done is closed once the loop started by Start returns, cancel cancels the cycle still running
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	logger *zap.SugaredLogger
+}
+
+// NewSnapshotService creates a new snapshot service
+func NewSnapshotService(storage repository.SnapshotStore, cfg config.SnapshotConfig, opts ...Option) *SnapshotService {
+	s := &SnapshotService{
+		cfg:     cfg,
+		storage: storage,
+		clock:   clock.New(),
+		logger:  zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start starts the snapshot service, the days missed while it was stopped are recorded right away
+func (s *SnapshotService) Start(ctx context.Context) {
+	t := s.clock.NewTicker(s.cfg.Interval)
+	// the cycle running when the context is done is finished, Stop waits for it
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.done, s.cancel = make(chan struct{}), cancel
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		defer t.Stop()
+		s.logger.Info("snapshot service started")
+		if err := s.takeSnapshots(work); err != nil {
+			s.logger.Errorf("failed to take balance snapshots: %v", err)
+		}
+		for {
+			select {
+			// stop the snapshot service
+			case <-ctx.Done():
+				s.logger.Info("snapshot service stopped")
+				return
+			// record the days that are over on ticker signal
+			case <-t.C():
+				if err := s.takeSnapshots(work); err != nil {
+					s.logger.Errorf("failed to take balance snapshots: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the snapshots being taken when the context passed to Start is done, so they are recorded
+// before the storage is closed. They are canceled once the context of Stop is done, the days are recorded
+// again after the restart.
+func (s *SnapshotService) Stop(ctx context.Context) error {
+	// the service wasn't started
+	if s.done == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("snapshot service cycle left running: %w", ctx.Err())
+	}
+}
+
+// takeSnapshots records the balances for the days that are over since the last recorded one,
+// going back at most the backfill days
+func (s *SnapshotService) takeSnapshots(ctx context.Context) error {
+	now := s.clock.Now().UTC()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+	from := yesterday.AddDate(0, 0, 1-max(s.cfg.BackfillDays, 1))
+
+	last, err := s.storage.GetLastSnapshotDay(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get last snapshot day: %w", err)
+	}
+	if !last.IsZero() && !last.Before(from) {
+		from = time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	}
+	for day := from; !day.After(yesterday); day = day.AddDate(0, 0, 1) {
+		n, err := s.storage.SnapshotBalances(ctx, day)
+		if err != nil {
+			return fmt.Errorf("failed to take balance snapshots for %s: %w", day.Format(time.DateOnly), err)
+		}
+		s.logger.Infof("recorded %d balance snapshots for %s", n, day.Format(time.DateOnly))
+	}
+	return nil
+}
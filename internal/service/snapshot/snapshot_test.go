@@ -0,0 +1,90 @@
+//go:build mock_tests
+// +build mock_tests
+
+package snapshot
+
+import (
+	"context"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/repository/mocks"
+	"loyaltySys/internal/service/snapshot/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSnapshotService_takeSnapshots(t *testing.T) {
+	now := time.Date(2024, 3, 10, 0, 30, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		last time.Time
+		want []time.Time
+	}{
+		{name: "first_run_backfills", last: time.Time{}, want: []time.Time{day(7), day(8), day(9)}},
+		{name: "missed_days", last: day(7), want: []time.Time{day(8), day(9)}},
+		{name: "long_outage_is_capped", last: day(1), want: []time.Time{day(7), day(8), day(9)}},
+		{name: "up_to_date", last: day(9), want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := mocks.NewSnapshotStore(t)
+			st.EXPECT().GetLastSnapshotDay(mock.Anything).Return(tt.last, nil).Once()
+			var got []time.Time
+			for _, d := range tt.want {
+				st.EXPECT().SnapshotBalances(mock.Anything, d).RunAndReturn(func(_ context.Context, d time.Time) (int64, error) {
+					got = append(got, d)
+					return 2, nil
+				}).Once()
+			}
+
+			s := NewSnapshotService(st, config.SnapshotConfig{Interval: time.Hour, BackfillDays: 3}, WithClock(clock.NewMock(now)))
+			assert.NoError(t, s.takeSnapshots(context.Background()))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSnapshotService_takeSnapshots_Error(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	st := mocks.NewSnapshotStore(t)
+	st.EXPECT().GetLastSnapshotDay(mock.Anything).Return(time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC), nil).Once()
+	// the next days are not recorded before the failed one
+	st.EXPECT().SnapshotBalances(mock.Anything, time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)).Return(0, assert.AnError).Once()
+
+	s := NewSnapshotService(st, config.SnapshotConfig{Interval: time.Hour, BackfillDays: 7}, WithClock(clock.NewMock(now)))
+	assert.ErrorIs(t, s.takeSnapshots(context.Background()), assert.AnError)
+}
+
+func TestSnapshotService_Stop(t *testing.T) {
+	st := mocks.NewSnapshotStore(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	st.EXPECT().GetLastSnapshotDay(mock.Anything).RunAndReturn(func(ctx context.Context) (time.Time, error) {
+		close(started)
+		select {
+		case <-release:
+			return time.Time{}, assert.AnError
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		}
+	}).Once()
+	s := NewSnapshotService(st, config.SnapshotConfig{Interval: time.Hour, BackfillDays: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	<-started
+	cancel()
+
+	// the snapshots being taken when the context of Start is done aren't canceled, Stop waits for them
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the snapshots were taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-stopped)
+}
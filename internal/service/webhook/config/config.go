@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// WebhookConfig is the webhook delivery worker configuration.
+type WebhookConfig struct {
+	Interval     time.Duration `env:"WEBHOOK_INTERVAL"`      // Interval of polling for the due deliveries
+	Timeout      time.Duration `env:"WEBHOOK_TIMEOUT"`       // Timeout of a delivery request
+	MaxAttempts  int           `env:"WEBHOOK_MAX_ATTEMPTS"`  // Attempts before the delivery is marked as failed
+	AllowPrivate bool          `env:"WEBHOOK_ALLOW_PRIVATE"` // Allow webhooks on loopback and private network addresses
+}
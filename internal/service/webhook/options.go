@@ -0,0 +1,24 @@
+package webhook
+
+import (
+	"loyaltySys/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// Option configures the webhook service.
+type Option func(*WebhookService)
+
+// WithLogger sets the webhook service logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *WebhookService) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock driving the polling ticker and the retry schedule.
+func WithClock(c clock.Clock) Option {
+	return func(s *WebhookService) {
+		s.clock = c
+	}
+}
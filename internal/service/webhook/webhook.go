@@ -0,0 +1,232 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository"
+	"loyaltySys/internal/service/webhook/config"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// batchSize is the maximum number of deliveries sent per poll.
+	batchSize = 50
+	// retryBase is the delay before the first retry, doubled with every attempt.
+	retryBase = 30 * time.Second
+	// retryMax caps the delay between the retries.
+	retryMax = time.Hour
+	// maxErrorLength caps the length of the error recorded for a failed attempt.
+	maxErrorLength = 512
+)
+
+// Request headers of a delivery.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// ErrForbiddenAddress is returned when the webhook resolves to a loopback or private network address.
+var ErrForbiddenAddress = errors.New("webhook address is not allowed")
+
+// WebhookService delivers the queued events to the webhooks
+type WebhookService struct {
+	client  *resty.Client
+	cfg     config.WebhookConfig
+	storage repository.DeliveryQueue
+	clock   clock.Clock
+	// done is closed once the loop started by Start returns, cancel cancels the cycle still running
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	logger *zap.SugaredLogger
+}
+
+// NewWebhookService creates a new webhook service
+func NewWebhookService(storage repository.DeliveryQueue, cfg config.WebhookConfig, opts ...Option) *WebhookService {
+	// refuse to connect to the internal network unless allowed, the URLs come from the users
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+			}
+			return nil
+		}
+	}
+	client := resty.New().
+		SetTransport(&http.Transport{DialContext: dialer.DialContext}).
+		SetTimeout(cfg.Timeout).
+		SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	s := &WebhookService{
+		client:  client,
+		cfg:     cfg,
+		storage: storage,
+		clock:   clock.New(),
+		logger:  zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start starts the webhook service
+func (s *WebhookService) Start(ctx context.Context) {
+	t := s.clock.NewTicker(s.cfg.Interval)
+	// the cycle running when the context is done is finished, Stop waits for it
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.done, s.cancel = make(chan struct{}), cancel
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		defer t.Stop()
+		s.logger.Info("webhook service started")
+		for {
+			select {
+			// stop the webhook service
+			case <-ctx.Done():
+				s.logger.Info("webhook service stopped")
+				return
+			// deliver the due events on ticker signal
+			case <-t.C():
+				if err := s.processDeliveries(work); err != nil {
+					s.logger.Errorf("failed to process webhook deliveries: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the deliveries in flight when the context passed to Start is done to be sent and stored.
+// The ones still in flight once the context of Stop is done are canceled and sent again after their lease.
+func (s *WebhookService) Stop(ctx context.Context) error {
+	// the service wasn't started
+	if s.done == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("webhook service cycle left running: %w", ctx.Err())
+	}
+}
+
+// processDeliveries claims the due deliveries and sends them concurrently
+func (s *WebhookService) processDeliveries(ctx context.Context) error {
+	// the lease covers the requests, so other workers don't send the deliveries meanwhile
+	deliveries, err := s.storage.ClaimWebhookDeliveries(ctx, batchSize, 2*s.cfg.Timeout)
+	if err != nil {
+		return fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(deliveries))
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(ctx, &d)
+			if err := s.storage.UpdateWebhookDelivery(ctx, &d); err != nil {
+				errCh <- fmt.Errorf("delivery %d: %w", d.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	// collect errors
+	var joined error
+	for err := range errCh {
+		joined = errors.Join(joined, err)
+	}
+	return joined
+}
+
+// deliver posts the signed payload to the webhook and schedules a retry if it fails
+func (s *WebhookService) deliver(ctx context.Context, d *models.WebhookDelivery) {
+	now := s.clock.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	d.Attempts++
+
+	resp, err := s.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(EventHeader, d.Event).
+		SetHeader(DeliveryHeader, strconv.FormatInt(d.ID, 10)).
+		SetHeader(SignatureHeader, "t="+timestamp+",v1="+Sign(d.Secret, timestamp, d.Payload)).
+		SetBody([]byte(d.Payload)).
+		Post(d.URL)
+	switch {
+	case err != nil:
+		d.ResponseCode = 0
+		d.LastError = err.Error()
+	case resp.IsSuccess():
+		d.Status = models.DeliveryDelivered
+		d.ResponseCode = resp.StatusCode()
+		d.LastError = ""
+		d.DeliveredAt = &now
+		d.NextAttemptAt = now
+		return
+	default:
+		d.ResponseCode = resp.StatusCode()
+		d.LastError = "unexpected status " + resp.Status()
+	}
+	if len(d.LastError) > maxErrorLength {
+		d.LastError = d.LastError[:maxErrorLength]
+	}
+
+	s.logger.Debugf("webhook delivery %d attempt %d failed: %s", d.ID, d.Attempts, d.LastError)
+	if d.Attempts >= s.cfg.MaxAttempts {
+		d.Status = models.DeliveryFailed
+		d.NextAttemptAt = now
+		return
+	}
+	d.NextAttemptAt = now.Add(retryDelay(d.Attempts))
+}
+
+// retryDelay returns the delay before the retry after the attempt, doubled with every attempt
+func retryDelay(attempt int) time.Duration {
+	delay := retryBase
+	for i := 1; i < attempt && delay < retryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMax)
+}
+
+// Sign returns the hex HMAC-SHA256 of the timestamp and the payload joined with a dot.
+// Receivers recompute it with the webhook secret and reject stale timestamps to prevent replays.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPublicIP reports whether the address is routable on the public internet.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
@@ -0,0 +1,154 @@
+//go:build mock_tests
+// +build mock_tests
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"loyaltySys/internal/clock"
+	"loyaltySys/internal/models"
+	"loyaltySys/internal/repository/mocks"
+	"loyaltySys/internal/service/webhook/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookService_processDeliveries(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	payload := json.RawMessage(`{"event":"withdrawal.completed","at":"2024-01-01T12:00:00Z","data":{"order":"2377225624","sum":100}}`)
+
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	tests := []struct {
+		name         string
+		code         int
+		attempts     int
+		allowPrivate bool
+		want         models.WebhookDelivery
+	}{
+		{
+			name:         "delivered",
+			code:         http.StatusNoContent,
+			allowPrivate: true,
+			want:         models.WebhookDelivery{Status: models.DeliveryDelivered, Attempts: 1, ResponseCode: http.StatusNoContent, DeliveredAt: &now, NextAttemptAt: now},
+		},
+		{
+			name:         "retry",
+			code:         http.StatusInternalServerError,
+			attempts:     2,
+			allowPrivate: true,
+			want: models.WebhookDelivery{Status: models.DeliveryPending, Attempts: 3, ResponseCode: http.StatusInternalServerError,
+				LastError: "unexpected status 500 Internal Server Error", NextAttemptAt: now.Add(2 * time.Minute)},
+		},
+		{
+			name:         "failed_after_max_attempts",
+			code:         http.StatusBadRequest,
+			attempts:     4,
+			allowPrivate: true,
+			want: models.WebhookDelivery{Status: models.DeliveryFailed, Attempts: 5, ResponseCode: http.StatusBadRequest,
+				LastError: "unexpected status 400 Bad Request", NextAttemptAt: now},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan request, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- request{header: r.Header, body: body}
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			d := models.WebhookDelivery{ID: 7, Event: models.WebhookWithdrawalCompleted, Payload: payload, Status: models.DeliveryPending,
+				Attempts: tt.attempts, URL: srv.URL, Secret: "secret"}
+			st := mocks.NewDeliveryQueue(t)
+			st.EXPECT().ClaimWebhookDeliveries(mock.Anything, batchSize, 20*time.Second).Return([]models.WebhookDelivery{d}, nil).Once()
+			var got models.WebhookDelivery
+			st.EXPECT().UpdateWebhookDelivery(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, d *models.WebhookDelivery) error {
+				got = *d
+				return nil
+			}).Once()
+
+			cfg := config.WebhookConfig{Interval: time.Second, Timeout: 10 * time.Second, MaxAttempts: 5, AllowPrivate: tt.allowPrivate}
+			s := NewWebhookService(st, cfg, WithClock(clock.NewMock(now)))
+			require.NoError(t, s.processDeliveries(context.Background()))
+
+			// the request is signed with the webhook secret
+			req := <-requests
+			assert.Equal(t, []byte(payload), req.body)
+			assert.Equal(t, models.WebhookWithdrawalCompleted, req.header.Get(EventHeader))
+			assert.Equal(t, "7", req.header.Get(DeliveryHeader))
+			ts := strconv.FormatInt(now.Unix(), 10)
+			assert.Equal(t, "t="+ts+",v1="+Sign("secret", ts, payload), req.header.Get(SignatureHeader))
+
+			tt.want.ID, tt.want.Event, tt.want.Payload, tt.want.URL, tt.want.Secret = d.ID, d.Event, d.Payload, d.URL, d.Secret
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWebhookService_Stop(t *testing.T) {
+	clk := clock.NewMock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	st := mocks.NewDeliveryQueue(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	st.EXPECT().ClaimWebhookDeliveries(mock.Anything, batchSize, 20*time.Second).
+		RunAndReturn(func(ctx context.Context, _ int, _ time.Duration) ([]models.WebhookDelivery, error) {
+			close(started)
+			select {
+			case <-release:
+				return nil, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}).Once()
+	s := NewWebhookService(st, config.WebhookConfig{Interval: time.Second, Timeout: 10 * time.Second}, WithClock(clk))
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	clk.Advance(time.Second)
+	<-started
+	cancel()
+
+	// the deliveries in flight when the context of Start is done are stored, Stop waits for them
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the deliveries were stored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-stopped)
+}
+
+func TestWebhookService_deliver_PrivateAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request to a private address must not be sent")
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := NewWebhookService(mocks.NewDeliveryQueue(t), config.WebhookConfig{Timeout: time.Second, MaxAttempts: 5}, WithClock(clock.NewMock(now)))
+	d := &models.WebhookDelivery{ID: 1, Payload: json.RawMessage(`{}`), Status: models.DeliveryPending, URL: srv.URL}
+	s.deliver(context.Background(), d)
+	assert.Equal(t, models.DeliveryPending, d.Status)
+	assert.Contains(t, d.LastError, ErrForbiddenAddress.Error())
+	assert.Equal(t, now.Add(retryBase), d.NextAttemptAt)
+}
+
+func Test_retryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, retryDelay(1))
+	assert.Equal(t, time.Minute, retryDelay(2))
+	assert.Equal(t, 8*time.Minute, retryDelay(5))
+	assert.Equal(t, time.Hour, retryDelay(20))
+}
@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// SMSConfig is the SMS provider configuration used for one-time login codes. Phone login is disabled if Provider is empty.
+type SMSConfig struct {
+	Provider   string        `env:"SMS_PROVIDER"`    // SMS provider: twilio, or log to write the messages to the log
+	AccountSID string        `env:"SMS_ACCOUNT_SID"` // Account identifier issued by the provider
+	AuthToken  string        `env:"SMS_AUTH_TOKEN"`  // Auth token issued by the provider
+	From       string        `env:"SMS_FROM"`        // Sender phone number
+	APIURL     string        `env:"SMS_API_URL"`     // Overrides the provider API URL
+	OTPTTL     time.Duration `env:"OTP_TTL"`         // Lifetime of a one-time code
+}
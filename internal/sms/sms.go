@@ -0,0 +1,93 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyaltySys/internal/sms/config"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+// Supported SMS providers.
+const (
+	ProviderTwilio = "twilio"
+	ProviderLog    = "log"
+)
+
+// twilioAPIURL is the base URL of the Twilio REST API.
+const twilioAPIURL = "https://api.twilio.com/2010-04-01"
+
+// ErrUnsupportedProvider is returned for an unknown provider name.
+var ErrUnsupportedProvider = errors.New("unsupported sms provider")
+
+// Sender delivers a text message to a phone number.
+type Sender interface {
+	Send(ctx context.Context, phone, text string) error
+}
+
+// NewSender creates a sender for the configured provider.
+// It returns nil if phone login is disabled.
+func NewSender(cfg config.SMSConfig, logger *zap.SugaredLogger) (Sender, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case ProviderLog:
+		return &logSender{logger: logger}, nil
+	case ProviderTwilio:
+		apiURL := cfg.APIURL
+		if apiURL == "" {
+			apiURL = twilioAPIURL
+		}
+		return &twilioSender{
+			client: resty.New().
+				SetBaseURL(apiURL).
+				SetBasicAuth(cfg.AccountSID, cfg.AuthToken).
+				SetTimeout(5 * time.Second),
+			accountSID: cfg.AccountSID,
+			from:       cfg.From,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, cfg.Provider)
+	}
+}
+
+// logSender writes the messages to the log instead of sending them, for development only.
+type logSender struct {
+	logger *zap.SugaredLogger
+}
+
+// Send logs the message.
+func (s *logSender) Send(_ context.Context, phone, text string) error {
+	s.logger.Infof("SMS to %s: %s", phone, text)
+	return nil
+}
+
+// twilioSender sends the messages with the Twilio Messages API.
+type twilioSender struct {
+	client     *resty.Client
+	accountSID string
+	from       string
+}
+
+// Send creates a message resource for the phone number.
+func (s *twilioSender) Send(ctx context.Context, phone, text string) error {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		SetPathParam("account_sid", s.accountSID).
+		SetFormData(map[string]string{
+			"To":   phone,
+			"From": s.from,
+			"Body": text,
+		}).
+		Post("/Accounts/{account_sid}/Messages.json")
+	if err != nil {
+		return fmt.Errorf("sms request failed: %w", err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("sms provider returned %d: %s", resp.StatusCode(), resp.String())
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package sms
+
+import (
+	"context"
+	"loyaltySys/internal/sms/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestNewSender(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	s, err := NewSender(config.SMSConfig{}, logger)
+	assert.NoError(t, err)
+	assert.Nil(t, s, "sms must be disabled without provider")
+
+	s, err = NewSender(config.SMSConfig{Provider: ProviderLog}, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Send(context.Background(), "+15550001111", "code"))
+
+	_, err = NewSender(config.SMSConfig{Provider: "unknown"}, logger)
+	assert.ErrorIs(t, err, ErrUnsupportedProvider)
+}
+
+func TestTwilioSender_Send(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/Accounts/AC1/Messages.json", r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "AC1", user)
+		assert.Equal(t, "token", pass)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "+15550002222", r.PostForm.Get("From"))
+		assert.Equal(t, "Your code: 123456", r.PostForm.Get("Body"))
+		if r.PostForm.Get("To") != "+15550001111" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	s, err := NewSender(config.SMSConfig{
+		Provider:   ProviderTwilio,
+		AccountSID: "AC1",
+		AuthToken:  "token",
+		From:       "+15550002222",
+		APIURL:     srv.URL,
+	}, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Send(context.Background(), "+15550001111", "Your code: 123456"))
+	assert.Error(t, s.Send(context.Background(), "+15550003333", "Your code: 123456"))
+}
@@ -0,0 +1,37 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// Default is the tenant of the single-program deployments and of the data created before the tenants.
+const Default = "default"
+
+// idPattern limits the tenant IDs to the characters safe in headers, tokens and logs.
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ctxKey is the context key of the tenant ID.
+type ctxKey struct{}
+
+// Validate checks the tenant ID is 1 to 63 lowercase letters, digits, dashes and underscores.
+func Validate(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("invalid tenant %q: must be 1 to 63 lowercase letters, digits, dashes and underscores", id)
+	}
+	return nil
+}
+
+// WithTenant returns a copy of the context carrying the tenant ID.
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the tenant ID of the context, Default if there is none.
+func FromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(ctxKey{}).(string); ok && id != "" {
+		return id
+	}
+	return Default
+}
@@ -0,0 +1,23 @@
+package tenant
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, Default, FromContext(context.Background()))
+	assert.Equal(t, Default, FromContext(WithTenant(context.Background(), "")))
+	assert.Equal(t, "acme", FromContext(WithTenant(context.Background(), "acme")))
+}
+
+func TestValidate(t *testing.T) {
+	for _, id := range []string{"default", "acme", "shop-2", "a_b", "0"} {
+		assert.NoError(t, Validate(id), id)
+	}
+	for _, id := range []string{"", "Acme", "-acme", "acme shop", "acme/1", string(make([]byte, 64))} {
+		assert.Error(t, Validate(id), id)
+	}
+}
@@ -0,0 +1,8 @@
+package config
+
+// TracingConfig is the OpenTelemetry tracing configuration. The spans are discarded if Endpoint is empty.
+type TracingConfig struct {
+	Endpoint    string  `env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // OTLP/HTTP collector the spans are exported to, e.g. http://localhost:4318
+	ServiceName string  `env:"OTEL_SERVICE_NAME"`           // Service name of the exported spans
+	SampleRatio float64 `env:"OTEL_TRACES_SAMPLE_RATIO"`    // Share of the traces started by the service that are sampled
+}
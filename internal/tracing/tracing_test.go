@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"loyaltySys/internal/tracing/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider recording the ended spans for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return rec
+}
+
+func TestSetup(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	// without the endpoint the provider isn't replaced
+	shutdown, err := Setup(context.Background(), config.TracingConfig{})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, prev, otel.GetTracerProvider())
+	assert.ElementsMatch(t, []string{"traceparent", "tracestate", "baggage"}, otel.GetTextMapPropagator().Fields())
+
+	// the exporter connects on the export only
+	shutdown, err = Setup(context.Background(), config.TracingConfig{Endpoint: "http://127.0.0.1:4318", ServiceName: "gophermart", SampleRatio: 1})
+	require.NoError(t, err)
+	assert.IsType(t, &sdktrace.TracerProvider{}, otel.GetTracerProvider())
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), config.TracingConfig{Endpoint: "://collector"})
+	assert.Error(t, err)
+}
+
+func TestTransport(t *testing.T) {
+	rec := recordSpans(t)
+	// only the propagation is set up
+	_, err := Setup(context.Background(), config.TracingConfig{})
+	require.NoError(t, err)
+	traceparents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, parent := Start(context.Background(), "parent", trace.SpanKindInternal)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/orders/9", nil)
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	parent.End()
+
+	// the request is a child of the caller's span and passes the trace on
+	spans := rec.Ended()
+	require.Len(t, spans, 2)
+	span := spans[0]
+	assert.Equal(t, "HTTP GET", span.Name())
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, codes.Error, span.Status().Code)
+	assert.Contains(t, span.Attributes(), semconv.HTTPResponseStatusCode(http.StatusTooManyRequests))
+	assert.Contains(t, <-traceparents, span.SpanContext().TraceID().String())
+	// the request of the caller isn't modified
+	assert.Empty(t, req.Header.Get("traceparent"))
+}